@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"log"
+	"time"
 
 	"github.com/golang/glog"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -26,6 +27,7 @@ import (
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/machinesetup"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/controller"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/webhook"
 	clusterapis "sigs.k8s.io/cluster-api/pkg/apis"
 	clustercommon "sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
@@ -36,6 +38,7 @@ import (
 var (
 	cloudConfig        = flag.String("cloud-config", "", "path to the GCE config")
 	machineSetupConfig = flag.String("machine-setup-config", "/etc/machinesetup/machine_setup_configs.yaml", "path to the machine setup config")
+	drainTimeout       = flag.Duration("drain-timeout", 5*time.Minute, "how long draining a node during a machine update may take")
 )
 
 func main() {
@@ -72,6 +75,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Setup all admission webhooks
+	if err := webhook.AddToManager(mgr); err != nil {
+		log.Fatal(err)
+	}
+
 	log.Printf("Starting the Cmd.")
 
 	// Start the Cmd
@@ -91,6 +99,7 @@ func initStaticDeps(mgr manager.Manager) {
 		Client:                   mgr.GetClient(),
 		Scheme:                   mgr.GetScheme(),
 		CloudConfigPath:          *cloudConfig,
+		DrainTimeout:             *drainTimeout,
 	})
 	if err != nil {
 		glog.Fatalf("Error creating cluster provisioner for google : %v", err)
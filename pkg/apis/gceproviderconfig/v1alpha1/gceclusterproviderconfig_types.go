@@ -30,6 +30,54 @@ type GCEClusterProviderConfig struct {
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
 	Project string `json:"project"`
+
+	// The VPC network the cluster's instances and firewall rules are attached
+	// to. If unset, the project's "default" network is used.
+	Network NetworkSpec `json:"network,omitempty"`
+
+	// If true, the cluster actuator fronts the masters with a TCP proxy load
+	// balancer on a reserved global address, and publishes that address as
+	// the cluster's API endpoint. Masters can then be replaced without
+	// changing the endpoint nodes connect to. Required for clusters with more
+	// than one master.
+	LoadBalancer bool `json:"loadBalancer,omitempty"`
+}
+
+// NetworkSpec selects the VPC network and subnetwork used by a cluster.
+type NetworkSpec struct {
+	// The name of the VPC network. If the network does not exist, the
+	// cluster actuator creates it in auto subnet mode. Defaults to "default",
+	// or to the cluster name for dedicated networks.
+	Name string `json:"name,omitempty"`
+
+	// The name of the subnetwork instances are attached to. It must exist in
+	// the region of every machine's zone. Defaults to the subnetwork named
+	// after the network, as created by GCE for auto subnet mode networks.
+	Subnetwork string `json:"subnetwork,omitempty"`
+
+	// If true, the cluster actuator creates a custom subnet mode network
+	// owned by the cluster, with a single node subnetwork in Region, and
+	// deletes both once the cluster is deleted. The subnetwork gets secondary
+	// ranges for the cluster's pod and service CIDR blocks.
+	Dedicated bool `json:"dedicated,omitempty"`
+
+	// The region of the dedicated node subnetwork and of the Cloud NAT
+	// gateway. All machines must be in zones of this region. Required for
+	// dedicated networks and Cloud NAT.
+	Region string `json:"region,omitempty"`
+
+	// The primary IP range of the dedicated node subnetwork. Defaults to
+	// 10.0.0.0/20.
+	NodeCIDRRange string `json:"nodeCidrRange,omitempty"`
+
+	// If true, the cluster actuator creates a Cloud Router with a Cloud NAT
+	// gateway in Region, so that instances without an external IP address
+	// can still reach the internet, e.g. to pull images.
+	CloudNAT bool `json:"cloudNAT,omitempty"`
+
+	// The IP ranges SSH connections to the instances of a dedicated network
+	// are allowed from. Defaults to 0.0.0.0/0.
+	SSHSourceRanges []string `json:"sshSourceRanges,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// GCEClusterProviderStatus records the GCE resources the cluster actuator
+// created or adopted for a cluster. It is stored in the cluster's
+// Status.ProviderStatus.
+type GCEClusterProviderStatus struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// The VPC network the cluster's instances are attached to.
+	Network *ResourceStatus `json:"network,omitempty"`
+
+	// The node subnetwork of a dedicated network.
+	Subnetwork *ResourceStatus `json:"subnetwork,omitempty"`
+
+	// The Cloud Router that hosts the cluster's Cloud NAT gateway.
+	Router *ResourceStatus `json:"router,omitempty"`
+
+	// The firewall rules created for the cluster.
+	FirewallRules []ResourceStatus `json:"firewallRules,omitempty"`
+
+	// The service accounts created for the cluster.
+	ServiceAccounts ServiceAccountsStatus `json:"serviceAccounts,omitempty"`
+
+	// The load balancer in front of the cluster's masters.
+	LoadBalancer *LoadBalancerStatus `json:"loadBalancer,omitempty"`
+}
+
+// ResourceStatus identifies a GCE resource.
+type ResourceStatus struct {
+	Name string `json:"name"`
+
+	// The URL of the resource. Empty for resources that were recorded
+	// before self-links were, until the next reconciliation fills it in.
+	SelfLink string `json:"selfLink,omitempty"`
+}
+
+// ServiceAccountsStatus holds the email addresses of the GCP service
+// accounts created for a cluster.
+type ServiceAccountsStatus struct {
+	Master            string `json:"master,omitempty"`
+	Worker            string `json:"worker,omitempty"`
+	IngressController string `json:"ingressController,omitempty"`
+	MachineController string `json:"machineController,omitempty"`
+}
+
+// LoadBalancerStatus records the resources of the control plane load
+// balancer, which all share the same name.
+type LoadBalancerStatus struct {
+	Name string `json:"name"`
+
+	// The reserved IP address of the load balancer.
+	Address string `json:"address,omitempty"`
+
+	AddressSelfLink        string `json:"addressSelfLink,omitempty"`
+	HealthCheckSelfLink    string `json:"healthCheckSelfLink,omitempty"`
+	BackendServiceSelfLink string `json:"backendServiceSelfLink,omitempty"`
+	TargetProxySelfLink    string `json:"targetProxySelfLink,omitempty"`
+	ForwardingRuleSelfLink string `json:"forwardingRuleSelfLink,omitempty"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GCEClusterProviderStatus{})
+}
@@ -31,12 +31,70 @@ type GCEMachineProviderConfig struct {
 
 	Roles []MachineRole `json:"roles,omitempty"`
 
-	Zone        string `json:"zone"`
-	MachineType string `json:"machineType"`
+	Zone string `json:"zone"`
+
+	// The name of a predefined machine type, e.g. n1-standard-1. Either this
+	// or CustomMachineType must be set.
+	MachineType string `json:"machineType,omitempty"`
+
+	// A machine type with a custom number of vCPUs and amount of memory.
+	CustomMachineType *CustomMachineType `json:"customMachineType,omitempty"`
+
+	// The minimum CPU platform of the instance, e.g. "Intel Skylake". GCE
+	// picks the platform by default.
+	MinCPUPlatform string `json:"minCpuPlatform,omitempty"`
 
 	// The name of the OS to be installed on the machine.
 	OS    string `json:"os,omitempty"`
 	Disks []Disk `json:"disks,omitempty"`
+
+	// If true, the instance gets no external IP address and is only
+	// reachable on its internal IP. Enable Cloud NAT on the cluster's network
+	// to give such instances internet access.
+	NoExternalIP bool `json:"noExternalIP,omitempty"`
+
+	// How GCE schedules the instance. Instances are not preemptible,
+	// restart automatically and migrate during host maintenance by default.
+	Scheduling *Scheduling `json:"scheduling,omitempty"`
+
+	// The GPUs attached to the instance. Instances with accelerators cannot
+	// migrate during host maintenance, so they are always terminated.
+	Accelerators []Accelerator `json:"accelerators,omitempty"`
+
+	// Labels added to the instance. The provider always labels instances
+	// with the name of their cluster and the namespace and name of their
+	// machine. Changing labels updates instances in place.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Network tags added to the instance, e.g. to target it with firewall
+	// rules. Changing tags updates instances in place.
+	Tags []string `json:"tags,omitempty"`
+
+	// Metadata items added to the instance. They cannot replace the items
+	// the provider sets, such as startup-script.
+	InstanceMetadata map[string]string `json:"instanceMetadata,omitempty"`
+
+	// Security features of the instance.
+	Security *Security `json:"security,omitempty"`
+
+	// The service account the instance acts as, overriding the master or
+	// worker service account the provider creates for the cluster. GCE
+	// instances have at most one service account. Masters need the
+	// permissions of the provider's master service account to run the
+	// cloud provider.
+	ServiceAccounts []ServiceAccount `json:"serviceAccounts,omitempty"`
+
+	// If set, the machines of the MachineSet that owns the machine get their
+	// instances from a managed instance group, instead of creating one each.
+	// Only machines without the Master role that belong to a MachineSet may
+	// use instance groups.
+	InstanceGroup *InstanceGroup `json:"instanceGroup,omitempty"`
+
+	// How a master is updated when its versions or provider config change.
+	// Defaults to InPlace. Machines without the Master role are always
+	// replaced: a new instance is created before the old node is drained
+	// and its instance deleted.
+	UpgradeStrategy UpgradeStrategy `json:"upgradeStrategy,omitempty"`
 }
 
 // The MachineRole indicates the purpose of the Machine, and will determine
@@ -65,13 +123,180 @@ const (
 	NodeRole   MachineRole = "Node"
 )
 
+// UpgradeStrategy is how a master is updated.
+type UpgradeStrategy string
+
+const (
+	// The control plane and kubelet of the master's instance are upgraded
+	// over SSH. Changes to the provider config are not applied.
+	InPlaceUpgrade UpgradeStrategy = "InPlace"
+
+	// A new instance is created from the machine's spec and joins the
+	// control plane. Once it is healthy, the old instance leaves etcd and is
+	// deleted. Only clusters with a load balancer can replace masters, as
+	// the new instance gets a new address.
+	ReplaceUpgrade UpgradeStrategy = "Replace"
+)
+
+// Scheduling holds the scheduling options of an instance.
+type Scheduling struct {
+	// If true, the instance is preemptible: in exchange for a lower price,
+	// GCE may stop it at any time, and always stops it within 24 hours. The
+	// machine controller starts preempted instances again. Only machines
+	// without the Master role may be preemptible.
+	//
+	// Spot instances, which superseded preemptible ones, cannot be requested
+	// yet: they need the provisioningModel and instanceTerminationAction
+	// scheduling fields, which the vendored GCE client predates.
+	Preemptible bool `json:"preemptible,omitempty"`
+
+	// Whether GCE restarts the instance when it stops for reasons other than
+	// a user action. Defaults to true, and must be false for preemptible
+	// instances.
+	AutomaticRestart *bool `json:"automaticRestart,omitempty"`
+
+	// What GCE does with the instance during host maintenance, either
+	// MIGRATE or TERMINATE. Defaults to MIGRATE, and must be TERMINATE for
+	// preemptible instances and instances with accelerators.
+	OnHostMaintenance string `json:"onHostMaintenance,omitempty"`
+}
+
+// Security configures security features of an instance.
+type Security struct {
+	// Shielded VM options. The image the instance boots from must be UEFI
+	// compatible.
+	ShieldedInstance *ShieldedInstanceConfig `json:"shieldedInstance,omitempty"`
+
+	// If true, users log in to the instance through OS Login instead of SSH
+	// keys from project or instance metadata. Masters are upgraded over SSH
+	// with a key from project metadata, so they cannot use OS Login.
+	OSLogin bool `json:"osLogin,omitempty"`
+}
+
+// ServiceAccount is a service account an instance acts as.
+type ServiceAccount struct {
+	// The email of the service account, or "default" for the Compute Engine
+	// default service account of the project.
+	Email string `json:"email"`
+
+	// The OAuth scopes granted to the instance, either as URLs or as their
+	// names, e.g. devstorage.read_write. Defaults to cloud-platform, which
+	// leaves access to the IAM roles of the service account.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// ShieldedInstanceConfig holds the Shielded VM options of an instance.
+type ShieldedInstanceConfig struct {
+	// If true, the instance only boots software signed by trusted keys.
+	SecureBoot bool `json:"secureBoot,omitempty"`
+
+	// If true, the instance has a virtual Trusted Platform Module.
+	VTPM bool `json:"vtpm,omitempty"`
+
+	// If true, the boot integrity of the instance is checked against a
+	// baseline. Requires VTPM.
+	IntegrityMonitoring bool `json:"integrityMonitoring,omitempty"`
+}
+
+// CustomMachineType describes a custom machine type, which GCE names after its
+// family, number of vCPUs and amount of memory, e.g. n2-custom-4-8192.
+type CustomMachineType struct {
+	// The machine family, one of n1, n2, n2d and e2. Defaults to n1.
+	Family string `json:"family,omitempty"`
+
+	CPUs     int64 `json:"cpus"`
+	MemoryMB int64 `json:"memoryMB"`
+
+	// If true, the instance may have more memory per vCPU than the family
+	// allows otherwise, at extra cost.
+	ExtendedMemory bool `json:"extendedMemory,omitempty"`
+}
+
+// InstanceGroup configures the managed instance group that backs the machines
+// of a MachineSet. The instance group is created from an instance template
+// rendered from the machines' provider config, and resized along with the
+// MachineSet. Each machine claims one of its instances. The instance group
+// recreates instances that fail, and the machine controller hands recreated
+// instances back to their machines.
+type InstanceGroup struct {
+	// The name of the instance group. Defaults to the name of the cluster
+	// followed by the name of the MachineSet.
+	Name string `json:"name,omitempty"`
+}
+
+// Accelerator requests accelerator cards of one type for an instance.
+type Accelerator struct {
+	// The name of the accelerator type, e.g. nvidia-tesla-k80. It must be
+	// offered in the machine's zone.
+	Type string `json:"type"`
+
+	// The number of cards to attach.
+	Count int64 `json:"count"`
+}
+
+// Disk is a disk attached to an instance. The first disk of a machine is its
+// boot disk, which is created from the machine's image unless it is attached
+// from an existing disk or created from a snapshot.
 type Disk struct {
+	// The parameters of the disk created for the instance. Ignored for disks
+	// attached from an existing disk.
 	InitializeParams DiskInitializeParams `json:"initializeParams"`
+
+	// Either PERSISTENT or SCRATCH, for a local SSD. Defaults to PERSISTENT.
+	Type DiskType `json:"type,omitempty"`
+
+	// The interface local SSDs are attached with, either SCSI or NVME.
+	// Defaults to SCSI.
+	Interface string `json:"interface,omitempty"`
+
+	// The name of an existing persistent disk in the machine's zone to
+	// attach, instead of creating one. The instances of machines attaching
+	// existing disks cannot be replaced, as the old instance holds the disk
+	// while the new one is created, so such machines cannot use the Replace
+	// upgrade strategy and, without the Master role, cannot be updated.
+	Source string `json:"source,omitempty"`
+
+	// Whether the disk is deleted along with the instance. Defaults to true,
+	// except for disks attached from an existing disk.
+	AutoDelete *bool `json:"autoDelete,omitempty"`
+
+	// The name the disk is exposed under in the instance, as
+	// /dev/disk/by-id/google-<deviceName>. Chosen by GCE if empty.
+	DeviceName string `json:"deviceName,omitempty"`
+
+	// The key that encrypts a new persistent disk. Disks are encrypted with
+	// a key managed by Google if empty.
+	EncryptionKey *DiskEncryptionKey `json:"encryptionKey,omitempty"`
 }
 
+// DiskType is the type of an attached disk.
+type DiskType string
+
+const (
+	PersistentDisk DiskType = "PERSISTENT"
+	ScratchDisk    DiskType = "SCRATCH"
+)
+
 type DiskInitializeParams struct {
-	DiskSizeGb int64  `json:"diskSizeGb"`
-	DiskType   string `json:"diskType"`
+	// The size of the disk. Local SSDs are always 375 GB.
+	DiskSizeGb int64 `json:"diskSizeGb"`
+	// The type of a persistent disk, e.g. pd-ssd. Local SSDs are of type
+	// local-ssd.
+	DiskType string `json:"diskType"`
+
+	// The snapshot to create the disk from, either the name of a snapshot in
+	// the cluster's project or its URL.
+	SourceSnapshot string `json:"sourceSnapshot,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// DiskEncryptionKey is a customer-managed key a disk is encrypted with.
+type DiskEncryptionKey struct {
+	// The resource name of the Cloud KMS key, i.e.
+	// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>.
+	// The Compute Engine service agent must be allowed to use it.
+	KMSKeyName string `json:"kmsKeyName"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// GCEMachineProviderStatus records the GCE instance the machine actuator
+// created for a machine, and the spec it was created from. It is stored in
+// the machine's Status.ProviderStatus.
+type GCEMachineProviderStatus struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// The location of the instance. These may differ from the machine's
+	// provider config until the instance has been recreated to match it.
+	Project      string `json:"project,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	InstanceName string `json:"instanceName,omitempty"`
+
+	// The managed instance group the instance belongs to, if any.
+	InstanceGroup string `json:"instanceGroup,omitempty"`
+
+	InstanceSelfLink string `json:"instanceSelfLink,omitempty"`
+	InstanceID       string `json:"instanceId,omitempty"`
+
+	// The state of the instance as reported by GCE, e.g. RUNNING.
+	InstanceState string `json:"instanceState,omitempty"`
+
+	InternalIP string `json:"internalIP,omitempty"`
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// The SSH host keys of the instance in authorized keys format, pinned
+	// when they were first read from its serial port. The serial port only
+	// keeps the latest output, so the keys the instance printed when it
+	// booted don't stay there.
+	HostKeys []string `json:"hostKeys,omitempty"`
+
+	// A hash of the provider config the instance was last created or
+	// updated from. A machine whose provider config hashes differently needs
+	// to be updated.
+	LastAppliedProviderConfigHash string `json:"lastAppliedProviderConfigHash,omitempty"`
+
+	Conditions []GCEMachineProviderCondition `json:"conditions,omitempty"`
+
+	// The progress of an in-place upgrade of the machine's versions. It is
+	// only set while an upgrade is under way or after one failed.
+	Upgrade *GCEMachineUpgradeStatus `json:"upgrade,omitempty"`
+
+	// The instance that replaces the machine's instance. It is only set
+	// while a replacement is under way or after one failed.
+	Replacement *GCEMachineReplacementStatus `json:"replacement,omitempty"`
+}
+
+// GCEMachineProviderConditionType is the type of a condition of a machine's
+// instance.
+type GCEMachineProviderConditionType string
+
+const (
+	// InstanceReady is true while the machine's instance is running.
+	InstanceReady GCEMachineProviderConditionType = "InstanceReady"
+)
+
+// GCEMachineProviderCondition describes the state of a machine's instance at
+// a certain point.
+type GCEMachineProviderCondition struct {
+	Type   GCEMachineProviderConditionType `json:"type"`
+	Status corev1.ConditionStatus          `json:"status"`
+
+	// The last time the condition changed from one status to another.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// A unique, one-word, CamelCase reason for the condition's last
+	// transition.
+	Reason string `json:"reason,omitempty"`
+
+	// A human readable message indicating details about the last transition.
+	Message string `json:"message,omitempty"`
+}
+
+// GCEMachineUpgradePhase is a step of an in-place upgrade.
+type GCEMachineUpgradePhase string
+
+const (
+	// The version skew of the upgrade is checked.
+	UpgradePreflight GCEMachineUpgradePhase = "Preflight"
+	// The kubeadm binary of the new version is downloaded and verified.
+	UpgradeKubeadm GCEMachineUpgradePhase = "Kubeadm"
+	// kubeadm checks that the cluster can be upgraded.
+	UpgradePlan GCEMachineUpgradePhase = "Plan"
+	// A snapshot of etcd is saved on the master.
+	UpgradeEtcdSnapshot GCEMachineUpgradePhase = "EtcdSnapshot"
+	// The control plane is upgraded.
+	UpgradeControlPlane GCEMachineUpgradePhase = "ControlPlane"
+	// The node is drained and its kubelet upgraded.
+	UpgradeKubelet GCEMachineUpgradePhase = "Kubelet"
+	// The kubelet package is rolled back after a failed upgrade.
+	UpgradeRollback GCEMachineUpgradePhase = "Rollback"
+	// The upgrade failed. It is not retried until the machine's versions
+	// change again.
+	UpgradeFailed GCEMachineUpgradePhase = "Failed"
+)
+
+// GCEMachineUpgradeStatus records an in-place upgrade, so that an upgrade
+// interrupted by a restart of the machine controller resumes at the phase it
+// reached.
+type GCEMachineUpgradeStatus struct {
+	// The versions the machine is upgraded from and to.
+	FromControlPlane string `json:"fromControlPlane,omitempty"`
+	FromKubelet      string `json:"fromKubelet,omitempty"`
+	ToControlPlane   string `json:"toControlPlane,omitempty"`
+	ToKubelet        string `json:"toKubelet,omitempty"`
+
+	Phase     GCEMachineUpgradePhase `json:"phase"`
+	StartTime metav1.Time            `json:"startTime,omitempty"`
+
+	// The path of the etcd snapshot saved on the master before its control
+	// plane was upgraded.
+	EtcdSnapshot string `json:"etcdSnapshot,omitempty"`
+
+	// Why the upgrade is rolled back or failed.
+	Message string `json:"message,omitempty"`
+}
+
+// GCEMachineReplacementPhase is a step of the replacement of a machine's
+// instance.
+type GCEMachineReplacementPhase string
+
+const (
+	// The new instance is created.
+	ReplacementCreate GCEMachineReplacementPhase = "Create"
+	// The new instance joins the cluster and becomes healthy.
+	ReplacementJoin GCEMachineReplacementPhase = "Join"
+	// The node of the old instance is cordoned and drained.
+	ReplacementDrain GCEMachineReplacementPhase = "Drain"
+	// The old instance is removed from the etcd cluster. Only masters run
+	// this phase.
+	ReplacementRemoveEtcdMember GCEMachineReplacementPhase = "RemoveEtcdMember"
+	// The old instance and its node are deleted.
+	ReplacementDeleteInstance GCEMachineReplacementPhase = "DeleteInstance"
+	// The replacement failed. The old instance keeps running. The new
+	// instance of a master is left for inspection, and the replacement is
+	// not retried until the machine's spec changes again.
+	ReplacementFailed GCEMachineReplacementPhase = "Failed"
+)
+
+// GCEMachineReplacementStatus records the replacement of a machine's
+// instance, so that a replacement interrupted by a restart of the machine
+// controller resumes at the phase it reached. The machine's instance remains
+// the old one until the replacement completes.
+type GCEMachineReplacementStatus struct {
+	// The zone and name of the new instance.
+	Zone         string `json:"zone"`
+	InstanceName string `json:"instanceName"`
+
+	// The provider config hash and versions the new instance is created
+	// from, which are recorded as applied once the replacement completes.
+	ProviderConfigHash string `json:"providerConfigHash"`
+	ControlPlane       string `json:"controlPlane,omitempty"`
+	Kubelet            string `json:"kubelet"`
+
+	// When the replacement started, and when it entered its current phase.
+	// Waiting for the new instance to join and for the old node to drain
+	// times out after the start of the phase.
+	Phase          GCEMachineReplacementPhase `json:"phase"`
+	StartTime      metav1.Time                `json:"startTime,omitempty"`
+	PhaseStartTime metav1.Time                `json:"phaseStartTime,omitempty"`
+
+	// Why the replacement failed.
+	Message string `json:"message,omitempty"`
+}
+
+func init() {
+	SchemeBuilder.Register(&GCEMachineProviderStatus{})
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+
+	compute "google.golang.org/api/compute/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// Returns the accelerators of an instance in the zone. Instance templates,
+// which have no zone, refer to accelerator types by name.
+func newGuestAccelerators(config *gceconfigv1.GCEMachineProviderConfig, zone string) []*compute.AcceleratorConfig {
+	var accelerators []*compute.AcceleratorConfig
+	for _, accelerator := range config.Accelerators {
+		acceleratorType := accelerator.Type
+		if zone != "" {
+			acceleratorType = fmt.Sprintf("zones/%s/acceleratorTypes/%s", zone, accelerator.Type)
+		}
+		accelerators = append(accelerators, &compute.AcceleratorConfig{
+			AcceleratorType:  acceleratorType,
+			AcceleratorCount: accelerator.Count,
+		})
+	}
+	return accelerators
+}
+
+// Checks that the machine's accelerators are offered in its zone, in the
+// requested numbers. Which accelerators a zone offers is only known to GCE,
+// so this cannot be checked when the machine is admitted.
+func (gce *GCEClient) validateAccelerators(project string, config *gceconfigv1.GCEMachineProviderConfig) *apierrors.MachineError {
+	for _, accelerator := range config.Accelerators {
+		acceleratorType, err := gce.computeService.AcceleratorTypesGet(project, config.Zone, accelerator.Type)
+		if errors.IsNotFound(err) {
+			return apierrors.InvalidMachineConfiguration("accelerator type %v is not available in zone %v", accelerator.Type, config.Zone)
+		}
+		if err != nil {
+			return apierrors.CreateMachine("error getting accelerator type %v: %v", accelerator.Type, err)
+		}
+		if max := acceleratorType.MaximumCardsPerInstance; max > 0 && accelerator.Count > max {
+			return apierrors.InvalidMachineConfiguration("at most %v accelerators of type %v can be attached to an instance, got %v", max, accelerator.Type, accelerator.Count)
+		}
+	}
+	return nil
+}
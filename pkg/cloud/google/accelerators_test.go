@@ -0,0 +1,169 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"strings"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAccelerators(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	var requestedZone, requestedType string
+	computeServiceMock.mockAcceleratorTypesGet = func(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error) {
+		requestedZone, requestedType = zone, acceleratorType
+		return &compute.AcceleratorType{Name: acceleratorType, MaximumCardsPerInstance: 8}, nil
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 2}}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	if requestedZone != "us-west5-f" || requestedType != "nvidia-tesla-k80" {
+		t.Errorf("expected accelerator type 'nvidia-tesla-k80' to be checked in 'us-west5-f', got '%v' in '%v'", requestedType, requestedZone)
+	}
+	if len(receivedInstance.GuestAccelerators) != 1 {
+		t.Fatalf("expected 1 guest accelerator, got %v", len(receivedInstance.GuestAccelerators))
+	}
+	accelerator := receivedInstance.GuestAccelerators[0]
+	if accelerator.AcceleratorType != "zones/us-west5-f/acceleratorTypes/nvidia-tesla-k80" || accelerator.AcceleratorCount != 2 {
+		t.Errorf("invalid guest accelerator: got '%+v'", accelerator)
+	}
+	if receivedInstance.Scheduling == nil || receivedInstance.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("expected an instance with accelerators to be terminated during host maintenance, got '%+v'", receivedInstance.Scheduling)
+	}
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "ACCELERATOR_TYPE=nvidia-tesla-k80\n", "ACCELERATOR_COUNT=2\n", "install-accelerator-drivers\n")
+}
+
+func TestMultipleAcceleratorsAreCommaSeparated(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	computeServiceMock.mockAcceleratorTypesGet = func(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error) {
+		return &compute.AcceleratorType{Name: acceleratorType, MaximumCardsPerInstance: 8}, nil
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 2}, {Type: "nvidia-tesla-p100", Count: 4}}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	if len(receivedInstance.GuestAccelerators) != 2 {
+		t.Fatalf("expected 2 guest accelerators, got %v", len(receivedInstance.GuestAccelerators))
+	}
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "ACCELERATOR_TYPE=nvidia-tesla-k80,nvidia-tesla-p100\n", "ACCELERATOR_COUNT=2,4\n")
+}
+
+func TestAcceleratorsOverrideMigration(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Scheduling = &gceconfigv1.Scheduling{OnHostMaintenance: "MIGRATE"}
+	config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 1}}
+	computeServiceMock.mockAcceleratorTypesGet = func(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error) {
+		return &compute.AcceleratorType{Name: acceleratorType}, nil
+	}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	if receivedInstance.Scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("invalid on host maintenance policy: expected 'TERMINATE' got '%v'", receivedInstance.Scheduling.OnHostMaintenance)
+	}
+}
+
+func TestNoAccelerators(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	if len(receivedInstance.GuestAccelerators) != 0 {
+		t.Errorf("expected no guest accelerators, got %v", len(receivedInstance.GuestAccelerators))
+	}
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "ACCELERATOR_TYPE=\n", "ACCELERATOR_COUNT=\n")
+	if strings.Contains(*startupScript.Value, "install-accelerator-drivers") {
+		t.Errorf("expected no accelerator drivers to be installed, got startup-script %q", *startupScript.Value)
+	}
+}
+
+func TestUnavailableAcceleratorsRecordMachineError(t *testing.T) {
+	testCases := []struct {
+		name            string
+		acceleratorType *compute.AcceleratorType
+		err             error
+	}{
+		{"accelerator type not in zone", nil, &googleapi.Error{Code: 404, Message: "not found"}},
+		{"too many accelerators", &compute.AcceleratorType{Name: "nvidia-tesla-k80", MaximumCardsPerInstance: 8}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var inserted bool
+			computeServiceMock := &GCEClientComputeServiceMock{
+				mockAcceleratorTypesGet: func(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error) {
+					return tc.acceleratorType, tc.err
+				},
+				mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+					return nil, &googleapi.Error{Code: 404, Message: "not found"}
+				},
+				mockInstancesInsert: func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+					inserted = true
+					return &compute.Operation{}, nil
+				},
+			}
+			config := newGCEMachineProviderConfigFixture()
+			config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+			config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 16}}
+			machine := newStoredMachine(t, "node-0", config)
+			fakeClient := listingClient{fake.NewFakeClient(machine.DeepCopy())}
+			gce, err := google.NewMachineActuator(google.MachineActuatorParams{
+				ComputeService:           computeServiceMock,
+				Kubeadm:                  newTokenCreatingKubeadm(t),
+				Client:                   fakeClient,
+				MachineSetupConfigGetter: newMachineSetupConfigWatcher(),
+				EventRecorder:            &record.FakeRecorder{},
+				Scheme:                   scheme.Scheme,
+			})
+			if err != nil {
+				t.Fatalf("unable to create machine actuator: %v", err)
+			}
+
+			if err := gce.Create(newDefaultClusterFixture(t), machine); err == nil {
+				t.Fatal("expected an error for the unavailable accelerators")
+			}
+			if inserted {
+				t.Error("expected no instance to be created")
+			}
+			stored := getMachine(t, fakeClient, machine)
+			if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.InvalidConfigurationMachineError {
+				t.Errorf("invalid error reason: expected '%v' got '%v'", common.InvalidConfigurationMachineError, stored.Status.ErrorReason)
+			}
+		})
+	}
+}
@@ -17,19 +17,73 @@ limitations under the License.
 package google
 
 import (
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 )
 
 type GCEClientComputeService interface {
+	AcceleratorTypesGet(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error)
+	DisksGet(project string, zone string, disk string) (*compute.Disk, error)
+	DisksInsert(project string, zone string, disk *compute.Disk) (*compute.Operation, error)
 	ImagesGet(project string, image string) (*compute.Image, error)
 	ImagesGetFromFamily(project string, family string) (*compute.Image, error)
 	InstancesDelete(project string, zone string, targetInstance string) (*compute.Operation, error)
 	InstancesGet(project string, zone string, instance string) (*compute.Instance, error)
 	InstancesInsert(project string, zone string, instance *compute.Instance) (*compute.Operation, error)
+	BetaInstancesInsert(project string, zone string, instance *computebeta.Instance) (*compute.Operation, error)
+	InstancesStart(project string, zone string, instance string) (*compute.Operation, error)
+	InstancesSetMetadata(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error)
+	InstancesSetLabels(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error)
+	InstancesSetTags(project string, zone string, instance string, tags *compute.Tags) (*compute.Operation, error)
+	InstancesGetSerialPortOutput(project string, zone string, instance string) (*compute.SerialPortOutput, error)
+	InstanceTemplatesGet(project string, instanceTemplate string) (*compute.InstanceTemplate, error)
+	InstanceTemplatesInsert(project string, instanceTemplate *compute.InstanceTemplate) (*compute.Operation, error)
+	BetaInstanceTemplatesInsert(project string, instanceTemplate *computebeta.InstanceTemplate) (*compute.Operation, error)
+	InstanceTemplatesDelete(project string, instanceTemplate string) (*compute.Operation, error)
+	InstanceGroupManagersGet(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManager, error)
+	InstanceGroupManagersInsert(project string, zone string, instanceGroupManager *compute.InstanceGroupManager) (*compute.Operation, error)
+	InstanceGroupManagersResize(project string, zone string, instanceGroupManager string, size int64) (*compute.Operation, error)
+	InstanceGroupManagersSetInstanceTemplate(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersSetInstanceTemplateRequest) (*compute.Operation, error)
+	InstanceGroupManagersListManagedInstances(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManagersListManagedInstancesResponse, error)
+	InstanceGroupManagersDeleteInstances(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersDeleteInstancesRequest) (*compute.Operation, error)
+	InstanceGroupManagersDelete(project string, zone string, instanceGroupManager string) (*compute.Operation, error)
+	MachineTypesList(project string, zone string) (*compute.MachineTypeList, error)
+	RegionsGet(project string, region string) (*compute.Region, error)
 	ZoneOperationsGet(project string, zone string, operation string) (*compute.Operation, error)
+	RegionOperationsGet(project string, region string, operation string) (*compute.Operation, error)
 	GlobalOperationsGet(project string, operation string) (*compute.Operation, error)
 	FirewallsGet(project string) (*compute.FirewallList, error)
 	FirewallsInsert(project string, firewallRule *compute.Firewall) (*compute.Operation, error)
 	FirewallsDelete(project string, name string) (*compute.Operation, error)
+	NetworksGet(project string, network string) (*compute.Network, error)
+	NetworksInsert(project string, network *compute.Network) (*compute.Operation, error)
+	NetworksDelete(project string, network string) (*compute.Operation, error)
+	SubnetworksGet(project string, region string, subnetwork string) (*compute.Subnetwork, error)
+	SubnetworksInsert(project string, region string, subnetwork *compute.Subnetwork) (*compute.Operation, error)
+	SubnetworksDelete(project string, region string, subnetwork string) (*compute.Operation, error)
+	RoutersGet(project string, region string, router string) (*compute.Router, error)
+	RoutersInsert(project string, region string, router *compute.Router) (*compute.Operation, error)
+	RoutersDelete(project string, region string, router string) (*compute.Operation, error)
+	GlobalAddressesGet(project string, address string) (*compute.Address, error)
+	GlobalAddressesInsert(project string, address *compute.Address) (*compute.Operation, error)
+	GlobalAddressesDelete(project string, address string) (*compute.Operation, error)
+	InstanceGroupsGet(project string, zone string, instanceGroup string) (*compute.InstanceGroup, error)
+	InstanceGroupsInsert(project string, zone string, instanceGroup *compute.InstanceGroup) (*compute.Operation, error)
+	InstanceGroupsAddInstances(project string, zone string, instanceGroup string, request *compute.InstanceGroupsAddInstancesRequest) (*compute.Operation, error)
+	InstanceGroupsListInstances(project string, zone string, instanceGroup string) (*compute.InstanceGroupsListInstances, error)
+	InstanceGroupsDelete(project string, zone string, instanceGroup string) (*compute.Operation, error)
+	HealthChecksGet(project string, healthCheck string) (*compute.HealthCheck, error)
+	HealthChecksInsert(project string, healthCheck *compute.HealthCheck) (*compute.Operation, error)
+	HealthChecksDelete(project string, healthCheck string) (*compute.Operation, error)
+	BackendServicesGet(project string, backendService string) (*compute.BackendService, error)
+	BackendServicesInsert(project string, backendService *compute.BackendService) (*compute.Operation, error)
+	BackendServicesUpdate(project string, name string, backendService *compute.BackendService) (*compute.Operation, error)
+	BackendServicesDelete(project string, backendService string) (*compute.Operation, error)
+	TargetTcpProxiesGet(project string, targetTcpProxy string) (*compute.TargetTcpProxy, error)
+	TargetTcpProxiesInsert(project string, targetTcpProxy *compute.TargetTcpProxy) (*compute.Operation, error)
+	TargetTcpProxiesDelete(project string, targetTcpProxy string) (*compute.Operation, error)
+	GlobalForwardingRulesGet(project string, forwardingRule string) (*compute.ForwardingRule, error)
+	GlobalForwardingRulesInsert(project string, forwardingRule *compute.ForwardingRule) (*compute.Operation, error)
+	GlobalForwardingRulesDelete(project string, forwardingRule string) (*compute.Operation, error)
 	WaitForOperation(project string, op *compute.Operation) error
 }
@@ -16,20 +16,97 @@ limitations under the License.
 
 package google_test
 
-import compute "google.golang.org/api/compute/v1"
+import (
+	computebeta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+)
 
 type GCEClientComputeServiceMock struct {
-	mockImagesGet           func(project string, image string) (*compute.Image, error)
-	mockImagesGetFromFamily func(project string, family string) (*compute.Image, error)
-	mockInstancesDelete     func(project string, zone string, targetInstance string) (*compute.Operation, error)
-	mockInstancesGet        func(project string, zone string, instance string) (*compute.Instance, error)
-	mockInstancesInsert     func(project string, zone string, instance *compute.Instance) (*compute.Operation, error)
-	mockZoneOperationsGet   func(project string, zone string, operation string) (*compute.Operation, error)
-	mockGlobalOperationsGet func(project string, operation string) (*compute.Operation, error)
-	mockFirewallsGet        func(project string) (*compute.FirewallList, error)
-	mockFirewallsInsert     func(project string, firewallRule *compute.Firewall) (*compute.Operation, error)
-	mockFirewallsDelete     func(project string, name string) (*compute.Operation, error)
-	mockWaitForOperation    func(project string, op *compute.Operation) error
+	mockAcceleratorTypesGet                       func(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error)
+	mockDisksGet                                  func(project string, zone string, disk string) (*compute.Disk, error)
+	mockDisksInsert                               func(project string, zone string, disk *compute.Disk) (*compute.Operation, error)
+	mockImagesGet                                 func(project string, image string) (*compute.Image, error)
+	mockImagesGetFromFamily                       func(project string, family string) (*compute.Image, error)
+	mockInstancesDelete                           func(project string, zone string, targetInstance string) (*compute.Operation, error)
+	mockInstancesGet                              func(project string, zone string, instance string) (*compute.Instance, error)
+	mockInstancesInsert                           func(project string, zone string, instance *compute.Instance) (*compute.Operation, error)
+	mockBetaInstancesInsert                       func(project string, zone string, instance *computebeta.Instance) (*compute.Operation, error)
+	mockInstancesStart                            func(project string, zone string, instance string) (*compute.Operation, error)
+	mockInstancesSetMetadata                      func(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error)
+	mockInstancesSetLabels                        func(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error)
+	mockInstancesSetTags                          func(project string, zone string, instance string, tags *compute.Tags) (*compute.Operation, error)
+	mockInstancesGetSerialPortOutput              func(project string, zone string, instance string) (*compute.SerialPortOutput, error)
+	mockInstanceTemplatesGet                      func(project string, instanceTemplate string) (*compute.InstanceTemplate, error)
+	mockInstanceTemplatesInsert                   func(project string, instanceTemplate *compute.InstanceTemplate) (*compute.Operation, error)
+	mockBetaInstanceTemplatesInsert               func(project string, instanceTemplate *computebeta.InstanceTemplate) (*compute.Operation, error)
+	mockInstanceTemplatesDelete                   func(project string, instanceTemplate string) (*compute.Operation, error)
+	mockInstanceGroupManagersGet                  func(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManager, error)
+	mockInstanceGroupManagersInsert               func(project string, zone string, instanceGroupManager *compute.InstanceGroupManager) (*compute.Operation, error)
+	mockInstanceGroupManagersResize               func(project string, zone string, instanceGroupManager string, size int64) (*compute.Operation, error)
+	mockInstanceGroupManagersSetInstanceTemplate  func(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersSetInstanceTemplateRequest) (*compute.Operation, error)
+	mockInstanceGroupManagersListManagedInstances func(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManagersListManagedInstancesResponse, error)
+	mockInstanceGroupManagersDeleteInstances      func(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersDeleteInstancesRequest) (*compute.Operation, error)
+	mockInstanceGroupManagersDelete               func(project string, zone string, instanceGroupManager string) (*compute.Operation, error)
+	mockMachineTypesList                          func(project string, zone string) (*compute.MachineTypeList, error)
+	mockRegionsGet                                func(project string, region string) (*compute.Region, error)
+	mockZoneOperationsGet                         func(project string, zone string, operation string) (*compute.Operation, error)
+	mockRegionOperationsGet                       func(project string, region string, operation string) (*compute.Operation, error)
+	mockGlobalOperationsGet                       func(project string, operation string) (*compute.Operation, error)
+	mockFirewallsGet                              func(project string) (*compute.FirewallList, error)
+	mockFirewallsInsert                           func(project string, firewallRule *compute.Firewall) (*compute.Operation, error)
+	mockFirewallsDelete                           func(project string, name string) (*compute.Operation, error)
+	mockNetworksGet                               func(project string, network string) (*compute.Network, error)
+	mockNetworksInsert                            func(project string, network *compute.Network) (*compute.Operation, error)
+	mockNetworksDelete                            func(project string, network string) (*compute.Operation, error)
+	mockSubnetworksGet                            func(project string, region string, subnetwork string) (*compute.Subnetwork, error)
+	mockSubnetworksInsert                         func(project string, region string, subnetwork *compute.Subnetwork) (*compute.Operation, error)
+	mockSubnetworksDelete                         func(project string, region string, subnetwork string) (*compute.Operation, error)
+	mockRoutersGet                                func(project string, region string, router string) (*compute.Router, error)
+	mockRoutersInsert                             func(project string, region string, router *compute.Router) (*compute.Operation, error)
+	mockRoutersDelete                             func(project string, region string, router string) (*compute.Operation, error)
+	mockGlobalAddressesGet                        func(project string, address string) (*compute.Address, error)
+	mockGlobalAddressesInsert                     func(project string, address *compute.Address) (*compute.Operation, error)
+	mockGlobalAddressesDelete                     func(project string, address string) (*compute.Operation, error)
+	mockInstanceGroupsGet                         func(project string, zone string, instanceGroup string) (*compute.InstanceGroup, error)
+	mockInstanceGroupsInsert                      func(project string, zone string, instanceGroup *compute.InstanceGroup) (*compute.Operation, error)
+	mockInstanceGroupsAddInstances                func(project string, zone string, instanceGroup string, request *compute.InstanceGroupsAddInstancesRequest) (*compute.Operation, error)
+	mockInstanceGroupsListInstances               func(project string, zone string, instanceGroup string) (*compute.InstanceGroupsListInstances, error)
+	mockInstanceGroupsDelete                      func(project string, zone string, instanceGroup string) (*compute.Operation, error)
+	mockHealthChecksGet                           func(project string, healthCheck string) (*compute.HealthCheck, error)
+	mockHealthChecksInsert                        func(project string, healthCheck *compute.HealthCheck) (*compute.Operation, error)
+	mockHealthChecksDelete                        func(project string, healthCheck string) (*compute.Operation, error)
+	mockBackendServicesGet                        func(project string, backendService string) (*compute.BackendService, error)
+	mockBackendServicesInsert                     func(project string, backendService *compute.BackendService) (*compute.Operation, error)
+	mockBackendServicesUpdate                     func(project string, name string, backendService *compute.BackendService) (*compute.Operation, error)
+	mockBackendServicesDelete                     func(project string, backendService string) (*compute.Operation, error)
+	mockTargetTcpProxiesGet                       func(project string, targetTcpProxy string) (*compute.TargetTcpProxy, error)
+	mockTargetTcpProxiesInsert                    func(project string, targetTcpProxy *compute.TargetTcpProxy) (*compute.Operation, error)
+	mockTargetTcpProxiesDelete                    func(project string, targetTcpProxy string) (*compute.Operation, error)
+	mockGlobalForwardingRulesGet                  func(project string, forwardingRule string) (*compute.ForwardingRule, error)
+	mockGlobalForwardingRulesInsert               func(project string, forwardingRule *compute.ForwardingRule) (*compute.Operation, error)
+	mockGlobalForwardingRulesDelete               func(project string, forwardingRule string) (*compute.Operation, error)
+	mockWaitForOperation                          func(project string, op *compute.Operation) error
+}
+
+func (c *GCEClientComputeServiceMock) AcceleratorTypesGet(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error) {
+	if c.mockAcceleratorTypesGet == nil {
+		return nil, nil
+	}
+	return c.mockAcceleratorTypesGet(project, zone, acceleratorType)
+}
+
+func (c *GCEClientComputeServiceMock) DisksGet(project string, zone string, disk string) (*compute.Disk, error) {
+	if c.mockDisksGet == nil {
+		return nil, nil
+	}
+	return c.mockDisksGet(project, zone, disk)
+}
+
+func (c *GCEClientComputeServiceMock) DisksInsert(project string, zone string, disk *compute.Disk) (*compute.Operation, error) {
+	if c.mockDisksInsert == nil {
+		return nil, nil
+	}
+	return c.mockDisksInsert(project, zone, disk)
 }
 
 func (c *GCEClientComputeServiceMock) ImagesGet(project string, image string) (*compute.Image, error) {
@@ -67,6 +144,139 @@ func (c *GCEClientComputeServiceMock) InstancesInsert(project string, zone strin
 	return c.mockInstancesInsert(project, zone, instance)
 }
 
+func (c *GCEClientComputeServiceMock) BetaInstancesInsert(project string, zone string, instance *computebeta.Instance) (*compute.Operation, error) {
+	if c.mockBetaInstancesInsert == nil {
+		return nil, nil
+	}
+	return c.mockBetaInstancesInsert(project, zone, instance)
+}
+
+func (c *GCEClientComputeServiceMock) InstancesStart(project string, zone string, instance string) (*compute.Operation, error) {
+	if c.mockInstancesStart == nil {
+		return nil, nil
+	}
+	return c.mockInstancesStart(project, zone, instance)
+}
+
+func (c *GCEClientComputeServiceMock) InstancesSetMetadata(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error) {
+	if c.mockInstancesSetMetadata == nil {
+		return nil, nil
+	}
+	return c.mockInstancesSetMetadata(project, zone, instance, metadata)
+}
+
+func (c *GCEClientComputeServiceMock) InstancesSetLabels(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	if c.mockInstancesSetLabels == nil {
+		return nil, nil
+	}
+	return c.mockInstancesSetLabels(project, zone, instance, request)
+}
+
+func (c *GCEClientComputeServiceMock) InstancesSetTags(project string, zone string, instance string, tags *compute.Tags) (*compute.Operation, error) {
+	if c.mockInstancesSetTags == nil {
+		return nil, nil
+	}
+	return c.mockInstancesSetTags(project, zone, instance, tags)
+}
+
+func (c *GCEClientComputeServiceMock) InstancesGetSerialPortOutput(project string, zone string, instance string) (*compute.SerialPortOutput, error) {
+	if c.mockInstancesGetSerialPortOutput == nil {
+		return nil, nil
+	}
+	return c.mockInstancesGetSerialPortOutput(project, zone, instance)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceTemplatesGet(project string, instanceTemplate string) (*compute.InstanceTemplate, error) {
+	if c.mockInstanceTemplatesGet == nil {
+		return nil, nil
+	}
+	return c.mockInstanceTemplatesGet(project, instanceTemplate)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceTemplatesInsert(project string, instanceTemplate *compute.InstanceTemplate) (*compute.Operation, error) {
+	if c.mockInstanceTemplatesInsert == nil {
+		return nil, nil
+	}
+	return c.mockInstanceTemplatesInsert(project, instanceTemplate)
+}
+
+func (c *GCEClientComputeServiceMock) BetaInstanceTemplatesInsert(project string, instanceTemplate *computebeta.InstanceTemplate) (*compute.Operation, error) {
+	if c.mockBetaInstanceTemplatesInsert == nil {
+		return nil, nil
+	}
+	return c.mockBetaInstanceTemplatesInsert(project, instanceTemplate)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceTemplatesDelete(project string, instanceTemplate string) (*compute.Operation, error) {
+	if c.mockInstanceTemplatesDelete == nil {
+		return nil, nil
+	}
+	return c.mockInstanceTemplatesDelete(project, instanceTemplate)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersGet(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManager, error) {
+	if c.mockInstanceGroupManagersGet == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersGet(project, zone, instanceGroupManager)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersInsert(project string, zone string, instanceGroupManager *compute.InstanceGroupManager) (*compute.Operation, error) {
+	if c.mockInstanceGroupManagersInsert == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersInsert(project, zone, instanceGroupManager)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersResize(project string, zone string, instanceGroupManager string, size int64) (*compute.Operation, error) {
+	if c.mockInstanceGroupManagersResize == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersResize(project, zone, instanceGroupManager, size)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersSetInstanceTemplate(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersSetInstanceTemplateRequest) (*compute.Operation, error) {
+	if c.mockInstanceGroupManagersSetInstanceTemplate == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersSetInstanceTemplate(project, zone, instanceGroupManager, request)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersListManagedInstances(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManagersListManagedInstancesResponse, error) {
+	if c.mockInstanceGroupManagersListManagedInstances == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersListManagedInstances(project, zone, instanceGroupManager)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersDeleteInstances(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersDeleteInstancesRequest) (*compute.Operation, error) {
+	if c.mockInstanceGroupManagersDeleteInstances == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersDeleteInstances(project, zone, instanceGroupManager, request)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupManagersDelete(project string, zone string, instanceGroupManager string) (*compute.Operation, error) {
+	if c.mockInstanceGroupManagersDelete == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupManagersDelete(project, zone, instanceGroupManager)
+}
+
+func (c *GCEClientComputeServiceMock) MachineTypesList(project string, zone string) (*compute.MachineTypeList, error) {
+	if c.mockMachineTypesList == nil {
+		return nil, nil
+	}
+	return c.mockMachineTypesList(project, zone)
+}
+
+func (c *GCEClientComputeServiceMock) RegionsGet(project string, region string) (*compute.Region, error) {
+	if c.mockRegionsGet == nil {
+		return nil, nil
+	}
+	return c.mockRegionsGet(project, region)
+}
+
 func (c *GCEClientComputeServiceMock) ZoneOperationsGet(project string, zone string, operation string) (*compute.Operation, error) {
 	if c.mockZoneOperationsGet == nil {
 		return nil, nil
@@ -74,6 +284,13 @@ func (c *GCEClientComputeServiceMock) ZoneOperationsGet(project string, zone str
 	return c.mockZoneOperationsGet(project, zone, operation)
 }
 
+func (c *GCEClientComputeServiceMock) RegionOperationsGet(project string, region string, operation string) (*compute.Operation, error) {
+	if c.mockRegionOperationsGet == nil {
+		return nil, nil
+	}
+	return c.mockRegionOperationsGet(project, region, operation)
+}
+
 func (c *GCEClientComputeServiceMock) GlobalOperationsGet(project string, operation string) (*compute.Operation, error) {
 	if c.mockGlobalOperationsGet == nil {
 		return nil, nil
@@ -102,6 +319,216 @@ func (c *GCEClientComputeServiceMock) FirewallsDelete(project string, name strin
 	return c.mockFirewallsDelete(project, name)
 }
 
+func (c *GCEClientComputeServiceMock) NetworksGet(project string, network string) (*compute.Network, error) {
+	if c.mockNetworksGet == nil {
+		return nil, nil
+	}
+	return c.mockNetworksGet(project, network)
+}
+
+func (c *GCEClientComputeServiceMock) NetworksInsert(project string, network *compute.Network) (*compute.Operation, error) {
+	if c.mockNetworksInsert == nil {
+		return nil, nil
+	}
+	return c.mockNetworksInsert(project, network)
+}
+
+func (c *GCEClientComputeServiceMock) NetworksDelete(project string, network string) (*compute.Operation, error) {
+	if c.mockNetworksDelete == nil {
+		return nil, nil
+	}
+	return c.mockNetworksDelete(project, network)
+}
+
+func (c *GCEClientComputeServiceMock) SubnetworksGet(project string, region string, subnetwork string) (*compute.Subnetwork, error) {
+	if c.mockSubnetworksGet == nil {
+		return nil, nil
+	}
+	return c.mockSubnetworksGet(project, region, subnetwork)
+}
+
+func (c *GCEClientComputeServiceMock) SubnetworksInsert(project string, region string, subnetwork *compute.Subnetwork) (*compute.Operation, error) {
+	if c.mockSubnetworksInsert == nil {
+		return nil, nil
+	}
+	return c.mockSubnetworksInsert(project, region, subnetwork)
+}
+
+func (c *GCEClientComputeServiceMock) SubnetworksDelete(project string, region string, subnetwork string) (*compute.Operation, error) {
+	if c.mockSubnetworksDelete == nil {
+		return nil, nil
+	}
+	return c.mockSubnetworksDelete(project, region, subnetwork)
+}
+
+func (c *GCEClientComputeServiceMock) RoutersGet(project string, region string, router string) (*compute.Router, error) {
+	if c.mockRoutersGet == nil {
+		return nil, nil
+	}
+	return c.mockRoutersGet(project, region, router)
+}
+
+func (c *GCEClientComputeServiceMock) RoutersInsert(project string, region string, router *compute.Router) (*compute.Operation, error) {
+	if c.mockRoutersInsert == nil {
+		return nil, nil
+	}
+	return c.mockRoutersInsert(project, region, router)
+}
+
+func (c *GCEClientComputeServiceMock) RoutersDelete(project string, region string, router string) (*compute.Operation, error) {
+	if c.mockRoutersDelete == nil {
+		return nil, nil
+	}
+	return c.mockRoutersDelete(project, region, router)
+}
+
+func (c *GCEClientComputeServiceMock) GlobalAddressesGet(project string, address string) (*compute.Address, error) {
+	if c.mockGlobalAddressesGet == nil {
+		return nil, nil
+	}
+	return c.mockGlobalAddressesGet(project, address)
+}
+
+func (c *GCEClientComputeServiceMock) GlobalAddressesInsert(project string, address *compute.Address) (*compute.Operation, error) {
+	if c.mockGlobalAddressesInsert == nil {
+		return nil, nil
+	}
+	return c.mockGlobalAddressesInsert(project, address)
+}
+
+func (c *GCEClientComputeServiceMock) GlobalAddressesDelete(project string, address string) (*compute.Operation, error) {
+	if c.mockGlobalAddressesDelete == nil {
+		return nil, nil
+	}
+	return c.mockGlobalAddressesDelete(project, address)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupsGet(project string, zone string, instanceGroup string) (*compute.InstanceGroup, error) {
+	if c.mockInstanceGroupsGet == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupsGet(project, zone, instanceGroup)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupsInsert(project string, zone string, instanceGroup *compute.InstanceGroup) (*compute.Operation, error) {
+	if c.mockInstanceGroupsInsert == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupsInsert(project, zone, instanceGroup)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupsAddInstances(project string, zone string, instanceGroup string, request *compute.InstanceGroupsAddInstancesRequest) (*compute.Operation, error) {
+	if c.mockInstanceGroupsAddInstances == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupsAddInstances(project, zone, instanceGroup, request)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupsListInstances(project string, zone string, instanceGroup string) (*compute.InstanceGroupsListInstances, error) {
+	if c.mockInstanceGroupsListInstances == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupsListInstances(project, zone, instanceGroup)
+}
+
+func (c *GCEClientComputeServiceMock) InstanceGroupsDelete(project string, zone string, instanceGroup string) (*compute.Operation, error) {
+	if c.mockInstanceGroupsDelete == nil {
+		return nil, nil
+	}
+	return c.mockInstanceGroupsDelete(project, zone, instanceGroup)
+}
+
+func (c *GCEClientComputeServiceMock) HealthChecksGet(project string, healthCheck string) (*compute.HealthCheck, error) {
+	if c.mockHealthChecksGet == nil {
+		return nil, nil
+	}
+	return c.mockHealthChecksGet(project, healthCheck)
+}
+
+func (c *GCEClientComputeServiceMock) HealthChecksInsert(project string, healthCheck *compute.HealthCheck) (*compute.Operation, error) {
+	if c.mockHealthChecksInsert == nil {
+		return nil, nil
+	}
+	return c.mockHealthChecksInsert(project, healthCheck)
+}
+
+func (c *GCEClientComputeServiceMock) HealthChecksDelete(project string, healthCheck string) (*compute.Operation, error) {
+	if c.mockHealthChecksDelete == nil {
+		return nil, nil
+	}
+	return c.mockHealthChecksDelete(project, healthCheck)
+}
+
+func (c *GCEClientComputeServiceMock) BackendServicesGet(project string, backendService string) (*compute.BackendService, error) {
+	if c.mockBackendServicesGet == nil {
+		return nil, nil
+	}
+	return c.mockBackendServicesGet(project, backendService)
+}
+
+func (c *GCEClientComputeServiceMock) BackendServicesInsert(project string, backendService *compute.BackendService) (*compute.Operation, error) {
+	if c.mockBackendServicesInsert == nil {
+		return nil, nil
+	}
+	return c.mockBackendServicesInsert(project, backendService)
+}
+
+func (c *GCEClientComputeServiceMock) BackendServicesUpdate(project string, name string, backendService *compute.BackendService) (*compute.Operation, error) {
+	if c.mockBackendServicesUpdate == nil {
+		return nil, nil
+	}
+	return c.mockBackendServicesUpdate(project, name, backendService)
+}
+
+func (c *GCEClientComputeServiceMock) BackendServicesDelete(project string, backendService string) (*compute.Operation, error) {
+	if c.mockBackendServicesDelete == nil {
+		return nil, nil
+	}
+	return c.mockBackendServicesDelete(project, backendService)
+}
+
+func (c *GCEClientComputeServiceMock) TargetTcpProxiesGet(project string, targetTcpProxy string) (*compute.TargetTcpProxy, error) {
+	if c.mockTargetTcpProxiesGet == nil {
+		return nil, nil
+	}
+	return c.mockTargetTcpProxiesGet(project, targetTcpProxy)
+}
+
+func (c *GCEClientComputeServiceMock) TargetTcpProxiesInsert(project string, targetTcpProxy *compute.TargetTcpProxy) (*compute.Operation, error) {
+	if c.mockTargetTcpProxiesInsert == nil {
+		return nil, nil
+	}
+	return c.mockTargetTcpProxiesInsert(project, targetTcpProxy)
+}
+
+func (c *GCEClientComputeServiceMock) TargetTcpProxiesDelete(project string, targetTcpProxy string) (*compute.Operation, error) {
+	if c.mockTargetTcpProxiesDelete == nil {
+		return nil, nil
+	}
+	return c.mockTargetTcpProxiesDelete(project, targetTcpProxy)
+}
+
+func (c *GCEClientComputeServiceMock) GlobalForwardingRulesGet(project string, forwardingRule string) (*compute.ForwardingRule, error) {
+	if c.mockGlobalForwardingRulesGet == nil {
+		return nil, nil
+	}
+	return c.mockGlobalForwardingRulesGet(project, forwardingRule)
+}
+
+func (c *GCEClientComputeServiceMock) GlobalForwardingRulesInsert(project string, forwardingRule *compute.ForwardingRule) (*compute.Operation, error) {
+	if c.mockGlobalForwardingRulesInsert == nil {
+		return nil, nil
+	}
+	return c.mockGlobalForwardingRulesInsert(project, forwardingRule)
+}
+
+func (c *GCEClientComputeServiceMock) GlobalForwardingRulesDelete(project string, forwardingRule string) (*compute.Operation, error) {
+	if c.mockGlobalForwardingRulesDelete == nil {
+		return nil, nil
+	}
+	return c.mockGlobalForwardingRulesDelete(project, forwardingRule)
+}
+
 func (c *GCEClientComputeServiceMock) WaitForOperation(project string, op *compute.Operation) error {
 	if c.mockWaitForOperation == nil {
 		return nil
@@ -82,6 +82,17 @@ func (crm *CloudResourceManagerService) ProjectsGet(id string) (*cloudresourcema
 	return project, nil
 }
 
+// A pass through wrapper for cloudresourcemanager.Projects.GetIamPolicy(...)
+func (crm *CloudResourceManagerService) ProjectsGetIamPolicy(project string) (*cloudresourcemanager.Policy, error) {
+	return crm.service.Projects.GetIamPolicy(project, &cloudresourcemanager.GetIamPolicyRequest{}).Do()
+}
+
+// A pass through wrapper for cloudresourcemanager.Projects.SetIamPolicy(...). The policy is only set if its etag
+// matches the current policy's.
+func (crm *CloudResourceManagerService) ProjectsSetIamPolicy(project string, policy *cloudresourcemanager.Policy) (*cloudresourcemanager.Policy, error) {
+	return crm.service.Projects.SetIamPolicy(project, &cloudresourcemanager.SetIamPolicyRequest{Policy: policy}).Do()
+}
+
 // Calls cloudresourcemanager.Projects.List(...) with the given filter applied. Paginated results are combined into a single
 // slice. When not applying a filter use with care as every visible project will be returned.
 func (crm *CloudResourceManagerService) ProjectsList(filter string) ([]*cloudresourcemanager.Project, error) {
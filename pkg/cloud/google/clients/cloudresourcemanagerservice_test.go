@@ -17,6 +17,7 @@ limitations under the License.
 package clients_test
 
 import (
+	"encoding/json"
 	"google.golang.org/api/cloudresourcemanager/v1"
 	"net/http"
 	"net/http/httptest"
@@ -131,6 +132,45 @@ func TestProjectList(t *testing.T) {
 	}
 }
 
+func TestProjectsGetIamPolicy(t *testing.T) {
+	mux, server, client := createMuxServerAndCloudResourceManagerClient(t)
+	defer server.Close()
+	responsePolicy := cloudresourcemanager.Policy{
+		Etag:     "BwWKmjvelug=",
+		Bindings: []*cloudresourcemanager.Binding{{Role: "roles/compute.viewer", Members: []string{"user:someone@example.com"}}},
+	}
+	mux.Handle("/v1/projects/projectId:getIamPolicy", handler(nil, &responsePolicy))
+	policy, err := client.ProjectsGetIamPolicy("projectId")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy.Etag != responsePolicy.Etag {
+		t.Errorf("etag mismatch: expected '%v' got '%v'", responsePolicy.Etag, policy.Etag)
+	}
+	if len(policy.Bindings) != 1 || policy.Bindings[0].Role != "roles/compute.viewer" {
+		t.Errorf("bindings mismatch: expected '%v' got '%v'", responsePolicy.Bindings, policy.Bindings)
+	}
+}
+
+func TestProjectsSetIamPolicy(t *testing.T) {
+	mux, server, client := createMuxServerAndCloudResourceManagerClient(t)
+	defer server.Close()
+	var request cloudresourcemanager.SetIamPolicyRequest
+	mux.HandleFunc("/v1/projects/projectId:setIamPolicy", func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		handleTestRequest(w, nil, request.Policy)
+	})
+	policy := cloudresourcemanager.Policy{Etag: "BwWKmjvelug="}
+	if _, err := client.ProjectsSetIamPolicy("projectId", &policy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if request.Policy == nil || request.Policy.Etag != policy.Etag {
+		t.Errorf("expected the policy to be sent with its etag, got '%+v'", request.Policy)
+	}
+}
+
 func verifyProjectsWithResponses(t *testing.T, projects []*cloudresourcemanager.Project, responses []cloudresourcemanager.ListProjectsResponse) {
 	t.Helper()
 	responseProjects := make([]*cloudresourcemanager.Project, 0)
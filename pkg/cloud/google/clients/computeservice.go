@@ -18,6 +18,7 @@ package clients
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -27,18 +28,24 @@ import (
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 )
 
 const (
-	gceTimeout   = time.Minute * 10
-	gceWaitSleep = time.Second * 5
+	gceTimeout = time.Minute * 10
 )
 
+// The interval between polls of a pending operation. Tests shorten it.
+var gceWaitSleep = time.Second * 5
+
 // ComputeService is a pass through wrapper for google.golang.org/api/compute/v1/compute
 // The purpose of the ComputeService's wrap of the GCE client is to enable tests to mock this struct and control behavior.
 type ComputeService struct {
 	service *compute.Service
+	// Creates the instances and instance templates that need options the
+	// v1 API of the vendored client lacks, such as Shielded VM.
+	betaService *computebeta.Service
 }
 
 func NewComputeService(client *http.Client) (*ComputeService, error) {
@@ -46,8 +53,13 @@ func NewComputeService(client *http.Client) (*ComputeService, error) {
 	if err != nil {
 		return nil, err
 	}
+	betaService, err := computebeta.New(client)
+	if err != nil {
+		return nil, err
+	}
 	return &ComputeService{
-		service: service,
+		service:     service,
+		betaService: betaService,
 	}, nil
 }
 
@@ -56,6 +68,11 @@ func NewComputeServiceForURL(client *http.Client, baseURL string) (*ComputeServi
 	if err != nil {
 		return nil, err
 	}
+	betaURL, err := url.Parse(computeService.betaService.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	computeService.betaService.BasePath = baseURL + betaURL.Path
 	url, err := url.Parse(computeService.service.BasePath)
 	if err != nil {
 		return nil, err
@@ -64,6 +81,21 @@ func NewComputeServiceForURL(client *http.Client, baseURL string) (*ComputeServi
 	return computeService, err
 }
 
+// A pass through wrapper for compute.Service.AcceleratorTypes.Get(...)
+func (c *ComputeService) AcceleratorTypesGet(project string, zone string, acceleratorType string) (*compute.AcceleratorType, error) {
+	return c.service.AcceleratorTypes.Get(project, zone, acceleratorType).Do()
+}
+
+// A pass through wrapper for compute.Service.Disks.Get(...)
+func (c *ComputeService) DisksGet(project string, zone string, disk string) (*compute.Disk, error) {
+	return c.service.Disks.Get(project, zone, disk).Do()
+}
+
+// A pass through wrapper for compute.Service.Disks.Insert(...)
+func (c *ComputeService) DisksInsert(project string, zone string, disk *compute.Disk) (*compute.Operation, error) {
+	return c.service.Disks.Insert(project, zone, disk).Do()
+}
+
 // A pass through wrapper for compute.Service.Images.Get(...)
 func (c *ComputeService) ImagesGet(project string, image string) (*compute.Image, error) {
 	return c.service.Images.Get(project, image).Do()
@@ -89,11 +121,147 @@ func (c *ComputeService) InstancesInsert(project string, zone string, instance *
 	return c.service.Instances.Insert(project, zone, instance).Do()
 }
 
+// A pass through wrapper for the beta compute.Service.Instances.Insert(...).
+// The operation is returned as a v1 operation, to be waited for like any
+// other.
+func (c *ComputeService) BetaInstancesInsert(project string, zone string, instance *computebeta.Instance) (*compute.Operation, error) {
+	op, err := c.betaService.Instances.Insert(project, zone, instance).Do()
+	if err != nil {
+		return nil, err
+	}
+	return operationFromBeta(op)
+}
+
+// A pass through wrapper for compute.Service.Instances.Start(...)
+func (c *ComputeService) InstancesStart(project string, zone string, instance string) (*compute.Operation, error) {
+	return c.service.Instances.Start(project, zone, instance).Do()
+}
+
+// A pass through wrapper for compute.Service.Instances.SetMetadata(...)
+func (c *ComputeService) InstancesSetMetadata(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error) {
+	return c.service.Instances.SetMetadata(project, zone, instance, metadata).Do()
+}
+
+// A pass through wrapper for compute.Service.Instances.SetLabels(...)
+func (c *ComputeService) InstancesSetLabels(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	return c.service.Instances.SetLabels(project, zone, instance, request).Do()
+}
+
+// A pass through wrapper for compute.Service.Instances.SetTags(...)
+func (c *ComputeService) InstancesSetTags(project string, zone string, instance string, tags *compute.Tags) (*compute.Operation, error) {
+	return c.service.Instances.SetTags(project, zone, instance, tags).Do()
+}
+
+// Returns the output of the first serial port of an instance, up to the last
+// megabyte the instance logged.
+func (c *ComputeService) InstancesGetSerialPortOutput(project string, zone string, instance string) (*compute.SerialPortOutput, error) {
+	return c.service.Instances.GetSerialPortOutput(project, zone, instance).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceTemplates.Get(...)
+func (c *ComputeService) InstanceTemplatesGet(project string, instanceTemplate string) (*compute.InstanceTemplate, error) {
+	return c.service.InstanceTemplates.Get(project, instanceTemplate).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceTemplates.Insert(...)
+func (c *ComputeService) InstanceTemplatesInsert(project string, instanceTemplate *compute.InstanceTemplate) (*compute.Operation, error) {
+	return c.service.InstanceTemplates.Insert(project, instanceTemplate).Do()
+}
+
+// A pass through wrapper for the beta
+// compute.Service.InstanceTemplates.Insert(...). The operation is returned as
+// a v1 operation, to be waited for like any other.
+func (c *ComputeService) BetaInstanceTemplatesInsert(project string, instanceTemplate *computebeta.InstanceTemplate) (*compute.Operation, error) {
+	op, err := c.betaService.InstanceTemplates.Insert(project, instanceTemplate).Do()
+	if err != nil {
+		return nil, err
+	}
+	return operationFromBeta(op)
+}
+
+// Converts an operation of the beta API, which has the same fields as one
+// of the v1 API.
+func operationFromBeta(op *computebeta.Operation) (*compute.Operation, error) {
+	b, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	var result compute.Operation
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// A pass through wrapper for compute.Service.InstanceTemplates.Delete(...)
+func (c *ComputeService) InstanceTemplatesDelete(project string, instanceTemplate string) (*compute.Operation, error) {
+	return c.service.InstanceTemplates.Delete(project, instanceTemplate).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.Get(...)
+func (c *ComputeService) InstanceGroupManagersGet(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManager, error) {
+	return c.service.InstanceGroupManagers.Get(project, zone, instanceGroupManager).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.Insert(...)
+func (c *ComputeService) InstanceGroupManagersInsert(project string, zone string, instanceGroupManager *compute.InstanceGroupManager) (*compute.Operation, error) {
+	return c.service.InstanceGroupManagers.Insert(project, zone, instanceGroupManager).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.Resize(...)
+func (c *ComputeService) InstanceGroupManagersResize(project string, zone string, instanceGroupManager string, size int64) (*compute.Operation, error) {
+	return c.service.InstanceGroupManagers.Resize(project, zone, instanceGroupManager, size).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.SetInstanceTemplate(...)
+func (c *ComputeService) InstanceGroupManagersSetInstanceTemplate(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersSetInstanceTemplateRequest) (*compute.Operation, error) {
+	return c.service.InstanceGroupManagers.SetInstanceTemplate(project, zone, instanceGroupManager, request).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.ListManagedInstances(...)
+func (c *ComputeService) InstanceGroupManagersListManagedInstances(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManagersListManagedInstancesResponse, error) {
+	return c.service.InstanceGroupManagers.ListManagedInstances(project, zone, instanceGroupManager).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.DeleteInstances(...)
+func (c *ComputeService) InstanceGroupManagersDeleteInstances(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersDeleteInstancesRequest) (*compute.Operation, error) {
+	return c.service.InstanceGroupManagers.DeleteInstances(project, zone, instanceGroupManager, request).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroupManagers.Delete(...)
+func (c *ComputeService) InstanceGroupManagersDelete(project string, zone string, instanceGroupManager string) (*compute.Operation, error) {
+	return c.service.InstanceGroupManagers.Delete(project, zone, instanceGroupManager).Do()
+}
+
+// A pass through wrapper for compute.Service.MachineTypes.List(...). The items
+// of all pages are returned in a single list.
+func (c *ComputeService) MachineTypesList(project string, zone string) (*compute.MachineTypeList, error) {
+	list := &compute.MachineTypeList{}
+	err := c.service.MachineTypes.List(project, zone).Pages(context.Background(), func(page *compute.MachineTypeList) error {
+		list.Items = append(list.Items, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// A pass through wrapper for compute.Service.Regions.Get(...)
+func (c *ComputeService) RegionsGet(project string, region string) (*compute.Region, error) {
+	return c.service.Regions.Get(project, region).Do()
+}
+
 // A pass through wrapper for compute.Service.ZoneOperations.Get(...)
 func (c *ComputeService) ZoneOperationsGet(project string, zone string, operation string) (*compute.Operation, error) {
 	return c.service.ZoneOperations.Get(project, zone, operation).Do()
 }
 
+// A pass through wrapper for compute.Service.RegionOperations.Get(...)
+func (c *ComputeService) RegionOperationsGet(project string, region string, operation string) (*compute.Operation, error) {
+	return c.service.RegionOperations.Get(project, region, operation).Do()
+}
+
 // A pass through wrapper for compute.Service.GlobalOperations.Get(...)
 func (c *ComputeService) GlobalOperationsGet(project string, operation string) (*compute.Operation, error) {
 	return c.service.GlobalOperations.Get(project, operation).Do()
@@ -114,6 +282,166 @@ func (c *ComputeService) FirewallsDelete(project string, name string) (*compute.
 	return c.service.Firewalls.Delete(project, name).Do()
 }
 
+// A pass through wrapper for compute.Service.Networks.Get(...)
+func (c *ComputeService) NetworksGet(project string, network string) (*compute.Network, error) {
+	return c.service.Networks.Get(project, network).Do()
+}
+
+// A pass through wrapper for compute.Service.Networks.Insert(...)
+func (c *ComputeService) NetworksInsert(project string, network *compute.Network) (*compute.Operation, error) {
+	return c.service.Networks.Insert(project, network).Do()
+}
+
+// A pass through wrapper for compute.Service.Networks.Delete(...)
+func (c *ComputeService) NetworksDelete(project string, network string) (*compute.Operation, error) {
+	return c.service.Networks.Delete(project, network).Do()
+}
+
+// A pass through wrapper for compute.Service.Subnetworks.Get(...)
+func (c *ComputeService) SubnetworksGet(project string, region string, subnetwork string) (*compute.Subnetwork, error) {
+	return c.service.Subnetworks.Get(project, region, subnetwork).Do()
+}
+
+// A pass through wrapper for compute.Service.Subnetworks.Insert(...)
+func (c *ComputeService) SubnetworksInsert(project string, region string, subnetwork *compute.Subnetwork) (*compute.Operation, error) {
+	return c.service.Subnetworks.Insert(project, region, subnetwork).Do()
+}
+
+// A pass through wrapper for compute.Service.Subnetworks.Delete(...)
+func (c *ComputeService) SubnetworksDelete(project string, region string, subnetwork string) (*compute.Operation, error) {
+	return c.service.Subnetworks.Delete(project, region, subnetwork).Do()
+}
+
+// A pass through wrapper for compute.Service.Routers.Get(...)
+func (c *ComputeService) RoutersGet(project string, region string, router string) (*compute.Router, error) {
+	return c.service.Routers.Get(project, region, router).Do()
+}
+
+// A pass through wrapper for compute.Service.Routers.Insert(...)
+func (c *ComputeService) RoutersInsert(project string, region string, router *compute.Router) (*compute.Operation, error) {
+	return c.service.Routers.Insert(project, region, router).Do()
+}
+
+// A pass through wrapper for compute.Service.Routers.Delete(...)
+func (c *ComputeService) RoutersDelete(project string, region string, router string) (*compute.Operation, error) {
+	return c.service.Routers.Delete(project, region, router).Do()
+}
+
+// A pass through wrapper for compute.Service.GlobalAddresses.Get(...)
+func (c *ComputeService) GlobalAddressesGet(project string, address string) (*compute.Address, error) {
+	return c.service.GlobalAddresses.Get(project, address).Do()
+}
+
+// A pass through wrapper for compute.Service.GlobalAddresses.Insert(...)
+func (c *ComputeService) GlobalAddressesInsert(project string, address *compute.Address) (*compute.Operation, error) {
+	return c.service.GlobalAddresses.Insert(project, address).Do()
+}
+
+// A pass through wrapper for compute.Service.GlobalAddresses.Delete(...)
+func (c *ComputeService) GlobalAddressesDelete(project string, address string) (*compute.Operation, error) {
+	return c.service.GlobalAddresses.Delete(project, address).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroups.Get(...)
+func (c *ComputeService) InstanceGroupsGet(project string, zone string, instanceGroup string) (*compute.InstanceGroup, error) {
+	return c.service.InstanceGroups.Get(project, zone, instanceGroup).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroups.Insert(...)
+func (c *ComputeService) InstanceGroupsInsert(project string, zone string, instanceGroup *compute.InstanceGroup) (*compute.Operation, error) {
+	return c.service.InstanceGroups.Insert(project, zone, instanceGroup).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroups.AddInstances(...)
+func (c *ComputeService) InstanceGroupsAddInstances(project string, zone string, instanceGroup string, request *compute.InstanceGroupsAddInstancesRequest) (*compute.Operation, error) {
+	return c.service.InstanceGroups.AddInstances(project, zone, instanceGroup, request).Do()
+}
+
+// A pass through wrapper for compute.Service.InstanceGroups.ListInstances(...).
+// The items of all pages are returned in a single list.
+func (c *ComputeService) InstanceGroupsListInstances(project string, zone string, instanceGroup string) (*compute.InstanceGroupsListInstances, error) {
+	list := &compute.InstanceGroupsListInstances{}
+	call := c.service.InstanceGroups.ListInstances(project, zone, instanceGroup, &compute.InstanceGroupsListInstancesRequest{})
+	err := call.Pages(context.Background(), func(page *compute.InstanceGroupsListInstances) error {
+		list.Items = append(list.Items, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// A pass through wrapper for compute.Service.InstanceGroups.Delete(...)
+func (c *ComputeService) InstanceGroupsDelete(project string, zone string, instanceGroup string) (*compute.Operation, error) {
+	return c.service.InstanceGroups.Delete(project, zone, instanceGroup).Do()
+}
+
+// A pass through wrapper for compute.Service.HealthChecks.Get(...)
+func (c *ComputeService) HealthChecksGet(project string, healthCheck string) (*compute.HealthCheck, error) {
+	return c.service.HealthChecks.Get(project, healthCheck).Do()
+}
+
+// A pass through wrapper for compute.Service.HealthChecks.Insert(...)
+func (c *ComputeService) HealthChecksInsert(project string, healthCheck *compute.HealthCheck) (*compute.Operation, error) {
+	return c.service.HealthChecks.Insert(project, healthCheck).Do()
+}
+
+// A pass through wrapper for compute.Service.HealthChecks.Delete(...)
+func (c *ComputeService) HealthChecksDelete(project string, healthCheck string) (*compute.Operation, error) {
+	return c.service.HealthChecks.Delete(project, healthCheck).Do()
+}
+
+// A pass through wrapper for compute.Service.BackendServices.Get(...)
+func (c *ComputeService) BackendServicesGet(project string, backendService string) (*compute.BackendService, error) {
+	return c.service.BackendServices.Get(project, backendService).Do()
+}
+
+// A pass through wrapper for compute.Service.BackendServices.Insert(...)
+func (c *ComputeService) BackendServicesInsert(project string, backendService *compute.BackendService) (*compute.Operation, error) {
+	return c.service.BackendServices.Insert(project, backendService).Do()
+}
+
+// A pass through wrapper for compute.Service.BackendServices.Update(...)
+func (c *ComputeService) BackendServicesUpdate(project string, name string, backendService *compute.BackendService) (*compute.Operation, error) {
+	return c.service.BackendServices.Update(project, name, backendService).Do()
+}
+
+// A pass through wrapper for compute.Service.BackendServices.Delete(...)
+func (c *ComputeService) BackendServicesDelete(project string, backendService string) (*compute.Operation, error) {
+	return c.service.BackendServices.Delete(project, backendService).Do()
+}
+
+// A pass through wrapper for compute.Service.TargetTcpProxies.Get(...)
+func (c *ComputeService) TargetTcpProxiesGet(project string, targetTcpProxy string) (*compute.TargetTcpProxy, error) {
+	return c.service.TargetTcpProxies.Get(project, targetTcpProxy).Do()
+}
+
+// A pass through wrapper for compute.Service.TargetTcpProxies.Insert(...)
+func (c *ComputeService) TargetTcpProxiesInsert(project string, targetTcpProxy *compute.TargetTcpProxy) (*compute.Operation, error) {
+	return c.service.TargetTcpProxies.Insert(project, targetTcpProxy).Do()
+}
+
+// A pass through wrapper for compute.Service.TargetTcpProxies.Delete(...)
+func (c *ComputeService) TargetTcpProxiesDelete(project string, targetTcpProxy string) (*compute.Operation, error) {
+	return c.service.TargetTcpProxies.Delete(project, targetTcpProxy).Do()
+}
+
+// A pass through wrapper for compute.Service.GlobalForwardingRules.Get(...)
+func (c *ComputeService) GlobalForwardingRulesGet(project string, forwardingRule string) (*compute.ForwardingRule, error) {
+	return c.service.GlobalForwardingRules.Get(project, forwardingRule).Do()
+}
+
+// A pass through wrapper for compute.Service.GlobalForwardingRules.Insert(...)
+func (c *ComputeService) GlobalForwardingRulesInsert(project string, forwardingRule *compute.ForwardingRule) (*compute.Operation, error) {
+	return c.service.GlobalForwardingRules.Insert(project, forwardingRule).Do()
+}
+
+// A pass through wrapper for compute.Service.GlobalForwardingRules.Delete(...)
+func (c *ComputeService) GlobalForwardingRulesDelete(project string, forwardingRule string) (*compute.Operation, error) {
+	return c.service.GlobalForwardingRules.Delete(project, forwardingRule).Do()
+}
+
 func (c *ComputeService) WaitForOperation(project string, op *compute.Operation) error {
 	glog.Infof("Wait for %v %q...", op.OperationType, op.Name)
 	defer glog.Infof("Finish wait for %v %q...", op.OperationType, op.Name)
@@ -137,10 +465,13 @@ func (c *ComputeService) WaitForOperation(project string, op *compute.Operation)
 	}
 }
 
-// getOp returns an updated operation.
+// getOp returns an updated operation. Zonal and regional operations have to
+// be fetched from the location they run in, everything else is global.
 func (c *ComputeService) getOp(project string, op *compute.Operation) (*compute.Operation, error) {
 	if op.Zone != "" {
 		return c.ZoneOperationsGet(project, path.Base(op.Zone), op.Name)
+	} else if op.Region != "" {
+		return c.RegionOperationsGet(project, path.Base(op.Region), op.Name)
 	} else {
 		return c.GlobalOperationsGet(project, op.Name)
 	}
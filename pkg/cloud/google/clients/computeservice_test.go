@@ -17,10 +17,13 @@ limitations under the License.
 package clients_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients"
 )
@@ -132,6 +135,306 @@ func TestInstancesInsert(t *testing.T) {
 	}
 }
 
+func TestBetaInstancesInsert(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := computebeta.Operation{
+		Name: "operationName",
+		Zone: "zoneName",
+	}
+	var receivedInstance computebeta.Instance
+	mux.HandleFunc("/compute/beta/projects/projectName/zones/zoneName/instances", func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&receivedInstance); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		handleTestRequest(w, nil, &responseOperation)
+	})
+	op, err := client.BetaInstancesInsert("projectName", "zoneName", &computebeta.Instance{
+		Name:             "instanceName",
+		ShieldedVmConfig: &computebeta.ShieldedVmConfig{EnableSecureBoot: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Name != "operationName" || op.Zone != "zoneName" {
+		t.Errorf("invalid operation: got '%+v'", op)
+	}
+	if receivedInstance.ShieldedVmConfig == nil || !receivedInstance.ShieldedVmConfig.EnableSecureBoot {
+		t.Errorf("expected a Shielded VM with Secure Boot, got '%+v'", receivedInstance.ShieldedVmConfig)
+	}
+}
+
+func TestInstancesGetSerialPortOutput(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOutput := compute.SerialPortOutput{
+		Contents: "serial port output",
+	}
+	mux.Handle("/compute/v1/projects/projectName/zones/zoneName/instances/instanceName/serialPort", handler(nil, &responseOutput))
+	output, err := client.InstancesGetSerialPortOutput("projectName", "zoneName", "instanceName")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if output.Contents != "serial port output" {
+		t.Errorf("expected 'serial port output' got '%v'", output.Contents)
+	}
+}
+
+func TestNetworksGet(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseNetwork := compute.Network{
+		Name:                  "networkName",
+		AutoCreateSubnetworks: true,
+	}
+	mux.Handle("/compute/v1/projects/projectName/global/networks/networkName", handler(nil, &responseNetwork))
+	network, err := client.NetworksGet("projectName", "networkName")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if network == nil {
+		t.Fatal("expected a valid network")
+	}
+	if "networkName" != network.Name {
+		t.Errorf("expected networkName got %v", network.Name)
+	}
+	if !network.AutoCreateSubnetworks {
+		t.Error("expected an auto subnet mode network")
+	}
+}
+
+func TestNetworksInsert(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := compute.Operation{
+		Id: 3002,
+	}
+	mux.Handle("/compute/v1/projects/projectName/global/networks", handler(nil, &responseOperation))
+	op, err := client.NetworksInsert("projectName", &compute.Network{Name: "networkName"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if op == nil {
+		t.Fatal("expected a valid operation")
+	}
+	if op.Id != uint64(3002) {
+		t.Errorf("expected %v got %v", 3002, op.Id)
+	}
+}
+
+func TestSubnetworksGet(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseSubnetwork := compute.Subnetwork{
+		Name:        "subnetworkName",
+		IpCidrRange: "10.0.0.0/20",
+	}
+	mux.Handle("/compute/v1/projects/projectName/regions/regionName/subnetworks/subnetworkName", handler(nil, &responseSubnetwork))
+	subnetwork, err := client.SubnetworksGet("projectName", "regionName", "subnetworkName")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if subnetwork == nil {
+		t.Fatal("expected a valid subnetwork")
+	}
+	if "subnetworkName" != subnetwork.Name {
+		t.Errorf("expected subnetworkName got %v", subnetwork.Name)
+	}
+	if "10.0.0.0/20" != subnetwork.IpCidrRange {
+		t.Errorf("expected 10.0.0.0/20 got %v", subnetwork.IpCidrRange)
+	}
+}
+
+func TestSubnetworksInsert(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := compute.Operation{
+		Id:     3003,
+		Region: "regionName",
+	}
+	mux.Handle("/compute/v1/projects/projectName/regions/regionName/subnetworks", handler(nil, &responseOperation))
+	op, err := client.SubnetworksInsert("projectName", "regionName", &compute.Subnetwork{Name: "subnetworkName"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if op == nil {
+		t.Fatal("expected a valid operation")
+	}
+	if op.Id != uint64(3003) {
+		t.Errorf("expected %v got %v", 3003, op.Id)
+	}
+}
+
+func TestRoutersInsert(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := compute.Operation{
+		Id:     4004,
+		Region: "regionName",
+	}
+	mux.Handle("/compute/v1/projects/projectName/regions/regionName/routers", handler(nil, &responseOperation))
+	op, err := client.RoutersInsert("projectName", "regionName", &compute.Router{Name: "routerName"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if op == nil {
+		t.Fatal("expected a valid operation")
+	}
+	if op.Id != uint64(4004) {
+		t.Errorf("expected %v got %v", 4004, op.Id)
+	}
+}
+
+func TestInstanceGroupsAddInstances(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := compute.Operation{
+		Id:   5005,
+		Zone: "zoneName",
+	}
+	mux.Handle("/compute/v1/projects/projectName/zones/zoneName/instanceGroups/groupName/addInstances", handler(nil, &responseOperation))
+	op, err := client.InstanceGroupsAddInstances("projectName", "zoneName", "groupName", &compute.InstanceGroupsAddInstancesRequest{
+		Instances: []*compute.InstanceReference{{Instance: "zones/zoneName/instances/instanceName"}},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if op == nil {
+		t.Fatal("expected a valid operation")
+	}
+	if op.Id != uint64(5005) {
+		t.Errorf("expected %v got %v", 5005, op.Id)
+	}
+}
+
+func TestInstanceGroupsListInstances(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	mux.Handle("/compute/v1/projects/projectName/zones/zoneName/instanceGroups/groupName/listInstances", paginatedHandler(nil, map[string]interface{}{
+		"": &compute.InstanceGroupsListInstances{
+			Items:         []*compute.InstanceWithNamedPorts{{Instance: "zones/zoneName/instances/first"}},
+			NextPageToken: "next",
+		},
+		"next": &compute.InstanceGroupsListInstances{
+			Items: []*compute.InstanceWithNamedPorts{{Instance: "zones/zoneName/instances/second"}},
+		},
+	}))
+	list, err := client.InstanceGroupsListInstances("projectName", "zoneName", "groupName")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(list.Items) != 2 || list.Items[1].Instance != "zones/zoneName/instances/second" {
+		t.Errorf("expected the instances of both pages, got %+v", list.Items)
+	}
+}
+
+func TestRegionsGet(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseRegion := compute.Region{
+		Name:  "regionName",
+		Zones: []string{"https://www.googleapis.com/compute/v1/projects/projectName/zones/zoneName"},
+	}
+	mux.Handle("/compute/v1/projects/projectName/regions/regionName", handler(nil, &responseRegion))
+	region, err := client.RegionsGet("projectName", "regionName")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if region.Name != "regionName" || len(region.Zones) != 1 {
+		t.Errorf("invalid region: got '%+v'", region)
+	}
+}
+
+func TestRegionOperationsGet(t *testing.T) {
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := compute.Operation{
+		Name:   "operationName",
+		Region: "regionName",
+		Status: "DONE",
+	}
+	mux.Handle("/compute/v1/projects/projectName/regions/regionName/operations/operationName", handler(nil, &responseOperation))
+	op, err := client.RegionOperationsGet("projectName", "regionName", "operationName")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if op == nil {
+		t.Fatal("expected a valid operation")
+	}
+	if "operationName" != op.Name {
+		t.Errorf("expected operationName got %v", op.Name)
+	}
+	if "DONE" != op.Status {
+		t.Errorf("expected DONE got %v", op.Status)
+	}
+}
+
+func TestWaitForOperationPolling(t *testing.T) {
+	defer clients.SetWaitSleep(time.Millisecond)()
+	testCases := []struct {
+		name string
+		op   compute.Operation
+		path string
+	}{
+		{
+			"zonal operation",
+			compute.Operation{Name: "operationName", Zone: "https://www.googleapis.com/compute/v1/projects/projectName/zones/zoneName"},
+			"/compute/v1/projects/projectName/zones/zoneName/operations/operationName",
+		},
+		{
+			"regional operation",
+			compute.Operation{Name: "operationName", Region: "https://www.googleapis.com/compute/v1/projects/projectName/regions/regionName"},
+			"/compute/v1/projects/projectName/regions/regionName/operations/operationName",
+		},
+		{
+			"global operation",
+			compute.Operation{Name: "operationName"},
+			"/compute/v1/projects/projectName/global/operations/operationName",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux, server, client := createMuxServerAndComputeClient(t)
+			defer server.Close()
+			done := tc.op
+			done.Status = "DONE"
+			polls := 0
+			mux.HandleFunc(tc.path, func(w http.ResponseWriter, req *http.Request) {
+				polls++
+				handler(nil, &done)(w, req)
+			})
+			pending := tc.op
+			pending.Status = "PENDING"
+			err := client.WaitForOperation("projectName", &pending)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if polls != 1 {
+				t.Errorf("expected the operation to be polled once at %v, got %v polls", tc.path, polls)
+			}
+		})
+	}
+}
+
+func TestWaitForRegionOperationError(t *testing.T) {
+	defer clients.SetWaitSleep(time.Millisecond)()
+	mux, server, client := createMuxServerAndComputeClient(t)
+	defer server.Close()
+	responseOperation := compute.Operation{
+		Name:   "operationName",
+		Region: "regionName",
+		Status: "DONE",
+		Error: &compute.OperationError{
+			Errors: []*compute.OperationErrorErrors{{Message: "testerrorthrown"}},
+		},
+	}
+	mux.Handle("/compute/v1/projects/projectName/regions/regionName/operations/operationName", handler(nil, &responseOperation))
+	err := client.WaitForOperation("projectName", &compute.Operation{Name: "operationName", Region: "regionName", Status: "RUNNING"})
+	if err == nil || err.Error() != "testerrorthrown\n" {
+		t.Errorf("expected error to occur: %v", "testerrorthrown")
+	}
+}
+
 func TestWaitForOperationSuccess(t *testing.T) {
 	_, server, client := createMuxServerAndComputeClient(t)
 	defer server.Close()
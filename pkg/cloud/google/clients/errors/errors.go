@@ -13,3 +13,13 @@ func IsNotFound(err error) bool {
 	ae, ok := err.(*googleapi.Error)
 	return ok && ae.Code == http.StatusNotFound
 }
+
+// IsConflict reports whether err is the result of the server replying with http.StatusConflict, e.g. because the
+// resource exists already or was modified concurrently.
+func IsConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	ae, ok := err.(*googleapi.Error)
+	return ok && ae.Code == http.StatusConflict
+}
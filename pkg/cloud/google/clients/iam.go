@@ -0,0 +1,119 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clients
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iam/v1"
+	"net/http"
+	"net/url"
+)
+
+// IAMService is a pass through wrapper for google.golang.org/api/iam/v1/
+// The purpose of the IAMService's wrap of the iam.Service client is to enable tests to mock this struct and control
+// behavior.
+type IAMService struct {
+	service *iam.Service
+}
+
+func NewIAMService() (*IAMService, error) {
+	client, err := google.DefaultClient(context.TODO(), iam.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	return NewIAMServiceForClient(client)
+}
+
+func NewIAMServiceForClient(client *http.Client) (*IAMService, error) {
+	service, err := iam.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &IAMService{
+		service: service,
+	}, nil
+}
+
+func NewIAMServiceForURL(client *http.Client, baseURL string) (*IAMService, error) {
+	iamService, err := NewIAMServiceForClient(client)
+	if err != nil {
+		return nil, err
+	}
+	url, err := url.Parse(iamService.service.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	iamService.service.BasePath = baseURL + url.Path
+	return iamService, err
+}
+
+// A pass through wrapper for iam.Projects.ServiceAccounts.Create(...)
+func (is *IAMService) ServiceAccountsCreate(project string, request *iam.CreateServiceAccountRequest) (*iam.ServiceAccount, error) {
+	return is.service.Projects.ServiceAccounts.Create(NormalizeProjectNameOrId(project), request).Do()
+}
+
+// Calls iam.Projects.ServiceAccounts.List(...). Paginated results are combined into a single slice.
+func (is *IAMService) ServiceAccountsList(project string) ([]*iam.ServiceAccount, error) {
+	var accounts []*iam.ServiceAccount
+	request := is.service.Projects.ServiceAccounts.List(NormalizeProjectNameOrId(project))
+	for {
+		response, err := request.Do()
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, response.Accounts...)
+		if response.NextPageToken == "" {
+			break
+		}
+		request.PageToken(response.NextPageToken)
+	}
+	return accounts, nil
+}
+
+// A pass through wrapper for iam.Projects.ServiceAccounts.Delete(...)
+func (is *IAMService) ServiceAccountsDelete(project string, email string) error {
+	_, err := is.service.Projects.ServiceAccounts.Delete(serviceAccountName(project, email)).Do()
+	return err
+}
+
+// A pass through wrapper for iam.Projects.ServiceAccounts.Keys.Create(...)
+func (is *IAMService) ServiceAccountKeysCreate(project string, email string, request *iam.CreateServiceAccountKeyRequest) (*iam.ServiceAccountKey, error) {
+	return is.service.Projects.ServiceAccounts.Keys.Create(serviceAccountName(project, email), request).Do()
+}
+
+// Calls iam.Projects.ServiceAccounts.Keys.List(...) for the keys created for the service account, leaving out the
+// keys Google manages.
+func (is *IAMService) ServiceAccountKeysList(project string, email string) ([]*iam.ServiceAccountKey, error) {
+	response, err := is.service.Projects.ServiceAccounts.Keys.List(serviceAccountName(project, email)).KeyTypes("USER_MANAGED").Do()
+	if err != nil {
+		return nil, err
+	}
+	return response.Keys, nil
+}
+
+// A pass through wrapper for iam.Projects.ServiceAccounts.Keys.Delete(...). The name of the key includes the
+// service account's.
+func (is *IAMService) ServiceAccountKeysDelete(name string) error {
+	_, err := is.service.Projects.ServiceAccounts.Keys.Delete(name).Do()
+	return err
+}
+
+func serviceAccountName(project string, email string) string {
+	return fmt.Sprintf("%s/serviceAccounts/%s", NormalizeProjectNameOrId(project), email)
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clients_test
+
+import (
+	"encoding/json"
+	"google.golang.org/api/iam/v1"
+	"net/http"
+	"net/http/httptest"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients"
+	"testing"
+)
+
+func TestServiceAccountsCreate(t *testing.T) {
+	mux, server, client := createMuxServerAndIAMClient(t)
+	defer server.Close()
+	var request iam.CreateServiceAccountRequest
+	responseAccount := iam.ServiceAccount{
+		Email: "k8s-worker-abcde@projectId.iam.gserviceaccount.com",
+	}
+	mux.HandleFunc("/v1/projects/projectId/serviceAccounts", func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		handleTestRequest(w, nil, &responseAccount)
+	})
+	account, err := client.ServiceAccountsCreate("projectId", &iam.CreateServiceAccountRequest{AccountId: "k8s-worker-abcde"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if request.AccountId != "k8s-worker-abcde" {
+		t.Errorf("account id mismatch: expected 'k8s-worker-abcde' got '%v'", request.AccountId)
+	}
+	if account.Email != responseAccount.Email {
+		t.Errorf("email mismatch: expected '%v' got '%v'", responseAccount.Email, account.Email)
+	}
+}
+
+func TestServiceAccountsDelete(t *testing.T) {
+	mux, server, client := createMuxServerAndIAMClient(t)
+	defer server.Close()
+	var method string
+	mux.HandleFunc("/v1/projects/projectId/serviceAccounts/k8s-worker-abcde@projectId.iam.gserviceaccount.com", func(w http.ResponseWriter, req *http.Request) {
+		method = req.Method
+		handleTestRequest(w, nil, &iam.Empty{})
+	})
+	if err := client.ServiceAccountsDelete("projectId", "k8s-worker-abcde@projectId.iam.gserviceaccount.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if method != http.MethodDelete {
+		t.Errorf("method mismatch: expected '%v' got '%v'", http.MethodDelete, method)
+	}
+}
+
+func TestServiceAccountKeysCreate(t *testing.T) {
+	mux, server, client := createMuxServerAndIAMClient(t)
+	defer server.Close()
+	responseKey := iam.ServiceAccountKey{
+		Name:           "projects/projectId/serviceAccounts/k8s-worker-abcde@projectId.iam.gserviceaccount.com/keys/keyId",
+		PrivateKeyData: "e30=",
+	}
+	mux.Handle("/v1/projects/projectId/serviceAccounts/k8s-worker-abcde@projectId.iam.gserviceaccount.com/keys", handler(nil, &responseKey))
+	key, err := client.ServiceAccountKeysCreate("projectId", "k8s-worker-abcde@projectId.iam.gserviceaccount.com", &iam.CreateServiceAccountKeyRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key.Name != responseKey.Name {
+		t.Errorf("key name mismatch: expected '%v' got '%v'", responseKey.Name, key.Name)
+	}
+	if key.PrivateKeyData != responseKey.PrivateKeyData {
+		t.Errorf("private key data mismatch: expected '%v' got '%v'", responseKey.PrivateKeyData, key.PrivateKeyData)
+	}
+}
+
+func TestServiceAccountsList(t *testing.T) {
+	account1 := iam.ServiceAccount{Email: "k8s-worker-abcde@projectId.iam.gserviceaccount.com"}
+	account2 := iam.ServiceAccount{Email: "k8s-master-abcde@projectId.iam.gserviceaccount.com"}
+	mux, server, client := createMuxServerAndIAMClient(t)
+	defer server.Close()
+	mux.Handle("/v1/projects/projectId/serviceAccounts", paginatedHandler(nil, map[string]interface{}{
+		"":           iam.ListServiceAccountsResponse{NextPageToken: "next-token", Accounts: []*iam.ServiceAccount{&account1}},
+		"next-token": iam.ListServiceAccountsResponse{Accounts: []*iam.ServiceAccount{&account2}},
+	}))
+	accounts, err := client.ServiceAccountsList("projectId")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(accounts) != 2 || accounts[0].Email != account1.Email || accounts[1].Email != account2.Email {
+		t.Errorf("accounts mismatch: expected '%v' got '%v'", []*iam.ServiceAccount{&account1, &account2}, accounts)
+	}
+}
+
+func TestServiceAccountKeysList(t *testing.T) {
+	mux, server, client := createMuxServerAndIAMClient(t)
+	defer server.Close()
+	var keyTypes []string
+	responseKey := iam.ServiceAccountKey{Name: "projects/projectId/serviceAccounts/k8s-worker-abcde@projectId.iam.gserviceaccount.com/keys/keyId"}
+	mux.HandleFunc("/v1/projects/projectId/serviceAccounts/k8s-worker-abcde@projectId.iam.gserviceaccount.com/keys", func(w http.ResponseWriter, req *http.Request) {
+		keyTypes = req.URL.Query()["keyTypes"]
+		handleTestRequest(w, nil, &iam.ListServiceAccountKeysResponse{Keys: []*iam.ServiceAccountKey{&responseKey}})
+	})
+	keys, err := client.ServiceAccountKeysList("projectId", "k8s-worker-abcde@projectId.iam.gserviceaccount.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Name != responseKey.Name {
+		t.Errorf("keys mismatch: expected '%v' got '%v'", []*iam.ServiceAccountKey{&responseKey}, keys)
+	}
+	if len(keyTypes) != 1 || keyTypes[0] != "USER_MANAGED" {
+		t.Errorf("key types mismatch: expected '[USER_MANAGED]' got '%v'", keyTypes)
+	}
+}
+
+func createMuxServerAndIAMClient(t *testing.T) (*http.ServeMux, *httptest.Server, *clients.IAMService) {
+	t.Helper()
+	mux, server := createMuxAndServer()
+	client, err := clients.NewIAMServiceForURL(server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("unable to create IAM service: %v", err)
+	}
+	return mux, server, client
+}
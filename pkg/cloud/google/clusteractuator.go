@@ -18,12 +18,14 @@ package google
 
 import (
 	"fmt"
+	"reflect"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
 
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
@@ -32,18 +34,28 @@ import (
 )
 
 const (
+	// Older versions recorded created firewall rules in annotations with
+	// this prefix. They are migrated into the cluster provider status.
 	firewallRuleAnnotationPrefix = "gce.clusterapi.k8s.io/firewall"
-	firewallRuleInternalSuffix   = "-allow-cluster-internal"
-	firewallRuleApiSuffix        = "-allow-api-public"
+
+	firewallRuleInternalSuffix = "-allow-cluster-internal"
+	firewallRuleApiSuffix      = "-allow-api-public"
+	firewallRuleSSHSuffix      = "-allow-ssh"
+
+	defaultSSHSourceRange = "0.0.0.0/0"
 )
 
 type GCEClusterClient struct {
-	computeService GCEClientComputeService
-	client         client.Client
+	computeService        GCEClientComputeService
+	serviceAccountService *ServiceAccountService
+	client                client.Client
 }
 
 type ClusterActuatorParams struct {
 	ComputeService GCEClientComputeService
+	// Deletes the leftover service accounts of deleted clusters when
+	// clusters are reconciled, if set.
+	ServiceAccountService *ServiceAccountService
 }
 
 func NewClusterActuator(m manager.Manager, params ClusterActuatorParams) (*GCEClusterClient, error) {
@@ -52,30 +64,76 @@ func NewClusterActuator(m manager.Manager, params ClusterActuatorParams) (*GCECl
 		return nil, err
 	}
 	return &GCEClusterClient{
-		computeService: computeService,
-		client:         m.GetClient(),
+		computeService:        computeService,
+		serviceAccountService: params.ServiceAccountService,
+		client:                m.GetClient(),
 	}, nil
 }
 
 func (gce *GCEClusterClient) Reconcile(cluster *clusterv1.Cluster) error {
 	glog.Infof("Reconciling cluster %v.", cluster.Name)
-	err := gce.createFirewallRuleIfNotExists(cluster, &compute.Firewall{
-		Name:    cluster.Name + firewallRuleInternalSuffix,
-		Network: "global/networks/default",
-		Allowed: []*compute.FirewallAllowed{
-			{
-				IPProtocol: "tcp",
-			},
-		},
-		TargetTags: []string{cluster.Name + "-worker"},
-		SourceTags: []string{cluster.Name + "-worker"},
-	})
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return fmt.Errorf("error parsing cluster provider config: %v", err)
+	}
+	status, err := clusterProviderStatus(cluster)
+	if err != nil {
+		return fmt.Errorf("error parsing cluster provider status: %v", err)
+	}
+	oldStatus := cluster.Status.DeepCopy()
+
+	// Record whatever got created, even if reconciliation failed halfway.
+	reconcileErr := gce.reconcileResources(cluster, clusterConfig, status)
+	if err := gce.updateClusterStatus(cluster, oldStatus, status); err != nil {
+		if reconcileErr != nil {
+			glog.Warningf("Error updating status of cluster %v: %v", cluster.Name, err)
+			return reconcileErr
+		}
+		return err
+	}
+	if gce.serviceAccountService != nil {
+		// The service accounts of other clusters are no business of this
+		// one, so failing to collect them doesn't fail its reconciliation.
+		if err := gce.deleteServiceAccountsOfDeletedClusters(clusterConfig.Project); err != nil {
+			glog.Warningf("Error deleting leftover service accounts in project %v: %v", clusterConfig.Project, err)
+		}
+	}
+	return reconcileErr
+}
+
+// Deletes the service accounts left behind in the project by clusters that
+// no longer exist. The clusters sharing a project must all be managed from
+// here, as the accounts of the others would look left behind.
+func (gce *GCEClusterClient) deleteServiceAccountsOfDeletedClusters(project string) error {
+	clusters := &clusterv1.ClusterList{}
+	if err := gce.client.List(context.Background(), &client.ListOptions{}, clusters); err != nil {
+		return fmt.Errorf("error listing clusters: %v", err)
+	}
+	return gce.serviceAccountService.DeleteServiceAccountsOfDeletedClusters(project, clusters.Items)
+}
+
+func (gce *GCEClusterClient) reconcileResources(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, status *gceconfigv1.GCEClusterProviderStatus) error {
+	if err := gce.reconcileNetwork(cluster, clusterConfig, status); err != nil {
+		return fmt.Errorf("error creating network for cluster: %v", err)
+	}
+	if err := gce.reconcileCloudNAT(cluster, clusterConfig, status); err != nil {
+		return fmt.Errorf("error creating Cloud NAT for cluster: %v", err)
+	}
+	err := gce.createFirewallRuleIfNotExists(cluster, clusterConfig, status, newInternalFirewallRule(cluster, clusterConfig))
 	if err != nil {
 		glog.Warningf("Error creating firewall rule for internal cluster traffic: %v", err)
 	}
-	err = gce.createFirewallRuleIfNotExists(cluster, &compute.Firewall{
+	if clusterConfig.Network.Dedicated {
+		// Unlike the default network, a dedicated network has no rule
+		// that lets SSH connections in.
+		err = gce.createFirewallRuleIfNotExists(cluster, clusterConfig, status, newSSHFirewallRule(cluster, clusterConfig))
+		if err != nil {
+			glog.Warningf("Error creating firewall rule for SSH traffic: %v", err)
+		}
+	}
+	err = gce.createFirewallRuleIfNotExists(cluster, clusterConfig, status, &compute.Firewall{
 		Name:    cluster.Name + firewallRuleApiSuffix,
-		Network: "global/networks/default",
+		Network: networkPath(cluster, clusterConfig),
 		Allowed: []*compute.FirewallAllowed{
 			{
 				IPProtocol: "tcp",
@@ -88,11 +146,102 @@ func (gce *GCEClusterClient) Reconcile(cluster *clusterv1.Cluster) error {
 	if err != nil {
 		glog.Warningf("Error creating firewall rule for core api server traffic: %v", err)
 	}
+	if err := gce.reconcileLoadBalancer(cluster, clusterConfig, status); err != nil {
+		return fmt.Errorf("error creating load balancer for cluster: %v", err)
+	}
+	return nil
+}
+
+// Returns the firewall rule for traffic between the cluster's instances. On a
+// dedicated network, which the cluster owns, it allows all protocols, and
+// traffic from the node subnetwork and the pod and service ranges too.
+func newInternalFirewallRule(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) *compute.Firewall {
+	rule := &compute.Firewall{
+		Name:    cluster.Name + firewallRuleInternalSuffix,
+		Network: networkPath(cluster, clusterConfig),
+		Allowed: []*compute.FirewallAllowed{
+			{
+				IPProtocol: "tcp",
+			},
+		},
+		TargetTags: []string{cluster.Name + "-worker"},
+		SourceTags: []string{cluster.Name + "-worker"},
+	}
+	if !clusterConfig.Network.Dedicated {
+		return rule
+	}
+	rule.Allowed = []*compute.FirewallAllowed{
+		{
+			IPProtocol: "all",
+		},
+	}
+	nodeCIDR := clusterConfig.Network.NodeCIDRRange
+	if nodeCIDR == "" {
+		nodeCIDR = defaultNodeCIDRRange
+	}
+	rule.SourceRanges = []string{nodeCIDR}
+	for _, cidr := range []string{getSubnet(cluster.Spec.ClusterNetwork.Pods), getSubnet(cluster.Spec.ClusterNetwork.Services)} {
+		if cidr != "" {
+			rule.SourceRanges = append(rule.SourceRanges, cidr)
+		}
+	}
+	return rule
+}
+
+// Returns the firewall rule for SSH connections to the instances of a
+// dedicated network.
+func newSSHFirewallRule(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) *compute.Firewall {
+	sourceRanges := clusterConfig.Network.SSHSourceRanges
+	if len(sourceRanges) == 0 {
+		sourceRanges = []string{defaultSSHSourceRange}
+	}
+	return &compute.Firewall{
+		Name:    cluster.Name + firewallRuleSSHSuffix,
+		Network: networkPath(cluster, clusterConfig),
+		Allowed: []*compute.FirewallAllowed{
+			{
+				IPProtocol: "tcp",
+				Ports:      []string{"22"},
+			},
+		},
+		TargetTags:   []string{cluster.Name + "-worker"},
+		SourceRanges: sourceRanges,
+	}
+}
+
+// Writes the provider status, and any other status change made during
+// reconciliation, into the cluster. Once the status is stored, the legacy
+// annotations it may have been migrated from are removed.
+func (gce *GCEClusterClient) updateClusterStatus(cluster *clusterv1.Cluster, oldStatus *clusterv1.ClusterStatus, status *gceconfigv1.GCEClusterProviderStatus) error {
+	if err := setClusterProviderStatus(cluster, status); err != nil {
+		return fmt.Errorf("error encoding cluster provider status: %v", err)
+	}
+	if !reflect.DeepEqual(oldStatus, &cluster.Status) {
+		if err := gce.client.Status().Update(context.Background(), cluster); err != nil {
+			return fmt.Errorf("error updating cluster status: %v", err)
+		}
+	}
+	if removeLegacyClusterAnnotations(cluster) {
+		if err := gce.client.Update(context.Background(), cluster); err != nil {
+			return fmt.Errorf("error removing legacy cluster annotations: %v", err)
+		}
+	}
 	return nil
 }
 
 func (gce *GCEClusterClient) Delete(cluster *clusterv1.Cluster) error {
-	err := gce.deleteFirewallRule(cluster, cluster.Name+firewallRuleInternalSuffix)
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return fmt.Errorf("error parsing cluster provider config: %v", err)
+	}
+	// A dedicated network can only go away together with the last instance
+	// in it, so hold off on tearing anything down until then.
+	if clusterConfig.Network.Dedicated {
+		if err := gce.checkNoMachinesRemain(cluster); err != nil {
+			return fmt.Errorf("error deleting network for cluster: %v", err)
+		}
+	}
+	err = gce.deleteFirewallRule(cluster, cluster.Name+firewallRuleInternalSuffix)
 	if err != nil {
 		return fmt.Errorf("error deleting firewall rule for internal cluster traffic: %v", err)
 	}
@@ -100,6 +249,21 @@ func (gce *GCEClusterClient) Delete(cluster *clusterv1.Cluster) error {
 	if err != nil {
 		return fmt.Errorf("error deleting firewall rule for core api server traffic: %v", err)
 	}
+	if clusterConfig.Network.Dedicated {
+		err = gce.deleteFirewallRule(cluster, cluster.Name+firewallRuleSSHSuffix)
+		if err != nil {
+			return fmt.Errorf("error deleting firewall rule for SSH traffic: %v", err)
+		}
+	}
+	if err := gce.deleteLoadBalancer(cluster, clusterConfig); err != nil {
+		return fmt.Errorf("error deleting load balancer for cluster: %v", err)
+	}
+	if err := gce.deleteCloudNAT(cluster, clusterConfig); err != nil {
+		return fmt.Errorf("error deleting Cloud NAT for cluster: %v", err)
+	}
+	if err := gce.deleteNetwork(cluster, clusterConfig); err != nil {
+		return fmt.Errorf("error deleting network for cluster: %v", err)
+	}
 
 	return nil
 }
@@ -119,22 +283,20 @@ func getOrNewComputeServiceForCluster(params ClusterActuatorParams) (GCEClientCo
 	return computeService, nil
 }
 
-func (gce *GCEClusterClient) createFirewallRuleIfNotExists(cluster *clusterv1.Cluster, firewallRule *compute.Firewall) error {
-	ruleExists, ok := cluster.ObjectMeta.Annotations[firewallRuleAnnotationPrefix+firewallRule.Name]
-	if ok && ruleExists == "true" {
+func (gce *GCEClusterClient) createFirewallRuleIfNotExists(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, status *gceconfigv1.GCEClusterProviderStatus, firewallRule *compute.Firewall) error {
+	if rule := findResource(status.FirewallRules, firewallRule.Name); rule != nil && rule.SelfLink != "" {
 		// The firewall rule was already created.
 		return nil
 	}
-	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
-	if err != nil {
-		return fmt.Errorf("error parsing cluster provider config: %v", err)
-	}
 	firewallRules, err := gce.computeService.FirewallsGet(clusterConfig.Project)
 	if err != nil {
 		return fmt.Errorf("error getting firewall rules: %v", err)
 	}
 
-	if !gce.containsFirewallRule(firewallRules, firewallRule.Name) {
+	var selfLink string
+	if rule := gce.findFirewallRule(firewallRules, firewallRule.Name); rule != nil {
+		selfLink = rule.SelfLink
+	} else {
 		op, err := gce.computeService.FirewallsInsert(clusterConfig.Project, firewallRule)
 		if err != nil {
 			return fmt.Errorf("error creating firewall rule: %v", err)
@@ -143,25 +305,22 @@ func (gce *GCEClusterClient) createFirewallRuleIfNotExists(cluster *clusterv1.Cl
 		if err != nil {
 			return fmt.Errorf("error waiting for firewall rule creation: %v", err)
 		}
+		selfLink = targetLink(op)
 	}
-	// TODO (mkjelland) move this to a GCEClusterProviderStatus #347
-	if cluster.ObjectMeta.Annotations == nil {
-		cluster.ObjectMeta.Annotations = make(map[string]string)
-	}
-	cluster.ObjectMeta.Annotations[firewallRuleAnnotationPrefix+firewallRule.Name] = "true"
-	if err := gce.client.Update(context.Background(), cluster); err != nil {
-		return fmt.Errorf("error updating cluster annotations %v", err)
-	}
+	status.FirewallRules = setResource(status.FirewallRules, gceconfigv1.ResourceStatus{
+		Name:     firewallRule.Name,
+		SelfLink: selfLink,
+	})
 	return nil
 }
 
-func (gce *GCEClusterClient) containsFirewallRule(firewallRules *compute.FirewallList, ruleName string) bool {
+func (gce *GCEClusterClient) findFirewallRule(firewallRules *compute.FirewallList, ruleName string) *compute.Firewall {
 	for _, rule := range firewallRules.Items {
 		if ruleName == rule.Name {
-			return true
+			return rule
 		}
 	}
-	return false
+	return nil
 }
 
 func (gce *GCEClusterClient) deleteFirewallRule(cluster *clusterv1.Cluster, ruleName string) error {
@@ -17,15 +17,32 @@ limitations under the License.
 package google_test
 
 import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/ghodss/yaml"
 	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	"sigs.k8s.io/cluster-api/pkg/controller/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
+func init() {
+	// The fake client only knows the types registered with the client-go scheme.
+	v1alpha1.AddToScheme(scheme.Scheme)
+}
+
 func aTestDelete(t *testing.T) {
 	testCases := []struct {
 		name                    string
@@ -59,6 +76,537 @@ func aTestDelete(t *testing.T) {
 	}
 }
 
+func TestReconcileDedicatedNetwork(t *testing.T) {
+	var insertedNetwork *compute.Network
+	var insertedSubnetwork *compute.Subnetwork
+	var subnetworkRegion string
+	notFound := &googleapi.Error{Code: 404, Message: "not found"}
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return nil, notFound
+		},
+		mockNetworksInsert: func(project string, network *compute.Network) (*compute.Operation, error) {
+			insertedNetwork = network
+			return &compute.Operation{TargetLink: "networks/" + network.Name}, nil
+		},
+		mockSubnetworksGet: func(project string, region string, subnetwork string) (*compute.Subnetwork, error) {
+			return nil, notFound
+		},
+		mockSubnetworksInsert: func(project string, region string, subnetwork *compute.Subnetwork) (*compute.Operation, error) {
+			subnetworkRegion = region
+			insertedSubnetwork = subnetwork
+			return &compute.Operation{TargetLink: "subnetworks/" + subnetwork.Name}, nil
+		},
+	}
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{
+		Dedicated: true,
+		Region:    "us-west5",
+	}
+	cluster := newClusterFixture(t, clusterConfig)
+	withFirewallRulesCreated(t, cluster)
+	actuator, fakeClient := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if insertedNetwork == nil {
+		t.Fatal("expected a network to be created")
+	}
+	if insertedNetwork.Name != cluster.Name {
+		t.Errorf("invalid network name: expected '%v' got '%v'", cluster.Name, insertedNetwork.Name)
+	}
+	if insertedNetwork.AutoCreateSubnetworks {
+		t.Error("expected a custom subnet mode network")
+	}
+	if insertedSubnetwork == nil {
+		t.Fatal("expected a subnetwork to be created")
+	}
+	if subnetworkRegion != "us-west5" {
+		t.Errorf("invalid subnetwork region: expected 'us-west5' got '%v'", subnetworkRegion)
+	}
+	if insertedSubnetwork.Network != "global/networks/"+cluster.Name {
+		t.Errorf("invalid subnetwork network: expected 'global/networks/%v' got '%v'", cluster.Name, insertedSubnetwork.Network)
+	}
+	if insertedSubnetwork.IpCidrRange != "10.0.0.0/20" {
+		t.Errorf("invalid subnetwork range: expected '10.0.0.0/20' got '%v'", insertedSubnetwork.IpCidrRange)
+	}
+	expectedRanges := map[string]string{
+		cluster.Name + "-pods":     "192.168.0.0/16",
+		cluster.Name + "-services": "10.96.0.0/12",
+	}
+	if len(insertedSubnetwork.SecondaryIpRanges) != len(expectedRanges) {
+		t.Fatalf("invalid secondary range count: expected '%v' got '%v'", len(expectedRanges), len(insertedSubnetwork.SecondaryIpRanges))
+	}
+	for _, r := range insertedSubnetwork.SecondaryIpRanges {
+		if expectedRanges[r.RangeName] != r.IpCidrRange {
+			t.Errorf("invalid secondary range %v: expected '%v' got '%v'", r.RangeName, expectedRanges[r.RangeName], r.IpCidrRange)
+		}
+	}
+
+	status := getClusterProviderStatus(t, fakeClient, cluster.Name)
+	expectedNetwork := gceconfigv1.ResourceStatus{Name: cluster.Name, SelfLink: "networks/" + cluster.Name}
+	if status.Network == nil || *status.Network != expectedNetwork {
+		t.Errorf("invalid network status: expected '%v' got '%v'", expectedNetwork, status.Network)
+	}
+	expectedSubnetwork := gceconfigv1.ResourceStatus{Name: cluster.Name, SelfLink: "subnetworks/" + cluster.Name}
+	if status.Subnetwork == nil || *status.Subnetwork != expectedSubnetwork {
+		t.Errorf("invalid subnetwork status: expected '%v' got '%v'", expectedSubnetwork, status.Subnetwork)
+	}
+}
+
+func TestDeleteDedicatedNetworkWaitsForMachinesOfCluster(t *testing.T) {
+	var deletedSubnetwork string
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockSubnetworksDelete: func(project string, region string, subnetwork string) (*compute.Operation, error) {
+			deletedSubnetwork = subnetwork
+			return &compute.Operation{}, nil
+		},
+	}
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{Dedicated: true, Region: "us-west5"}
+	cluster := newClusterFixture(t, clusterConfig)
+	cluster.Namespace = "default"
+	// Another cluster in the namespace has a machine of its own.
+	other := newStoredMachine(t, "other-0", newGCEMachineProviderConfigFixture())
+	other.Labels = map[string]string{"cluster.k8s.io/cluster-name": "other"}
+	owned := newStoredMachine(t, "node-0", newGCEMachineProviderConfigFixture())
+	owned.OwnerReferences = []v1.OwnerReference{{APIVersion: "cluster.k8s.io/v1alpha1", Kind: "Cluster", Name: cluster.Name}}
+	actuator, fakeClient := newClusterActuatorWithParams(t, google.ClusterActuatorParams{ComputeService: computeServiceMock}, cluster)
+	for _, machine := range []*v1alpha1.Machine{other, owned} {
+		if err := fakeClient.Create(context.Background(), machine); err != nil {
+			t.Fatalf("error storing machine: %v", err)
+		}
+	}
+
+	if err := actuator.Delete(cluster); err == nil || !strings.Contains(err.Error(), "waiting for 1 machine(s)") {
+		t.Fatalf("expected the deletion to wait for the machine of the cluster, got '%v'", err)
+	}
+	if err := fakeClient.Delete(context.Background(), owned); err != nil {
+		t.Fatalf("error deleting machine: %v", err)
+	}
+	if err := actuator.Delete(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if deletedSubnetwork != cluster.Name {
+		t.Errorf("expected subnetwork %v to be deleted, got '%v'", cluster.Name, deletedSubnetwork)
+	}
+}
+
+func TestReconcileDedicatedNetworkFirewallRules(t *testing.T) {
+	insertedRules := map[string]*compute.Firewall{}
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network}, nil
+		},
+		mockSubnetworksGet: func(project string, region string, subnetwork string) (*compute.Subnetwork, error) {
+			return &compute.Subnetwork{Name: subnetwork}, nil
+		},
+		mockFirewallsGet: func(project string) (*compute.FirewallList, error) {
+			return &compute.FirewallList{}, nil
+		},
+		mockFirewallsInsert: func(project string, firewall *compute.Firewall) (*compute.Operation, error) {
+			insertedRules[firewall.Name] = firewall
+			return &compute.Operation{TargetLink: "firewalls/" + firewall.Name}, nil
+		},
+	}
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{
+		Dedicated:       true,
+		Region:          "us-west5",
+		NodeCIDRRange:   "10.1.0.0/20",
+		SSHSourceRanges: []string{"203.0.113.0/24"},
+	}
+	cluster := newClusterFixture(t, clusterConfig)
+	actuator, _ := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	internal := insertedRules[cluster.Name+"-allow-cluster-internal"]
+	if internal == nil {
+		t.Fatal("expected a firewall rule for internal cluster traffic")
+	}
+	if len(internal.Allowed) != 1 || internal.Allowed[0].IPProtocol != "all" {
+		t.Errorf("expected all protocols to be allowed, got '%+v'", internal.Allowed[0])
+	}
+	expectedRanges := []string{"10.1.0.0/20", "192.168.0.0/16", "10.96.0.0/12"}
+	if !reflect.DeepEqual(internal.SourceRanges, expectedRanges) {
+		t.Errorf("invalid source ranges: expected '%v' got '%v'", expectedRanges, internal.SourceRanges)
+	}
+	if !reflect.DeepEqual(internal.SourceTags, []string{cluster.Name + "-worker"}) {
+		t.Errorf("invalid source tags: got '%v'", internal.SourceTags)
+	}
+	ssh := insertedRules[cluster.Name+"-allow-ssh"]
+	if ssh == nil {
+		t.Fatal("expected a firewall rule for SSH traffic")
+	}
+	if len(ssh.Allowed) != 1 || ssh.Allowed[0].IPProtocol != "tcp" || !reflect.DeepEqual(ssh.Allowed[0].Ports, []string{"22"}) {
+		t.Errorf("expected tcp:22 to be allowed, got '%+v'", ssh.Allowed[0])
+	}
+	if !reflect.DeepEqual(ssh.SourceRanges, []string{"203.0.113.0/24"}) {
+		t.Errorf("invalid SSH source ranges: got '%v'", ssh.SourceRanges)
+	}
+}
+
+func TestReconcileDefaultNetworkFirewallRules(t *testing.T) {
+	insertedRules := map[string]*compute.Firewall{}
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network}, nil
+		},
+		mockFirewallsGet: func(project string) (*compute.FirewallList, error) {
+			return &compute.FirewallList{}, nil
+		},
+		mockFirewallsInsert: func(project string, firewall *compute.Firewall) (*compute.Operation, error) {
+			insertedRules[firewall.Name] = firewall
+			return &compute.Operation{TargetLink: "firewalls/" + firewall.Name}, nil
+		},
+	}
+	cluster := newDefaultClusterFixture(t)
+	actuator, _ := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := insertedRules[cluster.Name+"-allow-ssh"]; ok {
+		t.Error("expected no SSH firewall rule on a network the cluster doesn't own")
+	}
+	internal := insertedRules[cluster.Name+"-allow-cluster-internal"]
+	if internal == nil || internal.Allowed[0].IPProtocol != "tcp" || len(internal.SourceRanges) != 0 {
+		t.Errorf("expected internal TCP traffic to be allowed between the cluster's instances, got '%+v'", internal)
+	}
+}
+
+func TestReconcileDedicatedNetworkWithoutRegion(t *testing.T) {
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{Dedicated: true}
+	cluster := newClusterFixture(t, clusterConfig)
+	actuator, _ := newClusterActuatorWithClient(t, &GCEClientComputeServiceMock{}, cluster)
+	if err := actuator.Reconcile(cluster); err == nil {
+		t.Error("expected an error for a dedicated network without a region")
+	}
+}
+
+func TestReconcileCloudNAT(t *testing.T) {
+	var insertedRouter *compute.Router
+	var routerRegion string
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network}, nil
+		},
+		mockRoutersGet: func(project string, region string, router string) (*compute.Router, error) {
+			return nil, &googleapi.Error{Code: 404, Message: "not found"}
+		},
+		mockRoutersInsert: func(project string, region string, router *compute.Router) (*compute.Operation, error) {
+			routerRegion = region
+			insertedRouter = router
+			return &compute.Operation{}, nil
+		},
+	}
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{
+		Region:   "us-west5",
+		CloudNAT: true,
+	}
+	cluster := newClusterFixture(t, clusterConfig)
+	withFirewallRulesCreated(t, cluster)
+	actuator, _ := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if insertedRouter == nil {
+		t.Fatal("expected a router to be created")
+	}
+	if routerRegion != "us-west5" {
+		t.Errorf("invalid router region: expected 'us-west5' got '%v'", routerRegion)
+	}
+	if insertedRouter.Network != "global/networks/default" {
+		t.Errorf("invalid router network: expected 'global/networks/default' got '%v'", insertedRouter.Network)
+	}
+	if len(insertedRouter.Nats) != 1 {
+		t.Fatalf("invalid NAT count: expected '1' got '%v'", len(insertedRouter.Nats))
+	}
+	if nat := insertedRouter.Nats[0]; nat.SourceSubnetworkIpRangesToNat != "ALL_SUBNETWORKS_ALL_IP_RANGES" {
+		t.Errorf("invalid NAT source ranges: got '%v'", nat.SourceSubnetworkIpRangesToNat)
+	}
+}
+
+func TestReconcileCloudNATWithoutRegion(t *testing.T) {
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{CloudNAT: true}
+	cluster := newClusterFixture(t, clusterConfig)
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network}, nil
+		},
+	}
+	actuator, _ := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err == nil {
+		t.Error("expected an error for Cloud NAT without a region")
+	}
+}
+
+func TestReconcileLoadBalancer(t *testing.T) {
+	var reserved bool
+	var insertedHealthCheck *compute.HealthCheck
+	var insertedBackendService *compute.BackendService
+	var insertedProxy *compute.TargetTcpProxy
+	var insertedForwardingRule *compute.ForwardingRule
+	notFound := &googleapi.Error{Code: 404, Message: "not found"}
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network}, nil
+		},
+		mockGlobalAddressesGet: func(project string, address string) (*compute.Address, error) {
+			if !reserved {
+				return nil, notFound
+			}
+			return &compute.Address{Name: address, Address: "203.0.113.5", SelfLink: "addresses/" + address}, nil
+		},
+		mockGlobalAddressesInsert: func(project string, address *compute.Address) (*compute.Operation, error) {
+			reserved = true
+			return &compute.Operation{}, nil
+		},
+		mockHealthChecksGet: func(project string, healthCheck string) (*compute.HealthCheck, error) {
+			return nil, notFound
+		},
+		mockHealthChecksInsert: func(project string, healthCheck *compute.HealthCheck) (*compute.Operation, error) {
+			insertedHealthCheck = healthCheck
+			return &compute.Operation{}, nil
+		},
+		mockBackendServicesGet: func(project string, backendService string) (*compute.BackendService, error) {
+			return nil, notFound
+		},
+		mockBackendServicesInsert: func(project string, backendService *compute.BackendService) (*compute.Operation, error) {
+			insertedBackendService = backendService
+			return &compute.Operation{}, nil
+		},
+		mockTargetTcpProxiesGet: func(project string, targetTcpProxy string) (*compute.TargetTcpProxy, error) {
+			return nil, notFound
+		},
+		mockTargetTcpProxiesInsert: func(project string, targetTcpProxy *compute.TargetTcpProxy) (*compute.Operation, error) {
+			insertedProxy = targetTcpProxy
+			return &compute.Operation{}, nil
+		},
+		mockGlobalForwardingRulesGet: func(project string, forwardingRule string) (*compute.ForwardingRule, error) {
+			return nil, notFound
+		},
+		mockGlobalForwardingRulesInsert: func(project string, forwardingRule *compute.ForwardingRule) (*compute.Operation, error) {
+			insertedForwardingRule = forwardingRule
+			return &compute.Operation{TargetLink: "forwardingRules/" + forwardingRule.Name}, nil
+		},
+	}
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.LoadBalancer = true
+	cluster := newClusterFixture(t, clusterConfig)
+	cluster.Status.APIEndpoints = nil
+	withFirewallRulesCreated(t, cluster)
+	actuator, fakeClient := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reserved {
+		t.Error("expected an address to be reserved")
+	}
+	if insertedHealthCheck == nil || insertedHealthCheck.TcpHealthCheck == nil || insertedHealthCheck.TcpHealthCheck.Port != 443 {
+		t.Errorf("expected a TCP health check on port 443, got %+v", insertedHealthCheck)
+	}
+	if insertedBackendService == nil || insertedBackendService.PortName != "https" {
+		t.Errorf("expected a backend service for the https port, got %+v", insertedBackendService)
+	}
+	if insertedProxy == nil || insertedProxy.Service != "global/backendServices/cluster-test-apiserver" {
+		t.Errorf("expected a target TCP proxy for the backend service, got %+v", insertedProxy)
+	}
+	if insertedForwardingRule == nil {
+		t.Fatal("expected a forwarding rule to be created")
+	}
+	if insertedForwardingRule.IPAddress != "203.0.113.5" || insertedForwardingRule.PortRange != "443" {
+		t.Errorf("invalid forwarding rule: got address '%v' and ports '%v'", insertedForwardingRule.IPAddress, insertedForwardingRule.PortRange)
+	}
+
+	stored := &v1alpha1.Cluster{}
+	if err := fakeClient.Get(context.Background(), client.ObjectKey{Name: cluster.Name}, stored); err != nil {
+		t.Fatalf("error getting cluster: %v", err)
+	}
+	expected := v1alpha1.APIEndpoint{Host: "203.0.113.5", Port: 443}
+	if len(stored.Status.APIEndpoints) != 1 || stored.Status.APIEndpoints[0] != expected {
+		t.Errorf("invalid API endpoints: expected '%v' got '%v'", expected, stored.Status.APIEndpoints)
+	}
+
+	status := getClusterProviderStatus(t, fakeClient, cluster.Name)
+	if status.LoadBalancer == nil {
+		t.Fatal("expected the load balancer to be recorded in the status")
+	}
+	if status.LoadBalancer.Address != "203.0.113.5" || status.LoadBalancer.AddressSelfLink != "addresses/cluster-test-apiserver" {
+		t.Errorf("invalid load balancer address status: got '%v' and '%v'", status.LoadBalancer.Address, status.LoadBalancer.AddressSelfLink)
+	}
+	if status.LoadBalancer.ForwardingRuleSelfLink != "forwardingRules/cluster-test-apiserver" {
+		t.Errorf("invalid forwarding rule self link: got '%v'", status.LoadBalancer.ForwardingRuleSelfLink)
+	}
+}
+
+func TestReconcileDeletesServiceAccountsOfDeletedClusters(t *testing.T) {
+	api := newFakeIAMAPI()
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	deleted := newNamedCluster(t, "deleted")
+	live := newNamedCluster(t, "live")
+	for _, cluster := range []*v1alpha1.Cluster{deleted, live} {
+		if err := sas.CreateWorkerNodeServiceAccount(cluster); err != nil {
+			t.Fatalf("unable to create worker service account: %v", err)
+		}
+	}
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network}, nil
+		},
+		mockFirewallsGet: func(project string) (*compute.FirewallList, error) {
+			return &compute.FirewallList{}, nil
+		},
+	}
+	params := google.ClusterActuatorParams{ComputeService: computeServiceMock, ServiceAccountService: sas}
+	actuator, _ := newClusterActuatorWithParams(t, params, live)
+
+	if err := actuator.Reconcile(live); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if email := clusterServiceAccounts(t, live).Worker; len(api.accounts) != 1 || api.accounts[email] == "" {
+		t.Errorf("expected only the account of the live cluster to be kept, got %v", api.accounts)
+	}
+}
+
+func TestReconcileMigratesLegacyAnnotations(t *testing.T) {
+	var firewallsInserted int
+	computeServiceMock := GCEClientComputeServiceMock{
+		mockNetworksGet: func(project string, network string) (*compute.Network, error) {
+			return &compute.Network{Name: network, SelfLink: "networks/" + network}, nil
+		},
+		mockFirewallsGet: func(project string) (*compute.FirewallList, error) {
+			return &compute.FirewallList{
+				Items: []*compute.Firewall{
+					{Name: "cluster-test-allow-cluster-internal", SelfLink: "firewalls/cluster-test-allow-cluster-internal"},
+					{Name: "cluster-test-allow-api-public", SelfLink: "firewalls/cluster-test-allow-api-public"},
+				},
+			}, nil
+		},
+		mockFirewallsInsert: func(project string, firewall *compute.Firewall) (*compute.Operation, error) {
+			firewallsInserted++
+			return &compute.Operation{}, nil
+		},
+	}
+	cluster := newDefaultClusterFixture(t)
+	cluster.ObjectMeta.Annotations = map[string]string{
+		"gce.clusterapi.k8s.io/firewallcluster-test-allow-cluster-internal": "true",
+		"gce.clusterapi.k8s.io/firewallcluster-test-allow-api-public":       "true",
+		"gce.clusterapi.k8s.io/service-account-k8s-master":                  "master@project.iam.gserviceaccount.com",
+		"gce.clusterapi.k8s.io/service-account-k8s-worker":                  "worker@project.iam.gserviceaccount.com",
+		"unrelated": "annotation",
+	}
+	actuator, fakeClient := newClusterActuatorWithClient(t, &computeServiceMock, cluster)
+	if err := actuator.Reconcile(cluster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if firewallsInserted != 0 {
+		t.Errorf("expected the existing firewall rules to be kept, got %v inserted", firewallsInserted)
+	}
+	stored := &v1alpha1.Cluster{}
+	if err := fakeClient.Get(context.Background(), client.ObjectKey{Name: cluster.Name}, stored); err != nil {
+		t.Fatalf("error getting cluster: %v", err)
+	}
+	expectedAnnotations := map[string]string{"unrelated": "annotation"}
+	if !reflect.DeepEqual(stored.ObjectMeta.Annotations, expectedAnnotations) {
+		t.Errorf("invalid annotations: expected '%v' got '%v'", expectedAnnotations, stored.ObjectMeta.Annotations)
+	}
+	status := getClusterProviderStatus(t, fakeClient, cluster.Name)
+	expectedServiceAccounts := gceconfigv1.ServiceAccountsStatus{
+		Master: "master@project.iam.gserviceaccount.com",
+		Worker: "worker@project.iam.gserviceaccount.com",
+	}
+	if status.ServiceAccounts != expectedServiceAccounts {
+		t.Errorf("invalid service accounts: expected '%v' got '%v'", expectedServiceAccounts, status.ServiceAccounts)
+	}
+	if len(status.FirewallRules) != 2 {
+		t.Fatalf("invalid firewall rule count: expected '2' got '%v'", len(status.FirewallRules))
+	}
+	for _, rule := range status.FirewallRules {
+		if rule.SelfLink != "firewalls/"+rule.Name {
+			t.Errorf("invalid self link of firewall rule %v: got '%v'", rule.Name, rule.SelfLink)
+		}
+	}
+}
+
+// Records the cluster's firewall rules in its provider status so that
+// Reconcile skips them.
+func withFirewallRulesCreated(t *testing.T, cluster *v1alpha1.Cluster) {
+	status := gceconfigv1.GCEClusterProviderStatus{}
+	for _, suffix := range []string{"-allow-cluster-internal", "-allow-api-public", "-allow-ssh"} {
+		status.FirewallRules = append(status.FirewallRules, gceconfigv1.ResourceStatus{
+			Name:     cluster.Name + suffix,
+			SelfLink: "firewalls/" + cluster.Name + suffix,
+		})
+	}
+	raw, err := json.Marshal(status)
+	if err != nil {
+		t.Fatalf("error encoding cluster provider status: %v", err)
+	}
+	cluster.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+}
+
+// Returns a cluster actuator whose client holds the given cluster.
+func newClusterActuatorWithClient(t *testing.T, computeServiceMock *GCEClientComputeServiceMock, cluster *v1alpha1.Cluster) (cluster.Actuator, client.Client) {
+	return newClusterActuatorWithParams(t, google.ClusterActuatorParams{ComputeService: computeServiceMock}, cluster)
+}
+
+// Returns a cluster actuator whose client holds the given clusters.
+func newClusterActuatorWithParams(t *testing.T, params google.ClusterActuatorParams, clusters ...*v1alpha1.Cluster) (cluster.Actuator, client.Client) {
+	var objs []runtime.Object
+	for _, cluster := range clusters {
+		// The fake client round-trips objects through JSON, like the API
+		// server.
+		raw, err := yaml.YAMLToJSON(cluster.Spec.ProviderConfig.Value.Raw)
+		if err != nil {
+			t.Fatalf("error converting provider config: %v", err)
+		}
+		cluster.Spec.ProviderConfig.Value.Raw = raw
+		objs = append(objs, cluster.DeepCopy())
+	}
+	fakeClient := listingClient{fake.NewFakeClient(objs...)}
+	actuator, err := google.NewClusterActuator(&fakeManager{client: fakeClient}, params)
+	if err != nil {
+		t.Fatalf("error creating cluster actuator: %v", err)
+	}
+	return actuator, fakeClient
+}
+
+func getClusterProviderStatus(t *testing.T, c client.Client, name string) *gceconfigv1.GCEClusterProviderStatus {
+	stored := &v1alpha1.Cluster{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: name}, stored); err != nil {
+		t.Fatalf("error getting cluster: %v", err)
+	}
+	if stored.Status.ProviderStatus == nil {
+		t.Fatal("expected the cluster to have a provider status")
+	}
+	status := &gceconfigv1.GCEClusterProviderStatus{}
+	if err := json.Unmarshal(stored.Status.ProviderStatus.Raw, status); err != nil {
+		t.Fatalf("error decoding cluster provider status: %v", err)
+	}
+	return status
+}
+
+// fakeManager satisfies manager.Manager for actuators that only need a client.
+type fakeManager struct {
+	manager.Manager
+	client client.Client
+}
+
+func (m *fakeManager) GetClient() client.Client {
+	return m.client
+}
+
 func newClusterActuator(t *testing.T, params google.ClusterActuatorParams) cluster.Actuator {
 	t.Helper()
 	m, err := manager.New(nil, manager.Options{})
@@ -0,0 +1,285 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/cert/triple"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/cert"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// How long a master waits before checking again whether the oldest master
+// upgraded the control plane.
+const controlPlaneUpgradeCheckInterval = 30 * time.Second
+
+// Metadata keys of the certificates and keys that all masters of a control
+// plane share. The first master gets freshly generated ones, and every other
+// master copies them from the metadata of a master that already exists.
+var sharedCertificateKeys = []string{
+	"ca-cert",
+	"ca-key",
+	"etcd-ca-cert",
+	"etcd-ca-key",
+	"front-proxy-ca-cert",
+	"front-proxy-ca-key",
+	"sa-key",
+	"sa-pub",
+}
+
+// Returns the master machines in the namespace of the given machine, oldest
+// first. Machines of a cluster share its namespace.
+func (gce *GCEClient) listMasters(machine *clusterv1.Machine) ([]clusterv1.Machine, error) {
+	machines := &clusterv1.MachineList{}
+	if err := gce.client.List(context.Background(), client.InNamespace(machine.Namespace), machines); err != nil {
+		return nil, fmt.Errorf("error listing machines: %v", err)
+	}
+	var masters []clusterv1.Machine
+	for _, m := range machines.Items {
+		config, err := machineProviderFromProviderConfig(m.Spec.ProviderConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing provider config of machine %v: %v", m.Name, err)
+		}
+		if isMaster(config.Roles) {
+			masters = append(masters, m)
+		}
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		ti, tj := masters[i].CreationTimestamp, masters[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return masters[i].Name < masters[j].Name
+	})
+	return masters, nil
+}
+
+// Checks that a new master's zone holds no more masters than any other zone
+// of its region, so that the masters of a highly available control plane are
+// spread across zones and the control plane survives the loss of one.
+func (gce *GCEClient) validateMasterZone(machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig) *apierrors.MachineError {
+	if gce.client == nil || !isMaster(machineConfig.Roles) {
+		return nil
+	}
+	masters, err := gce.listMasters(machine)
+	if err != nil {
+		return apierrors.CreateMachine("%v", err)
+	}
+	mastersInZone := map[string]int{}
+	for i := range masters {
+		m := &masters[i]
+		if m.Name == machine.Name || m.ObjectMeta.DeletionTimestamp != nil {
+			continue
+		}
+		config, err := machineProviderFromProviderConfig(m.Spec.ProviderConfig)
+		if err != nil {
+			return apierrors.InvalidMachineConfiguration("error parsing provider config of machine %v: %v", m.Name, err)
+		}
+		mastersInZone[config.Zone]++
+	}
+	zone := machineConfig.Zone
+	if mastersInZone[zone] == 0 {
+		return nil
+	}
+	region, err := gce.computeService.RegionsGet(clusterConfig.Project, regionForZone(zone))
+	if err != nil {
+		return apierrors.CreateMachine("error getting region of zone %v: %v", zone, err)
+	}
+	for _, z := range region.Zones {
+		z = path.Base(z)
+		if mastersInZone[z] < mastersInZone[zone] {
+			return apierrors.InvalidMachineConfiguration("zone %v already has %v masters while zone %v has %v: masters must be spread across the zones of their region",
+				zone, mastersInZone[zone], z, mastersInZone[z])
+		}
+	}
+	return nil
+}
+
+// Returns the instance of a master that already runs, or nil if the control
+// plane has not been initialized yet. The given machine's own instance only
+// counts while it is being replaced.
+func (gce *GCEClient) runningMaster(cluster *clusterv1.Cluster, machine *clusterv1.Machine, masters []clusterv1.Machine) (*compute.Instance, error) {
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	for i := range masters {
+		m := &masters[i]
+		status, err := gce.machineProviderStatus(m)
+		if err != nil {
+			return nil, err
+		}
+		if m.Name == machine.Name && status.Replacement == nil {
+			continue
+		}
+		config, err := machineProviderFromProviderConfig(m.Spec.ProviderConfig)
+		if err != nil {
+			return nil, err
+		}
+		project, zone, name := instanceLocation(status, clusterConfig, config, m)
+		instance, err := gce.computeService.InstancesGet(project, zone, name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error getting instance of master %v: %v", m.Name, err)
+		}
+		if instance != nil {
+			return instance, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the metadata that makes a master initialize a new control plane or
+// join the existing one. Masters join once another master runs. Until then,
+// only the oldest master may initialize the control plane, so that
+// concurrently created masters don't each start their own.
+func (gce *GCEClient) controlPlaneMetadata(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig) (join bool, shared map[string]string, err error) {
+	masters, err := gce.listMasters(machine)
+	if err != nil {
+		return false, nil, err
+	}
+	running, err := gce.runningMaster(cluster, machine, masters)
+	if err != nil {
+		return false, nil, err
+	}
+	if running != nil {
+		if !clusterConfig.LoadBalancer {
+			return false, nil, fmt.Errorf("cluster %v needs a load balancer for more than one master", cluster.Name)
+		}
+		shared, err := sharedCertificatesFromInstance(running)
+		if err != nil {
+			return false, nil, err
+		}
+		return true, shared, nil
+	}
+	if len(masters) > 0 && masters[0].Name != machine.Name {
+		return false, nil, fmt.Errorf("waiting for master %v to initialize the control plane", masters[0].Name)
+	}
+	if !clusterConfig.LoadBalancer {
+		return false, nil, nil
+	}
+	shared, err = newSharedCertificates(gce.certificateAuthority)
+	return false, shared, err
+}
+
+// Copies the shared certificates from the metadata of a running master.
+func sharedCertificatesFromInstance(instance *compute.Instance) (map[string]string, error) {
+	items := map[string]string{}
+	if instance.Metadata != nil {
+		for _, item := range instance.Metadata.Items {
+			if item.Value != nil {
+				items[item.Key] = *item.Value
+			}
+		}
+	}
+	shared := map[string]string{}
+	for _, key := range sharedCertificateKeys {
+		value, ok := items[key]
+		if !ok {
+			return nil, fmt.Errorf("master %v has no %v metadata to join its control plane", instance.Name, key)
+		}
+		shared[key] = value
+	}
+	return shared, nil
+}
+
+// Generates the certificate authorities and the service account key pair of
+// a new control plane, base64 encoded for use as instance metadata. The
+// cluster CA is only generated if none was given.
+func newSharedCertificates(ca *cert.CertificateAuthority) (map[string]string, error) {
+	shared := map[string]string{}
+	if ca != nil {
+		shared["ca-cert"] = base64.StdEncoding.EncodeToString(ca.Certificate)
+		shared["ca-key"] = base64.StdEncoding.EncodeToString(ca.PrivateKey)
+	} else if err := addCA(shared, "ca", "kubernetes"); err != nil {
+		return nil, err
+	}
+	if err := addCA(shared, "etcd-ca", "etcd-ca"); err != nil {
+		return nil, err
+	}
+	if err := addCA(shared, "front-proxy-ca", "front-proxy-ca"); err != nil {
+		return nil, err
+	}
+
+	saKey, err := certutil.NewPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("error creating service account key: %v", err)
+	}
+	saPub, err := certutil.EncodePublicKeyPEM(&saKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding service account public key: %v", err)
+	}
+	shared["sa-key"] = base64.StdEncoding.EncodeToString(certutil.EncodePrivateKeyPEM(saKey))
+	shared["sa-pub"] = base64.StdEncoding.EncodeToString(saPub)
+	return shared, nil
+}
+
+func addCA(shared map[string]string, prefix string, commonName string) error {
+	keyPair, err := triple.NewCA(commonName)
+	if err != nil {
+		return fmt.Errorf("error creating %v: %v", commonName, err)
+	}
+	shared[prefix+"-cert"] = base64.StdEncoding.EncodeToString(certutil.EncodeCertPEM(keyPair.Cert))
+	shared[prefix+"-key"] = base64.StdEncoding.EncodeToString(certutil.EncodePrivateKeyPEM(keyPair.Key))
+	return nil
+}
+
+// Returns whether the master upgrades the cluster. The oldest master upgrades
+// the cluster and the other masters follow once it is done, each upgrading
+// only its own control plane components.
+func (gce *GCEClient) upgradesCluster(machine *clusterv1.Machine) (bool, error) {
+	if gce.client == nil {
+		return true, nil
+	}
+	masters, err := gce.listMasters(machine)
+	if err != nil {
+		return false, err
+	}
+	if len(masters) == 0 || masters[0].Name == machine.Name {
+		return true, nil
+	}
+	if versions := masters[0].Status.Versions; versions == nil || versions.ControlPlane != machine.Spec.Versions.ControlPlane {
+		glog.Infof("Waiting for master %v to upgrade the control plane to %v", masters[0].Name, machine.Spec.Versions.ControlPlane)
+		return false, &controllererror.RequeueAfterError{RequeueAfter: controlPlaneUpgradeCheckInterval}
+	}
+	return false, nil
+}
+
+// Returns the kubeadm command that upgrades the control plane on a master.
+func controlPlaneUpgradeCommand(machine *clusterv1.Machine, upgradesCluster bool) string {
+	if upgradesCluster {
+		return fmt.Sprintf("sudo kubeadm upgrade apply %s -y", "v"+machine.Spec.Versions.ControlPlane)
+	}
+	return "sudo kubeadm upgrade node experimental-control-plane"
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/kubeadm"
+	"sigs.k8s.io/cluster-api/pkg/test-cmd-runner"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var sharedCertificateKeys = []string{
+	"ca-cert",
+	"ca-key",
+	"etcd-ca-cert",
+	"etcd-ca-key",
+	"front-proxy-ca-cert",
+	"front-proxy-ca-key",
+	"sa-key",
+	"sa-pub",
+}
+
+func TestFirstMasterInitializesControlPlane(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	withLoadBalancerBackend(computeServiceMock)
+	masters := newMasters(t, "master-0", "master-1")
+	gce, _ := newMachineActuatorWithClient(t, computeServiceMock, nil, masters...)
+	if err := gce.Create(newLoadBalancedClusterFixture(t), masters[0]); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "CONTROL_PLANE_JOIN=false\n")
+	for _, key := range sharedCertificateKeys {
+		if item := getMetadataItem(t, receivedInstance.Metadata, key); item.Value == nil || *item.Value == "" {
+			t.Errorf("expected a generated value for metadata item %v", key)
+		}
+	}
+}
+
+func TestMasterWaitsForControlPlaneInitialization(t *testing.T) {
+	_, computeServiceMock := newInsertInstanceCapturingMock()
+	masters := newMasters(t, "master-0", "master-1")
+	gce, _ := newMachineActuatorWithClient(t, computeServiceMock, nil, masters...)
+	err := gce.Create(newLoadBalancedClusterFixture(t), masters[1])
+	if err == nil || !strings.Contains(err.Error(), "master-0") {
+		t.Errorf("expected master-1 to wait for master-0, got %v", err)
+	}
+}
+
+func TestMasterJoinsControlPlane(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	computeServiceMock.mockInstancesGet = func(project string, zone string, instance string) (*compute.Instance, error) {
+		if instance == receivedInstance.Name {
+			return receivedInstance, nil
+		}
+		if instance != "master-0" {
+			return nil, &googleapi.Error{Code: 404, Message: "not found"}
+		}
+		metadata := &compute.Metadata{}
+		for _, key := range sharedCertificateKeys {
+			value := base64.StdEncoding.EncodeToString([]byte(key + "-value"))
+			metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: key, Value: &value})
+		}
+		return &compute.Instance{Name: instance, Metadata: metadata}, nil
+	}
+	withLoadBalancerBackend(computeServiceMock)
+	kubeadm := kubeadm.NewWithCmdRunner(test_cmd_runner.NewTestRunnerFailOnErr(t, tokenCreateCommandCallback))
+	masters := newMasters(t, "master-0", "master-1")
+	gce, _ := newMachineActuatorWithClient(t, computeServiceMock, kubeadm, masters...)
+	if err := gce.Create(newLoadBalancedClusterFixture(t), masters[1]); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value,
+		"CONTROL_PLANE_JOIN=true\n",
+		"TOKEN="+strings.TrimSpace(tokenCreateCmdOutput)+"\n",
+		"MASTER=172.12.0.1:1234\n")
+	for _, key := range sharedCertificateKeys {
+		checkMetadataItem(t, receivedInstance.Metadata, key, key+"-value")
+	}
+}
+
+func TestSecondMasterRequiresLoadBalancer(t *testing.T) {
+	_, computeServiceMock := newInsertInstanceCapturingMock()
+	computeServiceMock.mockInstancesGet = func(project string, zone string, instance string) (*compute.Instance, error) {
+		if instance != "master-0" {
+			return nil, &googleapi.Error{Code: 404, Message: "not found"}
+		}
+		return &compute.Instance{Name: instance}, nil
+	}
+	masters := newMasters(t, "master-0", "master-1")
+	gce, _ := newMachineActuatorWithClient(t, computeServiceMock, nil, masters...)
+	if err := gce.Create(newDefaultClusterFixture(t), masters[1]); err == nil {
+		t.Error("expected an error for a second master without a load balancer")
+	}
+}
+
+func TestMastersAreSpreadAcrossZones(t *testing.T) {
+	testCases := []struct {
+		name string
+		// The masters created before the last one, which is created in
+		// the first zone.
+		masters      int
+		expectReject bool
+	}{
+		{"zone without a master left", 1, true},
+		{"a master in every zone", 3, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var names []string
+			for i := 0; i <= tc.masters; i++ {
+				names = append(names, fmt.Sprintf("master-%d", i))
+			}
+			masters := newMasters(t, names...)
+			last := masters[len(masters)-1]
+			config := newGCEMachineProviderConfigFixture()
+			config.Zone = masterZones[0]
+			*last = *newStoredMachine(t, last.Name, config)
+			var requestedRegion string
+			computeServiceMock := &GCEClientComputeServiceMock{
+				mockRegionsGet: func(project string, region string) (*compute.Region, error) {
+					requestedRegion = region
+					r := &compute.Region{Name: region}
+					for _, zone := range masterZones {
+						r.Zones = append(r.Zones, "https://www.googleapis.com/compute/v1/projects/"+project+"/zones/"+zone)
+					}
+					return r, nil
+				},
+				mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+					return nil, &googleapi.Error{Code: 404, Message: "not found"}
+				},
+			}
+			gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, nil, masters...)
+			gce.Create(newLoadBalancedClusterFixture(t), last)
+
+			if requestedRegion != "us-west5" {
+				t.Errorf("expected the zones of region 'us-west5' to be checked, got '%v'", requestedRegion)
+			}
+			stored := getMachine(t, fakeClient, last)
+			rejected := stored.Status.ErrorReason != nil && *stored.Status.ErrorReason == common.InvalidConfigurationMachineError
+			if rejected != tc.expectReject {
+				t.Errorf("expected rejected to be %v, got error '%v'", tc.expectReject, stored.Status.ErrorMessage)
+			}
+		})
+	}
+}
+
+func newLoadBalancedClusterFixture(t *testing.T) *v1alpha1.Cluster {
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.LoadBalancer = true
+	return newClusterFixture(t, clusterConfig)
+}
+
+func withLoadBalancerBackend(computeServiceMock *GCEClientComputeServiceMock) {
+	computeServiceMock.mockBackendServicesGet = func(project string, backendService string) (*compute.BackendService, error) {
+		return &compute.BackendService{Name: backendService}, nil
+	}
+}
+
+// The zones of the region of the machine fixture, in which newMasters places
+// masters in turn.
+var masterZones = []string{"us-west5-f", "us-west5-a", "us-west5-b"}
+
+// Returns master machines with the given names, created in that order.
+func newMasters(t *testing.T, names ...string) []*v1alpha1.Machine {
+	var masters []*v1alpha1.Machine
+	created := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range names {
+		// Masters are spread across zones.
+		config := newGCEMachineProviderConfigFixture()
+		config.Zone = masterZones[i%len(masterZones)]
+		machine := newMachine(t, config)
+		machine.ObjectMeta = v1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			CreationTimestamp: v1.NewTime(created.Add(time.Duration(i) * time.Minute)),
+		}
+		// The fake client round-trips objects through JSON, like the API server.
+		raw, err := yaml.YAMLToJSON(machine.Spec.ProviderConfig.Value.Raw)
+		if err != nil {
+			t.Fatalf("error converting provider config: %v", err)
+		}
+		machine.Spec.ProviderConfig.Value.Raw = raw
+		masters = append(masters, machine)
+	}
+	return masters
+}
+
+// Returns a machine actuator whose client holds the given machines.
+func newMachineActuatorWithClient(t *testing.T, computeServiceMock *GCEClientComputeServiceMock, kubeadm *kubeadm.Kubeadm, machines ...*v1alpha1.Machine) (*google.GCEClient, client.Client) {
+	var objects []runtime.Object
+	for _, machine := range machines {
+		objects = append(objects, machine.DeepCopy())
+	}
+	fakeClient := listingClient{fake.NewFakeClient(objects...)}
+	params := google.MachineActuatorParams{
+		ComputeService:           computeServiceMock,
+		Kubeadm:                  kubeadm,
+		Client:                   fakeClient,
+		MachineSetupConfigGetter: newMachineSetupConfigWatcher(),
+		EventRecorder:            &record.FakeRecorder{},
+		Scheme:                   scheme.Scheme,
+	}
+	gce, err := google.NewMachineActuator(params)
+	if err != nil {
+		t.Fatalf("unable to create machine actuator: %v", err)
+	}
+	return gce, fakeClient
+}
+
+// listingClient fills in the kind of listed objects, which the fake client
+// expects to find in the list options.
+type listingClient struct {
+	client.Client
+}
+
+func (c listingClient) List(ctx context.Context, opts *client.ListOptions, list runtime.Object) error {
+	gvks, _, err := scheme.Scheme.ObjectKinds(list)
+	if err != nil {
+		return err
+	}
+	gvk := gvks[0]
+	gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	opts.Raw = &v1.ListOptions{TypeMeta: v1.TypeMeta{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind}}
+	return c.Client.List(ctx, opts, list)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	compute "google.golang.org/api/compute/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+)
+
+const localSSDDiskType = "local-ssd"
+
+func newDisks(config *gceconfigv1.GCEMachineProviderConfig, zone string, instanceName string, imagePath string, minDiskSizeGb int64) []*compute.AttachedDisk {
+	var disks []*compute.AttachedDisk
+	for idx, disk := range config.Disks {
+		d := compute.AttachedDisk{
+			AutoDelete: true,
+			Boot:       idx == 0,
+			Type:       string(disk.Type),
+			Interface:  disk.Interface,
+			DeviceName: disk.DeviceName,
+		}
+		switch {
+		case disk.Source != "":
+			d.AutoDelete = false
+			d.Source = diskPath(zone, disk.Source)
+		case disk.InitializeParams.SourceSnapshot != "":
+			// Instances cannot create their disks from snapshots, so these
+			// are created beforehand by createSnapshotDisks.
+			d.Source = diskPath(zone, snapshotDiskName(instanceName, idx))
+		case disk.Type == gceconfigv1.ScratchDisk:
+			d.InitializeParams = &compute.AttachedDiskInitializeParams{
+				DiskType: diskTypePath(zone, localSSDDiskType),
+			}
+		default:
+			diskSizeGb := disk.InitializeParams.DiskSizeGb
+			d.InitializeParams = &compute.AttachedDiskInitializeParams{
+				DiskSizeGb: diskSizeGb,
+				DiskType:   diskTypePath(zone, disk.InitializeParams.DiskType),
+				Labels:     disk.InitializeParams.Labels,
+			}
+			d.DiskEncryptionKey = newDiskEncryptionKey(disk.EncryptionKey)
+			if idx == 0 {
+				d.InitializeParams.SourceImage = imagePath
+				if diskSizeGb < minDiskSizeGb {
+					glog.Infof("increasing disk size to %v gb, the supplied disk size of %v gb is below the minimum", minDiskSizeGb, diskSizeGb)
+					d.InitializeParams.DiskSizeGb = minDiskSizeGb
+				}
+			}
+		}
+		if disk.AutoDelete != nil {
+			d.AutoDelete = *disk.AutoDelete
+		}
+		disks = append(disks, &d)
+	}
+	return disks
+}
+
+// Creates the disks of the machine that are created from snapshots, unless
+// they already exist. Each is named after the instance and its index in the
+// machine's disks.
+func (gce *GCEClient) createSnapshotDisks(project string, zone string, instanceName string, config *gceconfigv1.GCEMachineProviderConfig) error {
+	for idx, disk := range config.Disks {
+		if disk.Source != "" || disk.InitializeParams.SourceSnapshot == "" {
+			continue
+		}
+		name := snapshotDiskName(instanceName, idx)
+		_, err := gce.computeService.DisksGet(project, zone, name)
+		if err == nil {
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("error getting disk %v: %v", name, err)
+		}
+		op, err := gce.computeService.DisksInsert(project, zone, &compute.Disk{
+			Name:              name,
+			SizeGb:            disk.InitializeParams.DiskSizeGb,
+			Type:              diskTypePath(zone, disk.InitializeParams.DiskType),
+			SourceSnapshot:    snapshotPath(disk.InitializeParams.SourceSnapshot),
+			Labels:            disk.InitializeParams.Labels,
+			DiskEncryptionKey: newDiskEncryptionKey(disk.EncryptionKey),
+		})
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return fmt.Errorf("error creating disk %v from snapshot %v: %v", name, disk.InitializeParams.SourceSnapshot, err)
+		}
+	}
+	return nil
+}
+
+func snapshotDiskName(instanceName string, index int) string {
+	return fmt.Sprintf("%s-disk-%d", instanceName, index)
+}
+
+func newDiskEncryptionKey(key *gceconfigv1.DiskEncryptionKey) *compute.CustomerEncryptionKey {
+	if key == nil {
+		return nil
+	}
+	return &compute.CustomerEncryptionKey{KmsKeyName: key.KMSKeyName}
+}
+
+// Returns the path of a disk type in the zone. Instance templates, which have
+// no zone, refer to disk types by name.
+func diskTypePath(zone string, diskType string) string {
+	if zone == "" {
+		return diskType
+	}
+	return fmt.Sprintf("zones/%s/diskTypes/%s", zone, diskType)
+}
+
+// Returns the path of a disk given its name or URL.
+func diskPath(zone string, disk string) string {
+	if strings.Contains(disk, "/") {
+		return disk
+	}
+	return fmt.Sprintf("zones/%s/disks/%s", zone, disk)
+}
+
+// Returns the path of a snapshot given its name or URL.
+func snapshotPath(snapshot string) string {
+	if strings.Contains(snapshot, "/") {
+		return snapshot
+	}
+	return fmt.Sprintf("global/snapshots/%s", snapshot)
+}
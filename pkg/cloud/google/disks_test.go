@@ -0,0 +1,225 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"reflect"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+)
+
+const testImage = "projects/ubuntu-os-cloud/global/images/family/ubuntu-1604-lts"
+
+func TestDisks(t *testing.T) {
+	bootDisk := gceconfigv1.Disk{
+		InitializeParams: gceconfigv1.DiskInitializeParams{DiskType: "pd-ssd", DiskSizeGb: 30},
+	}
+	expectedBootDisk := &compute.AttachedDisk{
+		AutoDelete: true,
+		Boot:       true,
+		InitializeParams: &compute.AttachedDiskInitializeParams{
+			DiskSizeGb:  30,
+			DiskType:    "zones/us-west5-f/diskTypes/pd-ssd",
+			SourceImage: testImage,
+		},
+	}
+	keep := false
+	testCases := []struct {
+		name     string
+		disk     gceconfigv1.Disk
+		expected *compute.AttachedDisk
+	}{
+		{
+			name: "persistent disk",
+			disk: gceconfigv1.Disk{
+				InitializeParams: gceconfigv1.DiskInitializeParams{DiskType: "pd-standard", DiskSizeGb: 45},
+			},
+			expected: &compute.AttachedDisk{
+				AutoDelete: true,
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					DiskSizeGb: 45,
+					DiskType:   "zones/us-west5-f/diskTypes/pd-standard",
+				},
+			},
+		},
+		{
+			name: "local SSD",
+			disk: gceconfigv1.Disk{
+				Type:      gceconfigv1.ScratchDisk,
+				Interface: "NVME",
+			},
+			expected: &compute.AttachedDisk{
+				AutoDelete: true,
+				Type:       "SCRATCH",
+				Interface:  "NVME",
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					DiskType: "zones/us-west5-f/diskTypes/local-ssd",
+				},
+			},
+		},
+		{
+			name: "existing disk",
+			disk: gceconfigv1.Disk{Source: "data"},
+			expected: &compute.AttachedDisk{
+				Source: "zones/us-west5-f/disks/data",
+			},
+		},
+		{
+			name: "existing disk by URL",
+			disk: gceconfigv1.Disk{Source: "projects/other/zones/us-west5-f/disks/data"},
+			expected: &compute.AttachedDisk{
+				Source: "projects/other/zones/us-west5-f/disks/data",
+			},
+		},
+		{
+			name: "disk from snapshot",
+			disk: gceconfigv1.Disk{
+				InitializeParams: gceconfigv1.DiskInitializeParams{DiskType: "pd-ssd", SourceSnapshot: "data-backup"},
+			},
+			expected: &compute.AttachedDisk{
+				AutoDelete: true,
+				Source:     "zones/us-west5-f/disks/node-0-disk-1",
+			},
+		},
+		{
+			name: "kept disk",
+			disk: gceconfigv1.Disk{
+				InitializeParams: gceconfigv1.DiskInitializeParams{DiskType: "pd-ssd", DiskSizeGb: 100},
+				AutoDelete:       &keep,
+			},
+			expected: &compute.AttachedDisk{
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					DiskSizeGb: 100,
+					DiskType:   "zones/us-west5-f/diskTypes/pd-ssd",
+				},
+			},
+		},
+		{
+			name: "encrypted disk with labels and device name",
+			disk: gceconfigv1.Disk{
+				InitializeParams: gceconfigv1.DiskInitializeParams{
+					DiskType:   "pd-ssd",
+					DiskSizeGb: 100,
+					Labels:     map[string]string{"purpose": "data"},
+				},
+				DeviceName:    "data",
+				EncryptionKey: &gceconfigv1.DiskEncryptionKey{KMSKeyName: "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+			},
+			expected: &compute.AttachedDisk{
+				AutoDelete: true,
+				DeviceName: "data",
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					DiskSizeGb: 100,
+					DiskType:   "zones/us-west5-f/diskTypes/pd-ssd",
+					Labels:     map[string]string{"purpose": "data"},
+				},
+				DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+			computeServiceMock.mockDisksGet = func(project string, zone string, disk string) (*compute.Disk, error) {
+				return &compute.Disk{Name: disk}, nil
+			}
+			config := newGCEMachineProviderConfigFixture()
+			config.Disks = []gceconfigv1.Disk{bootDisk, tc.disk}
+			machine := newMachine(t, config)
+			machine.ObjectMeta.Name = "node-0"
+			if err := createCluster(t, machine, computeServiceMock, nil, nil); err != nil {
+				t.Fatalf("unable to create machine: %v", err)
+			}
+			checkInstanceValues(t, receivedInstance, 2)
+			checkAttachedDisk(t, receivedInstance.Disks[0], expectedBootDisk)
+			checkAttachedDisk(t, receivedInstance.Disks[1], tc.expected)
+		})
+	}
+}
+
+func TestBootDiskFromSnapshot(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	var createdDisk *compute.Disk
+	computeServiceMock.mockDisksGet = func(project string, zone string, disk string) (*compute.Disk, error) {
+		if createdDisk == nil || createdDisk.Name != disk {
+			return nil, &googleapi.Error{Code: 404, Message: "not found"}
+		}
+		return createdDisk, nil
+	}
+	computeServiceMock.mockDisksInsert = func(project string, zone string, disk *compute.Disk) (*compute.Operation, error) {
+		createdDisk = disk
+		return &compute.Operation{}, nil
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Disks = []gceconfigv1.Disk{
+		{
+			InitializeParams: gceconfigv1.DiskInitializeParams{
+				DiskType:       "pd-ssd",
+				DiskSizeGb:     50,
+				SourceSnapshot: "golden",
+				Labels:         map[string]string{"purpose": "boot"},
+			},
+			EncryptionKey: &gceconfigv1.DiskEncryptionKey{KMSKeyName: "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+		},
+	}
+	machine := newMachine(t, config)
+	machine.ObjectMeta.Name = "node-0"
+	if err := createCluster(t, machine, computeServiceMock, nil, nil); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	expectedDisk := &compute.Disk{
+		Name:              "node-0-disk-0",
+		SizeGb:            50,
+		Type:              "zones/us-west5-f/diskTypes/pd-ssd",
+		SourceSnapshot:    "global/snapshots/golden",
+		Labels:            map[string]string{"purpose": "boot"},
+		DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: "projects/p/locations/global/keyRings/r/cryptoKeys/k"},
+	}
+	if !reflect.DeepEqual(createdDisk, expectedDisk) {
+		t.Errorf("invalid disk: expected '%+v' got '%+v'", expectedDisk, createdDisk)
+	}
+	checkInstanceValues(t, receivedInstance, 1)
+	checkAttachedDisk(t, receivedInstance.Disks[0], &compute.AttachedDisk{
+		AutoDelete: true,
+		Boot:       true,
+		Source:     "zones/us-west5-f/disks/node-0-disk-0",
+	})
+
+	// The disk is not created again when the instance is.
+	createdDisk.SizeGb = 60
+	*receivedInstance = compute.Instance{}
+	if err := createCluster(t, machine, computeServiceMock, nil, nil); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	if createdDisk.SizeGb != 60 {
+		t.Error("expected the existing disk to be used")
+	}
+}
+
+func checkAttachedDisk(t *testing.T, disk *compute.AttachedDisk, expected *compute.AttachedDisk) {
+	t.Helper()
+	if !reflect.DeepEqual(disk, expected) {
+		t.Errorf("invalid disk: expected '%+v' got '%+v'", expected, disk)
+		if disk.InitializeParams != nil && expected.InitializeParams != nil {
+			t.Errorf("invalid initialize params: expected '%+v' got '%+v'", expected.InitializeParams, disk.InitializeParams)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apimachineryerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+)
+
+// How long draining a node may take by default before it gives up, and how
+// often a drain that waits for pods to go away checks them again.
+const (
+	defaultDrainTimeout = 5 * time.Minute
+	drainCheckInterval  = 10 * time.Second
+)
+
+// Drains a node through the API server of its cluster: the node is cordoned
+// and its pods are evicted, which respects their pod disruption budgets. Pods
+// of daemon sets and mirror pods of static pods are left alone, like kubectl
+// drain does. Returns a RequeueAfterError while pods remain, and an
+// upgradeError once they remained for longer than the drain timeout since
+// the drain started. Nothing is done if the node is gone.
+func (gce *GCEClient) drainNode(nodes kubernetes.Interface, name string, started time.Time) error {
+	if err := setNodeUnschedulable(nodes, name, true); err != nil {
+		return err
+	}
+	pods, err := nodes.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{FieldSelector: "spec.nodeName=" + name})
+	if err != nil {
+		return fmt.Errorf("error listing pods of node %v: %v", name, err)
+	}
+
+	var remaining, blocked []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !needsEviction(pod) {
+			continue
+		}
+		podName := pod.Namespace + "/" + pod.Name
+		remaining = append(remaining, podName)
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		err := nodes.PolicyV1beta1().Evictions(pod.Namespace).Evict(&policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+		})
+		switch {
+		case err == nil, apimachineryerrors.IsNotFound(err):
+		case apimachineryerrors.IsTooManyRequests(err):
+			// Evicting the pod would violate its disruption budget.
+			blocked = append(blocked, podName)
+		default:
+			return fmt.Errorf("error evicting pod %v: %v", podName, err)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	if time.Since(started) > gce.drainTimeout {
+		return &upgradeError{fmt.Sprintf("pods %v remained on node %v for longer than %v", strings.Join(remaining, ", "), name, gce.drainTimeout)}
+	}
+	if len(blocked) > 0 {
+		glog.Infof("Disruption budgets block the eviction of pods %v from node %v", strings.Join(blocked, ", "), name)
+	}
+	glog.Infof("Waiting for %d pods to leave node %v", len(remaining), name)
+	return &controllererror.RequeueAfterError{RequeueAfter: drainCheckInterval}
+}
+
+// Returns whether draining a node evicts the pod.
+func needsEviction(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+		return false
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "DaemonSet" {
+		return false
+	}
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// Cordons a node, or makes it schedulable again. Nothing is done if the node
+// is gone.
+func setNodeUnschedulable(nodes kubernetes.Interface, name string, unschedulable bool) error {
+	node, err := nodes.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if apimachineryerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting node %v: %v", name, err)
+	}
+	if node.Spec.Unschedulable == unschedulable {
+		return nil
+	}
+	node.Spec.Unschedulable = unschedulable
+	if _, err := nodes.CoreV1().Nodes().Update(node); err != nil {
+		return fmt.Errorf("error updating node %v: %v", name, err)
+	}
+	return nil
+}
+
+// Returns whether the node exists and its Ready condition is true.
+func isNodeReady(nodes kubernetes.Interface, name string) (bool, error) {
+	node, err := nodes.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if apimachineryerrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error getting node %v: %v", name, err)
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
+
+// Deletes a node. Nothing is done if it is already gone.
+func deleteNode(nodes kubernetes.Interface, name string) error {
+	err := nodes.CoreV1().Nodes().Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apimachineryerrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting node %v: %v", name, err)
+	}
+	return nil
+}
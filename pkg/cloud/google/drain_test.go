@@ -0,0 +1,274 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+)
+
+func TestDrainSkipsDaemonSetAndMirrorPods(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+	target.AddPod("node-0", "app", nil, &v1.OwnerReference{Kind: "ReplicaSet", Name: "app", Controller: boolPtr(true)}, corev1.PodRunning)
+	target.AddPod("node-0", "logs", nil, &v1.OwnerReference{Kind: "DaemonSet", Name: "logs", Controller: boolPtr(true)}, corev1.PodRunning)
+	target.AddPod("node-0", "proxy", map[string]string{corev1.MirrorPodAnnotationKey: "hash"}, nil, corev1.PodRunning)
+	target.AddPod("node-0", "job", nil, nil, corev1.PodSucceeded)
+	target.AddPod("node-1", "other", nil, nil, corev1.PodRunning)
+
+	f.joinReplacement(t)
+	err := f.update(t)
+	if _, ok := err.(*controllererror.RequeueAfterError); !ok {
+		t.Fatalf("expected the drain to wait for evicted pods, got '%v'", err)
+	}
+	if evicted := target.Evicted(); len(evicted) != 1 || evicted[0] != "default/app" {
+		t.Errorf("expected only pod app to be evicted, got '%v'", evicted)
+	}
+	if node := target.Node("node-0"); node == nil || !node.Spec.Unschedulable {
+		t.Errorf("expected node node-0 to be cordoned, got '%+v'", node)
+	}
+}
+
+func TestDrainRespectsDisruptionBudget(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+	target.AddPod("node-0", "db", nil, nil, corev1.PodRunning)
+	target.Block("default/db")
+
+	f.joinReplacement(t)
+	err := f.update(t)
+	if _, ok := err.(*controllererror.RequeueAfterError); !ok {
+		t.Fatalf("expected the drain to wait for the disruption budget, got '%v'", err)
+	}
+	if evicted := target.Evicted(); len(evicted) != 0 {
+		t.Errorf("expected no pod to be evicted, got '%v'", evicted)
+	}
+
+	// Pods that remain for longer than the drain timeout fail the
+	// replacement, and the old node takes pods again.
+	stored := getMachine(t, f.client, f.node)
+	status := getMachineProviderStatus(t, stored)
+	status.Replacement.PhaseStartTime.Time = status.Replacement.PhaseStartTime.Add(-2 * time.Minute)
+	setStoredProviderStatus(t, f.client, stored, status)
+	err = f.update(t)
+	if err == nil || !strings.Contains(err.Error(), "remained on node node-0") {
+		t.Fatalf("expected the replacement to fail, got '%v'", err)
+	}
+	stored = getMachine(t, f.client, f.node)
+	status = getMachineProviderStatus(t, stored)
+	if status.InstanceName != "node-0" || status.Replacement == nil || status.Replacement.Phase != gceconfigv1.ReplacementFailed {
+		t.Errorf("expected the replacement to have failed, got '%+v'", status)
+	}
+	if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.UnsupportedChangeMachineError {
+		t.Errorf("expected error reason UnsupportedChange, got '%v'", stored.Status.ErrorReason)
+	}
+	if node := target.Node("node-0"); node == nil || node.Spec.Unschedulable {
+		t.Errorf("expected node node-0 to be schedulable again, got '%+v'", node)
+	}
+	if len(f.deleted) != 0 || f.instances["node-0"] == nil {
+		t.Errorf("expected the old instance to be left, got '%v'", f.instances)
+	}
+}
+
+// targetCluster is an API server of a target cluster that serves its nodes
+// and pods. Evicting a pod deletes it, unless its disruption budget blocks
+// the eviction.
+type targetCluster struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu           sync.Mutex
+	nodes        map[string]*corev1.Node
+	pods         map[string]*corev1.Pod
+	blocked      map[string]bool
+	evicted      []string
+	deletedNodes []string
+}
+
+func newTargetCluster(t *testing.T) *targetCluster {
+	c := &targetCluster{
+		t:       t,
+		nodes:   map[string]*corev1.Node{},
+		pods:    map[string]*corev1.Pod{},
+		blocked: map[string]bool{},
+	}
+	c.server = httptest.NewServer(c)
+	return c
+}
+
+func (c *targetCluster) Close() {
+	c.server.Close()
+}
+
+func (c *targetCluster) GetTargetClusterClient(cluster *v1alpha1.Cluster, machine *v1alpha1.Machine) (kubernetes.Interface, error) {
+	return kubernetes.NewForConfig(&rest.Config{Host: c.server.URL})
+}
+
+func (c *targetCluster) AddNode(name string, ready bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	c.nodes[name] = &corev1.Node{
+		TypeMeta:   v1.TypeMeta{APIVersion: "v1", Kind: "Node"},
+		ObjectMeta: v1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func (c *targetCluster) AddPod(node string, name string, annotations map[string]string, controller *v1.OwnerReference, phase corev1.PodPhase) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pod := &corev1.Pod{
+		TypeMeta:   v1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+	if controller != nil {
+		pod.OwnerReferences = []v1.OwnerReference{*controller}
+	}
+	c.pods["default/"+name] = pod
+}
+
+// Makes the disruption budget of the pod block its eviction.
+func (c *targetCluster) Block(pod string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blocked[pod] = true
+}
+
+func (c *targetCluster) Node(name string) *corev1.Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[name]
+}
+
+func (c *targetCluster) Evicted() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.evicted...)
+}
+
+func (c *targetCluster) DeletedNodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.deletedNodes...)
+}
+
+func (c *targetCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	switch {
+	case len(path) == 2 && path[0] == "nodes":
+		c.serveNode(w, r, path[1])
+	case len(path) == 1 && path[0] == "pods" && r.Method == http.MethodGet:
+		node := strings.TrimPrefix(r.URL.Query().Get("fieldSelector"), "spec.nodeName=")
+		list := &corev1.PodList{TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "PodList"}}
+		for _, pod := range c.pods {
+			if pod.Spec.NodeName == node {
+				list.Items = append(list.Items, *pod)
+			}
+		}
+		c.write(w, http.StatusOK, list)
+	case len(path) == 5 && path[0] == "namespaces" && path[2] == "pods" && path[4] == "eviction" && r.Method == http.MethodPost:
+		key := path[1] + "/" + path[3]
+		switch {
+		case c.pods[key] == nil:
+			c.writeStatus(w, http.StatusNotFound, v1.StatusReasonNotFound)
+		case c.blocked[key]:
+			c.writeStatus(w, http.StatusTooManyRequests, v1.StatusReasonTooManyRequests)
+		default:
+			delete(c.pods, key)
+			c.evicted = append(c.evicted, key)
+			c.writeStatus(w, http.StatusCreated, "")
+		}
+	default:
+		c.t.Errorf("unexpected request %v %v", r.Method, r.URL)
+		c.writeStatus(w, http.StatusNotFound, v1.StatusReasonNotFound)
+	}
+}
+
+func (c *targetCluster) serveNode(w http.ResponseWriter, r *http.Request, name string) {
+	node := c.nodes[name]
+	if node == nil {
+		c.writeStatus(w, http.StatusNotFound, v1.StatusReasonNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		c.write(w, http.StatusOK, node)
+	case http.MethodPut:
+		updated := &corev1.Node{}
+		if err := json.NewDecoder(r.Body).Decode(updated); err != nil {
+			c.t.Errorf("error decoding node: %v", err)
+		}
+		updated.TypeMeta = node.TypeMeta
+		c.nodes[name] = updated
+		c.write(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		delete(c.nodes, name)
+		c.deletedNodes = append(c.deletedNodes, name)
+		c.writeStatus(w, http.StatusOK, "")
+	}
+}
+
+func (c *targetCluster) writeStatus(w http.ResponseWriter, code int, reason v1.StatusReason) {
+	status := &v1.Status{
+		TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   v1.StatusSuccess,
+		Code:     int32(code),
+		Reason:   reason,
+	}
+	if code >= http.StatusBadRequest {
+		status.Status = v1.StatusFailure
+	}
+	c.write(w, code, status)
+}
+
+func (c *targetCluster) write(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		c.t.Errorf("error encoding response: %v", err)
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,566 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/machinesetup"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// Machines of a MachineSet with an instance group in their provider config
+// get their instances from a managed instance group. The group is created
+// from an instance template rendered from the provider config, and resized to
+// the number of machines in the set, so that GCE creates the instances of a
+// scale-up at once. Each machine then claims one of the group's instances by
+// setting the machine's name and a token to join the cluster with in the
+// instance's metadata, which the startup script waits for.
+
+const (
+	// The instance metadata keys an instance learns the machine it backs and
+	// its join token from.
+	machineMetadataKey = "machine"
+	tokenMetadataKey   = "kubeadm-token"
+
+	// The interval at which machines retry claiming an instance while the
+	// instance group creates them.
+	instanceGroupClaimInterval = 30 * time.Second
+
+	// The interval at which the instances of machines are checked for having
+	// been recreated by their instance group, which drops their claim.
+	instanceGroupCheckInterval = 2 * time.Minute
+
+	// GCE names the instances of a group after the group followed by a dash
+	// and four characters, and instance names are limited to 63 characters.
+	// Instance template names additionally carry a hash of the template.
+	maxInstanceGroupNameLength = 52
+
+	managedInstanceActionNone = "NONE"
+)
+
+func inInstanceGroup(config *gceconfigv1.GCEMachineProviderConfig) bool {
+	return config.InstanceGroup != nil
+}
+
+// Returns the MachineSet that controls the machine, or nil if there is none.
+func machineSetOf(machine *clusterv1.Machine) *metav1.OwnerReference {
+	owner := metav1.GetControllerOf(machine)
+	if owner == nil || owner.Kind != "MachineSet" {
+		return nil
+	}
+	return owner
+}
+
+func instanceGroupName(cluster *clusterv1.Cluster, machineSet *metav1.OwnerReference, config *gceconfigv1.GCEMachineProviderConfig) string {
+	if config.InstanceGroup.Name != "" {
+		return config.InstanceGroup.Name
+	}
+	name := fmt.Sprintf("%s-%s", cluster.Name, machineSet.Name)
+	if len(name) > maxInstanceGroupNameLength {
+		name = name[:maxInstanceGroupNameLength]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// Returns the machines of the MachineSet that are not being deleted.
+func (gce *GCEClient) listMachineSetMachines(namespace string, machineSet *metav1.OwnerReference) ([]clusterv1.Machine, error) {
+	machines := &clusterv1.MachineList{}
+	if err := gce.client.List(context.Background(), client.InNamespace(namespace), machines); err != nil {
+		return nil, fmt.Errorf("error listing machines: %v", err)
+	}
+	var result []clusterv1.Machine
+	for _, m := range machines.Items {
+		owner := machineSetOf(&m)
+		if owner != nil && owner.UID == machineSet.UID && m.ObjectMeta.DeletionTimestamp == nil {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// Returns the names of the instances claimed by the given machines, other than
+// the given one.
+func (gce *GCEClient) claimedInstances(machines []clusterv1.Machine, except *clusterv1.Machine) (sets.String, error) {
+	claimed := sets.NewString()
+	for i := range machines {
+		if machines[i].ObjectMeta.UID == except.ObjectMeta.UID {
+			continue
+		}
+		status, err := gce.machineProviderStatus(&machines[i])
+		if err != nil {
+			return nil, err
+		}
+		if status.InstanceGroup != "" && status.InstanceName != "" {
+			claimed.Insert(status.InstanceName)
+		}
+	}
+	return claimed, nil
+}
+
+// Identifies the machine in the metadata of the instance it claimed.
+func machineKey(machine *clusterv1.Machine) string {
+	return machine.ObjectMeta.Namespace + "/" + machine.ObjectMeta.Name
+}
+
+func metadataValue(metadata *compute.Metadata, key string) string {
+	if metadata == nil {
+		return ""
+	}
+	for _, item := range metadata.Items {
+		if item.Key == key && item.Value != nil {
+			return *item.Value
+		}
+	}
+	return ""
+}
+
+// Creates the machine's instance by claiming one from the instance group of
+// its MachineSet, which is created or resized as needed. Returns a
+// RequeueAfterError while the group has no instance to claim yet.
+func (gce *GCEClient) createInInstanceGroup(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, configParams *machinesetup.ConfigParams, imagePath string) error {
+	if gce.client == nil {
+		return gce.handleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"machines in instance groups cannot be created without a cluster"), createEventAction)
+	}
+	machineSet := machineSetOf(machine)
+	if machineSet == nil {
+		return gce.handleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"only machines of a MachineSet can use instance groups"), createEventAction)
+	}
+	project := clusterConfig.Project
+	zone := machineConfig.Zone
+	groupName := instanceGroupName(cluster, machineSet, machineConfig)
+
+	if verr := gce.validateMachineType(project, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	if verr := gce.validateAccelerators(project, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	if verr := gce.validateImage(imagePath, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	template, err := gce.ensureInstanceTemplate(cluster, machine, clusterConfig, machineConfig, configParams, groupName, imagePath)
+	if err != nil {
+		return gce.handleMachineError(machine, apierrors.CreateMachine(
+			"error creating instance template: %v", err), createEventAction)
+	}
+	manager, err := gce.ensureInstanceGroupManager(project, zone, groupName, template)
+	if err != nil {
+		return gce.handleMachineError(machine, apierrors.CreateMachine(
+			"error creating instance group: %v", err), createEventAction)
+	}
+
+	machines, err := gce.listMachineSetMachines(machine.ObjectMeta.Namespace, machineSet)
+	if err != nil {
+		return err
+	}
+	// Grow the group to the size of the MachineSet at once, rather than by
+	// one instance per machine.
+	if size := int64(len(machines)); manager.TargetSize < size {
+		glog.Infof("Resizing instance group %v to %v instances.", groupName, size)
+		op, err := gce.computeService.InstanceGroupManagersResize(project, zone, groupName, size)
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return gce.handleMachineError(machine, apierrors.CreateMachine(
+				"error resizing instance group %v: %v", groupName, err), createEventAction)
+		}
+	}
+
+	instance, err := gce.claimInstance(project, zone, groupName, machine, machines)
+	if err != nil {
+		return gce.handleMachineError(machine, apierrors.CreateMachine(
+			"error claiming an instance of instance group %v: %v", groupName, err), createEventAction)
+	}
+	if instance == nil {
+		glog.Infof("Instance group %v has no instance for machine %v yet.", groupName, machine.ObjectMeta.Name)
+		return &controllererror.RequeueAfterError{RequeueAfter: instanceGroupClaimInterval}
+	}
+
+	// Label the instance with the machine's name, which its template lacks.
+	if _, err := gce.updateLabelsAndTags(cluster, machine, machineConfig, project, zone, instance); err != nil {
+		return gce.handleMachineError(machine, apierrors.CreateMachine(
+			"error labeling instance %v: %v", instance.Name, err), createEventAction)
+	}
+	gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Created", "Created Machine %v", machine.Name)
+	return gce.recordInstanceStatus(cluster, machine, instance.Name, groupName)
+}
+
+// Returns the path of an instance template for the machine's provider config,
+// creating it if needed. Templates are immutable, so they are named after a
+// hash of their properties, and a changed provider config results in a new
+// template.
+func (gce *GCEClient) ensureInstanceTemplate(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, configParams *machinesetup.ConfigParams, groupName string, imagePath string) (string, error) {
+	machineSetupConfigs, err := gce.machineSetupConfigGetter.GetMachineSetupConfig()
+	if err != nil {
+		return "", err
+	}
+	machineSetupMetadata, err := machineSetupConfigs.GetMetadata(configParams)
+	if err != nil {
+		return "", err
+	}
+	metadataMap, err := instanceGroupMetadata(cluster, machine, clusterConfig, machineConfig, &machineSetupMetadata)
+	if err != nil {
+		return "", err
+	}
+	setSecurityMetadata(machineConfig, metadataMap)
+	setInstanceMetadata(machineConfig, metadataMap)
+	var keys []string
+	for k := range metadataMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	metadata := &compute.Metadata{}
+	for _, k := range keys {
+		v := metadataMap[k]
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: k, Value: &v})
+	}
+
+	// Templates hold names rather than zonal paths of machine types, disk
+	// types and accelerator types.
+	properties := &compute.InstanceProperties{
+		MachineType:       machineTypePath(machineConfig, ""),
+		MinCpuPlatform:    machineConfig.MinCPUPlatform,
+		CanIpForward:      true,
+		NetworkInterfaces: newNetworkInterfaces(cluster, clusterConfig, machineConfig, machineConfig.Zone),
+		Disks:             newDisks(machineConfig, "", "", imagePath, int64(30)),
+		Metadata:          metadata,
+		Tags:              newTags(cluster, machineConfig),
+		Labels:            newLabels(cluster, machine.ObjectMeta.Namespace, "", machineConfig),
+		Scheduling:        newScheduling(machineConfig),
+		GuestAccelerators: newGuestAccelerators(machineConfig, ""),
+		ServiceAccounts:   gce.newServiceAccounts(cluster, machine, machineConfig),
+	}
+	b, err := json.Marshal(properties)
+	if err != nil {
+		return "", err
+	}
+	// Shielded VM options are set on the template apart from its v1
+	// properties, so they are hashed apart too.
+	if shielded := newShieldedVmConfig(machineConfig); shielded != nil {
+		sb, err := json.Marshal(shielded)
+		if err != nil {
+			return "", err
+		}
+		b = append(b, sb...)
+	}
+	sum := sha256.Sum256(b)
+	name := fmt.Sprintf("%s-%s", groupName, hex.EncodeToString(sum[:])[:10])
+	templatePath := fmt.Sprintf("global/instanceTemplates/%s", name)
+
+	project := clusterConfig.Project
+	_, err = gce.computeService.InstanceTemplatesGet(project, name)
+	if err == nil {
+		return templatePath, nil
+	}
+	if !errors.IsNotFound(err) {
+		return "", fmt.Errorf("error getting instance template %v: %v", name, err)
+	}
+	glog.Infof("Creating instance template %v.", name)
+	op, err := gce.insertInstanceTemplate(project, &compute.InstanceTemplate{
+		Name:       name,
+		Properties: properties,
+	}, machineConfig)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error creating instance template %v: %v", name, err)
+	}
+	return templatePath, nil
+}
+
+// Returns the named instance group manager, creating it with no instances if
+// it does not exist, and switching it to the given template if it uses
+// another one. Instances created from the old template keep running.
+func (gce *GCEClient) ensureInstanceGroupManager(project string, zone string, name string, template string) (*compute.InstanceGroupManager, error) {
+	manager, err := gce.computeService.InstanceGroupManagersGet(project, zone, name)
+	if errors.IsNotFound(err) {
+		glog.Infof("Creating instance group %v.", name)
+		manager = &compute.InstanceGroupManager{
+			Name:             name,
+			BaseInstanceName: name,
+			InstanceTemplate: template,
+			TargetSize:       0,
+			// The target size is required, and would be omitted as zero.
+			ForceSendFields: []string{"TargetSize"},
+		}
+		op, err := gce.computeService.InstanceGroupManagersInsert(project, zone, manager)
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error creating instance group %v: %v", name, err)
+		}
+		return manager, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance group %v: %v", name, err)
+	}
+	if oldTemplate := path.Base(manager.InstanceTemplate); oldTemplate != path.Base(template) {
+		glog.Infof("Switching instance group %v to instance template %v.", name, path.Base(template))
+		op, err := gce.computeService.InstanceGroupManagersSetInstanceTemplate(project, zone, name,
+			&compute.InstanceGroupManagersSetInstanceTemplateRequest{InstanceTemplate: template})
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error setting instance template of instance group %v: %v", name, err)
+		}
+		manager.InstanceTemplate = template
+		gce.deleteInstanceTemplate(project, oldTemplate)
+	}
+	return manager, nil
+}
+
+// Claims an instance of the group for the machine. Returns nil if every
+// instance is claimed by another machine or still being created.
+func (gce *GCEClient) claimInstance(project string, zone string, groupName string, machine *clusterv1.Machine, machines []clusterv1.Machine) (*compute.Instance, error) {
+	claimed, err := gce.claimedInstances(machines, machine)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := gce.computeService.InstanceGroupManagersListManagedInstances(project, zone, groupName)
+	if err != nil {
+		return nil, fmt.Errorf("error listing instances: %v", err)
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	key := machineKey(machine)
+	for _, managed := range resp.ManagedInstances {
+		name := path.Base(managed.Instance)
+		if managed.Instance == "" || managed.CurrentAction != managedInstanceActionNone || claimed.Has(name) {
+			continue
+		}
+		instance, err := gce.computeService.InstancesGet(project, zone, name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting instance %v: %v", name, err)
+		}
+		switch metadataValue(instance.Metadata, machineMetadataKey) {
+		case key:
+			// Claimed earlier, but the machine's status was not recorded.
+			return instance, nil
+		case "":
+			if err := gce.setInstanceClaim(project, zone, instance, key); err != nil {
+				return nil, err
+			}
+			return instance, nil
+		}
+	}
+	return nil, nil
+}
+
+// Sets the machine and a fresh join token in the instance's metadata.
+func (gce *GCEClient) setInstanceClaim(project string, zone string, instance *compute.Instance, key string) error {
+	token, err := gce.getKubeadmToken()
+	if err != nil {
+		return err
+	}
+	metadata := &compute.Metadata{}
+	if instance.Metadata != nil {
+		metadata.Fingerprint = instance.Metadata.Fingerprint
+		for _, item := range instance.Metadata.Items {
+			if item.Key != machineMetadataKey && item.Key != tokenMetadataKey {
+				metadata.Items = append(metadata.Items, item)
+			}
+		}
+	}
+	metadata.Items = append(metadata.Items,
+		&compute.MetadataItems{Key: machineMetadataKey, Value: &key},
+		&compute.MetadataItems{Key: tokenMetadataKey, Value: &token})
+	glog.Infof("Claiming instance %v for machine %v.", instance.Name, key)
+	op, err := gce.computeService.InstancesSetMetadata(project, zone, instance.Name, metadata)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil {
+		return fmt.Errorf("error setting metadata of instance %v: %v", instance.Name, err)
+	}
+	return nil
+}
+
+// Updates a machine of an instance group. Instances of a group all share its
+// template, so machines cannot be updated individually. Instances the group
+// recreated lost their claim, which is set again.
+func (gce *GCEClient) updateInInstanceGroup(cluster *clusterv1.Cluster, machine *clusterv1.Machine, machineConfig *gceconfigv1.GCEMachineProviderConfig, status *gceconfigv1.GCEMachineProviderStatus, requiresUpdate bool) error {
+	if requiresUpdate {
+		return gce.handleMachineError(machine, apierrors.InvalidMachineConfiguration(
+			"machines in instance groups cannot be updated, replace them through their MachineSet"), noEventAction)
+	}
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return err
+	}
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
+	if err != nil {
+		return fmt.Errorf("error getting instance of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	if key := machineKey(machine); metadataValue(instance.Metadata, machineMetadataKey) != key {
+		if err := gce.setInstanceClaim(project, zone, instance, key); err != nil {
+			return err
+		}
+		gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Reclaimed", "Reclaimed recreated instance of Machine %v", machine.Name)
+		if err := gce.recordInstanceStatus(cluster, machine, name, status.InstanceGroup); err != nil {
+			return err
+		}
+	} else if machine.Status.ProviderStatus == nil {
+		return gce.recordInstanceStatus(cluster, machine, name, status.InstanceGroup)
+	}
+	if _, err := gce.updateLabelsAndTags(cluster, machine, machineConfig, project, zone, instance); err != nil {
+		return err
+	}
+	return &controllererror.RequeueAfterError{RequeueAfter: instanceGroupCheckInterval}
+}
+
+// Deletes the machine's instance from its instance group, which shrinks the
+// group along with the MachineSet. Machines that never claimed an instance
+// take an unclaimed one with them, if the group has more instances than the
+// MachineSet has machines. The group and its template are deleted along with
+// the last machine of the set.
+func (gce *GCEClient) deleteFromInstanceGroup(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig) error {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	machineSet := machineSetOf(machine)
+	groupName := status.InstanceGroup
+	if groupName == "" {
+		if machineSet == nil {
+			return nil
+		}
+		groupName = instanceGroupName(cluster, machineSet, machineConfig)
+		name = ""
+	}
+
+	manager, err := gce.computeService.InstanceGroupManagersGet(project, zone, groupName)
+	if errors.IsNotFound(err) {
+		glog.Infof("Skipped deleting an instance of instance group %v that is already deleted.\n", groupName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var machines []clusterv1.Machine
+	if machineSet != nil && gce.client != nil {
+		machines, err = gce.listMachineSetMachines(machine.ObjectMeta.Namespace, machineSet)
+		if err != nil {
+			return err
+		}
+	}
+	if name == "" && manager.TargetSize > int64(len(machines)) {
+		name, err = gce.unclaimedInstance(project, zone, groupName, machine, machines)
+		if err != nil {
+			return err
+		}
+	}
+
+	if name != "" {
+		op, err := gce.computeService.InstanceGroupManagersDeleteInstances(project, zone, groupName,
+			&compute.InstanceGroupManagersDeleteInstancesRequest{
+				Instances: []string{fmt.Sprintf("zones/%s/instances/%s", zone, name)},
+			})
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return gce.handleMachineError(machine, apierrors.DeleteMachine(
+				"error deleting instance %v of instance group %v: %v", name, groupName, err), deleteEventAction)
+		}
+		manager.TargetSize--
+		gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Deleted", "Deleted Machine %v", name)
+	}
+
+	if machineSet != nil && gce.client != nil && len(machines) == 0 && manager.TargetSize <= 0 {
+		return gce.deleteInstanceGroup(project, zone, manager)
+	}
+	return nil
+}
+
+// Returns the name of an instance of the group no machine claimed, or an
+// empty name if there is none.
+func (gce *GCEClient) unclaimedInstance(project string, zone string, groupName string, machine *clusterv1.Machine, machines []clusterv1.Machine) (string, error) {
+	claimed, err := gce.claimedInstances(machines, machine)
+	if err != nil {
+		return "", err
+	}
+	resp, err := gce.computeService.InstanceGroupManagersListManagedInstances(project, zone, groupName)
+	if err != nil {
+		return "", fmt.Errorf("error listing instances of instance group %v: %v", groupName, err)
+	}
+	if resp == nil {
+		return "", nil
+	}
+	for _, managed := range resp.ManagedInstances {
+		if name := path.Base(managed.Instance); managed.Instance != "" && !claimed.Has(name) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+func (gce *GCEClient) deleteInstanceGroup(project string, zone string, manager *compute.InstanceGroupManager) error {
+	glog.Infof("Deleting instance group %v.", manager.Name)
+	op, err := gce.computeService.InstanceGroupManagersDelete(project, zone, manager.Name)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting instance group %v: %v", manager.Name, err)
+	}
+	gce.deleteInstanceTemplate(project, path.Base(manager.InstanceTemplate))
+	return nil
+}
+
+// Deletes an instance template that is no longer used. Failures only leak the
+// template, so they are logged rather than returned.
+func (gce *GCEClient) deleteInstanceTemplate(project string, name string) {
+	if name == "" || name == "." {
+		return
+	}
+	op, err := gce.computeService.InstanceTemplatesDelete(project, name)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		glog.Errorf("error deleting instance template %v: %v", name, err)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+func TestCreateClaimsInstancesOfInstanceGroup(t *testing.T) {
+	group, computeServiceMock := newInstanceGroupMock()
+	machines := newInstanceGroupMachines(t, "node-0", "node-1")
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machines...)
+	cluster := newDefaultClusterFixture(t)
+
+	for _, machine := range machines {
+		if err := gce.Create(cluster, getMachine(t, fakeClient, machine)); err != nil {
+			t.Fatalf("unable to create machine %v: %v", machine.Name, err)
+		}
+	}
+
+	if group.manager == nil || group.manager.Name != "cluster-test-workers" {
+		t.Fatalf("expected instance group 'cluster-test-workers' to be created, got '%+v'", group.manager)
+	}
+	if group.resizes != 1 || group.manager.TargetSize != 2 {
+		t.Errorf("expected the instance group to be resized to 2 instances once, got %v resizes to %v instances", group.resizes, group.manager.TargetSize)
+	}
+	template := group.templates[path.Base(group.manager.InstanceTemplate)]
+	if template == nil {
+		t.Fatalf("expected the instance group to use a created template, got '%v'", group.manager.InstanceTemplate)
+	}
+	if template.Properties.MachineType != "n1-standard-1" {
+		t.Errorf("invalid machine type: expected 'n1-standard-1' got '%v'", template.Properties.MachineType)
+	}
+	if template.Properties.Scheduling == nil || !template.Properties.Scheduling.Preemptible {
+		t.Errorf("expected preemptible instances, got '%+v'", template.Properties.Scheduling)
+	}
+	startupScript := getMetadataItem(t, template.Properties.Metadata, "startup-script").Value
+	if strings.Contains(*startupScript, strings.TrimSpace(tokenCreateCmdOutput)) || strings.Contains(*startupScript, "node-0") {
+		t.Errorf("expected the template not to hold a token or machine, got '%v'", *startupScript)
+	}
+
+	claimed := map[string]bool{}
+	for _, machine := range machines {
+		status := getMachineProviderStatus(t, getMachine(t, fakeClient, machine))
+		if status.InstanceGroup != "cluster-test-workers" {
+			t.Errorf("invalid instance group of machine %v: got '%v'", machine.Name, status.InstanceGroup)
+		}
+		instance := group.instances[status.InstanceName]
+		if instance == nil || claimed[status.InstanceName] {
+			t.Fatalf("expected machine %v to claim an instance of its own, got '%v'", machine.Name, status.InstanceName)
+		}
+		claimed[status.InstanceName] = true
+		if value := getMetadataItem(t, instance.Metadata, "machine").Value; *value != "default/"+machine.Name {
+			t.Errorf("invalid machine of instance %v: expected 'default/%v' got '%v'", instance.Name, machine.Name, *value)
+		}
+		if value := getMetadataItem(t, instance.Metadata, "kubeadm-token").Value; *value != strings.TrimSpace(tokenCreateCmdOutput) {
+			t.Errorf("invalid token of instance %v: got '%v'", instance.Name, *value)
+		}
+	}
+}
+
+func TestDeleteRemovesInstanceFromInstanceGroup(t *testing.T) {
+	group, computeServiceMock := newInstanceGroupMock()
+	machines := newInstanceGroupMachines(t, "node-0", "node-1")
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machines...)
+	cluster := newDefaultClusterFixture(t)
+	for _, machine := range machines {
+		if err := gce.Create(cluster, getMachine(t, fakeClient, machine)); err != nil {
+			t.Fatalf("unable to create machine %v: %v", machine.Name, err)
+		}
+	}
+
+	machine := getMachine(t, fakeClient, machines[0])
+	instanceName := getMachineProviderStatus(t, machine).InstanceName
+	if err := gce.Delete(cluster, machine); err != nil {
+		t.Fatalf("unable to delete machine: %v", err)
+	}
+	if _, ok := group.instances[instanceName]; ok {
+		t.Errorf("expected instance %v to be deleted", instanceName)
+	}
+	if group.manager.TargetSize != 1 {
+		t.Errorf("expected the instance group to shrink to 1 instance, got %v", group.manager.TargetSize)
+	}
+}
+
+// fakeInstanceGroup keeps the state of the instance templates and the single
+// instance group a mock compute service created.
+type fakeInstanceGroup struct {
+	templates map[string]*compute.InstanceTemplate
+	manager   *compute.InstanceGroupManager
+	instances map[string]*compute.Instance
+	resizes   int
+}
+
+func newInstanceGroupMock() (*fakeInstanceGroup, *GCEClientComputeServiceMock) {
+	group := &fakeInstanceGroup{
+		templates: map[string]*compute.InstanceTemplate{},
+		instances: map[string]*compute.Instance{},
+	}
+	notFound := &googleapi.Error{Code: 404, Message: "not found"}
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockInstanceTemplatesGet: func(project string, instanceTemplate string) (*compute.InstanceTemplate, error) {
+			if template, ok := group.templates[instanceTemplate]; ok {
+				return template, nil
+			}
+			return nil, notFound
+		},
+		mockInstanceTemplatesInsert: func(project string, instanceTemplate *compute.InstanceTemplate) (*compute.Operation, error) {
+			group.templates[instanceTemplate.Name] = instanceTemplate
+			return &compute.Operation{}, nil
+		},
+		mockInstanceGroupManagersGet: func(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManager, error) {
+			if group.manager == nil {
+				return nil, notFound
+			}
+			manager := *group.manager
+			return &manager, nil
+		},
+		mockInstanceGroupManagersInsert: func(project string, zone string, instanceGroupManager *compute.InstanceGroupManager) (*compute.Operation, error) {
+			manager := *instanceGroupManager
+			group.manager = &manager
+			return &compute.Operation{}, nil
+		},
+		mockInstanceGroupManagersResize: func(project string, zone string, instanceGroupManager string, size int64) (*compute.Operation, error) {
+			group.resizes++
+			for i := group.manager.TargetSize; i < size; i++ {
+				name := fmt.Sprintf("%s-%04d", group.manager.BaseInstanceName, i)
+				group.instances[name] = &compute.Instance{Name: name, Status: "RUNNING"}
+			}
+			group.manager.TargetSize = size
+			return &compute.Operation{}, nil
+		},
+		mockInstanceGroupManagersListManagedInstances: func(project string, zone string, instanceGroupManager string) (*compute.InstanceGroupManagersListManagedInstancesResponse, error) {
+			resp := &compute.InstanceGroupManagersListManagedInstancesResponse{}
+			for name := range group.instances {
+				resp.ManagedInstances = append(resp.ManagedInstances, &compute.ManagedInstance{
+					Instance:      fmt.Sprintf("zones/%s/instances/%s", zone, name),
+					CurrentAction: "NONE",
+				})
+			}
+			return resp, nil
+		},
+		mockInstanceGroupManagersDeleteInstances: func(project string, zone string, instanceGroupManager string, request *compute.InstanceGroupManagersDeleteInstancesRequest) (*compute.Operation, error) {
+			for _, instance := range request.Instances {
+				delete(group.instances, path.Base(instance))
+				group.manager.TargetSize--
+			}
+			return &compute.Operation{}, nil
+		},
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			if i, ok := group.instances[instance]; ok {
+				return i, nil
+			}
+			return nil, notFound
+		},
+		mockInstancesSetMetadata: func(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error) {
+			group.instances[instance].Metadata = metadata
+			return &compute.Operation{}, nil
+		},
+	}
+	return group, computeServiceMock
+}
+
+// Returns preemptible workers of the MachineSet 'workers' that use an
+// instance group.
+func newInstanceGroupMachines(t *testing.T, names ...string) []*v1alpha1.Machine {
+	return newInstanceGroupMachinesWithConfig(t, newInstanceGroupMachineConfig(), names...)
+}
+
+func newInstanceGroupMachineConfig() gceconfigv1.GCEMachineProviderConfig {
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.MachineType = "n1-standard-1"
+	config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true}
+	config.InstanceGroup = &gceconfigv1.InstanceGroup{}
+	return config
+}
+
+// Returns machines of the MachineSet 'workers' with the given provider config.
+func newInstanceGroupMachinesWithConfig(t *testing.T, config gceconfigv1.GCEMachineProviderConfig, names ...string) []*v1alpha1.Machine {
+	controller := true
+	var machines []*v1alpha1.Machine
+	for _, name := range names {
+		machine := newStoredMachine(t, name, config)
+		machine.ObjectMeta.UID = types.UID(name + "-uid")
+		machine.ObjectMeta.OwnerReferences = []v1.OwnerReference{{
+			APIVersion: "cluster.k8s.io/v1alpha1",
+			Kind:       "MachineSet",
+			Name:       "workers",
+			UID:        "workers-uid",
+			Controller: &controller,
+		}}
+		machines = append(machines, machine)
+	}
+	return machines
+}
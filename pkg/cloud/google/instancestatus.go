@@ -17,107 +17,304 @@ limitations under the License.
 package google
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	encodingjson "encoding/json"
 	"fmt"
+	"strconv"
 
 	"golang.org/x/net/context"
-
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer/json"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	"sigs.k8s.io/cluster-api/pkg/util"
 )
 
-// Long term, we should retrieve the current status by asking k8s, gce etc. for all the needed info.
-// For now, it is stored in the matching CRD under an annotation. This is similar to
-// the spec and status concept where the machine CRD is the instance spec and the annotation is the instance status.
+// The instance created for a machine is recorded in the machine's provider
+// status, and the versions it was created with in the machine's
+// Status.Versions. Together they tell what was last applied, so that changes
+// to the machine spec can be detected.
 
+// Older versions stored the whole machine the instance was last created or
+// updated from in this annotation. It is converted into the provider status.
 const InstanceStatusAnnotationKey = "instance-status"
 
-type instanceStatus *clusterv1.Machine
-
-// Get the status of the instance identified by the given machine
-func (gce *GCEClient) instanceStatus(machine *clusterv1.Machine) (instanceStatus, error) {
-	if gce.client == nil {
-		return nil, nil
+// Returns the provider status of the machine. Machines last updated by older
+// versions get a status converted from their legacy annotations, which is
+// stored along with the machine's status the next time it is updated.
+func (gce *GCEClient) machineProviderStatus(machine *clusterv1.Machine) (*gceconfigv1.GCEMachineProviderStatus, error) {
+	status := &gceconfigv1.GCEMachineProviderStatus{}
+	if machine.Status.ProviderStatus != nil && len(machine.Status.ProviderStatus.Raw) > 0 {
+		if err := encodingjson.Unmarshal(machine.Status.ProviderStatus.Raw, status); err != nil {
+			return nil, fmt.Errorf("decoding failure: %v", err)
+		}
+		return status, nil
 	}
-	currentMachine, err := util.GetMachineIfExists(gce.client, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name)
-	if err != nil {
+	if err := gce.convertLegacyAnnotations(machine, status); err != nil {
 		return nil, err
 	}
+	return status, nil
+}
 
-	if currentMachine == nil {
-		// The current status no longer exists because the matching CRD has been deleted (or does not exist yet ie. bootstrapping)
-		return nil, nil
+func (gce *GCEClient) convertLegacyAnnotations(machine *clusterv1.Machine, status *gceconfigv1.GCEMachineProviderStatus) error {
+	annotations := machine.ObjectMeta.Annotations
+	if annotations == nil {
+		return nil
 	}
-	return gce.machineInstanceStatus(currentMachine)
-}
+	status.Project = annotations[ProjectAnnotationKey]
+	status.Zone = annotations[ZoneAnnotationKey]
+	status.InstanceName = annotations[NameAnnotationKey]
 
-// Sets the status of the instance identified by the given machine to the given machine
-func (gce *GCEClient) updateInstanceStatus(machine *clusterv1.Machine) error {
-	if gce.client == nil {
+	a := annotations[InstanceStatusAnnotationKey]
+	if a == "" {
 		return nil
 	}
-	status := instanceStatus(machine)
-	currentMachine, err := util.GetMachineIfExists(gce.client, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name)
+	// See https://github.com/kubernetes/apimachinery/blob/master/pkg/runtime/serializer/json/json.go#L143-L150
+	serializer := json.NewSerializer(json.DefaultMetaFactory, gce.scheme, gce.scheme, false)
+	var lastApplied clusterv1.Machine
+	gvk := clusterv1.SchemeGroupVersion.WithKind("Machine")
+	if _, _, err := serializer.Decode([]byte(a), &gvk, &lastApplied); err != nil {
+		return fmt.Errorf("decoding failure: %v", err)
+	}
+	config, err := machineProviderFromProviderConfig(lastApplied.Spec.ProviderConfig)
 	if err != nil {
 		return err
 	}
+	hash, err := providerConfigHash(config)
+	if err != nil {
+		return err
+	}
+	status.LastAppliedProviderConfigHash = hash
+	if status.Zone == "" {
+		status.Zone = config.Zone
+	}
+	if status.InstanceName == "" {
+		status.InstanceName = lastApplied.ObjectMeta.Name
+	}
+	if machine.Status.Versions == nil {
+		versions := lastApplied.Spec.Versions
+		machine.Status.Versions = &versions
+	}
+	return nil
+}
 
-	if currentMachine == nil {
-		// The current status no longer exists because the matching CRD has been deleted.
-		return fmt.Errorf("Machine has already been deleted. Cannot update current instance status for machine %v", machine.ObjectMeta.Name)
+// Removes the annotations older versions recorded the machine's instance in.
+// Returns false if there were none.
+func removeLegacyMachineAnnotations(machine *clusterv1.Machine) bool {
+	removed := false
+	for _, key := range []string{InstanceStatusAnnotationKey, ProjectAnnotationKey, ZoneAnnotationKey, NameAnnotationKey} {
+		if _, ok := machine.ObjectMeta.Annotations[key]; ok {
+			delete(machine.ObjectMeta.Annotations, key)
+			removed = true
+		}
 	}
+	return removed
+}
 
-	m, err := gce.setMachineInstanceStatus(currentMachine, status)
+func setMachineProviderStatus(machine *clusterv1.Machine, status *gceconfigv1.GCEMachineProviderStatus) error {
+	status.APIVersion = gceconfigv1.SchemeGroupVersion.String()
+	status.Kind = "GCEMachineProviderStatus"
+	raw, err := encodingjson.Marshal(status)
 	if err != nil {
-		return err
+		return fmt.Errorf("encoding failure: %v", err)
 	}
+	machine.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+	return nil
+}
 
-	return gce.client.Update(context.Background(), m)
+// Returns the project, zone and name of the machine's instance. They are
+// taken from the provider status, so that instances can still be found after
+// their location changed in the provider config.
+func instanceLocation(status *gceconfigv1.GCEMachineProviderStatus, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, machine *clusterv1.Machine) (project string, zone string, name string) {
+	project, zone, name = status.Project, status.Zone, status.InstanceName
+	if project == "" {
+		project = clusterConfig.Project
+	}
+	if zone == "" {
+		zone = machineConfig.Zone
+	}
+	if name == "" {
+		name = machine.ObjectMeta.Name
+	}
+	return project, zone, name
 }
 
-// Gets the state of the instance stored on the given machine CRD
-func (gce *GCEClient) machineInstanceStatus(machine *clusterv1.Machine) (instanceStatus, error) {
-	if machine.ObjectMeta.Annotations == nil {
-		// No state
-		return nil, nil
+// Returns the name of the machine's instance, which is also the name of its
+// node. Instances that replaced the one first created for a machine are named
+// differently from the machine.
+func (gce *GCEClient) instanceName(machine *clusterv1.Machine) (string, error) {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return "", err
 	}
+	if status.InstanceName != "" {
+		return status.InstanceName, nil
+	}
+	return machine.ObjectMeta.Name, nil
+}
 
-	a := machine.ObjectMeta.Annotations[InstanceStatusAnnotationKey]
-	if a == "" {
-		// No state
-		return nil, nil
+// Returns a hash of the provider config that does not depend on how it was
+// serialized. Labels and tags are left out, as changing them does not require
+// recreating the instance, and so is the upgrade strategy, which only decides
+// how other changes are applied.
+func providerConfigHash(config *gceconfigv1.GCEMachineProviderConfig) (string, error) {
+	hashed := *config
+	hashed.Labels = nil
+	hashed.Tags = nil
+	hashed.UpgradeStrategy = ""
+	b, err := encodingjson.Marshal(&hashed)
+	if err != nil {
+		return "", err
 	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	// See https://github.com/kubernetes/apimachinery/blob/master/pkg/runtime/serializer/json/json.go#L143-L150
-	serializer := json.NewSerializer(json.DefaultMetaFactory, gce.scheme, gce.scheme, false)
-	var status clusterv1.Machine
-	gvk := clusterv1.SchemeGroupVersion.WithKind("Machine")
-	_, _, err := serializer.Decode([]byte(a), &gvk, &status)
+// Records the machine's instance in the machine's provider status, along with
+// the provider config and versions it was created or updated from.
+func (gce *GCEClient) updateInstanceStatus(cluster *clusterv1.Cluster, machine *clusterv1.Machine) error {
+	name, err := gce.instanceName(machine)
 	if err != nil {
-		return nil, fmt.Errorf("decoding failure: %v", err)
+		return err
 	}
+	return gce.recordInstanceStatus(cluster, machine, name, "")
+}
 
-	return instanceStatus(&status), nil
+// Records the instance of the given name as the machine's instance. Instances
+// of managed instance groups are named by GCE rather than after their machine.
+func (gce *GCEClient) recordInstanceStatus(cluster *clusterv1.Cluster, machine *clusterv1.Machine, instanceName string, instanceGroup string) error {
+	if gce.client == nil {
+		return nil
+	}
+	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
+	if err != nil {
+		return err
+	}
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return err
+	}
+	hash, err := providerConfigHash(machineConfig)
+	if err != nil {
+		return err
+	}
+	return gce.storeInstanceStatus(machine, clusterConfig.Project, machineConfig.Zone, instanceName, instanceGroup, hash, machine.Spec.Versions)
 }
 
-// Applies the state of an instance onto a given machine CRD
-func (gce *GCEClient) setMachineInstanceStatus(machine *clusterv1.Machine, status instanceStatus) (*clusterv1.Machine, error) {
-	// Avoid status within status within status ...
-	status.ObjectMeta.Annotations[InstanceStatusAnnotationKey] = ""
+// Records the instance as the machine's instance, created or updated from the
+// provider config with the given hash and the given versions. An upgrade or
+// replacement in the machine's status is kept until it is cleared.
+func (gce *GCEClient) storeInstanceStatus(machine *clusterv1.Machine, project string, zone string, instanceName string, instanceGroup string, hash string, versions clusterv1.MachineVersionInfo) error {
+	if gce.client == nil {
+		return nil
+	}
+	oldStatus, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	instance, err := gce.computeService.InstancesGet(project, zone, instanceName)
+	if err != nil {
+		return fmt.Errorf("error getting instance of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	status := newMachineProviderStatus(project, zone, instance, oldStatus.Conditions)
+	status.Upgrade = oldStatus.Upgrade
+	status.Replacement = oldStatus.Replacement
+	status.InstanceGroup = instanceGroup
+	status.LastAppliedProviderConfigHash = hash
+	if oldStatus.InstanceName == status.InstanceName && oldStatus.InstanceID == status.InstanceID {
+		status.HostKeys = oldStatus.HostKeys
+	}
 
-	// See https://github.com/kubernetes/apimachinery/blob/master/pkg/runtime/serializer/json/json.go#L143-L150
-	serializer := json.NewSerializer(json.DefaultMetaFactory, gce.scheme, gce.scheme, false)
-	b := []byte{}
-	buff := bytes.NewBuffer(b)
-	err := serializer.Encode((*clusterv1.Machine)(status), buff)
+	currentMachine, err := util.GetMachineIfExists(gce.client, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name)
 	if err != nil {
-		return nil, fmt.Errorf("encoding failure: %v", err)
+		return err
+	}
+	if currentMachine == nil {
+		// The current status no longer exists because the matching CRD has been deleted.
+		return fmt.Errorf("Machine has already been deleted. Cannot update current instance status for machine %v", machine.ObjectMeta.Name)
+	}
+	currentMachine.Status.Versions = &versions
+	// The machine now matches its spec, so earlier errors no longer apply.
+	currentMachine.Status.ErrorReason = nil
+	currentMachine.Status.ErrorMessage = nil
+	if err := setMachineProviderStatus(currentMachine, status); err != nil {
+		return err
+	}
+	if err := gce.client.Status().Update(context.Background(), currentMachine); err != nil {
+		return fmt.Errorf("error updating status of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	if removeLegacyMachineAnnotations(currentMachine) {
+		if err := gce.client.Update(context.Background(), currentMachine); err != nil {
+			return fmt.Errorf("error removing legacy annotations of machine %v: %v", machine.ObjectMeta.Name, err)
+		}
+	}
+	return nil
+}
+
+func newMachineProviderStatus(project string, zone string, instance *compute.Instance, conditions []gceconfigv1.GCEMachineProviderCondition) *gceconfigv1.GCEMachineProviderStatus {
+	status := &gceconfigv1.GCEMachineProviderStatus{
+		Project:          project,
+		Zone:             zone,
+		InstanceName:     instance.Name,
+		InstanceSelfLink: instance.SelfLink,
+		InstanceState:    instance.Status,
+		InstanceID:       instanceID(instance),
+	}
+	status.InternalIP, status.ExternalIP = instanceIPs(instance)
+
+	ready := gceconfigv1.GCEMachineProviderCondition{
+		Type:    gceconfigv1.InstanceReady,
+		Status:  corev1.ConditionFalse,
+		Reason:  "InstanceNotRunning",
+		Message: fmt.Sprintf("Instance %v is %v", instance.Name, instance.Status),
 	}
+	if instance.Status == "RUNNING" {
+		ready.Status = corev1.ConditionTrue
+		ready.Reason = "InstanceRunning"
+	}
+	status.Conditions = setCondition(conditions, ready)
+	return status
+}
+
+// Returns the ID GCE assigned to the instance, if any.
+func instanceID(instance *compute.Instance) string {
+	if instance.Id == 0 {
+		return ""
+	}
+	return strconv.FormatUint(instance.Id, 10)
+}
+
+// Returns the IP addresses of the instance's first network interface.
+func instanceIPs(instance *compute.Instance) (internalIP string, externalIP string) {
+	for _, networkInterface := range instance.NetworkInterfaces {
+		if networkInterface.Name == "nic0" {
+			internalIP = networkInterface.NetworkIP
+			for _, accessConfigs := range networkInterface.AccessConfigs {
+				externalIP = accessConfigs.NatIP
+			}
+		}
+	}
+	return internalIP, externalIP
+}
 
-	if machine.ObjectMeta.Annotations == nil {
-		machine.ObjectMeta.Annotations = make(map[string]string)
+// Sets a condition in the list, keeping its last transition time unless its
+// status changed.
+func setCondition(conditions []gceconfigv1.GCEMachineProviderCondition, condition gceconfigv1.GCEMachineProviderCondition) []gceconfigv1.GCEMachineProviderCondition {
+	var result []gceconfigv1.GCEMachineProviderCondition
+	condition.LastTransitionTime = metav1.Now()
+	for _, c := range conditions {
+		if c.Type != condition.Type {
+			result = append(result, c)
+			continue
+		}
+		if c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
 	}
-	machine.ObjectMeta.Annotations[InstanceStatusAnnotationKey] = buff.String()
-	return machine, nil
+	return append(result, condition)
 }
@@ -0,0 +1,233 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCreateRecordsInstanceStatus(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	insert := computeServiceMock.mockInstancesInsert
+	computeServiceMock.mockInstancesInsert = func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+		op, err := insert(project, zone, instance)
+		receivedInstance.Id = 1234
+		receivedInstance.SelfLink = "instances/" + instance.Name
+		receivedInstance.Status = "RUNNING"
+		receivedInstance.NetworkInterfaces = []*compute.NetworkInterface{
+			{
+				Name:          "nic0",
+				NetworkIP:     "10.0.0.2",
+				AccessConfigs: []*compute.AccessConfig{{NatIP: "203.0.113.9"}},
+			},
+		}
+		return op, err
+	}
+	masters := newMasters(t, "master-0")
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, nil, masters...)
+	if err := gce.Create(newDefaultClusterFixture(t), masters[0]); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	stored := getMachine(t, fakeClient, masters[0])
+	status := getMachineProviderStatus(t, stored)
+	expected := gceconfigv1.GCEMachineProviderStatus{
+		Project:          "project-name-2000",
+		Zone:             "us-west5-f",
+		InstanceName:     "master-0",
+		InstanceSelfLink: "instances/master-0",
+		InstanceID:       "1234",
+		InstanceState:    "RUNNING",
+		InternalIP:       "10.0.0.2",
+		ExternalIP:       "203.0.113.9",
+	}
+	if status.Project != expected.Project || status.Zone != expected.Zone || status.InstanceName != expected.InstanceName ||
+		status.InstanceSelfLink != expected.InstanceSelfLink || status.InstanceID != expected.InstanceID ||
+		status.InstanceState != expected.InstanceState || status.InternalIP != expected.InternalIP || status.ExternalIP != expected.ExternalIP {
+		t.Errorf("invalid provider status: expected '%+v' got '%+v'", expected, status)
+	}
+	if status.LastAppliedProviderConfigHash == "" {
+		t.Error("expected the hash of the provider config to be recorded")
+	}
+	if len(status.Conditions) != 1 || status.Conditions[0].Type != gceconfigv1.InstanceReady || status.Conditions[0].Status != corev1.ConditionTrue {
+		t.Errorf("expected the instance to be ready, got conditions '%+v'", status.Conditions)
+	}
+	if stored.Status.Versions == nil || *stored.Status.Versions != masters[0].Spec.Versions {
+		t.Errorf("invalid versions: expected '%v' got '%v'", masters[0].Spec.Versions, stored.Status.Versions)
+	}
+}
+
+func TestUpdateConvertsLegacyAnnotations(t *testing.T) {
+	var deleted, inserted bool
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			return &compute.Instance{Name: instance, Status: "RUNNING"}, nil
+		},
+		mockInstancesDelete: func(project string, zone string, instance string) (*compute.Operation, error) {
+			deleted = true
+			return &compute.Operation{}, nil
+		},
+		mockInstancesInsert: func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+			inserted = true
+			return &compute.Operation{}, nil
+		},
+	}
+	masters := newMasters(t, "master-0")
+	lastApplied := masters[0].DeepCopy()
+	lastApplied.TypeMeta = v1.TypeMeta{APIVersion: "cluster.k8s.io/v1alpha1", Kind: "Machine"}
+	instanceStatus, err := json.Marshal(lastApplied)
+	if err != nil {
+		t.Fatalf("error encoding instance status: %v", err)
+	}
+	masters[0].ObjectMeta.Annotations = map[string]string{
+		google.InstanceStatusAnnotationKey: string(instanceStatus),
+		google.ProjectAnnotationKey:        "project-name-2000",
+		google.ZoneAnnotationKey:           "us-west5-f",
+		google.NameAnnotationKey:           "master-0",
+	}
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, nil, masters...)
+	if err := gce.Update(newDefaultClusterFixture(t), masters[0]); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+
+	if deleted || inserted {
+		t.Error("expected the unchanged machine to keep its instance")
+	}
+	stored := getMachine(t, fakeClient, masters[0])
+	if len(stored.ObjectMeta.Annotations) != 0 {
+		t.Errorf("expected the legacy annotations to be removed, got '%v'", stored.ObjectMeta.Annotations)
+	}
+	status := getMachineProviderStatus(t, stored)
+	if status.InstanceName != "master-0" || status.Zone != "us-west5-f" || status.LastAppliedProviderConfigHash == "" {
+		t.Errorf("invalid provider status: got '%+v'", status)
+	}
+	if stored.Status.Versions == nil || *stored.Status.Versions != masters[0].Spec.Versions {
+		t.Errorf("invalid versions: expected '%v' got '%v'", masters[0].Spec.Versions, stored.Status.Versions)
+	}
+}
+
+func TestRecordingInstanceKeepsUpgrade(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	computeServiceMock.mockInstancesStart = func(project string, zone string, instance string) (*compute.Operation, error) {
+		receivedInstance.Status = "RUNNING"
+		return &compute.Operation{}, nil
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true}
+	master := newStoredMachine(t, "master-0", config)
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), master)
+	cluster := newDefaultClusterFixture(t)
+	if err := gce.Create(cluster, master); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	stored := getMachine(t, fakeClient, master)
+	status := getMachineProviderStatus(t, stored)
+	status.Upgrade = &gceconfigv1.GCEMachineUpgradeStatus{
+		ToControlPlane: "1.10.0",
+		ToKubelet:      "1.10.0",
+		Phase:          gceconfigv1.UpgradeFailed,
+	}
+	setStoredProviderStatus(t, fakeClient, stored, status)
+
+	// Restarting the preempted instance records it again.
+	receivedInstance.Status = "TERMINATED"
+	if err := gce.Update(cluster, getMachine(t, fakeClient, master)); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+	status = getMachineProviderStatus(t, getMachine(t, fakeClient, master))
+	if status.InstanceState != "RUNNING" {
+		t.Errorf("invalid instance state: expected 'RUNNING' got '%v'", status.InstanceState)
+	}
+	if status.Upgrade == nil || status.Upgrade.Phase != gceconfigv1.UpgradeFailed {
+		t.Errorf("expected the failed upgrade to be kept, got '%+v'", status.Upgrade)
+	}
+}
+
+func TestDeleteUsesRecordedInstanceLocation(t *testing.T) {
+	var deletedZone, deletedName string
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			return &compute.Instance{Name: instance}, nil
+		},
+		mockInstancesDelete: func(project string, zone string, instance string) (*compute.Operation, error) {
+			deletedZone, deletedName = zone, instance
+			return &compute.Operation{}, nil
+		},
+	}
+	machine := newMasters(t, "master-0")[0]
+	status, err := json.Marshal(gceconfigv1.GCEMachineProviderStatus{
+		Project:      "project-name-2000",
+		Zone:         "us-east1-b",
+		InstanceName: "master-0-old",
+	})
+	if err != nil {
+		t.Fatalf("error encoding provider status: %v", err)
+	}
+	machine.Status.ProviderStatus = &runtime.RawExtension{Raw: status}
+	gce := newMachineActuator(t, computeServiceMock, nil, nil)
+	if err := gce.Delete(newDefaultClusterFixture(t), machine); err != nil {
+		t.Fatalf("unable to delete machine: %v", err)
+	}
+	if deletedZone != "us-east1-b" || deletedName != "master-0-old" {
+		t.Errorf("expected instance 'master-0-old' in 'us-east1-b' to be deleted, got '%v' in '%v'", deletedName, deletedZone)
+	}
+}
+
+func getMachine(t *testing.T, c client.Client, machine *v1alpha1.Machine) *v1alpha1.Machine {
+	t.Helper()
+	stored := &v1alpha1.Machine{}
+	key := client.ObjectKey{Namespace: machine.Namespace, Name: machine.Name}
+	if err := c.Get(context.Background(), key, stored); err != nil {
+		t.Fatalf("error getting machine: %v", err)
+	}
+	return stored
+}
+
+func getMachineProviderStatus(t *testing.T, machine *v1alpha1.Machine) *gceconfigv1.GCEMachineProviderStatus {
+	t.Helper()
+	if machine.Status.ProviderStatus == nil {
+		t.Fatal("expected the machine to have a provider status")
+	}
+	status := &gceconfigv1.GCEMachineProviderStatus{}
+	if err := json.Unmarshal(machine.Status.ProviderStatus.Raw, status); err != nil {
+		t.Fatalf("error decoding machine provider status: %v", err)
+	}
+	return status
+}
+
+func setStoredProviderStatus(t *testing.T, c client.Client, machine *v1alpha1.Machine, status *gceconfigv1.GCEMachineProviderStatus) {
+	t.Helper()
+	raw, err := json.Marshal(status)
+	if err != nil {
+		t.Fatalf("error encoding provider status: %v", err)
+	}
+	machine.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+	if err := c.Status().Update(context.Background(), machine); err != nil {
+		t.Fatalf("error updating machine: %v", err)
+	}
+}
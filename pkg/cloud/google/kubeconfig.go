@@ -0,0 +1,364 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimachineryerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/cert/triple"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// The user of the kubeconfig kubeadm writes to /etc/kubernetes/admin.conf
+	// on masters, and its group, which the API server authorizes as cluster
+	// admins.
+	kubeConfigUser  = "kubernetes-admin"
+	kubeConfigGroup = "system:masters"
+
+	// The kubeconfig of a cluster is stored in the secret named after the
+	// cluster with this suffix, under the value key.
+	KubeConfigSecretSuffix = "-kubeconfig"
+	KubeConfigSecretKey    = "value"
+
+	// The client certificate of a stored kubeconfig is reused until it
+	// expires within this duration.
+	kubeConfigCertRenewal = 30 * 24 * time.Hour
+)
+
+// GCEClientKubeConfigGetter retrieves an admin kubeconfig of a cluster.
+type GCEClientKubeConfigGetter interface {
+	GetKubeConfig(cluster *clusterv1.Cluster, master *clusterv1.Machine) (string, error)
+}
+
+// GCEClientTargetClusterClientGetter returns a client of the API server of the
+// cluster a machine belongs to.
+type GCEClientTargetClusterClientGetter interface {
+	GetTargetClusterClient(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (kubernetes.Interface, error)
+}
+
+// Returns an admin kubeconfig of the cluster, and stores it in the cluster's
+// kubeconfig secret. Unless another kubeconfig getter was configured, the
+// kubeconfig is generated from the cluster CA, and only read from the master
+// over SSH if that fails.
+func (gce *GCEClient) GetKubeConfig(cluster *clusterv1.Cluster, master *clusterv1.Machine) (string, error) {
+	var kubeConfig string
+	var err error
+	if gce.kubeConfigGetter != nil {
+		kubeConfig, err = gce.kubeConfigGetter.GetKubeConfig(cluster, master)
+	} else {
+		kubeConfig, err = gce.kubeConfigFromCA(cluster, master)
+		if err != nil {
+			glog.Infof("Cannot generate kubeconfig of cluster %v, reading it from master %v over SSH: %v", cluster.Name, master.Name, err)
+			kubeConfig, err = gce.kubeConfigOverSSH(cluster, master)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := gce.storeKubeConfig(cluster, kubeConfig); err != nil {
+		return "", err
+	}
+	return kubeConfig, nil
+}
+
+// Generates a kubeconfig that authenticates to the API server of the cluster
+// with a client certificate of a cluster admin, signed by the cluster CA. The
+// kubeconfig stored in the cluster's kubeconfig secret is returned instead as
+// long as it still applies and its certificate is not about to expire.
+func (gce *GCEClient) kubeConfigFromCA(cluster *clusterv1.Cluster, master *clusterv1.Machine) (string, error) {
+	instance, err := gce.masterInstance(cluster, master)
+	if err != nil {
+		return "", err
+	}
+	ca, err := gce.clusterCA(instance)
+	if err != nil {
+		return "", err
+	}
+	server := apiServerURL(cluster, instance)
+	if gce.client != nil {
+		kubeConfig, err := gce.storedKubeConfig(cluster)
+		if err != nil {
+			return "", err
+		}
+		if kubeConfig != "" && isReusableKubeConfig(kubeConfig, server, ca) {
+			return kubeConfig, nil
+		}
+	}
+	clientKeyPair, err := triple.NewClientKeyPair(ca, kubeConfigUser, []string{kubeConfigGroup})
+	if err != nil {
+		return "", err
+	}
+
+	contextName := fmt.Sprintf("%s@%s", kubeConfigUser, cluster.Name)
+	config := clientcmdv1.Config{
+		Kind:       "Config",
+		APIVersion: "v1",
+		Clusters: []clientcmdv1.NamedCluster{{
+			Name: cluster.Name,
+			Cluster: clientcmdv1.Cluster{
+				Server:                   server,
+				CertificateAuthorityData: certutil.EncodeCertPEM(ca.Cert),
+			},
+		}},
+		AuthInfos: []clientcmdv1.NamedAuthInfo{{
+			Name: kubeConfigUser,
+			AuthInfo: clientcmdv1.AuthInfo{
+				ClientCertificateData: certutil.EncodeCertPEM(clientKeyPair.Cert),
+				ClientKeyData:         certutil.EncodePrivateKeyPEM(clientKeyPair.Key),
+			},
+		}},
+		Contexts: []clientcmdv1.NamedContext{{
+			Name: contextName,
+			Context: clientcmdv1.Context{
+				Cluster:  cluster.Name,
+				AuthInfo: kubeConfigUser,
+			},
+		}},
+		CurrentContext: contextName,
+	}
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("error encoding kubeconfig: %v", err)
+	}
+	return string(b), nil
+}
+
+// Returns whether the kubeconfig points at the server and authenticates with
+// a client certificate of the CA that does not expire soon.
+func isReusableKubeConfig(kubeConfig string, server string, ca *triple.KeyPair) bool {
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeConfig))
+	if err != nil {
+		return false
+	}
+	if config.Host != server || !bytes.Equal(config.CAData, certutil.EncodeCertPEM(ca.Cert)) {
+		return false
+	}
+	certs, err := certutil.ParseCertsPEM(config.CertData)
+	if err != nil {
+		return false
+	}
+	if err := certs[0].CheckSignatureFrom(ca.Cert); err != nil {
+		return false
+	}
+	return time.Until(certs[0].NotAfter) > kubeConfigCertRenewal
+}
+
+// Returns the CA the actuator was given, or else the one the master was
+// created with, which it keeps in its metadata.
+func (gce *GCEClient) clusterCA(instance *compute.Instance) (*triple.KeyPair, error) {
+	var certPEM, keyPEM []byte
+	if ca := gce.certificateAuthority; ca != nil {
+		certPEM, keyPEM = ca.Certificate, ca.PrivateKey
+	} else {
+		shared, err := sharedCertificatesFromInstance(instance)
+		if err != nil {
+			return nil, err
+		}
+		if certPEM, err = base64.StdEncoding.DecodeString(shared["ca-cert"]); err != nil {
+			return nil, fmt.Errorf("error decoding CA certificate of master %v: %v", instance.Name, err)
+		}
+		if keyPEM, err = base64.StdEncoding.DecodeString(shared["ca-key"]); err != nil {
+			return nil, fmt.Errorf("error decoding CA key of master %v: %v", instance.Name, err)
+		}
+	}
+
+	certs, err := certutil.ParseCertsPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA certificate: %v", err)
+	}
+	key, err := certutil.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CA key is not an RSA key")
+	}
+	return &triple.KeyPair{Cert: certs[0], Key: rsaKey}, nil
+}
+
+// The URL of the API server: the cluster's API endpoint, or the address of
+// the master while the cluster has none.
+func apiServerURL(cluster *clusterv1.Cluster, instance *compute.Instance) string {
+	if len(cluster.Status.APIEndpoints) > 0 {
+		return "https://" + getEndpoint(cluster.Status.APIEndpoints[0])
+	}
+	internalIP, publicIP := instanceIPs(instance)
+	if publicIP == "" {
+		return fmt.Sprintf("https://%s:%d", internalIP, apiServerPort)
+	}
+	return fmt.Sprintf("https://%s:%d", publicIP, apiServerPort)
+}
+
+func (gce *GCEClient) masterInstance(cluster *clusterv1.Cluster, master *clusterv1.Machine) (*compute.Instance, error) {
+	machineConfig, err := machineProviderFromProviderConfig(master.Spec.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	status, err := gce.machineProviderStatus(master)
+	if err != nil {
+		return nil, err
+	}
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, master)
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance of master %v: %v", master.Name, err)
+	}
+	return instance, nil
+}
+
+// Reads the kubeconfig kubeadm wrote on the master.
+func (gce *GCEClient) kubeConfigOverSSH(cluster *clusterv1.Cluster, master *clusterv1.Machine) (string, error) {
+	machineConfig, err := machineProviderFromProviderConfig(master.Spec.ProviderConfig)
+	if err != nil {
+		return "", err
+	}
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return "", err
+	}
+	status, err := gce.machineProviderStatus(master)
+	if err != nil {
+		return "", err
+	}
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, master)
+
+	// The kubeconfig holds the credentials of a cluster admin, so it is
+	// kept out of the logs.
+	kubeConfig, err := gce.sshCommand(project, zone, name, "sudo cat "+adminKubeConfig, true, master)
+	if err != nil {
+		return "", fmt.Errorf("error reading kubeconfig from master %v over SSH: %v", master.Name, err)
+	}
+	if kubeConfig == "" {
+		return "", fmt.Errorf("master %v has no kubeconfig yet", master.Name)
+	}
+	return kubeConfig, nil
+}
+
+// Returns a client of the API server of the cluster the machine belongs to.
+// Unless another getter was configured, it authenticates with the kubeconfig
+// stored in the cluster's kubeconfig secret, which is first stored from the
+// oldest master if there is none yet.
+func (gce *GCEClient) targetClusterClient(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (kubernetes.Interface, error) {
+	if gce.targetClusterClientGetter != nil {
+		return gce.targetClusterClientGetter.GetTargetClusterClient(cluster, machine)
+	}
+	if gce.client == nil {
+		return nil, fmt.Errorf("cannot reach cluster %v without a client to find its kubeconfig", cluster.Name)
+	}
+	kubeConfig, err := gce.storedKubeConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if kubeConfig == "" {
+		masters, err := gce.listMasters(machine)
+		if err != nil {
+			return nil, err
+		}
+		if len(masters) == 0 {
+			return nil, fmt.Errorf("cluster %v has no master", cluster.Name)
+		}
+		if kubeConfig, err = gce.GetKubeConfig(cluster, &masters[0]); err != nil {
+			return nil, err
+		}
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeConfig))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kubeconfig of cluster %v: %v", cluster.Name, err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Returns the kubeconfig stored in the kubeconfig secret of the cluster, or
+// an empty string if there is none.
+func (gce *GCEClient) storedKubeConfig(cluster *clusterv1.Cluster) (string, error) {
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: cluster.Namespace, Name: cluster.Name + KubeConfigSecretSuffix}
+	if err := gce.client.Get(context.Background(), key, secret); err != nil {
+		if apimachineryerrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error getting kubeconfig of cluster %v: %v", cluster.Name, err)
+	}
+	return string(secret.Data[KubeConfigSecretKey]), nil
+}
+
+// Creates or updates the kubeconfig secret of the cluster in its namespace,
+// owned by the cluster. A secret that already holds the kubeconfig is not
+// updated. Actuators without a client, like clusterctl's, leave it alone.
+func (gce *GCEClient) storeKubeConfig(cluster *clusterv1.Cluster, kubeConfig string) error {
+	if gce.client == nil {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: cluster.Namespace, Name: cluster.Name + KubeConfigSecretSuffix}
+	err := gce.client.Get(context.Background(), key, secret)
+	switch {
+	case apimachineryerrors.IsNotFound(err):
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: clusterv1.SchemeGroupVersion.String(),
+						Kind:       "Cluster",
+						Name:       cluster.Name,
+						UID:        cluster.UID,
+					},
+				},
+			},
+			Data: map[string][]byte{
+				KubeConfigSecretKey: []byte(kubeConfig),
+			},
+		}
+		err = gce.client.Create(context.Background(), secret)
+	case err == nil:
+		if string(secret.Data[KubeConfigSecretKey]) == kubeConfig {
+			return nil
+		}
+		secret.Data = map[string][]byte{
+			KubeConfigSecretKey: []byte(kubeConfig),
+		}
+		err = gce.client.Update(context.Background(), secret)
+	}
+	if err != nil {
+		return fmt.Errorf("error storing kubeconfig of cluster %v: %v", cluster.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	certutil "k8s.io/client-go/util/cert"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/cert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestGetKubeConfigFromCA(t *testing.T) {
+	ca, err := cert.Load("testdata/ca")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			return &compute.Instance{Name: instance}, nil
+		},
+	}
+	gce := newMachineActuator(t, computeServiceMock, ca, nil)
+	cluster := newDefaultClusterFixture(t)
+	cluster.Status.APIEndpoints = []v1alpha1.APIEndpoint{{Host: "203.0.113.10", Port: 443}}
+	master := newMachine(t, newGCEMachineProviderConfigFixture())
+
+	kubeConfig, err := gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+	checkKubeConfig(t, kubeConfig, "https://203.0.113.10:443", ca.Certificate)
+}
+
+func TestGetKubeConfigFromMasterCA(t *testing.T) {
+	ca, err := cert.Load("testdata/ca")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gce, fakeClient, cluster, master := newKubeConfigMaster(t, ca)
+
+	kubeConfig, err := gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+	checkKubeConfig(t, kubeConfig, "https://203.0.113.20:443", ca.Certificate)
+
+	if secret := getKubeConfigSecret(t, fakeClient); string(secret.Data["value"]) != kubeConfig {
+		t.Errorf("expected the kubeconfig to be stored, got '%s'", secret.Data["value"])
+	}
+}
+
+func TestGetKubeConfigReusesStoredCertificate(t *testing.T) {
+	ca, err := cert.Load("testdata/ca")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gce, fakeClient, cluster, master := newKubeConfigMaster(t, ca)
+
+	kubeConfig, err := gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+	again, err := gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig again: %v", err)
+	}
+	if again != kubeConfig {
+		t.Errorf("expected the stored kubeconfig to be reused")
+	}
+	if stored := getKubeConfigSecret(t, fakeClient); string(stored.Data["value"]) != kubeConfig {
+		t.Errorf("expected the kubeconfig secret to keep the kubeconfig")
+	}
+
+	// A new API endpoint needs a new kubeconfig.
+	cluster.Status.APIEndpoints = []v1alpha1.APIEndpoint{{Host: "203.0.113.30", Port: 443}}
+	kubeConfig, err = gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+	checkKubeConfig(t, kubeConfig, "https://203.0.113.30:443", ca.Certificate)
+}
+
+func TestGetKubeConfigRenewsExpiringCertificate(t *testing.T) {
+	ca, err := cert.Load("testdata/ca")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gce, fakeClient, cluster, master := newKubeConfigMaster(t, ca)
+	kubeConfig, err := gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+
+	// Replace the client certificate with one that expires tomorrow.
+	config, err := clientcmd.Load([]byte(kubeConfig))
+	if err != nil {
+		t.Fatalf("unable to parse kubeconfig: %v", err)
+	}
+	authInfo := config.AuthInfos[config.Contexts[config.CurrentContext].AuthInfo]
+	expiring := newExpiringClientCert(t, ca, authInfo.ClientKeyData, 24*time.Hour)
+	b := []byte(strings.Replace(kubeConfig,
+		base64.StdEncoding.EncodeToString(authInfo.ClientCertificateData),
+		base64.StdEncoding.EncodeToString(expiring), 1))
+	secret := getKubeConfigSecret(t, fakeClient)
+	secret.Data["value"] = b
+	if err := fakeClient.Update(context.Background(), secret); err != nil {
+		t.Fatalf("unable to update kubeconfig secret: %v", err)
+	}
+
+	renewed, err := gce.GetKubeConfig(cluster, master)
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+	if renewed == string(b) {
+		t.Fatalf("expected the expiring certificate to be renewed")
+	}
+	checkKubeConfig(t, renewed, "https://203.0.113.20:443", ca.Certificate)
+	if stored := getKubeConfigSecret(t, fakeClient); string(stored.Data["value"]) != renewed {
+		t.Errorf("expected the renewed kubeconfig to be stored")
+	}
+}
+
+func TestGetKubeConfigOverSSH(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	adminConf := "apiVersion: v1\nkind: Config\nusers:\n- name: kubernetes-admin"
+	server.Respond(sshResponses{output: map[string]string{"admin.conf": adminConf + "\n"}})
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), time.Minute)
+	cluster.ObjectMeta.Namespace = "default"
+	server.Commands()
+
+	// The master has no CA to generate a kubeconfig from.
+	kubeConfig, err := gce.GetKubeConfig(cluster, getMachine(t, fakeClient, master))
+	if err != nil {
+		t.Fatalf("unable to get kubeconfig: %v", err)
+	}
+	if kubeConfig != adminConf {
+		t.Errorf("expected the kubeconfig of the master, got '%v'", kubeConfig)
+	}
+	if commands := server.Commands(); len(commands) != 1 || commands[0] != "sudo cat /etc/kubernetes/admin.conf" {
+		t.Errorf("expected the kubeconfig to be read over SSH, got '%v'", commands)
+	}
+}
+
+// Returns an actuator with a stored master, the instance of which keeps the
+// CA in its metadata and has the public IP 203.0.113.20. The cluster has no
+// API endpoint yet.
+func newKubeConfigMaster(t *testing.T, ca *cert.CertificateAuthority) (*google.GCEClient, client.Client, *v1alpha1.Cluster, *v1alpha1.Machine) {
+	caCert := base64.StdEncoding.EncodeToString(ca.Certificate)
+	caKey := base64.StdEncoding.EncodeToString(ca.PrivateKey)
+	metadata := &compute.Metadata{}
+	for _, key := range []string{"etcd-ca-cert", "etcd-ca-key", "front-proxy-ca-cert", "front-proxy-ca-key", "sa-key", "sa-pub"} {
+		value := "unused"
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: key, Value: &value})
+	}
+	metadata.Items = append(metadata.Items,
+		&compute.MetadataItems{Key: "ca-cert", Value: &caCert},
+		&compute.MetadataItems{Key: "ca-key", Value: &caKey})
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			return &compute.Instance{
+				Name:     instance,
+				Metadata: metadata,
+				NetworkInterfaces: []*compute.NetworkInterface{{
+					Name:          "nic0",
+					NetworkIP:     "10.0.0.2",
+					AccessConfigs: []*compute.AccessConfig{{NatIP: "203.0.113.20"}},
+				}},
+			}, nil
+		},
+	}
+	master := newStoredMachine(t, "master-0", newGCEMachineProviderConfigFixture())
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, nil, master)
+	cluster := newDefaultClusterFixture(t)
+	cluster.ObjectMeta.Namespace = "default"
+	cluster.Status.APIEndpoints = nil
+	return gce, fakeClient, cluster, master
+}
+
+func getKubeConfigSecret(t *testing.T, c client.Client) *corev1.Secret {
+	t.Helper()
+	secret := &corev1.Secret{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "cluster-test-kubeconfig"}, secret); err != nil {
+		t.Fatalf("unable to get kubeconfig secret: %v", err)
+	}
+	return secret
+}
+
+// Returns a PEM encoded client certificate of a cluster admin for the key,
+// signed by the CA and valid for the given duration.
+func newExpiringClientCert(t *testing.T, ca *cert.CertificateAuthority, keyPEM []byte, validity time.Duration) []byte {
+	t.Helper()
+	key, err := certutil.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		t.Fatalf("unable to parse client key: %v", err)
+	}
+	caCerts, err := certutil.ParseCertsPEM(ca.Certificate)
+	if err != nil {
+		t.Fatalf("unable to parse CA certificate: %v", err)
+	}
+	caKey, err := certutil.ParsePrivateKeyPEM(ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("unable to parse CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kubernetes-admin", Organization: []string{"system:masters"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCerts[0], key.(*rsa.PrivateKey).Public(), caKey)
+	if err != nil {
+		t.Fatalf("unable to create client certificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: certutil.CertificateBlockType, Bytes: der})
+}
+
+// Checks that the kubeconfig points at the server and authenticates as a
+// cluster admin with a certificate signed by the CA.
+func checkKubeConfig(t *testing.T, kubeConfig string, server string, caCert []byte) {
+	t.Helper()
+	config, err := clientcmd.Load([]byte(kubeConfig))
+	if err != nil {
+		t.Fatalf("unable to parse kubeconfig: %v", err)
+	}
+	context := config.Contexts[config.CurrentContext]
+	if context == nil {
+		t.Fatalf("kubeconfig has no current context")
+	}
+	cluster := config.Clusters[context.Cluster]
+	if cluster == nil {
+		t.Fatalf("kubeconfig has no cluster")
+	}
+	if cluster.Server != server {
+		t.Errorf("invalid server: expected '%v' got '%v'", server, cluster.Server)
+	}
+	if string(cluster.CertificateAuthorityData) != string(caCert) {
+		t.Errorf("expected the cluster CA certificate")
+	}
+	authInfo := config.AuthInfos[context.AuthInfo]
+	if authInfo == nil {
+		t.Fatalf("kubeconfig has no user")
+	}
+	certs, err := certutil.ParseCertsPEM(authInfo.ClientCertificateData)
+	if err != nil {
+		t.Fatalf("unable to parse client certificate: %v", err)
+	}
+	caCerts, err := certutil.ParseCertsPEM(caCert)
+	if err != nil {
+		t.Fatalf("unable to parse CA certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCerts[0])
+	_, err = certs[0].Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Errorf("client certificate is not signed by the CA: %v", err)
+	}
+	if len(certs[0].Subject.Organization) != 1 || certs[0].Subject.Organization[0] != "system:masters" {
+		t.Errorf("invalid client certificate organization: expected 'system:masters' got '%v'", certs[0].Subject.Organization)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// The labels every instance gets, so that costs can be attributed to
+// clusters and machines.
+const (
+	ClusterNameLabelKey      = "cluster-name"
+	MachineNamespaceLabelKey = "machine-namespace"
+	MachineNameLabelKey      = "machine-name"
+)
+
+var invalidLabelValueCharsRegexp = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// Turns a Kubernetes name into a GCE label value, which may only hold lower
+// case letters, digits, '-' and '_', and at most 63 characters.
+func labelValue(name string) string {
+	value := invalidLabelValueCharsRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return value
+}
+
+// Returns the labels of the machine's instance. The labels the provider sets
+// take precedence over those of the provider config. Instance templates are
+// shared by the machines of a MachineSet, so they are given no machine name,
+// and their instances are labeled with it once a machine claims them.
+func newLabels(cluster *clusterv1.Cluster, namespace string, machineName string, config *gceconfigv1.GCEMachineProviderConfig) map[string]string {
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels[ClusterNameLabelKey] = labelValue(cluster.Name)
+	labels[MachineNamespaceLabelKey] = labelValue(namespace)
+	if machineName != "" {
+		labels[MachineNameLabelKey] = labelValue(machineName)
+	}
+	return labels
+}
+
+// Returns the network tags of the machine's instance, the ones the provider
+// sets first.
+func newTags(cluster *clusterv1.Cluster, config *gceconfigv1.GCEMachineProviderConfig) *compute.Tags {
+	items := []string{
+		"https-server",
+		fmt.Sprintf("%s-worker", cluster.Name),
+	}
+	for _, tag := range config.Tags {
+		if !sets.NewString(items...).Has(tag) {
+			items = append(items, tag)
+		}
+	}
+	return &compute.Tags{Items: items}
+}
+
+// Adds the metadata items of the provider config to the instance metadata.
+// The items the provider sets take precedence.
+func setInstanceMetadata(config *gceconfigv1.GCEMachineProviderConfig, metadata map[string]string) {
+	for k, v := range config.InstanceMetadata {
+		if _, ok := metadata[k]; !ok {
+			metadata[k] = v
+		}
+	}
+}
+
+// Brings the labels and tags of the machine's instance in line with its
+// provider config. They are updated in place rather than by recreating the
+// instance. Returns false if they already matched.
+func (gce *GCEClient) updateLabelsAndTags(cluster *clusterv1.Cluster, machine *clusterv1.Machine, config *gceconfigv1.GCEMachineProviderConfig, project string, zone string, instance *compute.Instance) (bool, error) {
+	updated := false
+	labels := newLabels(cluster, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name, config)
+	if value, ok := instance.Labels[BootstrapLabelKey]; ok {
+		labels[BootstrapLabelKey] = value
+	}
+	if !(len(labels) == 0 && len(instance.Labels) == 0) && !reflect.DeepEqual(labels, instance.Labels) {
+		glog.Infof("Updating labels of instance %v of machine %v.", instance.Name, machine.ObjectMeta.Name)
+		op, err := gce.computeService.InstancesSetLabels(project, zone, instance.Name, &compute.InstancesSetLabelsRequest{
+			Labels:           labels,
+			LabelFingerprint: instance.LabelFingerprint,
+		})
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return false, fmt.Errorf("error setting labels of instance %v: %v", instance.Name, err)
+		}
+		updated = true
+	}
+
+	tags := newTags(cluster, config)
+	var currentTags []string
+	var fingerprint string
+	if instance.Tags != nil {
+		currentTags, fingerprint = instance.Tags.Items, instance.Tags.Fingerprint
+	}
+	if !sets.NewString(tags.Items...).Equal(sets.NewString(currentTags...)) {
+		glog.Infof("Updating network tags of instance %v of machine %v.", instance.Name, machine.ObjectMeta.Name)
+		tags.Fingerprint = fingerprint
+		op, err := gce.computeService.InstancesSetTags(project, zone, instance.Name, tags)
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return false, fmt.Errorf("error setting network tags of instance %v: %v", instance.Name, err)
+		}
+		updated = true
+	}
+
+	if updated {
+		gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Updated", "Updated labels and tags of Machine %v", machine.Name)
+	}
+	return updated, nil
+}
+
+// Updates the labels and tags of the machine's instance, which is located
+// through the machine's provider status.
+func (gce *GCEClient) updateInstanceLabelsAndTags(cluster *clusterv1.Cluster, machine *clusterv1.Machine, config *gceconfigv1.GCEMachineProviderConfig, status *gceconfigv1.GCEMachineProviderStatus) (bool, error) {
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return false, err
+	}
+	project, zone, name := instanceLocation(status, clusterConfig, config, machine)
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
+	if err != nil {
+		return false, fmt.Errorf("error getting instance of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	return gce.updateLabelsAndTags(cluster, machine, config, project, zone, instance)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+)
+
+func TestInstanceLabelsTagsAndMetadata(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Labels = map[string]string{"team": "platform"}
+	config.Tags = []string{"allow-ssh", "https-server"}
+	config.InstanceMetadata = map[string]string{"serial-port-enable": "TRUE", "startup-script": "echo replaced"}
+	machine := newStoredMachine(t, "Node.0", config)
+	if err := createCluster(t, machine, computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	expectedLabels := map[string]string{
+		"team":              "platform",
+		"cluster-name":      "cluster-test",
+		"machine-namespace": "default",
+		"machine-name":      "node-0",
+		"bootstrap":         "true",
+	}
+	if len(receivedInstance.Labels) != len(expectedLabels) {
+		t.Errorf("invalid labels: expected '%v' got '%v'", expectedLabels, receivedInstance.Labels)
+	}
+	for k, v := range expectedLabels {
+		if receivedInstance.Labels[k] != v {
+			t.Errorf("invalid label %v: expected '%v' got '%v'", k, v, receivedInstance.Labels[k])
+		}
+	}
+	expectedTags := []string{"https-server", "cluster-test-worker", "allow-ssh"}
+	if len(receivedInstance.Tags.Items) != len(expectedTags) {
+		t.Fatalf("invalid tags: expected '%v' got '%v'", expectedTags, receivedInstance.Tags.Items)
+	}
+	for i, tag := range expectedTags {
+		if receivedInstance.Tags.Items[i] != tag {
+			t.Errorf("invalid tag %v: expected '%v' got '%v'", i, tag, receivedInstance.Tags.Items[i])
+		}
+	}
+	if value := getMetadataItem(t, receivedInstance.Metadata, "serial-port-enable").Value; *value != "TRUE" {
+		t.Errorf("invalid serial-port-enable metadata: expected 'TRUE' got '%v'", *value)
+	}
+	if value := getMetadataItem(t, receivedInstance.Metadata, "startup-script").Value; *value == "echo replaced" {
+		t.Error("expected the startup script not to be replaced")
+	}
+}
+
+func TestUpdateChangesLabelsAndTagsInPlace(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	var inserted, deleted int
+	insert := computeServiceMock.mockInstancesInsert
+	computeServiceMock.mockInstancesInsert = func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+		inserted++
+		return insert(project, zone, instance)
+	}
+	computeServiceMock.mockInstancesDelete = func(project string, zone string, instance string) (*compute.Operation, error) {
+		deleted++
+		return &compute.Operation{}, nil
+	}
+	var labelsRequest *compute.InstancesSetLabelsRequest
+	computeServiceMock.mockInstancesSetLabels = func(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+		labelsRequest = request
+		receivedInstance.Labels = request.Labels
+		return &compute.Operation{}, nil
+	}
+	var tags *compute.Tags
+	computeServiceMock.mockInstancesSetTags = func(project string, zone string, instance string, t *compute.Tags) (*compute.Operation, error) {
+		tags = t
+		receivedInstance.Tags = t
+		return &compute.Operation{}, nil
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Labels = map[string]string{"team": "platform"}
+	machine := newStoredMachine(t, "node-0", config)
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machine)
+	cluster := newDefaultClusterFixture(t)
+	if err := gce.Create(cluster, machine); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	receivedInstance.LabelFingerprint = "fingerprint"
+
+	config.Labels = map[string]string{"team": "data"}
+	config.Tags = []string{"allow-ssh"}
+	stored := getMachine(t, fakeClient, machine)
+	stored.Spec.ProviderConfig = newStoredMachine(t, "node-0", config).Spec.ProviderConfig
+	if err := gce.Update(cluster, stored); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+
+	if inserted != 1 || deleted != 0 {
+		t.Errorf("expected the instance to be updated in place, got %v inserts and %v deletes", inserted, deleted)
+	}
+	if labelsRequest == nil || labelsRequest.Labels["team"] != "data" || labelsRequest.Labels["machine-name"] != "node-0" {
+		t.Errorf("expected the labels to be set, got '%+v'", labelsRequest)
+	} else if labelsRequest.LabelFingerprint != "fingerprint" {
+		t.Errorf("invalid label fingerprint: expected 'fingerprint' got '%v'", labelsRequest.LabelFingerprint)
+	}
+	if tags == nil || len(tags.Items) != 3 || tags.Items[2] != "allow-ssh" {
+		t.Errorf("expected the tags to be set, got '%+v'", tags)
+	}
+
+	// Labels and tags that match are left alone.
+	labelsRequest, tags = nil, nil
+	stored = getMachine(t, fakeClient, stored)
+	stored.Spec.ProviderConfig = newStoredMachine(t, "node-0", config).Spec.ProviderConfig
+	if err := gce.Update(cluster, stored); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+	if labelsRequest != nil || tags != nil {
+		t.Errorf("expected matching labels and tags to be left alone, got '%+v' and '%+v'", labelsRequest, tags)
+	}
+}
@@ -0,0 +1,412 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	compute "google.golang.org/api/compute/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	apiServerPort     = 443
+	apiServerPortName = "https"
+
+	loadBalancerSuffix = "-apiserver"
+)
+
+// Returns the name shared by the global address, health check, backend
+// service, target proxy and forwarding rule of the cluster's control plane
+// load balancer. Each of them lives in its own namespace, so they don't clash.
+func loadBalancerName(cluster *clusterv1.Cluster) string {
+	return cluster.Name + loadBalancerSuffix
+}
+
+// Returns the name of the unmanaged instance group that holds the cluster's
+// masters in the given zone.
+func masterInstanceGroupName(cluster *clusterv1.Cluster, zone string) string {
+	return fmt.Sprintf("%s-master-%s", cluster.Name, zone)
+}
+
+func masterInstanceGroupPath(project string, zone string, name string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/instanceGroups/%s", project, zone, name)
+}
+
+// Returns the host of the cluster's control plane endpoint, or an empty
+// string if the cluster has no load balancer.
+func controlPlaneEndpointHost(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) string {
+	if !clusterConfig.LoadBalancer || len(cluster.Status.APIEndpoints) == 0 {
+		return ""
+	}
+	return cluster.Status.APIEndpoints[0].Host
+}
+
+// Creates the cluster's control plane load balancer: a global address, a TCP
+// health check, a backend service, a target TCP proxy and a forwarding rule
+// for port 443. The address is then written into the cluster's API endpoints,
+// and the load balancer's resources are recorded in the status. Masters add
+// their instance group to the backend service as they are created.
+func (gce *GCEClusterClient) reconcileLoadBalancer(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, status *gceconfigv1.GCEClusterProviderStatus) error {
+	if !clusterConfig.LoadBalancer {
+		return nil
+	}
+	project := clusterConfig.Project
+	name := loadBalancerName(cluster)
+	if status.LoadBalancer == nil || status.LoadBalancer.Name != name {
+		status.LoadBalancer = &gceconfigv1.LoadBalancerStatus{Name: name}
+	}
+	lbStatus := status.LoadBalancer
+
+	address, err := gce.reserveAddress(project, name)
+	if err != nil {
+		return err
+	}
+	lbStatus.Address = address.Address
+	lbStatus.AddressSelfLink = address.SelfLink
+
+	healthCheck, err := gce.computeService.HealthChecksGet(project, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting health check %v: %v", name, err)
+	}
+	if err == nil {
+		lbStatus.HealthCheckSelfLink = healthCheck.SelfLink
+	} else {
+		glog.Infof("Creating health check %v.", name)
+		lbStatus.HealthCheckSelfLink, err = gce.insertAndWait(project, name, "health check", func() (*compute.Operation, error) {
+			return gce.computeService.HealthChecksInsert(project, &compute.HealthCheck{
+				Name: name,
+				Type: "TCP",
+				TcpHealthCheck: &compute.TCPHealthCheck{
+					Port: apiServerPort,
+				},
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	backendService, err := gce.computeService.BackendServicesGet(project, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting backend service %v: %v", name, err)
+	}
+	if err == nil {
+		lbStatus.BackendServiceSelfLink = backendService.SelfLink
+	} else {
+		glog.Infof("Creating backend service %v.", name)
+		lbStatus.BackendServiceSelfLink, err = gce.insertAndWait(project, name, "backend service", func() (*compute.Operation, error) {
+			return gce.computeService.BackendServicesInsert(project, &compute.BackendService{
+				Name:                name,
+				Protocol:            "TCP",
+				PortName:            apiServerPortName,
+				LoadBalancingScheme: "EXTERNAL",
+				HealthChecks:        []string{fmt.Sprintf("global/healthChecks/%s", name)},
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	proxy, err := gce.computeService.TargetTcpProxiesGet(project, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting target TCP proxy %v: %v", name, err)
+	}
+	if err == nil {
+		lbStatus.TargetProxySelfLink = proxy.SelfLink
+	} else {
+		glog.Infof("Creating target TCP proxy %v.", name)
+		lbStatus.TargetProxySelfLink, err = gce.insertAndWait(project, name, "target TCP proxy", func() (*compute.Operation, error) {
+			return gce.computeService.TargetTcpProxiesInsert(project, &compute.TargetTcpProxy{
+				Name:    name,
+				Service: fmt.Sprintf("global/backendServices/%s", name),
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	forwardingRule, err := gce.computeService.GlobalForwardingRulesGet(project, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting forwarding rule %v: %v", name, err)
+	}
+	if err == nil {
+		lbStatus.ForwardingRuleSelfLink = forwardingRule.SelfLink
+	} else {
+		glog.Infof("Creating forwarding rule %v.", name)
+		lbStatus.ForwardingRuleSelfLink, err = gce.insertAndWait(project, name, "forwarding rule", func() (*compute.Operation, error) {
+			return gce.computeService.GlobalForwardingRulesInsert(project, &compute.ForwardingRule{
+				Name:       name,
+				IPAddress:  address.Address,
+				IPProtocol: "TCP",
+				PortRange:  fmt.Sprintf("%d", apiServerPort),
+				Target:     fmt.Sprintf("global/targetTcpProxies/%s", name),
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	setAPIEndpoint(cluster, address.Address)
+	return nil
+}
+
+// Returns the global address with the given name, reserving it first if
+// necessary.
+func (gce *GCEClusterClient) reserveAddress(project string, name string) (*compute.Address, error) {
+	address, err := gce.computeService.GlobalAddressesGet(project, name)
+	if err == nil {
+		return address, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("error getting address %v: %v", name, err)
+	}
+	glog.Infof("Reserving address %v.", name)
+	_, err = gce.insertAndWait(project, name, "address", func() (*compute.Operation, error) {
+		return gce.computeService.GlobalAddressesInsert(project, &compute.Address{Name: name})
+	})
+	if err != nil {
+		return nil, err
+	}
+	address, err = gce.computeService.GlobalAddressesGet(project, name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting address %v: %v", name, err)
+	}
+	return address, nil
+}
+
+// Runs the given insert call and waits for it to complete. Returns the URL of
+// the created resource.
+func (gce *GCEClusterClient) insertAndWait(project string, name string, kind string, insert func() (*compute.Operation, error)) (string, error) {
+	op, err := insert()
+	if err != nil {
+		return "", fmt.Errorf("error creating %v %v: %v", kind, name, err)
+	}
+	if err := gce.computeService.WaitForOperation(project, op); err != nil {
+		return "", fmt.Errorf("error waiting for %v %v creation: %v", kind, name, err)
+	}
+	return targetLink(op), nil
+}
+
+// Makes the load balancer address the cluster's only API endpoint. The
+// cluster actuator writes it along with the rest of the cluster status.
+func setAPIEndpoint(cluster *clusterv1.Cluster, address string) {
+	cluster.Status.APIEndpoints = []clusterv1.APIEndpoint{
+		{
+			Host: address,
+			Port: apiServerPort,
+		},
+	}
+}
+
+// Deletes the cluster's control plane load balancer, including the masters'
+// instance groups, in the reverse order of creation.
+func (gce *GCEClusterClient) deleteLoadBalancer(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) error {
+	if !clusterConfig.LoadBalancer {
+		return nil
+	}
+	project := clusterConfig.Project
+	name := loadBalancerName(cluster)
+
+	err := gce.deleteAndWait(project, name, "forwarding rule", func() (*compute.Operation, error) {
+		return gce.computeService.GlobalForwardingRulesDelete(project, name)
+	})
+	if err != nil {
+		return err
+	}
+	err = gce.deleteAndWait(project, name, "target TCP proxy", func() (*compute.Operation, error) {
+		return gce.computeService.TargetTcpProxiesDelete(project, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The instance groups are only known from the backends of the backend
+	// service, so look them up before it goes away.
+	var groups []string
+	backendService, err := gce.computeService.BackendServicesGet(project, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting backend service %v: %v", name, err)
+	}
+	if err == nil {
+		for _, backend := range backendService.Backends {
+			groups = append(groups, backend.Group)
+		}
+	}
+	err = gce.deleteAndWait(project, name, "backend service", func() (*compute.Operation, error) {
+		return gce.computeService.BackendServicesDelete(project, name)
+	})
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		zone, groupName := zoneAndNameFromURL(group)
+		err = gce.deleteAndWait(project, groupName, "instance group", func() (*compute.Operation, error) {
+			return gce.computeService.InstanceGroupsDelete(project, zone, groupName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = gce.deleteAndWait(project, name, "health check", func() (*compute.Operation, error) {
+		return gce.computeService.HealthChecksDelete(project, name)
+	})
+	if err != nil {
+		return err
+	}
+	return gce.deleteAndWait(project, name, "address", func() (*compute.Operation, error) {
+		return gce.computeService.GlobalAddressesDelete(project, name)
+	})
+}
+
+// Runs the given delete call and waits for it to complete. Resources that
+// are already gone are not an error.
+func (gce *GCEClusterClient) deleteAndWait(project string, name string, kind string, del func() (*compute.Operation, error)) error {
+	op, err := del()
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting %v %v: %v", kind, name, err)
+	}
+	return nil
+}
+
+// Returns the zone and name of a zonal resource from its URL, e.g.
+// .../zones/us-central1-a/instanceGroups/name.
+func zoneAndNameFromURL(url string) (string, string) {
+	parts := strings.Split(url, "/")
+	var zone string
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "zones" {
+			zone = parts[i+1]
+		}
+	}
+	return zone, parts[len(parts)-1]
+}
+
+// Adds the instance of a master to the load balancer, which a previous
+// attempt may have failed to do after the instance was created.
+func (gce *GCEClient) reconcileLoadBalancerMembership(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig) error {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	_, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	return gce.joinLoadBalancer(cluster, clusterConfig, machineConfig, zone, name)
+}
+
+// Adds the instance of the given name to the cluster's load balancer if the
+// machine is a master and the cluster has one.
+func (gce *GCEClient) joinLoadBalancer(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, zone string, name string) error {
+	if !isMaster(machineConfig.Roles) || !clusterConfig.LoadBalancer {
+		return nil
+	}
+	return gce.addToLoadBalancer(cluster, clusterConfig, zone, name)
+}
+
+// Adds a master instance to the instance group of its zone, creating the
+// group and adding it to the load balancer's backend service as needed.
+// Instances that are already members are left alone.
+func (gce *GCEClient) addToLoadBalancer(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, zone string, instance string) error {
+	project := clusterConfig.Project
+	groupName := masterInstanceGroupName(cluster, zone)
+	instancePath := fmt.Sprintf("zones/%s/instances/%s", zone, instance)
+
+	member := false
+	_, err := gce.computeService.InstanceGroupsGet(project, zone, groupName)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting instance group %v: %v", groupName, err)
+	}
+	if err == nil {
+		members, err := gce.computeService.InstanceGroupsListInstances(project, zone, groupName)
+		if err != nil {
+			return fmt.Errorf("error listing instances of instance group %v: %v", groupName, err)
+		}
+		if members != nil {
+			for _, m := range members.Items {
+				if strings.HasSuffix(m.Instance, instancePath) {
+					member = true
+				}
+			}
+		}
+	} else {
+		glog.Infof("Creating instance group %v.", groupName)
+		op, err := gce.computeService.InstanceGroupsInsert(project, zone, &compute.InstanceGroup{
+			Name:    groupName,
+			Network: networkPath(cluster, clusterConfig),
+			NamedPorts: []*compute.NamedPort{
+				{
+					Name: apiServerPortName,
+					Port: apiServerPort,
+				},
+			},
+		})
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return fmt.Errorf("error creating instance group %v: %v", groupName, err)
+		}
+	}
+
+	if !member {
+		op, err := gce.computeService.InstanceGroupsAddInstances(project, zone, groupName, &compute.InstanceGroupsAddInstancesRequest{
+			Instances: []*compute.InstanceReference{
+				{
+					Instance: instancePath,
+				},
+			},
+		})
+		if err == nil {
+			err = gce.computeService.WaitForOperation(project, op)
+		}
+		if err != nil {
+			return fmt.Errorf("error adding instance %v to instance group %v: %v", instance, groupName, err)
+		}
+	}
+
+	name := loadBalancerName(cluster)
+	backendService, err := gce.computeService.BackendServicesGet(project, name)
+	if err != nil {
+		return fmt.Errorf("error getting backend service %v: %v", name, err)
+	}
+	groupPath := masterInstanceGroupPath(project, zone, groupName)
+	for _, backend := range backendService.Backends {
+		if strings.HasSuffix(backend.Group, groupPath) {
+			return nil
+		}
+	}
+	backendService.Backends = append(backendService.Backends, &compute.Backend{Group: groupPath})
+	op, err := gce.computeService.BackendServicesUpdate(project, name, backendService)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil {
+		return fmt.Errorf("error adding instance group %v to backend service %v: %v", groupName, name, err)
+	}
+	return nil
+}
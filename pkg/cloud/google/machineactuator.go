@@ -20,9 +20,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"reflect"
 	"regexp"
 	"strings"
@@ -36,10 +34,14 @@ import (
 	"google.golang.org/api/googleapi"
 
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apimachineryerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 
 	"github.com/ghodss/yaml"
 	gcfg "gopkg.in/gcfg.v1"
@@ -48,6 +50,7 @@ import (
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/machinesetup"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	"sigs.k8s.io/cluster-api/pkg/cert"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
 	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
 	"sigs.k8s.io/cluster-api/pkg/kubeadm"
 	"sigs.k8s.io/cluster-api/pkg/util"
@@ -55,6 +58,8 @@ import (
 )
 
 const (
+	// Older versions recorded the location of a machine's instance in these
+	// annotations. They are converted into the machine provider status.
 	ProjectAnnotationKey = "gcp-project"
 	ZoneAnnotationKey    = "gcp-zone"
 	NameAnnotationKey    = "gcp-name"
@@ -73,6 +78,9 @@ const (
 	noEventAction     = ""
 )
 
+// A full image path, of an image or of the latest image of a family.
+var imagePathRegexp = regexp.MustCompile("projects/(.+)/global/images/(family/)*(.+)")
+
 var MachineActuator *GCEClient
 
 type SshCreds struct {
@@ -89,26 +97,47 @@ type GCEClientMachineSetupConfigGetter interface {
 }
 
 type GCEClient struct {
-	certificateAuthority     *cert.CertificateAuthority
-	computeService           GCEClientComputeService
-	kubeadm                  GCEClientKubeadm
-	serviceAccountService    *ServiceAccountService
-	sshCreds                 SshCreds
-	client                   client.Client
-	machineSetupConfigGetter GCEClientMachineSetupConfigGetter
-	eventRecorder            record.EventRecorder
-	scheme                   *runtime.Scheme
+	certificateAuthority      *cert.CertificateAuthority
+	computeService            GCEClientComputeService
+	kubeadm                   GCEClientKubeadm
+	kubeConfigGetter          GCEClientKubeConfigGetter
+	targetClusterClientGetter GCEClientTargetClusterClientGetter
+	serviceAccountService     *ServiceAccountService
+	sshCreds                  SshCreds
+	sshPort                   int
+	sshCommandTimeout         time.Duration
+	drainTimeout              time.Duration
+	client                    client.Client
+	machineSetupConfigGetter  GCEClientMachineSetupConfigGetter
+	eventRecorder             record.EventRecorder
+	scheme                    *runtime.Scheme
+	machineTypes              *machineTypeCache
 }
 
 type MachineActuatorParams struct {
-	CertificateAuthority     *cert.CertificateAuthority
-	ComputeService           GCEClientComputeService
-	Kubeadm                  GCEClientKubeadm
-	Client                   client.Client
-	MachineSetupConfigGetter GCEClientMachineSetupConfigGetter
-	EventRecorder            record.EventRecorder
-	Scheme                   *runtime.Scheme
-	CloudConfigPath          string
+	CertificateAuthority      *cert.CertificateAuthority
+	ComputeService            GCEClientComputeService
+	IAMService                GCEClientIAMService
+	ResourceManagerService    GCEClientResourceManagerService
+	SecretsGetter             corev1client.SecretsGetter
+	Kubeadm                   GCEClientKubeadm
+	KubeConfigGetter          GCEClientKubeConfigGetter
+	TargetClusterClientGetter GCEClientTargetClusterClientGetter
+	Client                    client.Client
+	MachineSetupConfigGetter  GCEClientMachineSetupConfigGetter
+	EventRecorder             record.EventRecorder
+	Scheme                    *runtime.Scheme
+	CloudConfigPath           string
+	// The directory the SSH key secret is mounted in, SshKeysPath by
+	// default, and the port and command timeout of SSH connections to
+	// machines.
+	SSHKeysPath       string
+	SSHPort           int
+	SSHCommandTimeout time.Duration
+	// How long draining a node may take, 5 minutes by default. Pods whose
+	// disruption budgets block their eviction for longer fail the update
+	// of their machine.
+	DrainTimeout time.Duration
 }
 
 func NewMachineActuator(params MachineActuatorParams) (*GCEClient, error) {
@@ -117,33 +146,46 @@ func NewMachineActuator(params MachineActuatorParams) (*GCEClient, error) {
 		return nil, err
 	}
 
-	serviceAccountService := NewServiceAccountService()
+	serviceAccountService := NewServiceAccountService(params.IAMService, params.ResourceManagerService, params.SecretsGetter)
 
 	// Only applicable if it's running inside machine controller pod.
-	var privateKeyPath, user string
-	if _, err := os.Stat("/etc/sshkeys/private"); err == nil {
-		privateKeyPath = "/etc/sshkeys/private"
-
-		b, err := ioutil.ReadFile("/etc/sshkeys/user")
-		if err != nil {
-			return nil, err
-		}
-		user = string(b)
+	sshKeysPath := params.SSHKeysPath
+	if sshKeysPath == "" {
+		sshKeysPath = SshKeysPath
+	}
+	sshCreds, err := loadSshCreds(sshKeysPath)
+	if err != nil {
+		return nil, err
+	}
+	sshPort := params.SSHPort
+	if sshPort == 0 {
+		sshPort = defaultSshPort
+	}
+	sshCommandTimeout := params.SSHCommandTimeout
+	if sshCommandTimeout == 0 {
+		sshCommandTimeout = defaultSshCommandTimeout
+	}
+	drainTimeout := params.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = defaultDrainTimeout
 	}
 
 	return &GCEClient{
-		certificateAuthority:  params.CertificateAuthority,
-		computeService:        computeService,
-		kubeadm:               getOrNewKubeadm(params),
-		serviceAccountService: serviceAccountService,
-		sshCreds: SshCreds{
-			privateKeyPath: privateKeyPath,
-			user:           user,
-		},
-		client:                   params.Client,
-		machineSetupConfigGetter: params.MachineSetupConfigGetter,
-		eventRecorder:            params.EventRecorder,
-		scheme:                   params.Scheme,
+		certificateAuthority:      params.CertificateAuthority,
+		computeService:            computeService,
+		kubeadm:                   getOrNewKubeadm(params),
+		kubeConfigGetter:          params.KubeConfigGetter,
+		targetClusterClientGetter: params.TargetClusterClientGetter,
+		serviceAccountService:     serviceAccountService,
+		sshCreds:                  sshCreds,
+		sshPort:                   sshPort,
+		sshCommandTimeout:         sshCommandTimeout,
+		drainTimeout:              drainTimeout,
+		client:                    params.Client,
+		machineSetupConfigGetter:  params.MachineSetupConfigGetter,
+		eventRecorder:             params.EventRecorder,
+		scheme:                    params.Scheme,
+		machineTypes:              newMachineTypeCache(),
 	}, nil
 }
 
@@ -193,12 +235,18 @@ func (gce *GCEClient) CreateMachineController(cluster *clusterv1.Cluster, initia
 		return err
 	}
 
-	// Setup SSH access to master VM
-	if err := gce.setupSSHAccess(cluster, util.GetMaster(initialMachines)); err != nil {
+	// Setup SSH access to master VMs
+	var masters []*clusterv1.Machine
+	for _, machine := range initialMachines {
+		if util.IsMaster(machine) {
+			masters = append(masters, machine)
+		}
+	}
+	if err := gce.setupSSHAccess(cluster, masters, clientSet.CoreV1()); err != nil {
 		return err
 	}
 
-	if err := CreateExtApiServerRoleBinding(); err != nil {
+	if err := CreateExtApiServerRoleBinding(&clientSet); err != nil {
 		return err
 	}
 
@@ -255,6 +303,42 @@ func (gce *GCEClient) Create(cluster *clusterv1.Cluster, machine *clusterv1.Mach
 		return gce.handleMachineError(machine, verr, createEventAction)
 	}
 
+	configParams, imagePath, err := gce.machineImage(machine, machineConfig)
+	if err != nil {
+		return err
+	}
+	if inInstanceGroup(machineConfig) {
+		return gce.createInInstanceGroup(cluster, machine, clusterConfig, machineConfig, configParams, imagePath)
+	}
+
+	instance, err := gce.instanceIfExists(cluster, machine)
+	if err != nil {
+		return err
+	}
+	if instance != nil {
+		glog.Infof("Skipped creating a VM that already exists.\n")
+		return gce.reconcileLoadBalancerMembership(cluster, machine, clusterConfig, machineConfig)
+	}
+
+	if verr := gce.validateMasterZone(machine, clusterConfig, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	name := machine.ObjectMeta.Name
+	if err := gce.createInstance(cluster, machine, clusterConfig, machineConfig, configParams, imagePath, machineConfig.Zone, name); err != nil {
+		return err
+	}
+	gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Created", "Created Machine %v", machine.Name)
+	// If we have a v1Alpha1Client, then record in the machine's status
+	// exactly what VM we created for it.
+	if err := gce.recordInstanceStatus(cluster, machine, name, ""); err != nil {
+		return err
+	}
+	return gce.joinLoadBalancer(cluster, clusterConfig, machineConfig, machineConfig.Zone, name)
+}
+
+// Returns the parameters the machine's setup is looked up with, and the path
+// of the image its instances boot from.
+func (gce *GCEClient) machineImage(machine *clusterv1.Machine, machineConfig *gceconfigv1.GCEMachineProviderConfig) (*machinesetup.ConfigParams, string, error) {
 	configParams := &machinesetup.ConfigParams{
 		OS:       machineConfig.OS,
 		Roles:    machineConfig.Roles,
@@ -262,99 +346,69 @@ func (gce *GCEClient) Create(cluster *clusterv1.Cluster, machine *clusterv1.Mach
 	}
 	machineSetupConfigs, err := gce.machineSetupConfigGetter.GetMachineSetupConfig()
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 	image, err := machineSetupConfigs.GetImage(configParams)
 	if err != nil {
-		return err
-	}
-	imagePath := gce.getImagePath(image)
-	metadata, err := gce.getMetadata(cluster, machine, clusterConfig, configParams)
-	if err != nil {
-		return err
+		return nil, "", err
 	}
+	return configParams, gce.getImagePath(image), nil
+}
 
-	instance, err := gce.instanceIfExists(cluster, machine)
+// Creates an instance of the given name for the machine.
+func (gce *GCEClient) createInstance(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, configParams *machinesetup.ConfigParams, imagePath string, zone string, name string) error {
+	project := clusterConfig.Project
+	if verr := gce.validateMachineType(project, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	if verr := gce.validateAccelerators(project, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	if verr := gce.validateImage(imagePath, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, createEventAction)
+	}
+	metadata, err := gce.getMetadata(cluster, machine, clusterConfig, machineConfig, configParams)
 	if err != nil {
 		return err
 	}
+	if err := gce.createSnapshotDisks(project, zone, name, machineConfig); err != nil {
+		return gce.handleMachineError(machine, apierrors.CreateMachine(
+			"error creating disks: %v", err), createEventAction)
+	}
 
-	name := machine.ObjectMeta.Name
-	project := clusterConfig.Project
-	zone := machineConfig.Zone
-
-	if instance == nil {
-		labels := map[string]string{}
-		if gce.client == nil {
-			labels[BootstrapLabelKey] = "true"
-		}
-
-		op, err := gce.computeService.InstancesInsert(project, zone, &compute.Instance{
-			Name:         name,
-			MachineType:  fmt.Sprintf("zones/%s/machineTypes/%s", zone, machineConfig.MachineType),
-			CanIpForward: true,
-			NetworkInterfaces: []*compute.NetworkInterface{
-				{
-					Network: "global/networks/default",
-					AccessConfigs: []*compute.AccessConfig{
-						{
-							Type: "ONE_TO_ONE_NAT",
-							Name: "External NAT",
-						},
-					},
-				},
-			},
-			Disks:    newDisks(machineConfig, zone, imagePath, int64(30)),
-			Metadata: metadata,
-			Tags: &compute.Tags{
-				Items: []string{
-					"https-server",
-					fmt.Sprintf("%s-worker", cluster.Name)},
-			},
-			Labels: labels,
-			ServiceAccounts: []*compute.ServiceAccount{
-				{
-					Email: gce.serviceAccountService.GetDefaultServiceAccountForMachine(cluster, machine),
-					Scopes: []string{
-						compute.CloudPlatformScope,
-					},
-				},
-			},
-		})
+	labels := newLabels(cluster, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name, machineConfig)
+	if gce.client == nil {
+		labels[BootstrapLabelKey] = "true"
+	}
 
-		if err == nil {
-			err = gce.computeService.WaitForOperation(clusterConfig.Project, op)
-		}
+	op, err := gce.insertInstance(project, zone, &compute.Instance{
+		Name:              name,
+		MachineType:       machineTypePath(machineConfig, zone),
+		MinCpuPlatform:    machineConfig.MinCPUPlatform,
+		CanIpForward:      true,
+		NetworkInterfaces: newNetworkInterfaces(cluster, clusterConfig, machineConfig, zone),
+		Disks:             newDisks(machineConfig, zone, name, imagePath, int64(30)),
+		Metadata:          metadata,
+		Tags:              newTags(cluster, machineConfig),
+		Labels:            labels,
+		Scheduling:        newScheduling(machineConfig),
+		GuestAccelerators: newGuestAccelerators(machineConfig, zone),
+		ServiceAccounts:   gce.newServiceAccounts(cluster, machine, machineConfig),
+	}, machineConfig)
 
-		if err != nil {
-			return gce.handleMachineError(machine, apierrors.CreateMachine(
-				"error creating GCE instance: %v", err), createEventAction)
-		}
+	if err == nil {
+		err = gce.computeService.WaitForOperation(clusterConfig.Project, op)
+	}
 
-		gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Created", "Created Machine %v", machine.Name)
-		// If we have a v1Alpha1Client, then annotate the machine so that we
-		// remember exactly what VM we created for it.
-		if gce.client != nil {
-			return gce.updateAnnotations(cluster, machine)
-		}
-	} else {
-		glog.Infof("Skipped creating a VM that already exists.\n")
+	if err != nil {
+		return gce.handleMachineError(machine, apierrors.CreateMachine(
+			"error creating GCE instance: %v", err), createEventAction)
 	}
 
 	return nil
 }
 
 func (gce *GCEClient) Delete(cluster *clusterv1.Cluster, machine *clusterv1.Machine) error {
-	instance, err := gce.instanceIfExists(cluster, machine)
-	if err != nil {
-		return err
-	}
-
-	if instance == nil {
-		glog.Infof("Skipped deleting a VM that is already deleted.\n")
-		return nil
-	}
-
 	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
 	if err != nil {
 		return gce.handleMachineError(machine,
@@ -367,25 +421,37 @@ func (gce *GCEClient) Delete(cluster *clusterv1.Cluster, machine *clusterv1.Mach
 			apierrors.InvalidMachineConfiguration("Cannot unmarshal cluster's providerConfig field: %v", err), deleteEventAction)
 	}
 
-	if verr := gce.validateMachine(machine, machineConfig); verr != nil {
-		return gce.handleMachineError(machine, verr, deleteEventAction)
+	if inInstanceGroup(machineConfig) {
+		return gce.deleteFromInstanceGroup(cluster, machine, clusterConfig, machineConfig)
+	}
+
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	if status.Replacement != nil {
+		if err := gce.deleteReplacementInstance(clusterConfig.Project, status.Replacement); err != nil {
+			return gce.handleMachineError(machine, apierrors.DeleteMachine(
+				"error deleting replacement GCE instance: %v", err), deleteEventAction)
+		}
 	}
 
-	var project, zone, name string
+	instance, err := gce.instanceIfExists(cluster, machine)
+	if err != nil {
+		return err
+	}
 
-	if machine.ObjectMeta.Annotations != nil {
-		project = machine.ObjectMeta.Annotations[ProjectAnnotationKey]
-		zone = machine.ObjectMeta.Annotations[ZoneAnnotationKey]
-		name = machine.ObjectMeta.Annotations[NameAnnotationKey]
+	if instance == nil {
+		glog.Infof("Skipped deleting a VM that is already deleted.\n")
+		return nil
 	}
 
-	// If the annotations are missing, fall back on providerConfig
-	if project == "" || zone == "" || name == "" {
-		project = clusterConfig.Project
-		zone = machineConfig.Zone
-		name = machine.ObjectMeta.Name
+	if verr := gce.validateMachine(machine, machineConfig); verr != nil {
+		return gce.handleMachineError(machine, verr, deleteEventAction)
 	}
 
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+
 	op, err := gce.computeService.InstancesDelete(project, zone, name)
 	if err == nil {
 		err = gce.computeService.WaitForOperation(clusterConfig.Project, op)
@@ -436,6 +502,7 @@ func (gce *GCEClient) PostDelete(cluster *clusterv1.Cluster) error {
 	if err := gce.serviceAccountService.DeleteMachineControllerServiceAccount(cluster); err != nil {
 		return fmt.Errorf("error deleting machine controller service account: %v", err)
 	}
+
 	return nil
 }
 
@@ -450,58 +517,82 @@ func (gce *GCEClient) Update(cluster *clusterv1.Cluster, goalMachine *clusterv1.
 		return gce.handleMachineError(goalMachine, verr, noEventAction)
 	}
 
-	status, err := gce.instanceStatus(goalMachine)
+	status, err := gce.machineProviderStatus(goalMachine)
 	if err != nil {
 		return err
 	}
 
-	currentMachine := (*clusterv1.Machine)(status)
-	if currentMachine == nil {
+	if status.LastAppliedProviderConfigHash == "" || goalMachine.Status.Versions == nil {
 		instance, err := gce.instanceIfExists(cluster, goalMachine)
 		if err != nil {
 			return err
 		}
 		if instance != nil && instance.Labels[BootstrapLabelKey] != "" {
 			glog.Infof("Populating current state for bootstrap machine %v", goalMachine.ObjectMeta.Name)
-			return gce.updateAnnotations(cluster, goalMachine)
+			return gce.updateInstanceStatus(cluster, goalMachine)
 		} else {
 			return fmt.Errorf("Cannot retrieve current state to update machine %v", goalMachine.ObjectMeta.Name)
 		}
 	}
 
-	currentConfig, err := machineProviderFromProviderConfig(currentMachine.Spec.ProviderConfig)
+	requiresUpdate, err := gce.requiresUpdate(status, goalMachine, goalConfig)
 	if err != nil {
-		return gce.handleMachineError(currentMachine, apierrors.InvalidMachineConfiguration(
-			"Cannot unmarshal machine's providerConfig field: %v", err), noEventAction)
+		return err
 	}
-
-	if !gce.requiresUpdate(currentMachine, goalMachine) {
-		return nil
+	if inInstanceGroup(goalConfig) {
+		return gce.updateInInstanceGroup(cluster, goalMachine, goalConfig, status, requiresUpdate)
 	}
-
-	if isMaster(currentConfig.Roles) {
-		glog.Infof("Doing an in-place upgrade for master.\n")
-		// TODO: should we support custom CAs here?
-		err = gce.updateMasterInplace(cluster, currentMachine, goalMachine)
-		if err != nil {
-			glog.Errorf("master inplace update failed: %v", err)
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return gce.handleMachineError(goalMachine,
+			apierrors.InvalidMachineConfiguration("Cannot unmarshal cluster's providerConfig field: %v", err), noEventAction)
+	}
+	if status.Replacement != nil {
+		if requiresUpdate || !canAbandonReplacement(status.Replacement) {
+			return gce.replaceMachineInstance(cluster, goalMachine, clusterConfig, goalConfig)
 		}
-	} else {
-		glog.Infof("re-creating machine %s for update.", currentMachine.ObjectMeta.Name)
-		err = gce.Delete(cluster, currentMachine)
-		if err != nil {
-			glog.Errorf("delete machine %s for update failed: %v", currentMachine.ObjectMeta.Name, err)
-		} else {
-			err = gce.Create(cluster, goalMachine)
+		// The spec went back to that of the machine's instance before
+		// the replacement started to take over from it.
+		if err := gce.abandonReplacement(cluster, goalMachine, clusterConfig, goalConfig, status.Replacement); err != nil {
+			return err
+		}
+	}
+	if !requiresUpdate {
+		restarted := false
+		if isPreemptible(goalConfig) {
+			restarted, err = gce.startPreemptedInstance(cluster, goalMachine, goalConfig, status)
 			if err != nil {
-				glog.Errorf("create machine %s for update failed: %v", goalMachine.ObjectMeta.Name, err)
+				return err
 			}
 		}
+		if _, err := gce.updateInstanceLabelsAndTags(cluster, goalMachine, goalConfig, status); err != nil {
+			return err
+		}
+		if err := gce.reconcileLoadBalancerMembership(cluster, goalMachine, clusterConfig, goalConfig); err != nil {
+			return err
+		}
+		if restarted || goalMachine.Status.ProviderStatus == nil {
+			// Record the state of the restarted instance, or store the
+			// status converted from legacy annotations.
+			return gce.updateInstanceStatus(cluster, goalMachine)
+		}
+		if isPreemptible(goalConfig) {
+			return &controllererror.RequeueAfterError{RequeueAfter: preemptionCheckInterval}
+		}
+		return nil
 	}
+
+	if !isMaster(goalConfig.Roles) || isReplaceUpgrade(goalConfig) {
+		return gce.replaceMachineInstance(cluster, goalMachine, clusterConfig, goalConfig)
+	}
+	glog.Infof("Doing an in-place upgrade for master.\n")
+	// TODO: should we support custom CAs here?
+	err = gce.updateMasterInplace(cluster, goalMachine.Status.Versions, goalMachine)
 	if err != nil {
+		glog.Errorf("master inplace update failed: %v", err)
 		return err
 	}
-	return gce.updateInstanceStatus(goalMachine)
+	return gce.updateInstanceStatus(cluster, goalMachine)
 }
 
 func (gce *GCEClient) Exists(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (bool, error) {
@@ -509,53 +600,67 @@ func (gce *GCEClient) Exists(cluster *clusterv1.Cluster, machine *clusterv1.Mach
 	if err != nil {
 		return false, err
 	}
-	return (i != nil), err
+	if i == nil {
+		return false, nil
+	}
+	// A preempted instance exists but runs nothing, so it is started before
+	// the machine is updated, which may be busy replacing it.
+	if isPreempted(i) {
+		if err := gce.startExistingPreemptedInstance(cluster, machine); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
-func (gce *GCEClient) GetIP(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (string, error) {
+// Starts the preempted instance of a machine and records its new state.
+// Managed instance groups start their own instances.
+func (gce *GCEClient) startExistingPreemptedInstance(cluster *clusterv1.Cluster, machine *clusterv1.Machine) error {
 	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if inInstanceGroup(machineConfig) {
+		return nil
+	}
+	status, err := gce.machineProviderStatus(machine)
 	if err != nil {
-		return "", err
+		return err
+	}
+	restarted, err := gce.startPreemptedInstance(cluster, machine, machineConfig, status)
+	if err != nil || !restarted {
+		return err
 	}
+	return gce.updateInstanceStatus(cluster, machine)
+}
 
-	instance, err := gce.computeService.InstancesGet(clusterConfig.Project, machineConfig.Zone, machine.ObjectMeta.Name)
+func (gce *GCEClient) GetIP(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (string, error) {
+	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
 	if err != nil {
 		return "", err
 	}
 
-	var publicIP string
-
-	for _, networkInterface := range instance.NetworkInterfaces {
-		if networkInterface.Name == "nic0" {
-			for _, accessConfigs := range networkInterface.AccessConfigs {
-				publicIP = accessConfigs.NatIP
-			}
-		}
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return "", err
 	}
-	return publicIP, nil
-}
 
-func (gce *GCEClient) GetKubeConfig(cluster *clusterv1.Cluster, master *clusterv1.Machine) (string, error) {
-	machineConfig, err := machineProviderFromProviderConfig(master.Spec.ProviderConfig)
+	status, err := gce.machineProviderStatus(machine)
 	if err != nil {
 		return "", err
 	}
-
-	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
 	if err != nil {
 		return "", err
 	}
 
-	command := "sudo cat /etc/kubernetes/admin.conf"
-	result := strings.TrimSpace(util.ExecCommand(
-		"gcloud", "compute", "ssh", "--project", clusterConfig.Project,
-		"--zone", machineConfig.Zone, master.ObjectMeta.Name, "--command", command, "--", "-q"))
-	return result, nil
+	internalIP, publicIP := instanceIPs(instance)
+	// Machines without an external IP are only reachable on their internal IP.
+	if publicIP == "" {
+		return internalIP, nil
+	}
+	return publicIP, nil
 }
 
 func isMaster(roles []gceconfigv1.MachineRole) bool {
@@ -567,60 +672,27 @@ func isMaster(roles []gceconfigv1.MachineRole) bool {
 	return false
 }
 
-func (gce *GCEClient) updateAnnotations(cluster *clusterv1.Cluster, machine *clusterv1.Machine) error {
-	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
-	name := machine.ObjectMeta.Name
-	zone := machineConfig.Zone
+// The machine's spec differs from what was last applied to its instance in
+// a way that requires an update.
+func (gce *GCEClient) requiresUpdate(status *gceconfigv1.GCEMachineProviderStatus, machine *clusterv1.Machine, machineConfig *gceconfigv1.GCEMachineProviderConfig) (bool, error) {
+	hash, err := providerConfigHash(machineConfig)
 	if err != nil {
-		return gce.handleMachineError(machine,
-			apierrors.InvalidMachineConfiguration("Cannot unmarshal machine's providerConfig field: %v", err), noEventAction)
-	}
-
-	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
-	project := clusterConfig.Project
-	if err != nil {
-		return gce.handleMachineError(machine,
-			apierrors.InvalidMachineConfiguration("Cannot unmarshal cluster's providerConfig field: %v", err), noEventAction)
-	}
-
-	if machine.ObjectMeta.Annotations == nil {
-		machine.ObjectMeta.Annotations = make(map[string]string)
-	}
-	machine.ObjectMeta.Annotations[ProjectAnnotationKey] = project
-	machine.ObjectMeta.Annotations[ZoneAnnotationKey] = zone
-	machine.ObjectMeta.Annotations[NameAnnotationKey] = name
-	if err := gce.client.Update(context.Background(), machine); err != nil {
-		return err
+		return false, err
 	}
-	return gce.updateInstanceStatus(machine)
-}
-
-// The two machines differ in a way that requires an update
-func (gce *GCEClient) requiresUpdate(a *clusterv1.Machine, b *clusterv1.Machine) bool {
-	// Do not want status changes. Do want changes that impact machine provisioning
-	return !reflect.DeepEqual(a.Spec.ObjectMeta, b.Spec.ObjectMeta) ||
-		!reflect.DeepEqual(a.Spec.ProviderConfig, b.Spec.ProviderConfig) ||
-		!reflect.DeepEqual(a.Spec.Versions, b.Spec.Versions) ||
-		a.ObjectMeta.Name != b.ObjectMeta.Name
+	return hash != status.LastAppliedProviderConfigHash ||
+		!reflect.DeepEqual(machine.Status.Versions, &machine.Spec.Versions), nil
 }
 
 // Gets the instance represented by the given machine
 func (gce *GCEClient) instanceIfExists(cluster *clusterv1.Cluster, machine *clusterv1.Machine) (*compute.Instance, error) {
-	identifyingMachine := machine
-
-	// Try to use the last saved status locating the machine
-	// in case instance details like the proj or zone has changed
-	status, err := gce.instanceStatus(machine)
+	// Use the last saved status to locate the machine in case instance
+	// details like the project or zone have changed.
+	status, err := gce.machineProviderStatus(machine)
 	if err != nil {
 		return nil, err
 	}
 
-	if status != nil {
-		identifyingMachine = (*clusterv1.Machine)(status)
-	}
-
-	// Get the VM via specified location and name
-	machineConfig, err := machineProviderFromProviderConfig(identifyingMachine.Spec.ProviderConfig)
+	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -630,7 +702,8 @@ func (gce *GCEClient) instanceIfExists(cluster *clusterv1.Cluster, machine *clus
 		return nil, err
 	}
 
-	instance, err := gce.computeService.InstancesGet(clusterConfig.Project, machineConfig.Zone, identifyingMachine.ObjectMeta.Name)
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
 	if err != nil {
 		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
 			return nil, nil
@@ -647,54 +720,15 @@ func (gce *GCEClient) machineproviderconfig(providerConfig clusterv1.ProviderCon
 }
 */
 
-func (gce *GCEClient) updateMasterInplace(cluster *clusterv1.Cluster, oldMachine *clusterv1.Machine, newMachine *clusterv1.Machine) error {
-	if oldMachine.Spec.Versions.ControlPlane != newMachine.Spec.Versions.ControlPlane {
-		cmd := fmt.Sprintf(
-			"curl -fsSL https://dl.k8s.io/release/v%s/bin/linux/amd64/kubeadm | sudo tee /usr/bin/kubeadm > /dev/null; "+
-				"sudo chmod a+rx /usr/bin/kubeadm", newMachine.Spec.Versions.ControlPlane)
-		_, err := gce.remoteSshCommand(cluster, newMachine, cmd)
-		if err != nil {
-			glog.Infof("remotesshcomand error: %v", err)
-			return err
-		}
-
-		// TODO: We might want to upgrade kubeadm if the target control plane version is newer.
-		// Upgrade control plan.
-		cmd = fmt.Sprintf("sudo kubeadm upgrade apply %s -y", "v"+newMachine.Spec.Versions.ControlPlane)
-		_, err = gce.remoteSshCommand(cluster, newMachine, cmd)
-		if err != nil {
-			glog.Infof("remotesshcomand error: %v", err)
-			return err
-		}
-	}
-
-	// Upgrade kubelet.
-	if oldMachine.Spec.Versions.Kubelet != newMachine.Spec.Versions.Kubelet {
-		cmd := fmt.Sprintf("sudo kubectl drain %s --kubeconfig /etc/kubernetes/admin.conf --ignore-daemonsets", newMachine.Name)
-		// The errors are intentionally ignored as master has static pods.
-		gce.remoteSshCommand(cluster, newMachine, cmd)
-		// Upgrade kubelet to desired version.
-		cmd = fmt.Sprintf("sudo apt-get install kubelet=%s", newMachine.Spec.Versions.Kubelet+"-00")
-		_, err := gce.remoteSshCommand(cluster, newMachine, cmd)
-		if err != nil {
-			glog.Infof("remotesshcomand error: %v", err)
-			return err
-		}
-		cmd = fmt.Sprintf("sudo kubectl uncordon %s --kubeconfig /etc/kubernetes/admin.conf", newMachine.Name)
-		_, err = gce.remoteSshCommand(cluster, newMachine, cmd)
-		if err != nil {
-			glog.Infof("remotesshcomand error: %v", err)
-			return err
-		}
-	}
-
-	return nil
-}
-
 func (gce *GCEClient) validateMachine(machine *clusterv1.Machine, config *gceconfigv1.GCEMachineProviderConfig) *apierrors.MachineError {
 	if machine.Spec.Versions.Kubelet == "" {
 		return apierrors.InvalidMachineConfiguration("spec.versions.kubelet can't be empty")
 	}
+	switch config.UpgradeStrategy {
+	case "", gceconfigv1.InPlaceUpgrade, gceconfigv1.ReplaceUpgrade:
+	default:
+		return apierrors.InvalidMachineConfiguration("unknown upgradeStrategy %q", config.UpgradeStrategy)
+	}
 	return nil
 }
 
@@ -708,7 +742,11 @@ func (gce *GCEClient) handleMachineError(machine *clusterv1.Machine, err *apierr
 		message := err.Message
 		machine.Status.ErrorReason = &reason
 		machine.Status.ErrorMessage = &message
-		panic("UpdateStatus not implemented")
+		// A failure to record the error is only logged, so that the original
+		// error is what gets returned.
+		if uerr := gce.updateMachineErrorStatus(machine); uerr != nil {
+			glog.Errorf("Error updating status of machine %v: %v", machine.ObjectMeta.Name, uerr)
+		}
 	}
 
 	if eventAction != noEventAction {
@@ -719,24 +757,36 @@ func (gce *GCEClient) handleMachineError(machine *clusterv1.Machine, err *apierr
 	return err
 }
 
+// Persists the error reason and message of the machine through the status
+// subresource. The machine is fetched again on conflicts, so that the error is
+// recorded on top of whatever changed it in the meantime.
+func (gce *GCEClient) updateMachineErrorStatus(machine *clusterv1.Machine) error {
+	current := machine.DeepCopy()
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		current.Status.ErrorReason = machine.Status.ErrorReason
+		current.Status.ErrorMessage = machine.Status.ErrorMessage
+		err := gce.client.Status().Update(context.Background(), current)
+		if !apimachineryerrors.IsConflict(err) {
+			return err
+		}
+		latest, gerr := util.GetMachineIfExists(gce.client, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name)
+		if gerr != nil {
+			return gerr
+		}
+		if latest == nil {
+			return fmt.Errorf("machine has already been deleted")
+		}
+		current = latest
+		return err
+	})
+}
+
 func (gce *GCEClient) getImagePath(img string) (imagePath string) {
 	defaultImg := "projects/ubuntu-os-cloud/global/images/family/ubuntu-1604-lts"
 
 	// A full image path must match the regex format. If it doesn't, we will fall back to a default base image.
-	matches := regexp.MustCompile("projects/(.+)/global/images/(family/)*(.+)").FindStringSubmatch(img)
-	if matches != nil {
-		// Check to see if the image exists in the given path. The presence of "family" in the path dictates which API call we need to make.
-		project, family, name := matches[1], matches[2], matches[3]
-		var err error
-		if family == "" {
-			_, err = gce.computeService.ImagesGet(project, name)
-		} else {
-			_, err = gce.computeService.ImagesGetFromFamily(project, name)
-		}
-
-		if err == nil {
-			return img
-		}
+	if _, err := gce.getImage(img); err == nil {
+		return img
 	}
 
 	// Otherwise, fall back to the base image.
@@ -744,28 +794,79 @@ func (gce *GCEClient) getImagePath(img string) (imagePath string) {
 	return defaultImg
 }
 
-func newDisks(config *gceconfigv1.GCEMachineProviderConfig, zone string, imagePath string, minDiskSizeGb int64) []*compute.AttachedDisk {
-	var disks []*compute.AttachedDisk
-	for idx, disk := range config.Disks {
-		diskSizeGb := disk.InitializeParams.DiskSizeGb
-		d := compute.AttachedDisk{
-			AutoDelete: true,
-			InitializeParams: &compute.AttachedDiskInitializeParams{
-				DiskSizeGb: diskSizeGb,
-				DiskType:   fmt.Sprintf("zones/%s/diskTypes/%s", zone, disk.InitializeParams.DiskType),
+// Gets the image at the given path, which names either an image or an image
+// family.
+func (gce *GCEClient) getImage(imagePath string) (*compute.Image, error) {
+	matches := imagePathRegexp.FindStringSubmatch(imagePath)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid image path %q", imagePath)
+	}
+	// The presence of "family" in the path dictates which API call we need to make.
+	project, family, name := matches[1], matches[2], matches[3]
+	if family == "" {
+		return gce.computeService.ImagesGet(project, name)
+	}
+	return gce.computeService.ImagesGetFromFamily(project, name)
+}
+
+// The service accounts of the instance: those of the provider config, or the
+// master or worker service account of the cluster.
+func (gce *GCEClient) newServiceAccounts(cluster *clusterv1.Cluster, machine *clusterv1.Machine, machineConfig *gceconfigv1.GCEMachineProviderConfig) []*compute.ServiceAccount {
+	if len(machineConfig.ServiceAccounts) == 0 {
+		return []*compute.ServiceAccount{
+			{
+				Email: gce.serviceAccountService.GetDefaultServiceAccountForMachine(cluster, machine),
+				Scopes: []string{
+					compute.CloudPlatformScope,
+				},
 			},
 		}
-		if idx == 0 {
-			d.InitializeParams.SourceImage = imagePath
-			d.Boot = true
-			if diskSizeGb < minDiskSizeGb {
-				glog.Infof("increasing disk size to %v gb, the supplied disk size of %v gb is below the minimum", minDiskSizeGb, diskSizeGb)
-				d.InitializeParams.DiskSizeGb = minDiskSizeGb
+	}
+	var serviceAccounts []*compute.ServiceAccount
+	for _, sa := range machineConfig.ServiceAccounts {
+		scopes := []string{compute.CloudPlatformScope}
+		if len(sa.Scopes) > 0 {
+			scopes = nil
+			for _, scope := range sa.Scopes {
+				scopes = append(scopes, scopeURL(scope))
 			}
 		}
-		disks = append(disks, &d)
+		serviceAccounts = append(serviceAccounts, &compute.ServiceAccount{
+			Email:  sa.Email,
+			Scopes: scopes,
+		})
+	}
+	return serviceAccounts
+}
+
+// Scopes may be given by name, which is the last element of their URL.
+func scopeURL(scope string) string {
+	if strings.Contains(scope, "/") {
+		return scope
+	}
+	return "https://www.googleapis.com/auth/" + scope
+}
+
+func newNetworkInterfaces(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, zone string) []*compute.NetworkInterface {
+	networkInterface := compute.NetworkInterface{
+		Network: networkPath(cluster, clusterConfig),
+	}
+	// Instances without an access config get no external IP address.
+	if !machineConfig.NoExternalIP {
+		networkInterface.AccessConfigs = []*compute.AccessConfig{
+			{
+				Type: "ONE_TO_ONE_NAT",
+				Name: "External NAT",
+			},
+		}
 	}
-	return disks
+	// Leave the subnetwork to GCE unless one was asked for, so that legacy
+	// networks without subnetworks keep working. Custom subnet mode networks
+	// have no subnetwork GCE could pick.
+	if clusterConfig.Network.Subnetwork != "" || clusterConfig.Network.Dedicated {
+		networkInterface.Subnetwork = subnetworkPath(cluster, clusterConfig, zone)
+	}
+	return []*compute.NetworkInterface{&networkInterface}
 }
 
 // Just a temporary hack to grab a single range from the config.
@@ -843,7 +944,7 @@ func clientWithAltTokenSource(gceConfigPath string) (*http.Client, error) {
 	return client, nil
 }
 
-func (gce *GCEClient) getMetadata(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, configParams *machinesetup.ConfigParams) (*compute.Metadata, error) {
+func (gce *GCEClient) getMetadata(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, configParams *machinesetup.ConfigParams) (*compute.Metadata, error) {
 	var metadataMap map[string]string
 	if machine.Spec.Versions.Kubelet == "" {
 		return nil, errors.New("invalid master configuration: missing Machine.Spec.Versions.Kubelet")
@@ -861,13 +962,34 @@ func (gce *GCEClient) getMetadata(cluster *clusterv1.Cluster, machine *clusterv1
 			return nil, gce.handleMachineError(machine, apierrors.InvalidMachineConfiguration(
 				"invalid master configuration: missing Machine.Spec.Versions.ControlPlane"), createEventAction)
 		}
-		var err error
-		metadataMap, err = masterMetadata(cluster, machine, clusterConfig.Project, &machineSetupMetadata)
+		var join bool
+		var shared map[string]string
+		if gce.client != nil {
+			join, shared, err = gce.controlPlaneMetadata(cluster, machine, clusterConfig)
+		} else if clusterConfig.LoadBalancer {
+			shared, err = newSharedCertificates(gce.certificateAuthority)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Masters joining an existing control plane need a token like nodes.
+		var token string
+		if join {
+			token, err = gce.getKubeadmToken()
+			if err != nil {
+				return nil, err
+			}
+		}
+		metadataMap, err = masterMetadata(token, cluster, machine, clusterConfig, machineConfig, &machineSetupMetadata)
 		if err != nil {
 			return nil, err
 		}
 		ca := gce.certificateAuthority
-		if ca != nil {
+		if shared != nil {
+			for k, v := range shared {
+				metadataMap[k] = v
+			}
+		} else if ca != nil {
 			metadataMap["ca-cert"] = base64.StdEncoding.EncodeToString(ca.Certificate)
 			metadataMap["ca-key"] = base64.StdEncoding.EncodeToString(ca.PrivateKey)
 		}
@@ -877,11 +999,13 @@ func (gce *GCEClient) getMetadata(cluster *clusterv1.Cluster, machine *clusterv1
 		if err != nil {
 			return nil, err
 		}
-		metadataMap, err = nodeMetadata(kubeadmToken, cluster, machine, clusterConfig.Project, &machineSetupMetadata)
+		metadataMap, err = nodeMetadata(kubeadmToken, cluster, machine, clusterConfig, machineConfig, &machineSetupMetadata)
 		if err != nil {
 			return nil, err
 		}
 	}
+	setSecurityMetadata(machineConfig, metadataMap)
+	setInstanceMetadata(machineConfig, metadataMap)
 	var metadataItems []*compute.MetadataItems
 	for k, v := range metadataMap {
 		v := v // rebind scope to avoid loop aliasing below
@@ -899,8 +1023,19 @@ func (gce *GCEClient) getMetadata(cluster *clusterv1.Cluster, machine *clusterv1
 // TODO: We need to change this when we create dedicated service account for apiserver/controller
 // pod.
 //
-func CreateExtApiServerRoleBinding() error {
-	return run("kubectl", "create", "rolebinding",
-		"-n", "kube-system", "machine-controller", "--role=extension-apiserver-authentication-reader",
-		"--serviceaccount=default:default")
+func CreateExtApiServerRoleBinding(clientSet kubernetes.Interface) error {
+	_, err := clientSet.RbacV1().RoleBindings("kube-system").Create(&rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "machine-controller"},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     "extension-apiserver-authentication-reader",
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Namespace: "default",
+			Name:      "default",
+		}},
+	})
+	return err
 }
@@ -18,21 +18,27 @@ package google_test
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/record"
 	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/machinesetup"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
 	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	"sigs.k8s.io/cluster-api/pkg/cert"
 	"sigs.k8s.io/cluster-api/pkg/kubeadm"
 	"sigs.k8s.io/cluster-api/pkg/test-cmd-runner"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func init() {
@@ -181,6 +187,303 @@ func TestTwoDisks(t *testing.T) {
 	checkDiskValues(t, receivedInstance.Disks[1], false, 45, "pd-standard", "")
 }
 
+func TestDefaultNetwork(t *testing.T) {
+	config := newGCEMachineProviderConfigFixture()
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	createClusterAndFailOnError(t, config, computeServiceMock, nil)
+	checkNetworkInterface(t, receivedInstance, "global/networks/default", "")
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "NETWORK=default\n", "SUBNETWORK=default\n")
+}
+
+func TestCustomNetwork(t *testing.T) {
+	config := newGCEMachineProviderConfigFixture()
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{
+		Name:       "cluster-network",
+		Subnetwork: "cluster-subnetwork",
+	}
+	cluster := newClusterFixture(t, clusterConfig)
+	gce := newMachineActuator(t, computeServiceMock, nil, nil)
+	if err := gce.Create(cluster, newMachine(t, config)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	checkNetworkInterface(t, receivedInstance, "global/networks/cluster-network", "regions/us-west5/subnetworks/cluster-subnetwork")
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "NETWORK=cluster-network\n", "SUBNETWORK=cluster-subnetwork\n")
+}
+
+func TestDedicatedNetwork(t *testing.T) {
+	config := newGCEMachineProviderConfigFixture()
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.Network = gceconfigv1.NetworkSpec{
+		Dedicated: true,
+		Region:    "us-west5",
+	}
+	cluster := newClusterFixture(t, clusterConfig)
+	gce := newMachineActuator(t, computeServiceMock, nil, nil)
+	if err := gce.Create(cluster, newMachine(t, config)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	checkNetworkInterface(t, receivedInstance, "global/networks/cluster-test", "regions/us-west5/subnetworks/cluster-test")
+}
+
+func TestNoExternalIP(t *testing.T) {
+	config := newGCEMachineProviderConfigFixture()
+	config.NoExternalIP = true
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	createClusterAndFailOnError(t, config, computeServiceMock, nil)
+	checkNetworkInterface(t, receivedInstance, "global/networks/default", "")
+	if len(receivedInstance.NetworkInterfaces[0].AccessConfigs) != 0 {
+		t.Errorf("expected no access configs, got %v", len(receivedInstance.NetworkInterfaces[0].AccessConfigs))
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	testCases := []struct {
+		name            string
+		serviceAccounts []gceconfigv1.ServiceAccount
+		expectedEmail   string
+		expectedScopes  []string
+	}{
+		{
+			name:           "cluster service account",
+			expectedScopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+		},
+		{
+			name:            "default scopes",
+			serviceAccounts: []gceconfigv1.ServiceAccount{{Email: "default"}},
+			expectedEmail:   "default",
+			expectedScopes:  []string{"https://www.googleapis.com/auth/cloud-platform"},
+		},
+		{
+			name: "custom scopes",
+			serviceAccounts: []gceconfigv1.ServiceAccount{{
+				Email:  "gcs-writer@my-project.iam.gserviceaccount.com",
+				Scopes: []string{"devstorage.read_write", "https://www.googleapis.com/auth/logging.write"},
+			}},
+			expectedEmail:  "gcs-writer@my-project.iam.gserviceaccount.com",
+			expectedScopes: []string{"https://www.googleapis.com/auth/devstorage.read_write", "https://www.googleapis.com/auth/logging.write"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newGCEMachineProviderConfigFixture()
+			config.ServiceAccounts = tc.serviceAccounts
+			receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+			createClusterAndFailOnError(t, config, computeServiceMock, nil)
+			if len(receivedInstance.ServiceAccounts) != 1 {
+				t.Fatalf("expected one service account, got %v", len(receivedInstance.ServiceAccounts))
+			}
+			sa := receivedInstance.ServiceAccounts[0]
+			if sa.Email != tc.expectedEmail {
+				t.Errorf("invalid service account email: expected '%v' got '%v'", tc.expectedEmail, sa.Email)
+			}
+			if !reflect.DeepEqual(sa.Scopes, tc.expectedScopes) {
+				t.Errorf("invalid scopes: expected '%v' got '%v'", tc.expectedScopes, sa.Scopes)
+			}
+		})
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	testCases := []struct {
+		name          string
+		accessConfigs []*compute.AccessConfig
+		expectedIP    string
+	}{
+		{"external IP", []*compute.AccessConfig{{NatIP: "203.0.113.10"}}, "203.0.113.10"},
+		{"internal IP only", nil, "10.0.0.2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			computeServiceMock := &GCEClientComputeServiceMock{
+				mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+					return &compute.Instance{
+						NetworkInterfaces: []*compute.NetworkInterface{
+							{
+								Name:          "nic0",
+								NetworkIP:     "10.0.0.2",
+								AccessConfigs: tc.accessConfigs,
+							},
+						},
+					}, nil
+				},
+			}
+			gce := newMachineActuator(t, computeServiceMock, nil, nil)
+			ip, err := gce.GetIP(newDefaultClusterFixture(t), newMachine(t, newGCEMachineProviderConfigFixture()))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ip != tc.expectedIP {
+				t.Errorf("invalid IP: expected '%v' got '%v'", tc.expectedIP, ip)
+			}
+		})
+	}
+}
+
+func TestMasterJoinsLoadBalancer(t *testing.T) {
+	config := newGCEMachineProviderConfigFixture()
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	var insertedGroup *compute.InstanceGroup
+	var addedInstances *compute.InstanceGroupsAddInstancesRequest
+	var updatedBackendService *compute.BackendService
+	computeServiceMock.mockInstanceGroupsGet = func(project string, zone string, instanceGroup string) (*compute.InstanceGroup, error) {
+		return nil, &googleapi.Error{Code: 404, Message: "not found"}
+	}
+	computeServiceMock.mockInstanceGroupsInsert = func(project string, zone string, instanceGroup *compute.InstanceGroup) (*compute.Operation, error) {
+		insertedGroup = instanceGroup
+		return &compute.Operation{}, nil
+	}
+	computeServiceMock.mockInstanceGroupsAddInstances = func(project string, zone string, instanceGroup string, request *compute.InstanceGroupsAddInstancesRequest) (*compute.Operation, error) {
+		addedInstances = request
+		return &compute.Operation{}, nil
+	}
+	computeServiceMock.mockBackendServicesGet = func(project string, backendService string) (*compute.BackendService, error) {
+		return &compute.BackendService{Name: backendService}, nil
+	}
+	computeServiceMock.mockBackendServicesUpdate = func(project string, name string, backendService *compute.BackendService) (*compute.Operation, error) {
+		updatedBackendService = backendService
+		return &compute.Operation{}, nil
+	}
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.LoadBalancer = true
+	cluster := newClusterFixture(t, clusterConfig)
+	machine := newMachine(t, config)
+	machine.ObjectMeta.Name = "master-0"
+	gce := newMachineActuator(t, computeServiceMock, nil, nil)
+	if err := gce.Create(cluster, machine); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	startupScript := getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "CONTROL_PLANE_ENDPOINT=172.12.0.1\n")
+	if insertedGroup == nil || insertedGroup.Name != "cluster-test-master-us-west5-f" {
+		t.Fatalf("expected instance group 'cluster-test-master-us-west5-f' to be created, got %+v", insertedGroup)
+	}
+	if addedInstances == nil || len(addedInstances.Instances) != 1 || addedInstances.Instances[0].Instance != "zones/us-west5-f/instances/master-0" {
+		t.Errorf("expected the master to be added to its instance group, got %+v", addedInstances)
+	}
+	if updatedBackendService == nil || len(updatedBackendService.Backends) != 1 {
+		t.Fatalf("expected the instance group to be added to the backend service, got %+v", updatedBackendService)
+	}
+	expectedGroup := "projects/project-name-2000/zones/us-west5-f/instanceGroups/cluster-test-master-us-west5-f"
+	if updatedBackendService.Backends[0].Group != expectedGroup {
+		t.Errorf("invalid backend group: expected '%v' got '%v'", expectedGroup, updatedBackendService.Backends[0].Group)
+	}
+}
+
+func TestMasterLoadBalancerMembershipIsRepaired(t *testing.T) {
+	var instances fakeInstances
+	computeServiceMock := instances.computeService()
+	withLoadBalancerBackend(computeServiceMock)
+	var group *compute.InstanceGroup
+	members := map[string]bool{}
+	addErr := errors.New("backend unavailable")
+	computeServiceMock.mockInstanceGroupsGet = func(project string, zone string, instanceGroup string) (*compute.InstanceGroup, error) {
+		if group == nil {
+			return nil, &googleapi.Error{Code: 404, Message: "not found"}
+		}
+		return group, nil
+	}
+	computeServiceMock.mockInstanceGroupsInsert = func(project string, zone string, instanceGroup *compute.InstanceGroup) (*compute.Operation, error) {
+		group = instanceGroup
+		return &compute.Operation{}, nil
+	}
+	computeServiceMock.mockInstanceGroupsListInstances = func(project string, zone string, instanceGroup string) (*compute.InstanceGroupsListInstances, error) {
+		list := &compute.InstanceGroupsListInstances{}
+		for instance := range members {
+			list.Items = append(list.Items, &compute.InstanceWithNamedPorts{Instance: "https://www.googleapis.com/compute/v1/projects/" + project + "/" + instance})
+		}
+		return list, nil
+	}
+	var adds int
+	computeServiceMock.mockInstanceGroupsAddInstances = func(project string, zone string, instanceGroup string, request *compute.InstanceGroupsAddInstancesRequest) (*compute.Operation, error) {
+		adds++
+		if addErr != nil {
+			return nil, addErr
+		}
+		for _, instance := range request.Instances {
+			if members[instance.Instance] {
+				return nil, &googleapi.Error{Code: 400, Message: "memberAlreadyExists"}
+			}
+			members[instance.Instance] = true
+		}
+		return &compute.Operation{}, nil
+	}
+	master := newStoredMachine(t, "master-0", newGCEMachineProviderConfigFixture())
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), master)
+	cluster := newLoadBalancedClusterFixture(t)
+
+	if err := gce.Create(cluster, master); err == nil || !strings.Contains(err.Error(), "backend unavailable") {
+		t.Fatalf("expected adding the master to the load balancer to fail, got '%v'", err)
+	}
+	if instances.instances["master-0"] == nil || len(members) != 0 {
+		t.Fatalf("expected the instance to be created outside the load balancer, got members '%v'", members)
+	}
+
+	// The next Create finds the instance and adds it.
+	addErr = nil
+	if err := gce.Create(cluster, master); err != nil {
+		t.Fatalf("unable to create master: %v", err)
+	}
+	if !members["zones/us-west5-f/instances/master-0"] || len(instances.instances) != 1 {
+		t.Fatalf("expected the existing instance to be added, got members '%v'", members)
+	}
+	if err := gce.Create(cluster, master); err != nil {
+		t.Fatalf("expected adding a member again to be skipped, got '%v'", err)
+	}
+	if adds != 2 {
+		t.Errorf("expected the instance to be added twice, got %v adds", adds)
+	}
+
+	// Update adds instances that left the group.
+	delete(members, "zones/us-west5-f/instances/master-0")
+	if err := gce.Update(cluster, getMachine(t, fakeClient, master)); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	if !members["zones/us-west5-f/instances/master-0"] {
+		t.Errorf("expected the update to add the instance again, got members '%v'", members)
+	}
+}
+
+func TestMasterWaitsForLoadBalancerAddress(t *testing.T) {
+	_, computeServiceMock := newInsertInstanceCapturingMock()
+	clusterConfig := newGCEClusterProviderConfigFixture()
+	clusterConfig.LoadBalancer = true
+	cluster := newClusterFixture(t, clusterConfig)
+	cluster.Status.APIEndpoints = nil
+	gce := newMachineActuator(t, computeServiceMock, nil, nil)
+	if err := gce.Create(cluster, newMachine(t, newGCEMachineProviderConfigFixture())); err == nil {
+		t.Error("expected an error while the load balancer has no address")
+	}
+}
+
+func checkNetworkInterface(t *testing.T, instance *compute.Instance, network string, subnetwork string) {
+	t.Helper()
+	if len(instance.NetworkInterfaces) != 1 {
+		t.Fatalf("invalid network interface count: expected '1' got '%v'", len(instance.NetworkInterfaces))
+	}
+	networkInterface := instance.NetworkInterfaces[0]
+	if networkInterface.Network != network {
+		t.Errorf("invalid network: expected '%v' got '%v'", network, networkInterface.Network)
+	}
+	if networkInterface.Subnetwork != subnetwork {
+		t.Errorf("invalid subnetwork: expected '%v' got '%v'", subnetwork, networkInterface.Subnetwork)
+	}
+}
+
+func checkStartupScriptContains(t *testing.T, startupScript string, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		if !strings.Contains(startupScript, e) {
+			t.Errorf("startup-script is missing %q", e)
+		}
+	}
+}
+
 func getMetadataItem(t *testing.T, metadata *compute.Metadata, itemKey string) *compute.MetadataItems {
 	for _, i := range metadata.Items {
 		if i.Key == itemKey {
@@ -232,6 +535,67 @@ func TestCreateWithCAShouldPopulateMetadata(t *testing.T) {
 	checkMetadataItem(t, receivedInstance.Metadata, "ca-key", string(ca.PrivateKey))
 }
 
+func TestInvalidConfigRecordsMachineError(t *testing.T) {
+	testCases := []struct {
+		name          string
+		action        func(gce *google.GCEClient, cluster *v1alpha1.Cluster, machine *v1alpha1.Machine) error
+		invalidConfig bool
+		expectedEvent string
+	}{
+		{"create with invalid provider config", (*google.GCEClient).Create, true, "Warning FailedCreate InvalidConfiguration"},
+		{"create without kubelet version", (*google.GCEClient).Create, false, "Warning FailedCreate InvalidConfiguration"},
+		{"delete with invalid provider config", (*google.GCEClient).Delete, true, "Warning FailedDelete InvalidConfiguration"},
+		{"delete without kubelet version", (*google.GCEClient).Delete, false, "Warning FailedDelete InvalidConfiguration"},
+		{"update with invalid provider config", (*google.GCEClient).Update, true, ""},
+		{"update without kubelet version", (*google.GCEClient).Update, false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := newMasters(t, "master-0")[0]
+			if tc.invalidConfig {
+				machine.Spec.ProviderConfig.Value.Raw = []byte(`{"zone": {"name": "us-west5-f"}}`)
+			} else {
+				machine.Spec.Versions.Kubelet = ""
+			}
+			fakeClient := listingClient{fake.NewFakeClient(machine.DeepCopy())}
+			recorder := record.NewFakeRecorder(10)
+			gce, err := google.NewMachineActuator(google.MachineActuatorParams{
+				ComputeService: &GCEClientComputeServiceMock{
+					mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+						return &compute.Instance{Name: instance}, nil
+					},
+				},
+				Client:                   fakeClient,
+				MachineSetupConfigGetter: newMachineSetupConfigWatcher(),
+				EventRecorder:            recorder,
+				Scheme:                   scheme.Scheme,
+			})
+			if err != nil {
+				t.Fatalf("unable to create machine actuator: %v", err)
+			}
+
+			if err := tc.action(gce, newDefaultClusterFixture(t), machine); err == nil {
+				t.Fatal("expected an error for the invalid machine")
+			}
+			stored := getMachine(t, fakeClient, machine)
+			if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.InvalidConfigurationMachineError {
+				t.Errorf("invalid error reason: expected '%v' got '%v'", common.InvalidConfigurationMachineError, stored.Status.ErrorReason)
+			}
+			if stored.Status.ErrorMessage == nil || *stored.Status.ErrorMessage == "" {
+				t.Error("expected an error message to be recorded")
+			}
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if event != tc.expectedEvent {
+				t.Errorf("invalid event: expected '%v' got '%v'", tc.expectedEvent, event)
+			}
+		})
+	}
+}
+
 func checkMetadataItem(t *testing.T, metadata *compute.Metadata, key string, expectedValue string) {
 	item := getMetadataItem(t, metadata, key)
 	value, err := base64.StdEncoding.DecodeString(*item.Value)
@@ -253,6 +617,11 @@ func createClusterAndFailOnError(t *testing.T, config gceconfigv1.GCEMachineProv
 
 func createCluster(t *testing.T, machine *v1alpha1.Machine, computeServiceMock *GCEClientComputeServiceMock, ca *cert.CertificateAuthority, kubeadm *kubeadm.Kubeadm) error {
 	cluster := newDefaultClusterFixture(t)
+	gce := newMachineActuator(t, computeServiceMock, ca, kubeadm)
+	return gce.Create(cluster, machine)
+}
+
+func newMachineActuator(t *testing.T, computeServiceMock *GCEClientComputeServiceMock, ca *cert.CertificateAuthority, kubeadm *kubeadm.Kubeadm) *google.GCEClient {
 	configWatch := newMachineSetupConfigWatcher()
 	params := google.MachineActuatorParams{
 		CertificateAuthority:     ca,
@@ -265,18 +634,26 @@ func createCluster(t *testing.T, machine *v1alpha1.Machine, computeServiceMock *
 	if err != nil {
 		t.Fatalf("unable to create machine actuator: %v", err)
 	}
-	return gce.Create(cluster, machine)
+	return gce
 }
 
 func newInsertInstanceCapturingMock() (*compute.Instance, *GCEClientComputeServiceMock) {
 	var receivedInstance compute.Instance
+	var inserted bool
 	computeServiceMock := GCEClientComputeServiceMock{
 		mockInstancesInsert: func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
 			receivedInstance = *instance
+			inserted = true
 			return &compute.Operation{
 				Status: "DONE",
 			}, nil
 		},
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			if !inserted || instance != receivedInstance.Name {
+				return nil, &googleapi.Error{Code: 404, Message: "not found"}
+			}
+			return &receivedInstance, nil
+		},
 	}
 	return &receivedInstance, &computeServiceMock
 }
@@ -287,7 +664,7 @@ func newMachineSetupConfigMock() *GCEClientMachineSetupConfigMock {
 			return "", nil
 		},
 		mockGetMetadata: func(params *machinesetup.ConfigParams) (machinesetup.Metadata, error) {
-			metadata := machinesetup.Metadata{}
+			metadata := machinesetup.Metadata{AcceleratorDriverScript: "install-accelerator-drivers"}
 			return metadata, nil
 		},
 		mockGetImage: func(params *machinesetup.ConfigParams) (string, error) {
@@ -353,7 +730,10 @@ func newGCEClusterProviderConfigFixture() gceconfigv1.GCEClusterProviderConfig {
 }
 
 func newDefaultClusterFixture(t *testing.T) *v1alpha1.Cluster {
-	gceProviderConfig := newGCEClusterProviderConfigFixture()
+	return newClusterFixture(t, newGCEClusterProviderConfigFixture())
+}
+
+func newClusterFixture(t *testing.T, gceProviderConfig gceconfigv1.GCEClusterProviderConfig) *v1alpha1.Cluster {
 	providerConfig, err := google.ProviderConfigFromCluster(&gceProviderConfig)
 	if err != nil {
 		t.Fatalf("unable to encode provider config: %v", err)
@@ -65,6 +65,12 @@ type config struct {
 
 type Metadata struct {
 	StartupScript string `json:"startupScript"`
+
+	// Installs the drivers of the accelerators attached to an instance, e.g.
+	// GPUs. How drivers are installed depends on the image, so the script
+	// is given per config and only run on instances with accelerators,
+	// before the startup script.
+	AcceleratorDriverScript string `json:"acceleratorDriverScript,omitempty"`
 }
 
 type ConfigParams struct {
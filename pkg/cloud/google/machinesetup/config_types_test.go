@@ -95,6 +95,40 @@ func TestParseMachineSetupYaml(t *testing.T) {
 	}
 }
 
+func TestGetMetadataWithAcceleratorDriverScript(t *testing.T) {
+	validConfigs, err := parseMachineSetupYaml(strings.NewReader(`items:
+- machineParams:
+  - os: ubuntu-1604-lts
+    roles:
+    - Node
+    versions:
+      kubelet: 1.12.0
+  image: projects/ubuntu-os-cloud/global/images/family/ubuntu-1604-lts
+  metadata:
+    acceleratorDriverScript: |
+      apt-get install -y cuda-drivers
+    startupScript: |
+      echo this is the node config.`))
+	if err != nil {
+		t.Fatalf("unable to parse machine setup configs: %v", err)
+	}
+	params := &ConfigParams{
+		OS:       "ubuntu-1604-lts",
+		Roles:    []gceconfigv1.MachineRole{gceconfigv1.NodeRole},
+		Versions: clusterv1.MachineVersionInfo{Kubelet: "1.12.0"},
+	}
+	metadata, err := validConfigs.GetMetadata(params)
+	if err != nil {
+		t.Fatalf("unable to get metadata: %v", err)
+	}
+	if metadata.AcceleratorDriverScript != "apt-get install -y cuda-drivers\n" {
+		t.Errorf("invalid accelerator driver script: got %q", metadata.AcceleratorDriverScript)
+	}
+	if metadata.StartupScript != "echo this is the node config." {
+		t.Errorf("invalid startup script: got %q", metadata.StartupScript)
+	}
+}
+
 func TestGetYaml(t *testing.T) {
 	testTables := []struct {
 		validConfigs    ValidConfigs
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	compute "google.golang.org/api/compute/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+const defaultMachineFamily = "n1"
+
+// Returns the name of the machine's machine type. Custom machine types are
+// named after their family, vCPUs and memory. N1 custom machine types carry no
+// family prefix.
+func machineTypeName(config *gceconfigv1.GCEMachineProviderConfig) string {
+	custom := config.CustomMachineType
+	if custom == nil {
+		return config.MachineType
+	}
+	name := fmt.Sprintf("custom-%d-%d", custom.CPUs, custom.MemoryMB)
+	if family := machineFamily(custom); family != defaultMachineFamily {
+		name = family + "-" + name
+	}
+	if custom.ExtendedMemory {
+		name += "-ext"
+	}
+	return name
+}
+
+func machineFamily(custom *gceconfigv1.CustomMachineType) string {
+	if custom.Family == "" {
+		return defaultMachineFamily
+	}
+	return custom.Family
+}
+
+// Returns the machine type of an instance in the zone. Instance templates,
+// which have no zone, refer to machine types by name.
+func machineTypePath(config *gceconfigv1.GCEMachineProviderConfig, zone string) string {
+	if zone == "" {
+		return machineTypeName(config)
+	}
+	return fmt.Sprintf("zones/%s/machineTypes/%s", zone, machineTypeName(config))
+}
+
+// machineTypeCache holds the machine types offered in each zone, which only
+// change when GCE introduces new ones.
+type machineTypeCache struct {
+	lock  sync.Mutex
+	zones map[string][]*compute.MachineType
+}
+
+func newMachineTypeCache() *machineTypeCache {
+	return &machineTypeCache{zones: map[string][]*compute.MachineType{}}
+}
+
+// Returns the machine types offered in the zone, listing them on first use.
+func (gce *GCEClient) zoneMachineTypes(project string, zone string) ([]*compute.MachineType, error) {
+	cache := gce.machineTypes
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	key := project + "/" + zone
+	if machineTypes, ok := cache.zones[key]; ok {
+		return machineTypes, nil
+	}
+	list, err := gce.computeService.MachineTypesList(project, zone)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		return nil, nil
+	}
+	cache.zones[key] = list.Items
+	return list.Items, nil
+}
+
+// Checks that the machine's machine type is offered in its zone. Custom
+// machine types need a zone that offers their family, and cannot exceed the
+// vCPUs and, without extended memory, the memory of the family's largest
+// predefined machine type there. Zones whose machine types could not be
+// listed are not checked.
+func (gce *GCEClient) validateMachineType(project string, config *gceconfigv1.GCEMachineProviderConfig) *apierrors.MachineError {
+	machineTypes, err := gce.zoneMachineTypes(project, config.Zone)
+	if err != nil {
+		return apierrors.CreateMachine("error listing machine types of zone %v: %v", config.Zone, err)
+	}
+	if len(machineTypes) == 0 {
+		return nil
+	}
+	custom := config.CustomMachineType
+	if custom == nil {
+		for _, machineType := range machineTypes {
+			if machineType.Name == config.MachineType {
+				return nil
+			}
+		}
+		return apierrors.InvalidMachineConfiguration("machine type %v is not available in zone %v", config.MachineType, config.Zone)
+	}
+
+	family := machineFamily(custom)
+	var found bool
+	var maxCPUs, maxMemoryMB int64
+	for _, machineType := range machineTypes {
+		if !strings.HasPrefix(machineType.Name, family+"-") {
+			continue
+		}
+		found = true
+		if machineType.GuestCpus > maxCPUs {
+			maxCPUs = machineType.GuestCpus
+		}
+		if machineType.MemoryMb > maxMemoryMB {
+			maxMemoryMB = machineType.MemoryMb
+		}
+	}
+	if !found {
+		return apierrors.InvalidMachineConfiguration("machine family %v is not available in zone %v", family, config.Zone)
+	}
+	if custom.CPUs > maxCPUs {
+		return apierrors.InvalidMachineConfiguration("custom machine types of family %v have at most %v vCPUs in zone %v, got %v", family, maxCPUs, config.Zone, custom.CPUs)
+	}
+	if !custom.ExtendedMemory && custom.MemoryMB > maxMemoryMB {
+		return apierrors.InvalidMachineConfiguration("custom machine types of family %v have at most %v MB of memory in zone %v without extended memory, got %v", family, maxMemoryMB, config.Zone, custom.MemoryMB)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+)
+
+func TestMachineTypes(t *testing.T) {
+	testCases := []struct {
+		name                string
+		machineType         string
+		customMachineType   *gceconfigv1.CustomMachineType
+		expectedMachineType string
+	}{
+		{"predefined", "n1-standard-8", nil, "zones/us-west5-f/machineTypes/n1-standard-8"},
+		{"custom", "", &gceconfigv1.CustomMachineType{CPUs: 2, MemoryMB: 7680}, "zones/us-west5-f/machineTypes/custom-2-7680"},
+		{"custom of family", "", &gceconfigv1.CustomMachineType{Family: "n2", CPUs: 4, MemoryMB: 16384}, "zones/us-west5-f/machineTypes/n2-custom-4-16384"},
+		{"custom with extended memory", "", &gceconfigv1.CustomMachineType{CPUs: 2, MemoryMB: 65536, ExtendedMemory: true}, "zones/us-west5-f/machineTypes/custom-2-65536-ext"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+			computeServiceMock.mockMachineTypesList = listMachineTypes
+			config := newGCEMachineProviderConfigFixture()
+			config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+			config.MachineType = tc.machineType
+			config.CustomMachineType = tc.customMachineType
+			config.MinCPUPlatform = "Intel Skylake"
+			if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+				t.Fatalf("unable to create machine: %v", err)
+			}
+			if receivedInstance.MachineType != tc.expectedMachineType {
+				t.Errorf("invalid machine type: expected '%v' got '%v'", tc.expectedMachineType, receivedInstance.MachineType)
+			}
+			if receivedInstance.MinCpuPlatform != "Intel Skylake" {
+				t.Errorf("invalid minimum CPU platform: expected 'Intel Skylake' got '%v'", receivedInstance.MinCpuPlatform)
+			}
+		})
+	}
+}
+
+func TestMachineTypesAreListedOncePerZone(t *testing.T) {
+	_, computeServiceMock := newInsertInstanceCapturingMock()
+	var listed int
+	computeServiceMock.mockMachineTypesList = func(project string, zone string) (*compute.MachineTypeList, error) {
+		listed++
+		return listMachineTypes(project, zone)
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.MachineType = "n1-standard-8"
+	gce := newMachineActuator(t, computeServiceMock, nil, newTokenCreatingKubeadm(t))
+	cluster := newDefaultClusterFixture(t)
+	for _, name := range []string{"node-0", "node-1"} {
+		machine := newMachine(t, config)
+		machine.ObjectMeta.Name = name
+		if err := gce.Create(cluster, machine); err != nil {
+			t.Fatalf("unable to create machine %v: %v", name, err)
+		}
+	}
+	if listed != 1 {
+		t.Errorf("expected the machine types of the zone to be listed once, got %v times", listed)
+	}
+}
+
+func TestUnavailableMachineTypeRecordsMachineError(t *testing.T) {
+	testCases := []struct {
+		name              string
+		machineType       string
+		customMachineType *gceconfigv1.CustomMachineType
+	}{
+		{"predefined machine type not in zone", "n2-standard-2", nil},
+		{"machine family not in zone", "", &gceconfigv1.CustomMachineType{Family: "n2d", CPUs: 2, MemoryMB: 4096}},
+		{"too many vCPUs", "", &gceconfigv1.CustomMachineType{CPUs: 16, MemoryMB: 16384}},
+		{"too much memory", "", &gceconfigv1.CustomMachineType{CPUs: 8, MemoryMB: 65536}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var inserted bool
+			computeServiceMock := &GCEClientComputeServiceMock{
+				mockMachineTypesList: listMachineTypes,
+				mockInstancesInsert: func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+					inserted = true
+					return &compute.Operation{}, nil
+				},
+			}
+			config := newGCEMachineProviderConfigFixture()
+			config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+			config.MachineType = tc.machineType
+			config.CustomMachineType = tc.customMachineType
+			machine := newStoredMachine(t, "node-0", config)
+			gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machine)
+
+			if err := gce.Create(newDefaultClusterFixture(t), machine); err == nil {
+				t.Fatal("expected an error for the unavailable machine type")
+			}
+			if inserted {
+				t.Error("expected no instance to be created")
+			}
+			stored := getMachine(t, fakeClient, machine)
+			if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.InvalidConfigurationMachineError {
+				t.Errorf("invalid error reason: expected '%v' got '%v'", common.InvalidConfigurationMachineError, stored.Status.ErrorReason)
+			}
+		})
+	}
+}
+
+// Lists the machine types of a zone that offers N1 and N2 machine types.
+func listMachineTypes(project string, zone string) (*compute.MachineTypeList, error) {
+	return &compute.MachineTypeList{
+		Items: []*compute.MachineType{
+			{Name: "n1-standard-1", GuestCpus: 1, MemoryMb: 3840},
+			{Name: "n1-standard-8", GuestCpus: 8, MemoryMb: 30720},
+			{Name: "n2-standard-8", GuestCpus: 8, MemoryMb: 32768},
+		},
+	}, nil
+}
@@ -18,10 +18,12 @@ package google
 
 import (
 	"bytes"
+	"strings"
 	"text/template"
 
 	"fmt"
 
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
 	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/machinesetup"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 )
@@ -32,15 +34,26 @@ type metadataParams struct {
 	Machine      *clusterv1.Machine
 	DockerImages []string
 	Project      string
+	Network      string
+	Subnetwork   string
 	Metadata     *machinesetup.Metadata
+	Accelerators []gceconfigv1.Accelerator
 
 	// These fields are set when executing the template if they are necessary.
-	PodCIDR        string
-	ServiceCIDR    string
-	MasterEndpoint string
+	PodCIDR              string
+	ServiceCIDR          string
+	MasterEndpoint       string
+	ControlPlaneEndpoint string
+	ControlPlaneJoin     bool
+
+	// Set for the instance templates of managed instance groups, whose
+	// instances get their machine and token from instance metadata.
+	InstanceGroup      bool
+	MachineMetadataKey string
+	TokenMetadataKey   string
 }
 
-func nodeMetadata(token string, cluster *clusterv1.Cluster, machine *clusterv1.Machine, project string, metadata *machinesetup.Metadata) (map[string]string, error) {
+func nodeMetadata(token string, cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, metadata *machinesetup.Metadata) (map[string]string, error) {
 	if len(cluster.Status.APIEndpoints) == 0 {
 		return nil, fmt.Errorf("master endpoint not found in apiEndpoints for cluster %v", cluster)
 	}
@@ -48,8 +61,11 @@ func nodeMetadata(token string, cluster *clusterv1.Cluster, machine *clusterv1.M
 		Token:          token,
 		Cluster:        cluster,
 		Machine:        machine,
-		Project:        project,
+		Project:        clusterConfig.Project,
+		Network:        networkName(cluster, clusterConfig),
+		Subnetwork:     subnetworkName(cluster, clusterConfig),
 		Metadata:       metadata,
+		Accelerators:   machineConfig.Accelerators,
 		PodCIDR:        getSubnet(cluster.Spec.ClusterNetwork.Pods),
 		ServiceCIDR:    getSubnet(cluster.Spec.ClusterNetwork.Services),
 		MasterEndpoint: getEndpoint(cluster.Status.APIEndpoints[0]),
@@ -60,19 +76,68 @@ func nodeMetadata(token string, cluster *clusterv1.Cluster, machine *clusterv1.M
 	if err := nodeEnvironmentVarsTemplate.Execute(&buf, params); err != nil {
 		return nil, err
 	}
-	buf.WriteString(params.Metadata.StartupScript)
+	writeStartupScript(&buf, params)
 	nodeMetadata["startup-script"] = buf.String()
 	return nodeMetadata, nil
 }
 
-func masterMetadata(cluster *clusterv1.Cluster, machine *clusterv1.Machine, project string, metadata *machinesetup.Metadata) (map[string]string, error) {
+// Returns the metadata of the instance template of a managed instance group.
+// It is shared by all instances of the group, so the machine an instance backs
+// and the token it joins the cluster with are left to the instance metadata
+// set when a machine claims the instance.
+func instanceGroupMetadata(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, metadata *machinesetup.Metadata) (map[string]string, error) {
+	if len(cluster.Status.APIEndpoints) == 0 {
+		return nil, fmt.Errorf("master endpoint not found in apiEndpoints for cluster %v", cluster)
+	}
 	params := metadataParams{
-		Cluster:     cluster,
-		Machine:     machine,
-		Project:     project,
-		Metadata:    metadata,
-		PodCIDR:     getSubnet(cluster.Spec.ClusterNetwork.Pods),
-		ServiceCIDR: getSubnet(cluster.Spec.ClusterNetwork.Services),
+		Cluster:            cluster,
+		Machine:            machine,
+		Project:            clusterConfig.Project,
+		Network:            networkName(cluster, clusterConfig),
+		Subnetwork:         subnetworkName(cluster, clusterConfig),
+		Metadata:           metadata,
+		Accelerators:       machineConfig.Accelerators,
+		PodCIDR:            getSubnet(cluster.Spec.ClusterNetwork.Pods),
+		ServiceCIDR:        getSubnet(cluster.Spec.ClusterNetwork.Services),
+		MasterEndpoint:     getEndpoint(cluster.Status.APIEndpoints[0]),
+		InstanceGroup:      true,
+		MachineMetadataKey: machineMetadataKey,
+		TokenMetadataKey:   tokenMetadataKey,
+	}
+
+	var buf bytes.Buffer
+	if err := nodeEnvironmentVarsTemplate.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+	writeStartupScript(&buf, params)
+	return map[string]string{"startup-script": buf.String()}, nil
+}
+
+// Returns the metadata of a master. Given a token, the master joins the
+// control plane behind the cluster's load balancer instead of initializing a
+// new one.
+func masterMetadata(token string, cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, metadata *machinesetup.Metadata) (map[string]string, error) {
+	// The load balancer address goes into the master's serving certificate,
+	// so it has to be known before the master is created.
+	if clusterConfig.LoadBalancer && len(cluster.Status.APIEndpoints) == 0 {
+		return nil, fmt.Errorf("waiting for the load balancer of cluster %v to get an address", cluster.Name)
+	}
+	params := metadataParams{
+		Cluster:              cluster,
+		Machine:              machine,
+		Project:              clusterConfig.Project,
+		Network:              networkName(cluster, clusterConfig),
+		Subnetwork:           subnetworkName(cluster, clusterConfig),
+		Metadata:             metadata,
+		Accelerators:         machineConfig.Accelerators,
+		PodCIDR:              getSubnet(cluster.Spec.ClusterNetwork.Pods),
+		ServiceCIDR:          getSubnet(cluster.Spec.ClusterNetwork.Services),
+		ControlPlaneEndpoint: controlPlaneEndpointHost(cluster, clusterConfig),
+	}
+	if token != "" {
+		params.Token = token
+		params.ControlPlaneJoin = true
+		params.MasterEndpoint = getEndpoint(cluster.Status.APIEndpoints[0])
 	}
 
 	masterMetadata := map[string]string{}
@@ -80,11 +145,24 @@ func masterMetadata(cluster *clusterv1.Cluster, machine *clusterv1.Machine, proj
 	if err := masterEnvironmentVarsTemplate.Execute(&buf, params); err != nil {
 		return nil, err
 	}
-	buf.WriteString(params.Metadata.StartupScript)
+	writeStartupScript(&buf, params)
 	masterMetadata["startup-script"] = buf.String()
 	return masterMetadata, nil
 }
 
+// Appends the startup script of the machine setup config to the environment
+// variables. On instances with accelerators, the config's accelerator driver
+// script runs first.
+func writeStartupScript(buf *bytes.Buffer, params metadataParams) {
+	if len(params.Accelerators) > 0 && params.Metadata.AcceleratorDriverScript != "" {
+		buf.WriteString(params.Metadata.AcceleratorDriverScript)
+		if !strings.HasSuffix(params.Metadata.AcceleratorDriverScript, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	buf.WriteString(params.Metadata.StartupScript)
+}
+
 func getEndpoint(apiEndpoint clusterv1.APIEndpoint) string {
 	return fmt.Sprintf("%s:%d", apiEndpoint.Host, apiEndpoint.Port)
 }
@@ -99,7 +177,7 @@ func init() {
 	nodeEnvironmentVarsTemplate = template.Must(template.New("nodeEnvironmentVars").Parse(nodeEnvironmentVars))
 }
 
-// TODO(kcoronado): replace with actual network and node tag args when they are added into provider config.
+// TODO(kcoronado): replace with actual node tag args when they are added into provider config.
 const masterEnvironmentVars = `
 #!/bin/bash
 KUBELET_VERSION={{ .Machine.Spec.Versions.Kubelet }}
@@ -115,28 +193,55 @@ POD_CIDR={{ .PodCIDR }}
 SERVICE_CIDR={{ .ServiceCIDR }}
 # Environment variables for GCE cloud config
 PROJECT={{ .Project }}
-NETWORK=default
-SUBNETWORK=kubernetes
+NETWORK={{ .Network }}
+SUBNETWORK={{ .Subnetwork }}
 CLUSTER_NAME={{ .Cluster.Name }}
 NODE_TAG="$CLUSTER_NAME-worker"
+# Address of the control plane load balancer, if any
+CONTROL_PLANE_ENDPOINT={{ .ControlPlaneEndpoint }}
+# Set when the master joins the control plane of an existing master
+CONTROL_PLANE_JOIN={{ .ControlPlaneJoin }}
+TOKEN={{ .Token }}
+MASTER={{ .MasterEndpoint }}
+# The accelerators attached to the instance, for startup scripts that install
+# their drivers. Comma-separated, in the same order in both variables. Empty if
+# there are none.
+ACCELERATOR_TYPE={{ range $i, $a := .Accelerators }}{{ if $i }},{{ end }}{{ $a.Type }}{{ end }}
+ACCELERATOR_COUNT={{ range $i, $a := .Accelerators }}{{ if $i }},{{ end }}{{ $a.Count }}{{ end }}
 `
 
 const nodeEnvironmentVars = `
 #!/bin/bash
 KUBELET_VERSION={{ .Machine.Spec.Versions.Kubelet }}
-TOKEN={{ .Token }}
 MASTER={{ .MasterEndpoint }}
+{{- if .InstanceGroup }}
+# Instances of managed instance groups learn which machine they back, and get
+# a token to join the cluster with, once a machine claims them.
+function instance_attribute() {
+	curl -sf -H "Metadata-Flavor: Google" "http://metadata.google.internal/computeMetadata/v1/instance/attributes/$1"
+}
+until MACHINE=$(instance_attribute {{ .MachineMetadataKey }}) && TOKEN=$(instance_attribute {{ .TokenMetadataKey }}); do
+	sleep 5
+done
+{{- else }}
+TOKEN={{ .Token }}
 NAMESPACE={{ .Machine.ObjectMeta.Namespace }}
 MACHINE=$NAMESPACE
 MACHINE+="/"
 MACHINE+={{ .Machine.ObjectMeta.Name }}
+{{- end }}
 CLUSTER_DNS_DOMAIN={{ .Cluster.Spec.ClusterNetwork.ServiceDomain }}
 POD_CIDR={{ .PodCIDR }}
 SERVICE_CIDR={{ .ServiceCIDR }}
 # Environment variables for GCE cloud config
 PROJECT={{ .Project }}
-NETWORK=default
-SUBNETWORK=kubernetes
+NETWORK={{ .Network }}
+SUBNETWORK={{ .Subnetwork }}
 CLUSTER_NAME={{ .Cluster.Name }}
 NODE_TAG="$CLUSTER_NAME-worker"
+# The accelerators attached to the instance, for startup scripts that install
+# their drivers. Comma-separated, in the same order in both variables. Empty if
+# there are none.
+ACCELERATOR_TYPE={{ range $i, $a := .Accelerators }}{{ if $i }},{{ end }}{{ $a.Type }}{{ end }}
+ACCELERATOR_COUNT={{ range $i, $a := .Accelerators }}{{ if $i }},{{ end }}{{ $a.Count }}{{ end }}
 `
@@ -0,0 +1,314 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultNetworkName   = "default"
+	defaultNodeCIDRRange = "10.0.0.0/20"
+
+	podsRangeSuffix     = "-pods"
+	servicesRangeSuffix = "-services"
+
+	routerSuffix = "-router"
+	natSuffix    = "-nat"
+
+	// The label that ties a machine to its cluster when clusters share a
+	// namespace.
+	machineClusterLabelName = "cluster.k8s.io/cluster-name"
+)
+
+// Returns the name of the VPC network used by the cluster.
+func networkName(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) string {
+	if clusterConfig.Network.Name != "" {
+		return clusterConfig.Network.Name
+	}
+	if clusterConfig.Network.Dedicated {
+		return cluster.Name
+	}
+	return defaultNetworkName
+}
+
+// Returns the name of the subnetwork used by the cluster. Auto subnet mode
+// networks name their subnetworks after the network itself, and dedicated
+// networks follow the same convention.
+func subnetworkName(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) string {
+	if clusterConfig.Network.Subnetwork == "" {
+		return networkName(cluster, clusterConfig)
+	}
+	return clusterConfig.Network.Subnetwork
+}
+
+// Returns the partial URL of the cluster's network, as accepted by instance
+// and firewall resources.
+func networkPath(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) string {
+	return fmt.Sprintf("global/networks/%s", networkName(cluster, clusterConfig))
+}
+
+// Returns the partial URL of the cluster's subnetwork in the region that
+// contains the given zone.
+func subnetworkPath(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, zone string) string {
+	return fmt.Sprintf("regions/%s/subnetworks/%s", regionForZone(zone), subnetworkName(cluster, clusterConfig))
+}
+
+// Returns the region a zone belongs to, e.g. us-central1 for us-central1-a.
+func regionForZone(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// Creates the cluster's network unless a network with that name already
+// exists, in which case it is used as is. Dedicated networks are created in
+// custom subnet mode along with their node subnetwork, everything else in
+// auto subnet mode. The network and subnetwork are recorded in the status.
+func (gce *GCEClusterClient) reconcileNetwork(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, status *gceconfigv1.GCEClusterProviderStatus) error {
+	name := networkName(cluster, clusterConfig)
+	dedicated := clusterConfig.Network.Dedicated
+	if dedicated && clusterConfig.Network.Region == "" {
+		return fmt.Errorf("a region is required for dedicated network %v", name)
+	}
+
+	network, err := gce.computeService.NetworksGet(clusterConfig.Project, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting network %v: %v", name, err)
+	}
+	var selfLink string
+	if err == nil {
+		selfLink = network.SelfLink
+	} else {
+		glog.Infof("Creating network %v.", name)
+		network := &compute.Network{
+			Name:                  name,
+			AutoCreateSubnetworks: !dedicated,
+			ForceSendFields:       []string{"AutoCreateSubnetworks"},
+		}
+		if dedicated {
+			network.Description = fmt.Sprintf("Network for cluster %v", cluster.Name)
+		}
+		op, err := gce.computeService.NetworksInsert(clusterConfig.Project, network)
+		if err != nil {
+			return fmt.Errorf("error creating network %v: %v", name, err)
+		}
+		if err := gce.computeService.WaitForOperation(clusterConfig.Project, op); err != nil {
+			return fmt.Errorf("error waiting for network %v creation: %v", name, err)
+		}
+		selfLink = targetLink(op)
+	}
+	status.Network = &gceconfigv1.ResourceStatus{Name: name, SelfLink: selfLink}
+
+	if !dedicated {
+		return nil
+	}
+	return gce.createSubnetworkIfNotExists(cluster, clusterConfig, status)
+}
+
+func (gce *GCEClusterClient) createSubnetworkIfNotExists(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, status *gceconfigv1.GCEClusterProviderStatus) error {
+	name := subnetworkName(cluster, clusterConfig)
+	region := clusterConfig.Network.Region
+	subnetwork, err := gce.computeService.SubnetworksGet(clusterConfig.Project, region, name)
+	if err == nil {
+		status.Subnetwork = &gceconfigv1.ResourceStatus{Name: name, SelfLink: subnetwork.SelfLink}
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting subnetwork %v: %v", name, err)
+	}
+
+	ipCidrRange := clusterConfig.Network.NodeCIDRRange
+	if ipCidrRange == "" {
+		ipCidrRange = defaultNodeCIDRRange
+	}
+	glog.Infof("Creating subnetwork %v in %v.", name, region)
+	op, err := gce.computeService.SubnetworksInsert(clusterConfig.Project, region, &compute.Subnetwork{
+		Name:                  name,
+		Network:               networkPath(cluster, clusterConfig),
+		IpCidrRange:           ipCidrRange,
+		PrivateIpGoogleAccess: true,
+		SecondaryIpRanges:     newSecondaryRanges(cluster, name),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating subnetwork %v: %v", name, err)
+	}
+	if err := gce.computeService.WaitForOperation(clusterConfig.Project, op); err != nil {
+		return fmt.Errorf("error waiting for subnetwork %v creation: %v", name, err)
+	}
+	status.Subnetwork = &gceconfigv1.ResourceStatus{Name: name, SelfLink: targetLink(op)}
+	return nil
+}
+
+// Returns the secondary ranges of a dedicated node subnetwork, one for the
+// cluster's pods and one for its services, named after the subnetwork.
+func newSecondaryRanges(cluster *clusterv1.Cluster, subnetwork string) []*compute.SubnetworkSecondaryRange {
+	var ranges []*compute.SubnetworkSecondaryRange
+	if podCIDR := getSubnet(cluster.Spec.ClusterNetwork.Pods); podCIDR != "" {
+		ranges = append(ranges, &compute.SubnetworkSecondaryRange{
+			RangeName:   subnetwork + podsRangeSuffix,
+			IpCidrRange: podCIDR,
+		})
+	}
+	if serviceCIDR := getSubnet(cluster.Spec.ClusterNetwork.Services); serviceCIDR != "" {
+		ranges = append(ranges, &compute.SubnetworkSecondaryRange{
+			RangeName:   subnetwork + servicesRangeSuffix,
+			IpCidrRange: serviceCIDR,
+		})
+	}
+	return ranges
+}
+
+// Returns the name of the Cloud Router that hosts the cluster's Cloud NAT
+// gateway.
+func routerName(cluster *clusterv1.Cluster) string {
+	return cluster.Name + routerSuffix
+}
+
+// Creates a Cloud Router with a Cloud NAT gateway for all subnetworks of the
+// cluster's network in Network.Region, unless the router already exists.
+// The router is recorded in the status.
+func (gce *GCEClusterClient) reconcileCloudNAT(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig, status *gceconfigv1.GCEClusterProviderStatus) error {
+	if !clusterConfig.Network.CloudNAT {
+		return nil
+	}
+	region := clusterConfig.Network.Region
+	if region == "" {
+		return fmt.Errorf("a region is required for the Cloud NAT of cluster %v", cluster.Name)
+	}
+
+	name := routerName(cluster)
+	router, err := gce.computeService.RoutersGet(clusterConfig.Project, region, name)
+	if err == nil {
+		status.Router = &gceconfigv1.ResourceStatus{Name: name, SelfLink: router.SelfLink}
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("error getting router %v: %v", name, err)
+	}
+
+	glog.Infof("Creating router %v with Cloud NAT in %v.", name, region)
+	op, err := gce.computeService.RoutersInsert(clusterConfig.Project, region, &compute.Router{
+		Name:        name,
+		Description: fmt.Sprintf("Cloud NAT for cluster %v", cluster.Name),
+		Network:     networkPath(cluster, clusterConfig),
+		Nats: []*compute.RouterNat{
+			{
+				Name:                          cluster.Name + natSuffix,
+				NatIpAllocateOption:           "AUTO_ONLY",
+				SourceSubnetworkIpRangesToNat: "ALL_SUBNETWORKS_ALL_IP_RANGES",
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating router %v: %v", name, err)
+	}
+	if err := gce.computeService.WaitForOperation(clusterConfig.Project, op); err != nil {
+		return fmt.Errorf("error waiting for router %v creation: %v", name, err)
+	}
+	status.Router = &gceconfigv1.ResourceStatus{Name: name, SelfLink: targetLink(op)}
+	return nil
+}
+
+// Deletes the cluster's Cloud Router, and with it the Cloud NAT gateway.
+func (gce *GCEClusterClient) deleteCloudNAT(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) error {
+	if !clusterConfig.Network.CloudNAT {
+		return nil
+	}
+
+	name := routerName(cluster)
+	op, err := gce.computeService.RoutersDelete(clusterConfig.Project, clusterConfig.Network.Region, name)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(clusterConfig.Project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting router %v: %v", name, err)
+	}
+	return nil
+}
+
+// Returns an error while machines of the cluster still exist, as their
+// instances keep the network in use.
+func (gce *GCEClusterClient) checkNoMachinesRemain(cluster *clusterv1.Cluster) error {
+	machines := &clusterv1.MachineList{}
+	if err := gce.client.List(context.Background(), client.InNamespace(cluster.Namespace), machines); err != nil {
+		return fmt.Errorf("error listing machines: %v", err)
+	}
+	remaining := 0
+	for i := range machines.Items {
+		if isMachineOfCluster(&machines.Items[i], cluster) {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("waiting for %d machine(s) to be deleted", remaining)
+	}
+	return nil
+}
+
+// Returns whether the machine belongs to the cluster. Machines that are
+// neither labeled with nor owned by a cluster belong to the cluster of their
+// namespace, as the machine controller assumes.
+func isMachineOfCluster(machine *clusterv1.Machine, cluster *clusterv1.Cluster) bool {
+	if name, ok := machine.Labels[machineClusterLabelName]; ok {
+		return name == cluster.Name
+	}
+	for _, ref := range machine.OwnerReferences {
+		if ref.Kind == "Cluster" && ref.APIVersion == clusterv1.SchemeGroupVersion.String() {
+			return ref.Name == cluster.Name
+		}
+	}
+	return true
+}
+
+// Deletes the cluster's dedicated network and its node subnetwork. Networks
+// the cluster does not own are left alone.
+func (gce *GCEClusterClient) deleteNetwork(cluster *clusterv1.Cluster, clusterConfig *gceconfigv1.GCEClusterProviderConfig) error {
+	if !clusterConfig.Network.Dedicated {
+		return nil
+	}
+
+	subnetwork := subnetworkName(cluster, clusterConfig)
+	op, err := gce.computeService.SubnetworksDelete(clusterConfig.Project, clusterConfig.Network.Region, subnetwork)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(clusterConfig.Project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting subnetwork %v: %v", subnetwork, err)
+	}
+
+	network := networkName(cluster, clusterConfig)
+	op, err = gce.computeService.NetworksDelete(clusterConfig.Project, network)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(clusterConfig.Project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting network %v: %v", network, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"encoding/json"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+// Returns the provider status of the cluster. Resources that older versions
+// recorded in annotations are merged in, so that they are migrated into the
+// status the next time the cluster actuator writes it.
+func clusterProviderStatus(cluster *clusterv1.Cluster) (*gceconfigv1.GCEClusterProviderStatus, error) {
+	status := &gceconfigv1.GCEClusterProviderStatus{}
+	if cluster.Status.ProviderStatus != nil && len(cluster.Status.ProviderStatus.Raw) > 0 {
+		if err := json.Unmarshal(cluster.Status.ProviderStatus.Raw, status); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, value := range cluster.ObjectMeta.Annotations {
+		if strings.HasPrefix(key, ClusterAnnotationPrefix) {
+			email := serviceAccountEmail(status, strings.TrimPrefix(key, ClusterAnnotationPrefix))
+			if email != nil && *email == "" {
+				*email = value
+			}
+		} else if strings.HasPrefix(key, firewallRuleAnnotationPrefix) && value == "true" {
+			name := strings.TrimPrefix(key, firewallRuleAnnotationPrefix)
+			if findResource(status.FirewallRules, name) == nil {
+				status.FirewallRules = append(status.FirewallRules, gceconfigv1.ResourceStatus{Name: name})
+			}
+		}
+	}
+	return status, nil
+}
+
+// Writes the provider status into the cluster object. It is up to the caller
+// to persist it.
+func setClusterProviderStatus(cluster *clusterv1.Cluster, status *gceconfigv1.GCEClusterProviderStatus) error {
+	status.APIVersion = gceconfigv1.SchemeGroupVersion.String()
+	status.Kind = "GCEClusterProviderStatus"
+	raw, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	cluster.Status.ProviderStatus = &runtime.RawExtension{Raw: raw}
+	return nil
+}
+
+// Removes the annotations older versions recorded cluster resources in.
+// Returns false if there were none.
+func removeLegacyClusterAnnotations(cluster *clusterv1.Cluster) bool {
+	removed := false
+	for key := range cluster.ObjectMeta.Annotations {
+		if strings.HasPrefix(key, ClusterAnnotationPrefix) || strings.HasPrefix(key, firewallRuleAnnotationPrefix) {
+			delete(cluster.ObjectMeta.Annotations, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// Returns the field of the status that holds the email of the service
+// account with the given prefix, or nil for unknown prefixes.
+func serviceAccountEmail(status *gceconfigv1.GCEClusterProviderStatus, serviceAccountPrefix string) *string {
+	switch serviceAccountPrefix {
+	case MasterNodeServiceAccountPrefix:
+		return &status.ServiceAccounts.Master
+	case WorkerNodeServiceAccountPrefix:
+		return &status.ServiceAccounts.Worker
+	case IngressControllerServiceAccountPrefix:
+		return &status.ServiceAccounts.IngressController
+	case MachineControllerServiceAccountPrefix:
+		return &status.ServiceAccounts.MachineController
+	}
+	return nil
+}
+
+func findResource(resources []gceconfigv1.ResourceStatus, name string) *gceconfigv1.ResourceStatus {
+	for i := range resources {
+		if resources[i].Name == name {
+			return &resources[i]
+		}
+	}
+	return nil
+}
+
+// Records a resource in the list, replacing an earlier record of it.
+func setResource(resources []gceconfigv1.ResourceStatus, resource gceconfigv1.ResourceStatus) []gceconfigv1.ResourceStatus {
+	if r := findResource(resources, resource.Name); r != nil {
+		*r = resource
+		return resources
+	}
+	return append(resources, resource)
+}
+
+// Returns the URL of the resource an operation acted on.
+func targetLink(op *compute.Operation) string {
+	if op == nil {
+		return ""
+	}
+	return op.TargetLink
+}
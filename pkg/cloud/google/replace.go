@@ -0,0 +1,434 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
+	commonerrors "sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+// A master is replaced by running these phases in order. Like an in-place
+// upgrade, the phase a replacement reached is recorded in the machine's
+// provider status before it runs, and every phase can safely run again.
+var masterReplacementPhases = []gceconfigv1.GCEMachineReplacementPhase{
+	gceconfigv1.ReplacementCreate,
+	gceconfigv1.ReplacementJoin,
+	gceconfigv1.ReplacementDrain,
+	gceconfigv1.ReplacementRemoveEtcdMember,
+	gceconfigv1.ReplacementDeleteInstance,
+}
+
+// A machine without the Master role is replaced by running these phases in
+// order. Its new instance joins the cluster before the old node is drained,
+// so that the cluster keeps its capacity.
+var workerReplacementPhases = []gceconfigv1.GCEMachineReplacementPhase{
+	gceconfigv1.ReplacementCreate,
+	gceconfigv1.ReplacementJoin,
+	gceconfigv1.ReplacementDrain,
+	gceconfigv1.ReplacementDeleteInstance,
+}
+
+const (
+	// How long a new instance may take to join the cluster and become
+	// healthy, and how often it is checked meanwhile.
+	joinTimeout              = 20 * time.Minute
+	replacementCheckInterval = 30 * time.Second
+)
+
+// Runs the current phase of a replacement. The status locates the machine's
+// old instance.
+type replacementPhaseFunc func(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, status *gceconfigv1.GCEMachineProviderStatus, replacement *gceconfigv1.GCEMachineReplacementStatus) error
+
+func isReplaceUpgrade(config *gceconfigv1.GCEMachineProviderConfig) bool {
+	return config.UpgradeStrategy == gceconfigv1.ReplaceUpgrade
+}
+
+// Replaces the instance of a master with a new one created from the machine's
+// spec. The new instance joins the control plane behind the cluster's load
+// balancer, and once it is healthy, the old instance is drained, removed from
+// etcd and deleted. The new instance becomes the machine's instance when the
+// replacement completes.
+func (gce *GCEClient) replaceMaster(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig) error {
+	if !clusterConfig.LoadBalancer {
+		return gce.handleMachineError(machine, &apierrors.MachineError{
+			Reason:  commonerrors.UnsupportedChangeMachineError,
+			Message: fmt.Sprintf("Cannot replace master %v: cluster %v has no load balancer", machine.ObjectMeta.Name, cluster.Name),
+		}, noEventAction)
+	}
+	return gce.replaceInstance(cluster, machine, clusterConfig, machineConfig, masterReplacementPhases, gce.runMasterReplacementPhase)
+}
+
+// Replaces the instance of a machine without the Master role with a new one
+// created from the machine's spec. Once the node of the new instance is
+// ready, the old node is cordoned and drained through the cluster's API
+// server, and the old instance and its node are deleted. The old instance
+// keeps running if the new one cannot be created or the drain fails.
+func (gce *GCEClient) replaceWorker(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig) error {
+	return gce.replaceInstance(cluster, machine, clusterConfig, machineConfig, workerReplacementPhases, gce.runWorkerReplacementPhase)
+}
+
+// Replaces the instance of a machine the way its roles call for.
+func (gce *GCEClient) replaceMachineInstance(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig) error {
+	if isMaster(machineConfig.Roles) {
+		return gce.replaceMaster(cluster, machine, clusterConfig, machineConfig)
+	}
+	return gce.replaceWorker(cluster, machine, clusterConfig, machineConfig)
+}
+
+// Runs the given phases of the replacement of a machine's instance, starting
+// a new replacement unless one is under way or failed for the same spec.
+func (gce *GCEClient) replaceInstance(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, phases []gceconfigv1.GCEMachineReplacementPhase, runPhase replacementPhaseFunc) error {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	hash, err := providerConfigHash(machineConfig)
+	if err != nil {
+		return err
+	}
+
+	replacement := status.Replacement
+	if replacement == nil || replacement.Phase == gceconfigv1.ReplacementFailed && !replacesWith(replacement, hash, machine.Spec.Versions) {
+		if source := attachedDiskSource(machineConfig); source != "" {
+			return gce.handleMachineError(machine, &apierrors.MachineError{
+				Reason:  commonerrors.UnsupportedChangeMachineError,
+				Message: fmt.Sprintf("Cannot replace instance %v of machine %v: the new instance cannot attach disk %v while the old one holds it", status.InstanceName, machine.ObjectMeta.Name, source),
+			}, noEventAction)
+		}
+		if replacement != nil {
+			if err := gce.cleanUpFailedReplacement(cluster, machine, clusterConfig, machineConfig, replacement); err != nil {
+				return err
+			}
+		}
+		now := metav1.Now()
+		replacement = &gceconfigv1.GCEMachineReplacementStatus{
+			Zone:               machineConfig.Zone,
+			InstanceName:       replacementInstanceName(machine, now.Time),
+			ProviderConfigHash: hash,
+			ControlPlane:       machine.Spec.Versions.ControlPlane,
+			Kubelet:            machine.Spec.Versions.Kubelet,
+			Phase:              phases[0],
+			StartTime:          now,
+			PhaseStartTime:     now,
+		}
+		glog.Infof("Replacing instance %v of machine %v with %v", status.InstanceName, machine.ObjectMeta.Name, replacement.InstanceName)
+		if err := gce.recordReplacementStatus(machine, replacement); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if replacement.Phase == gceconfigv1.ReplacementFailed {
+			return fmt.Errorf("replacement of machine %v failed: %v", machine.ObjectMeta.Name, replacement.Message)
+		}
+		glog.Infof("Running replacement phase %v of machine %v", replacement.Phase, machine.ObjectMeta.Name)
+		next := nextReplacementPhase(phases, replacement.Phase)
+		if err := runPhase(cluster, machine, clusterConfig, machineConfig, status, replacement); err != nil {
+			if _, ok := err.(*upgradeError); !ok {
+				return err
+			}
+			replacement.Message = fmt.Sprintf("phase %v failed: %v", replacement.Phase, err)
+			next = gceconfigv1.ReplacementFailed
+		}
+		if next == "" {
+			gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Replaced", "Replaced instance %v of Machine %v with %v", status.InstanceName, machine.ObjectMeta.Name, replacement.InstanceName)
+			// The replacement is cleared when the new instance is
+			// recorded.
+			if err := gce.setReplacementStatus(machine, nil); err != nil {
+				return err
+			}
+			versions := clusterv1.MachineVersionInfo{ControlPlane: replacement.ControlPlane, Kubelet: replacement.Kubelet}
+			return gce.storeInstanceStatus(machine, clusterConfig.Project, replacement.Zone, replacement.InstanceName, "", replacement.ProviderConfigHash, versions)
+		}
+		replacement.Phase = next
+		replacement.PhaseStartTime = metav1.Now()
+		if err := gce.recordReplacementStatus(machine, replacement); err != nil {
+			return err
+		}
+		if next == gceconfigv1.ReplacementFailed {
+			gce.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedReplacement", "Replacement of Machine %v failed: %v", machine.ObjectMeta.Name, replacement.Message)
+			return gce.handleMachineError(machine, &apierrors.MachineError{
+				Reason:  commonerrors.UnsupportedChangeMachineError,
+				Message: fmt.Sprintf("Replacement of instance %v with %v failed: %v", status.InstanceName, replacement.InstanceName, replacement.Message),
+			}, noEventAction)
+		}
+	}
+}
+
+// Returns the first existing disk the machine attaches, or "" if it creates
+// all its disks.
+func attachedDiskSource(config *gceconfigv1.GCEMachineProviderConfig) string {
+	for _, disk := range config.Disks {
+		if disk.Source != "" {
+			return disk.Source
+		}
+	}
+	return ""
+}
+
+// Returns whether the replacement can stop and leave the machine with its
+// instance: it failed, or the old instance is not being drained yet.
+func canAbandonReplacement(replacement *gceconfigv1.GCEMachineReplacementStatus) bool {
+	switch replacement.Phase {
+	case gceconfigv1.ReplacementCreate, gceconfigv1.ReplacementJoin, gceconfigv1.ReplacementFailed:
+		return true
+	}
+	return false
+}
+
+// Stops the replacement of a machine whose spec no longer calls for it, and
+// cleans up after it.
+func (gce *GCEClient) abandonReplacement(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	glog.Infof("Abandoning the replacement of machine %v with %v", machine.ObjectMeta.Name, replacement.InstanceName)
+	if err := gce.cleanUpFailedReplacement(cluster, machine, clusterConfig, machineConfig, replacement); err != nil {
+		return err
+	}
+	return gce.recordReplacementStatus(machine, nil)
+}
+
+// Cleans up after a failed or abandoned replacement. The instance of a master
+// replacement may have joined etcd, so it is left for the operator. That of
+// any other machine is deleted along with its node.
+func (gce *GCEClient) cleanUpFailedReplacement(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	if isMaster(machineConfig.Roles) {
+		glog.Warningf("Leaving instance %v of the replacement of master %v", replacement.InstanceName, machine.ObjectMeta.Name)
+		return nil
+	}
+	glog.Infof("Deleting instance %v of the replacement of machine %v", replacement.InstanceName, machine.ObjectMeta.Name)
+	if err := gce.deleteReplacementInstance(clusterConfig.Project, replacement); err != nil {
+		return err
+	}
+	nodes, err := gce.targetClusterClient(cluster, machine)
+	if err != nil {
+		return err
+	}
+	return deleteNode(nodes, replacement.InstanceName)
+}
+
+// Returns whether the replacement creates an instance from the given provider
+// config hash and versions.
+func replacesWith(replacement *gceconfigv1.GCEMachineReplacementStatus, hash string, versions clusterv1.MachineVersionInfo) bool {
+	return replacement.ProviderConfigHash == hash && replacement.ControlPlane == versions.ControlPlane && replacement.Kubelet == versions.Kubelet
+}
+
+// Returns a name for a new instance of the machine, made unique by the time it
+// is created. GCE limits instance names to 63 characters.
+func replacementInstanceName(machine *clusterv1.Machine, now time.Time) string {
+	suffix := "-" + strconv.FormatInt(now.Unix(), 36)
+	name := machine.ObjectMeta.Name
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// Runs the current phase of the replacement of a master.
+func (gce *GCEClient) runMasterReplacementPhase(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, status *gceconfigv1.GCEMachineProviderStatus, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	project := clusterConfig.Project
+	oldProject, oldZone, oldName := instanceLocation(status, clusterConfig, machineConfig, machine)
+
+	switch replacement.Phase {
+	case gceconfigv1.ReplacementCreate:
+		return gce.createReplacementInstance(cluster, machine, clusterConfig, machineConfig, replacement)
+
+	case gceconfigv1.ReplacementJoin:
+		if _, err := gce.instanceSshCommand(project, replacement.Zone, replacement.InstanceName, masterHealthCommand()); err != nil {
+			if time.Since(replacement.PhaseStartTime.Time) > joinTimeout {
+				return &upgradeError{fmt.Sprintf("instance %v did not become healthy within %v: %v", replacement.InstanceName, joinTimeout, err)}
+			}
+			glog.Infof("Waiting for instance %v to join the control plane: %v", replacement.InstanceName, err)
+			return &controllererror.RequeueAfterError{RequeueAfter: replacementCheckInterval}
+		}
+		return nil
+
+	case gceconfigv1.ReplacementDrain:
+		// The old node is drained through the new master, which stays
+		// reachable while the old one goes away.
+		cmd := fmt.Sprintf("set -e; node=$(sudo kubectl --kubeconfig %s get node %s -o name --ignore-not-found); [ -z \"$node\" ] || %s",
+			adminKubeConfig, oldName, gce.drainCommand(oldName))
+		_, err := gce.instanceSshCommand(project, replacement.Zone, replacement.InstanceName, cmd)
+		return err
+
+	case gceconfigv1.ReplacementRemoveEtcdMember:
+		return gce.removeEtcdMember(project, replacement.Zone, replacement.InstanceName, oldName)
+
+	case gceconfigv1.ReplacementDeleteInstance:
+		if err := gce.deleteInstance(oldProject, oldZone, oldName); err != nil {
+			return err
+		}
+		cmd := fmt.Sprintf("sudo kubectl --kubeconfig %s delete node %s --ignore-not-found", adminKubeConfig, oldName)
+		_, err := gce.instanceSshCommand(project, replacement.Zone, replacement.InstanceName, cmd)
+		return err
+	}
+	return &upgradeError{fmt.Sprintf("unknown replacement phase %v", replacement.Phase)}
+}
+
+// Runs the current phase of the replacement of a machine without the Master
+// role. Unlike masters, its nodes are managed through the cluster's API
+// server, as the machine controller cannot reach them over SSH through a
+// master.
+func (gce *GCEClient) runWorkerReplacementPhase(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, status *gceconfigv1.GCEMachineProviderStatus, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	oldProject, oldZone, oldName := instanceLocation(status, clusterConfig, machineConfig, machine)
+	// The cluster must be reachable before a new instance is created, or
+	// the old node could not be drained.
+	nodes, err := gce.targetClusterClient(cluster, machine)
+	if err != nil {
+		return err
+	}
+
+	switch replacement.Phase {
+	case gceconfigv1.ReplacementCreate:
+		return gce.createReplacementInstance(cluster, machine, clusterConfig, machineConfig, replacement)
+
+	case gceconfigv1.ReplacementJoin:
+		ready, err := isNodeReady(nodes, replacement.InstanceName)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		if time.Since(replacement.PhaseStartTime.Time) > joinTimeout {
+			return &upgradeError{fmt.Sprintf("node %v did not become ready within %v", replacement.InstanceName, joinTimeout)}
+		}
+		glog.Infof("Waiting for node %v to become ready", replacement.InstanceName)
+		return &controllererror.RequeueAfterError{RequeueAfter: replacementCheckInterval}
+
+	case gceconfigv1.ReplacementDrain:
+		err := gce.drainNode(nodes, oldName, replacement.PhaseStartTime.Time)
+		if _, ok := err.(*upgradeError); ok {
+			// The old node takes pods again while the replacement
+			// waits for the machine's spec to change.
+			if err := setNodeUnschedulable(nodes, oldName, false); err != nil {
+				return err
+			}
+		}
+		return err
+
+	case gceconfigv1.ReplacementDeleteInstance:
+		if err := gce.deleteInstance(oldProject, oldZone, oldName); err != nil {
+			return err
+		}
+		return deleteNode(nodes, oldName)
+	}
+	return &upgradeError{fmt.Sprintf("unknown replacement phase %v", replacement.Phase)}
+}
+
+// Creates the new instance of a replacement unless it already exists, and
+// adds it to the cluster's load balancer if it replaces a master.
+func (gce *GCEClient) createReplacementInstance(cluster *clusterv1.Cluster, machine *clusterv1.Machine, clusterConfig *gceconfigv1.GCEClusterProviderConfig, machineConfig *gceconfigv1.GCEMachineProviderConfig, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	_, err := gce.computeService.InstancesGet(clusterConfig.Project, replacement.Zone, replacement.InstanceName)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if err != nil {
+		configParams, imagePath, err := gce.machineImage(machine, machineConfig)
+		if err != nil {
+			return err
+		}
+		if err := gce.createInstance(cluster, machine, clusterConfig, machineConfig, configParams, imagePath, replacement.Zone, replacement.InstanceName); err != nil {
+			return err
+		}
+	}
+	return gce.joinLoadBalancer(cluster, clusterConfig, machineConfig, replacement.Zone, replacement.InstanceName)
+}
+
+func nextReplacementPhase(phases []gceconfigv1.GCEMachineReplacementPhase, phase gceconfigv1.GCEMachineReplacementPhase) gceconfigv1.GCEMachineReplacementPhase {
+	for i := range phases[:len(phases)-1] {
+		if phases[i] == phase {
+			return phases[i+1]
+		}
+	}
+	return ""
+}
+
+// Returns the command that succeeds once the node of the master is ready and
+// its etcd member is healthy.
+func masterHealthCommand() string {
+	ready := fmt.Sprintf("[ \"$(sudo kubectl --kubeconfig %s get node $(hostname) -o jsonpath='{.status.conditions[?(@.type==\"Ready\")].status}')\" = True ]", adminKubeConfig)
+	return ready + " && " + etcdctlCommand("endpoint health")
+}
+
+// Removes the etcd member of the given master through the etcd member of
+// another master. Nothing is done if the member is already gone.
+func (gce *GCEClient) removeEtcdMember(project string, zone string, instance string, member string) error {
+	output, err := gce.instanceSshCommand(project, zone, instance, etcdctlCommand("member list"))
+	if err != nil {
+		return err
+	}
+	// Members are listed as: ID, status, name, peer URLs, client URLs.
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, ", ")
+		if len(fields) < 3 || fields[2] != member {
+			continue
+		}
+		glog.Infof("Removing etcd member %v (%v)", member, fields[0])
+		_, err := gce.instanceSshCommand(project, zone, instance, etcdctlCommand("member remove "+fields[0]))
+		return err
+	}
+	return nil
+}
+
+// Records the replacement in the machine's provider status.
+func (gce *GCEClient) recordReplacementStatus(machine *clusterv1.Machine, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	if err := gce.setReplacementStatus(machine, replacement); err != nil {
+		return err
+	}
+	return gce.storeMachineStatus(machine)
+}
+
+// Sets the replacement in the provider status of the machine without storing
+// it.
+func (gce *GCEClient) setReplacementStatus(machine *clusterv1.Machine, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	status.Replacement = replacement
+	return setMachineProviderStatus(machine, status)
+}
+
+// Deletes the new instance of a replacement that is under way or failed.
+func (gce *GCEClient) deleteReplacementInstance(project string, replacement *gceconfigv1.GCEMachineReplacementStatus) error {
+	return gce.deleteInstance(project, replacement.Zone, replacement.InstanceName)
+}
+
+// Deletes an instance and waits until it is gone. Nothing is done if it is
+// already gone.
+func (gce *GCEClient) deleteInstance(project string, zone string, name string) error {
+	op, err := gce.computeService.InstancesDelete(project, zone, name)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting instance %v: %v", name, err)
+	}
+	return nil
+}
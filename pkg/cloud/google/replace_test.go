@@ -0,0 +1,527 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const etcdMemberList = "8e9e05c52164694d, started, master-0, https://10.0.0.2:2380, https://10.0.0.2:2379\n" +
+	"91bc3c398fb3c146, started, master-0-new, https://10.0.0.3:2380, https://10.0.0.3:2379\n"
+
+func TestMasterReplacement(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	f := newReplacingMaster(t, server, newLoadBalancedClusterFixture(t))
+	server.Respond(sshResponses{output: map[string]string{"member list": etcdMemberList}})
+
+	if err := f.gce.Update(f.cluster, upgradeMachine(t, f.client, f.master, "1.10.0", "1.10.0")); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+
+	stored := getMachine(t, f.client, f.master)
+	status := getMachineProviderStatus(t, stored)
+	name := status.InstanceName
+	if !strings.HasPrefix(name, "master-0-") || f.instances[name] == nil {
+		t.Fatalf("expected a new instance to be recorded, got '%v'", name)
+	}
+	if status.Replacement != nil {
+		t.Errorf("expected the completed replacement to be cleared, got '%+v'", status.Replacement)
+	}
+	if versions := stored.Status.Versions; versions == nil || versions.ControlPlane != "1.10.0" || versions.Kubelet != "1.10.0" {
+		t.Errorf("expected the versions to be upgraded, got '%+v'", versions)
+	}
+	if _, ok := f.instances["master-0"]; ok || strings.Join(f.deleted, ",") != "master-0" {
+		t.Errorf("expected the old instance to be deleted, got '%v'", f.deleted)
+	}
+	// The new instance joins the control plane of the old one.
+	startupScript := getMetadataItem(t, f.instances[name].Metadata, "startup-script")
+	checkStartupScriptContains(t, *startupScript.Value, "CONTROL_PLANE_JOIN=true\n", "CONTROL_PLANE_VERSION=1.10.0\n")
+
+	checkCommandPrefixes(t, server.Commands(), []string{
+		"[ \"$(sudo kubectl --kubeconfig /etc/kubernetes/admin.conf get node $(hostname)",
+		"set -e; node=$(sudo kubectl --kubeconfig /etc/kubernetes/admin.conf get node master-0 -o name --ignore-not-found); [ -z \"$node\" ] || sudo kubectl --kubeconfig /etc/kubernetes/admin.conf drain master-0",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf -n kube-system exec etcd-$(hostname) -- sh -c 'ETCDCTL_API=3 etcdctl",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf -n kube-system exec etcd-$(hostname) -- sh -c 'ETCDCTL_API=3 etcdctl",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf delete node master-0 --ignore-not-found",
+	})
+
+	// The next upgrade runs on the new instance and node.
+	if err := f.gce.Update(f.cluster, upgradeMachine(t, f.client, f.master, "1.10.0", "1.10.0")); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	if commands := server.Commands(); len(commands) != 0 {
+		t.Errorf("expected no commands for an up to date master, got '%v'", commands)
+	}
+}
+
+func TestMasterReplacementRemovesOldEtcdMember(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	f := newReplacingMaster(t, server, newLoadBalancedClusterFixture(t))
+	server.Respond(sshResponses{output: map[string]string{"member list": etcdMemberList}})
+
+	if err := f.gce.Update(f.cluster, upgradeKubelet(t, f.client, f.master)); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	var removed []string
+	for _, command := range server.Commands() {
+		if strings.Contains(command, "member remove") {
+			removed = append(removed, command)
+		}
+	}
+	if len(removed) != 1 || !strings.HasSuffix(removed[0], "member remove 8e9e05c52164694d'") {
+		t.Errorf("expected etcd member master-0 to be removed, got '%v'", removed)
+	}
+}
+
+func TestMasterReplacementWaitsForJoin(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	f := newReplacingMaster(t, server, newLoadBalancedClusterFixture(t))
+	server.Respond(sshResponses{fail: "[ \"$(sudo kubectl"})
+
+	err := f.gce.Update(f.cluster, upgradeKubelet(t, f.client, f.master))
+	if _, ok := err.(*controllererror.RequeueAfterError); !ok {
+		t.Fatalf("expected the replacement to wait for the new master, got '%v'", err)
+	}
+	stored := getMachine(t, f.client, f.master)
+	status := getMachineProviderStatus(t, stored)
+	if status.InstanceName != "master-0" {
+		t.Errorf("expected the old instance to remain the machine's instance, got '%v'", status.InstanceName)
+	}
+	replacement := status.Replacement
+	if replacement == nil || replacement.Phase != gceconfigv1.ReplacementJoin || f.instances[replacement.InstanceName] == nil {
+		t.Fatalf("expected the replacement to wait in phase Join, got '%+v'", replacement)
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("expected no instance to be deleted, got '%v'", f.deleted)
+	}
+
+	// A new master that doesn't become healthy in time fails the replacement.
+	replacement.PhaseStartTime.Time = replacement.PhaseStartTime.Add(-time.Hour)
+	setStoredProviderStatus(t, f.client, stored, status)
+	err = f.gce.Update(f.cluster, upgradeKubelet(t, f.client, f.master))
+	if err == nil || !strings.Contains(err.Error(), "did not become healthy") {
+		t.Fatalf("expected the replacement to fail, got '%v'", err)
+	}
+	stored = getMachine(t, f.client, f.master)
+	if replacement := getMachineProviderStatus(t, stored).Replacement; replacement == nil || replacement.Phase != gceconfigv1.ReplacementFailed {
+		t.Errorf("expected the replacement to have failed, got '%+v'", replacement)
+	}
+	if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.UnsupportedChangeMachineError {
+		t.Errorf("expected error reason UnsupportedChange, got '%v'", stored.Status.ErrorReason)
+	}
+	if len(f.deleted) != 0 || len(f.instances) != 2 {
+		t.Errorf("expected both instances to be left, got '%v'", f.instances)
+	}
+
+	// Deleting the machine deletes both instances.
+	if err := f.gce.Delete(f.cluster, stored); err != nil {
+		t.Fatalf("unable to delete master: %v", err)
+	}
+	if len(f.instances) != 0 {
+		t.Errorf("expected all instances to be deleted, got '%v'", f.instances)
+	}
+}
+
+func TestMasterReplacementRequiresLoadBalancer(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	f := newReplacingMaster(t, server, newDefaultClusterFixture(t))
+
+	err := f.gce.Update(f.cluster, upgradeKubelet(t, f.client, f.master))
+	if err == nil || !strings.Contains(err.Error(), "no load balancer") {
+		t.Fatalf("expected an error, got '%v'", err)
+	}
+	if len(f.instances) != 1 || len(server.Commands()) != 0 {
+		t.Errorf("expected the master to be left alone, got instances '%v'", f.instances)
+	}
+	stored := getMachine(t, f.client, f.master)
+	if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.UnsupportedChangeMachineError {
+		t.Errorf("expected error reason UnsupportedChange, got '%v'", stored.Status.ErrorReason)
+	}
+}
+
+func TestUnknownUpgradeStrategy(t *testing.T) {
+	_, computeServiceMock := newInsertInstanceCapturingMock()
+	config := newGCEMachineProviderConfigFixture()
+	config.UpgradeStrategy = "Recreate"
+	master := newStoredMachine(t, "master-0", config)
+	gce, _ := newMachineActuatorWithClient(t, computeServiceMock, nil, master)
+	err := gce.Create(newLoadBalancedClusterFixture(t), master)
+	if err == nil || !strings.Contains(err.Error(), "unknown upgradeStrategy") {
+		t.Errorf("expected an invalid configuration error, got '%v'", err)
+	}
+}
+
+func TestWorkerReplacement(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+	target.AddPod("node-0", "app", nil, nil, corev1.PodRunning)
+
+	// The new instance is created before the old node is touched.
+	name := f.joinReplacement(t)
+	if !strings.HasPrefix(name, "node-0-") || f.instances[name] == nil || f.instances["node-0"] == nil {
+		t.Fatalf("expected both instances to run, got '%v'", f.instances)
+	}
+	if node := target.Node("node-0"); node == nil || node.Spec.Unschedulable || len(target.Evicted()) != 0 {
+		t.Errorf("expected node node-0 to be left alone while the new node joins, got '%+v'", node)
+	}
+
+	// The drain waits until the evicted pods are gone.
+	if _, ok := f.update(t).(*controllererror.RequeueAfterError); !ok {
+		t.Fatal("expected the drain to wait for the evicted pod")
+	}
+	if evicted := target.Evicted(); len(evicted) != 1 || evicted[0] != "default/app" {
+		t.Errorf("expected pod app to be evicted, got '%v'", evicted)
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("expected no instance to be deleted while draining, got '%v'", f.deleted)
+	}
+
+	if err := f.update(t); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+	stored := getMachine(t, f.client, f.node)
+	status := getMachineProviderStatus(t, stored)
+	if status.InstanceName != name || status.Replacement != nil {
+		t.Errorf("expected instance %v to be recorded, got '%+v'", name, status)
+	}
+	if stored.Status.Versions == nil || stored.Status.Versions.Kubelet != "1.9.4" {
+		t.Errorf("expected kubelet 1.9.4 to be recorded, got '%+v'", stored.Status.Versions)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != "node-0" {
+		t.Errorf("expected the old instance to be deleted, got '%v'", f.deleted)
+	}
+	if deleted := target.DeletedNodes(); len(deleted) != 1 || deleted[0] != "node-0" {
+		t.Errorf("expected node node-0 to be deleted, got '%v'", deleted)
+	}
+}
+
+func TestWorkerReplacementKeepsOldInstanceIfCreateFails(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+	f.insertErr = &googleapi.Error{Code: 403, Message: "quota exceeded"}
+
+	if err := f.update(t); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("expected the update to fail, got '%v'", err)
+	}
+	status := getMachineProviderStatus(t, getMachine(t, f.client, f.node))
+	if status.InstanceName != "node-0" || f.instances["node-0"] == nil || len(f.deleted) != 0 {
+		t.Errorf("expected the old instance to be kept, got '%+v' and instances '%v'", status, f.instances)
+	}
+	if node := target.Node("node-0"); node == nil || node.Spec.Unschedulable {
+		t.Errorf("expected node node-0 to be left alone, got '%+v'", node)
+	}
+
+	// The replacement resumes once the instance can be created.
+	f.insertErr = nil
+	if _, ok := f.update(t).(*controllererror.RequeueAfterError); !ok {
+		t.Fatal("expected the replacement to wait for the new node")
+	}
+	if len(f.instances) != 2 {
+		t.Errorf("expected the new instance to be created, got '%v'", f.instances)
+	}
+}
+
+func TestWorkerReplacementRejectsExistingDisks(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+
+	machine := getMachine(t, f.client, f.node)
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Disks = append(config.Disks, gceconfigv1.Disk{Source: "data"})
+	machine.Spec.ProviderConfig = newStoredMachine(t, machine.Name, config).Spec.ProviderConfig
+
+	if err := f.gce.Update(f.cluster, machine); err == nil || !strings.Contains(err.Error(), "cannot attach disk data") {
+		t.Fatalf("expected an error, got '%v'", err)
+	}
+	if len(f.instances) != 1 || f.instances["node-0"] == nil {
+		t.Errorf("expected no new instance, got '%v'", f.instances)
+	}
+	stored := getMachine(t, f.client, f.node)
+	if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.UnsupportedChangeMachineError {
+		t.Errorf("expected error reason UnsupportedChange, got '%v'", stored.Status.ErrorReason)
+	}
+	if status := getMachineProviderStatus(t, stored); status.Replacement != nil {
+		t.Errorf("expected no replacement to start, got '%+v'", status.Replacement)
+	}
+}
+
+func TestWorkerReplacementIsAbandonedWhenSpecRollsBack(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+	name := f.joinReplacement(t)
+
+	// The spec goes back to that of the old instance before it is drained.
+	stored := getMachine(t, f.client, f.node)
+	stored.Spec.Versions = f.node.Spec.Versions
+	if err := f.gce.Update(f.cluster, stored); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+	status := getMachineProviderStatus(t, getMachine(t, f.client, f.node))
+	if status.InstanceName != "node-0" || status.Replacement != nil {
+		t.Errorf("expected the replacement to be abandoned, got '%+v'", status)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != name || f.instances["node-0"] == nil {
+		t.Errorf("expected the new instance to be deleted, got '%v'", f.deleted)
+	}
+	if deleted := target.DeletedNodes(); len(deleted) != 1 || deleted[0] != name {
+		t.Errorf("expected node %v to be deleted, got '%v'", name, deleted)
+	}
+	if node := target.Node("node-0"); node == nil || node.Spec.Unschedulable {
+		t.Errorf("expected node node-0 to be left alone, got '%+v'", node)
+	}
+}
+
+func TestWorkerReplacementResumesWhenSpecRollsBackDuringDrain(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+	target.AddPod("node-0", "app", nil, nil, corev1.PodRunning)
+	name := f.joinReplacement(t)
+	if _, ok := f.update(t).(*controllererror.RequeueAfterError); !ok {
+		t.Fatal("expected the drain to wait for the evicted pod")
+	}
+
+	// The old node is already drained, so the replacement completes.
+	stored := getMachine(t, f.client, f.node)
+	stored.Spec.Versions = f.node.Spec.Versions
+	if err := f.gce.Update(f.cluster, stored); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+	status := getMachineProviderStatus(t, getMachine(t, f.client, f.node))
+	if status.InstanceName != name || status.Replacement != nil {
+		t.Errorf("expected instance %v to be recorded, got '%+v'", name, status)
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != "node-0" {
+		t.Errorf("expected the old instance to be deleted, got '%v'", f.deleted)
+	}
+}
+
+func TestWorkerReplacementWaitsForReadyNode(t *testing.T) {
+	target := newTargetCluster(t)
+	defer target.Close()
+	f := newReplacingWorker(t, target)
+
+	if _, ok := f.update(t).(*controllererror.RequeueAfterError); !ok {
+		t.Fatal("expected the replacement to wait for the new node")
+	}
+	stored := getMachine(t, f.client, f.node)
+	status := getMachineProviderStatus(t, stored)
+	failed := status.Replacement.InstanceName
+	target.AddNode(failed, false)
+	if _, ok := f.update(t).(*controllererror.RequeueAfterError); !ok {
+		t.Fatal("expected the replacement to wait for the new node to become ready")
+	}
+
+	// A node that doesn't become ready in time fails the replacement.
+	status.Replacement.PhaseStartTime.Time = status.Replacement.PhaseStartTime.Add(-time.Hour)
+	setStoredProviderStatus(t, f.client, stored, status)
+	if err := f.update(t); err == nil || !strings.Contains(err.Error(), "did not become ready") {
+		t.Fatalf("expected the replacement to fail, got '%v'", err)
+	}
+	if replacement := getMachineProviderStatus(t, getMachine(t, f.client, f.node)).Replacement; replacement == nil || replacement.Phase != gceconfigv1.ReplacementFailed {
+		t.Errorf("expected the replacement to have failed, got '%+v'", replacement)
+	}
+	if len(f.deleted) != 0 || len(f.instances) != 2 {
+		t.Errorf("expected both instances to be left, got '%v'", f.instances)
+	}
+	if err := f.update(t); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("expected the failed replacement not to be retried, got '%v'", err)
+	}
+
+	// A new spec starts a new replacement, which deletes the failed one.
+	stored = upgradeMachine(t, f.client, f.node, "", "1.9.5")
+	if _, ok := f.gce.Update(f.cluster, stored).(*controllererror.RequeueAfterError); !ok {
+		t.Fatal("expected the new replacement to wait for its node")
+	}
+	if len(f.deleted) != 1 || f.deleted[0] != failed || f.instances["node-0"] == nil {
+		t.Errorf("expected the instance of the failed replacement to be deleted, got '%v'", f.deleted)
+	}
+	if deleted := target.DeletedNodes(); len(deleted) != 1 || deleted[0] != failed {
+		t.Errorf("expected node %v to be deleted, got '%v'", failed, deleted)
+	}
+}
+
+// fakeInstances keeps the instances a compute service mock inserts.
+type fakeInstances struct {
+	instances map[string]*compute.Instance
+	deleted   []string
+	// Fails inserting instances if set.
+	insertErr error
+}
+
+func (f *fakeInstances) computeService() *GCEClientComputeServiceMock {
+	f.instances = map[string]*compute.Instance{}
+	return &GCEClientComputeServiceMock{
+		mockInstancesInsert: func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+			if f.insertErr != nil {
+				return nil, f.insertErr
+			}
+			inserted := *instance
+			inserted.Status = "RUNNING"
+			inserted.NetworkInterfaces = []*compute.NetworkInterface{{Name: "nic0", NetworkIP: "127.0.0.1"}}
+			f.instances[instance.Name] = &inserted
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			if i, ok := f.instances[instance]; ok {
+				return i, nil
+			}
+			return nil, &googleapi.Error{Code: 404, Message: "not found"}
+		},
+		mockInstancesDelete: func(project string, zone string, instance string) (*compute.Operation, error) {
+			if _, ok := f.instances[instance]; !ok {
+				return nil, &googleapi.Error{Code: 404, Message: "not found"}
+			}
+			delete(f.instances, instance)
+			f.deleted = append(f.deleted, instance)
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+	}
+}
+
+type replacingMasterFixture struct {
+	fakeInstances
+	gce     *google.GCEClient
+	client  client.Client
+	cluster *v1alpha1.Cluster
+	master  *v1alpha1.Machine
+}
+
+// Returns a created master with the Replace upgrade strategy. All its
+// instances are reachable through the SSH server.
+func newReplacingMaster(t *testing.T, server *sshServer, cluster *v1alpha1.Cluster) *replacingMasterFixture {
+	f := &replacingMasterFixture{cluster: cluster}
+	computeServiceMock := f.computeService()
+	computeServiceMock.mockInstancesGetSerialPortOutput = func(project string, zone string, instance string) (*compute.SerialPortOutput, error) {
+		authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(server.hostKey.PublicKey())))
+		return &compute.SerialPortOutput{Contents: hostKeysOutput(authorizedKey)}, nil
+	}
+	withLoadBalancerBackend(computeServiceMock)
+
+	config := newGCEMachineProviderConfigFixture()
+	config.UpgradeStrategy = gceconfigv1.ReplaceUpgrade
+	f.master = newStoredMachine(t, "master-0", config)
+	f.master.Spec.Versions.Kubelet = "1.9.3"
+	f.client = listingClient{fake.NewFakeClient([]runtime.Object{f.master.DeepCopy()}...)}
+	params := google.MachineActuatorParams{
+		ComputeService:           computeServiceMock,
+		Kubeadm:                  newTokenCreatingKubeadm(t),
+		Client:                   f.client,
+		MachineSetupConfigGetter: newMachineSetupConfigWatcher(),
+		EventRecorder:            &record.FakeRecorder{},
+		Scheme:                   scheme.Scheme,
+		SSHKeysPath:              server.keysPath,
+		SSHPort:                  server.port,
+		SSHCommandTimeout:        time.Minute,
+	}
+	var err error
+	f.gce, err = google.NewMachineActuator(params)
+	if err != nil {
+		t.Fatalf("unable to create machine actuator: %v", err)
+	}
+	if err := f.gce.Create(cluster, f.master); err != nil {
+		t.Fatalf("unable to create master: %v", err)
+	}
+	return f
+}
+
+type replacingWorkerFixture struct {
+	fakeInstances
+	gce     *google.GCEClient
+	client  client.Client
+	cluster *v1alpha1.Cluster
+	node    *v1alpha1.Machine
+	target  *targetCluster
+}
+
+// Returns a created machine with the Node role, whose node is ready in the
+// target cluster. Nodes are drained within a minute.
+func newReplacingWorker(t *testing.T, target *targetCluster) *replacingWorkerFixture {
+	f := &replacingWorkerFixture{cluster: newDefaultClusterFixture(t), target: target}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	f.node = newStoredMachine(t, "node-0", config)
+	f.node.Spec.Versions.Kubelet = "1.9.3"
+	f.client = listingClient{fake.NewFakeClient([]runtime.Object{f.node.DeepCopy()}...)}
+	params := google.MachineActuatorParams{
+		ComputeService:            f.computeService(),
+		Kubeadm:                   newTokenCreatingKubeadm(t),
+		TargetClusterClientGetter: target,
+		Client:                    f.client,
+		MachineSetupConfigGetter:  newMachineSetupConfigWatcher(),
+		EventRecorder:             &record.FakeRecorder{},
+		Scheme:                    scheme.Scheme,
+		DrainTimeout:              time.Minute,
+	}
+	var err error
+	f.gce, err = google.NewMachineActuator(params)
+	if err != nil {
+		t.Fatalf("unable to create machine actuator: %v", err)
+	}
+	if err := f.gce.Create(f.cluster, f.node); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	target.AddNode("node-0", true)
+	return f
+}
+
+// Updates the kubelet of the machine.
+func (f *replacingWorkerFixture) update(t *testing.T) error {
+	return f.gce.Update(f.cluster, upgradeMachine(t, f.client, f.node, "", "1.9.4"))
+}
+
+// Starts the replacement of the machine, and makes the node of the new
+// instance ready once the replacement waits for it. Returns its name.
+func (f *replacingWorkerFixture) joinReplacement(t *testing.T) string {
+	t.Helper()
+	err := f.update(t)
+	if _, ok := err.(*controllererror.RequeueAfterError); !ok {
+		t.Fatalf("expected the replacement to wait for the new node, got '%v'", err)
+	}
+	replacement := getMachineProviderStatus(t, getMachine(t, f.client, f.node)).Replacement
+	if replacement == nil || replacement.Phase != gceconfigv1.ReplacementJoin {
+		t.Fatalf("expected the replacement to wait in phase Join, got '%+v'", replacement)
+	}
+	f.target.AddNode(replacement.InstanceName, true)
+	return replacement.InstanceName
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const (
+	// The interval at which the instances of preemptible machines are
+	// checked for preemption. Nothing notifies the machine controller when
+	// GCE preempts an instance, so it has to poll.
+	preemptionCheckInterval = 2 * time.Minute
+
+	onHostMaintenanceTerminate = "TERMINATE"
+	instanceStatusTerminated   = "TERMINATED"
+)
+
+func isPreemptible(config *gceconfigv1.GCEMachineProviderConfig) bool {
+	return config.Scheduling != nil && config.Scheduling.Preemptible
+}
+
+func newScheduling(config *gceconfigv1.GCEMachineProviderConfig) *compute.Scheduling {
+	if config.Scheduling == nil && len(config.Accelerators) == 0 {
+		return nil
+	}
+	scheduling := &compute.Scheduling{}
+	if config.Scheduling != nil {
+		scheduling.Preemptible = config.Scheduling.Preemptible
+		scheduling.AutomaticRestart = config.Scheduling.AutomaticRestart
+		scheduling.OnHostMaintenance = config.Scheduling.OnHostMaintenance
+	}
+	if len(config.Accelerators) > 0 {
+		// GCE cannot migrate instances with accelerators.
+		scheduling.OnHostMaintenance = onHostMaintenanceTerminate
+	}
+	if scheduling.Preemptible {
+		// GCE rejects preemptible instances that restart automatically or
+		// migrate during host maintenance.
+		if scheduling.AutomaticRestart == nil {
+			automaticRestart := false
+			scheduling.AutomaticRestart = &automaticRestart
+		}
+		if scheduling.OnHostMaintenance == "" {
+			scheduling.OnHostMaintenance = onHostMaintenanceTerminate
+		}
+	}
+	return scheduling
+}
+
+// Returns whether GCE preempted the instance and it has not been started
+// since.
+func isPreempted(instance *compute.Instance) bool {
+	return instance.Status == instanceStatusTerminated && instance.Scheduling != nil && instance.Scheduling.Preemptible
+}
+
+// Starts the machine's instance again if GCE preempted it. Returns false if
+// the instance was not preempted.
+func (gce *GCEClient) startPreemptedInstance(cluster *clusterv1.Cluster, machine *clusterv1.Machine, machineConfig *gceconfigv1.GCEMachineProviderConfig, status *gceconfigv1.GCEMachineProviderStatus) (bool, error) {
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
+	if err != nil {
+		return false, err
+	}
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
+	if err != nil {
+		return false, fmt.Errorf("error getting instance of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	if !isPreempted(instance) {
+		return false, nil
+	}
+
+	glog.Infof("Starting preempted instance %v of machine %v.", name, machine.ObjectMeta.Name)
+	op, err := gce.computeService.InstancesStart(project, zone, name)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil {
+		return false, fmt.Errorf("error starting preempted instance %v: %v", name, err)
+	}
+	gce.eventRecorder.Eventf(machine, corev1.EventTypeNormal, "Restarted", "Restarted preempted instance of Machine %v", machine.Name)
+	return true, nil
+}
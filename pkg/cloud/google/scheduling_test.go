@@ -0,0 +1,151 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	compute "google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	controllererror "sigs.k8s.io/cluster-api/pkg/controller/error"
+	"sigs.k8s.io/cluster-api/pkg/kubeadm"
+	"sigs.k8s.io/cluster-api/pkg/test-cmd-runner"
+)
+
+func TestDefaultScheduling(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	createClusterAndFailOnError(t, newGCEMachineProviderConfigFixture(), computeServiceMock, nil)
+	if receivedInstance.Scheduling != nil {
+		t.Errorf("expected the default scheduling, got '%+v'", receivedInstance.Scheduling)
+	}
+}
+
+func TestPreemptibleScheduling(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	machine := newPreemptibleWorker(t)
+	if err := createCluster(t, machine, computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	scheduling := receivedInstance.Scheduling
+	if scheduling == nil || !scheduling.Preemptible {
+		t.Fatalf("expected a preemptible instance, got '%+v'", scheduling)
+	}
+	if scheduling.AutomaticRestart == nil || *scheduling.AutomaticRestart {
+		t.Errorf("expected the preemptible instance not to restart automatically")
+	}
+	if scheduling.OnHostMaintenance != "TERMINATE" {
+		t.Errorf("invalid on host maintenance policy: expected 'TERMINATE' got '%v'", scheduling.OnHostMaintenance)
+	}
+}
+
+func TestUpdateStartsPreemptedInstance(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	var started int
+	computeServiceMock.mockInstancesStart = func(project string, zone string, instance string) (*compute.Operation, error) {
+		started++
+		receivedInstance.Status = "RUNNING"
+		return &compute.Operation{}, nil
+	}
+	machine := newPreemptibleWorker(t)
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machine)
+	cluster := newDefaultClusterFixture(t)
+	if err := gce.Create(cluster, machine); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	receivedInstance.Status = "TERMINATED"
+	if err := gce.Update(cluster, getMachine(t, fakeClient, machine)); err != nil {
+		t.Fatalf("unable to update machine: %v", err)
+	}
+	if started != 1 {
+		t.Fatalf("expected the preempted instance to be started once, got %v", started)
+	}
+	if status := getMachineProviderStatus(t, getMachine(t, fakeClient, machine)); status.InstanceState != "RUNNING" {
+		t.Errorf("invalid instance state: expected 'RUNNING' got '%v'", status.InstanceState)
+	}
+
+	// Running preemptible instances are checked on again later.
+	err := gce.Update(cluster, getMachine(t, fakeClient, machine))
+	if _, ok := err.(*controllererror.RequeueAfterError); !ok {
+		t.Errorf("expected the machine to be requeued, got '%v'", err)
+	}
+	if started != 1 {
+		t.Errorf("expected the running instance not to be started, got %v starts", started)
+	}
+}
+
+func TestExistsStartsPreemptedInstance(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	var started int
+	computeServiceMock.mockInstancesStart = func(project string, zone string, instance string) (*compute.Operation, error) {
+		started++
+		receivedInstance.Status = "RUNNING"
+		return &compute.Operation{}, nil
+	}
+	machine := newPreemptibleWorker(t)
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machine)
+	cluster := newDefaultClusterFixture(t)
+	if err := gce.Create(cluster, machine); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	receivedInstance.Status = "TERMINATED"
+	exists, err := gce.Exists(cluster, getMachine(t, fakeClient, machine))
+	if err != nil || !exists {
+		t.Fatalf("expected the preempted instance to exist, got %v and error '%v'", exists, err)
+	}
+	if started != 1 {
+		t.Fatalf("expected the preempted instance to be started once, got %v", started)
+	}
+	if status := getMachineProviderStatus(t, getMachine(t, fakeClient, machine)); status.InstanceState != "RUNNING" {
+		t.Errorf("invalid instance state: expected 'RUNNING' got '%v'", status.InstanceState)
+	}
+
+	if _, err := gce.Exists(cluster, getMachine(t, fakeClient, machine)); err != nil {
+		t.Fatalf("unable to check the instance: %v", err)
+	}
+	if started != 1 {
+		t.Errorf("expected the running instance not to be started, got %v starts", started)
+	}
+}
+
+func newPreemptibleWorker(t *testing.T) *v1alpha1.Machine {
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true}
+	return newStoredMachine(t, "node-0", config)
+}
+
+// Returns a machine that can be stored in a fake client.
+func newStoredMachine(t *testing.T, name string, config gceconfigv1.GCEMachineProviderConfig) *v1alpha1.Machine {
+	machine := newMachine(t, config)
+	machine.ObjectMeta = v1.ObjectMeta{Name: name, Namespace: "default"}
+	// The fake client round-trips objects through JSON, like the API server.
+	raw, err := yaml.YAMLToJSON(machine.Spec.ProviderConfig.Value.Raw)
+	if err != nil {
+		t.Fatalf("error converting provider config: %v", err)
+	}
+	machine.Spec.ProviderConfig.Value.Raw = raw
+	return machine
+}
+
+func newTokenCreatingKubeadm(t *testing.T) *kubeadm.Kubeadm {
+	return kubeadm.NewWithCmdRunner(test_cmd_runner.NewTestRunnerFailOnErr(t, tokenCreateCommandCallback))
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"encoding/json"
+
+	computebeta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+)
+
+const (
+	// The instance metadata key that enables OS Login on an instance.
+	osLoginMetadataKey = "enable-oslogin"
+
+	// The guest OS feature of the images that can boot Shielded VMs.
+	uefiCompatibleFeature = "UEFI_COMPATIBLE"
+)
+
+func osLoginEnabled(config *gceconfigv1.GCEMachineProviderConfig) bool {
+	return config.Security != nil && config.Security.OSLogin
+}
+
+// Adds the metadata that enables the machine's security features to the
+// instance metadata.
+func setSecurityMetadata(config *gceconfigv1.GCEMachineProviderConfig, metadata map[string]string) {
+	if osLoginEnabled(config) {
+		metadata[osLoginMetadataKey] = "TRUE"
+	}
+}
+
+// Returns the Shielded VM options of the instance, or nil if it has none.
+func newShieldedVmConfig(config *gceconfigv1.GCEMachineProviderConfig) *computebeta.ShieldedVmConfig {
+	if config.Security == nil || config.Security.ShieldedInstance == nil {
+		return nil
+	}
+	shielded := config.Security.ShieldedInstance
+	return &computebeta.ShieldedVmConfig{
+		EnableSecureBoot:          shielded.SecureBoot,
+		EnableVtpm:                shielded.VTPM,
+		EnableIntegrityMonitoring: shielded.IntegrityMonitoring,
+		// Disabled options would be omitted, and GCE enables vTPM and
+		// integrity monitoring by default.
+		ForceSendFields: []string{"EnableSecureBoot", "EnableVtpm", "EnableIntegrityMonitoring"},
+	}
+}
+
+// Checks that the image the instance boots from supports the machine's
+// security features. Shielded VMs need a UEFI compatible image.
+func (gce *GCEClient) validateImage(imagePath string, config *gceconfigv1.GCEMachineProviderConfig) *apierrors.MachineError {
+	if newShieldedVmConfig(config) == nil {
+		return nil
+	}
+	image, err := gce.getImage(imagePath)
+	if err != nil {
+		return apierrors.CreateMachine("error getting image %v: %v", imagePath, err)
+	}
+	if image == nil {
+		return apierrors.InvalidMachineConfiguration("image %v not found", imagePath)
+	}
+	for _, feature := range image.GuestOsFeatures {
+		if feature.Type == uefiCompatibleFeature {
+			return nil
+		}
+	}
+	return apierrors.InvalidMachineConfiguration("image %v is not UEFI compatible, so it cannot boot a Shielded VM", imagePath)
+}
+
+// Creates the instance, through the beta compute API if it is a Shielded VM.
+// The v1 API of the vendored client has no Shielded VM options.
+func (gce *GCEClient) insertInstance(project string, zone string, instance *compute.Instance, config *gceconfigv1.GCEMachineProviderConfig) (*compute.Operation, error) {
+	shielded := newShieldedVmConfig(config)
+	if shielded == nil {
+		return gce.computeService.InstancesInsert(project, zone, instance)
+	}
+	var betaInstance computebeta.Instance
+	if err := convertToBeta(instance, &betaInstance); err != nil {
+		return nil, err
+	}
+	betaInstance.ShieldedVmConfig = shielded
+	return gce.computeService.BetaInstancesInsert(project, zone, &betaInstance)
+}
+
+// Creates the instance template, through the beta compute API if its
+// instances are Shielded VMs.
+func (gce *GCEClient) insertInstanceTemplate(project string, template *compute.InstanceTemplate, config *gceconfigv1.GCEMachineProviderConfig) (*compute.Operation, error) {
+	shielded := newShieldedVmConfig(config)
+	if shielded == nil {
+		return gce.computeService.InstanceTemplatesInsert(project, template)
+	}
+	var betaTemplate computebeta.InstanceTemplate
+	if err := convertToBeta(template, &betaTemplate); err != nil {
+		return nil, err
+	}
+	betaTemplate.Properties.ShieldedVmConfig = shielded
+	return gce.computeService.BetaInstanceTemplatesInsert(project, &betaTemplate)
+}
+
+// Converts a resource of the v1 compute API to the same resource of the beta
+// API, which has all of its fields.
+func convertToBeta(v1 interface{}, beta interface{}) error {
+	b, err := json.Marshal(v1)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, beta)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+
+	computebeta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+)
+
+func TestOSLogin(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Security = &gceconfigv1.Security{OSLogin: true}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	if value := getMetadataItem(t, receivedInstance.Metadata, "enable-oslogin").Value; *value != "TRUE" {
+		t.Errorf("invalid enable-oslogin metadata: expected 'TRUE' got '%v'", *value)
+	}
+	getMetadataItem(t, receivedInstance.Metadata, "startup-script")
+}
+
+func TestNoOSLogin(t *testing.T) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	for _, item := range receivedInstance.Metadata.Items {
+		if item.Key == "enable-oslogin" {
+			t.Errorf("expected no enable-oslogin metadata, got '%v'", *item.Value)
+		}
+	}
+}
+
+func TestShieldedVM(t *testing.T) {
+	var receivedInstance *computebeta.Instance
+	var requestedFamily string
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockImagesGetFromFamily: func(project string, family string) (*compute.Image, error) {
+			requestedFamily = project + "/" + family
+			return newUEFICompatibleImage(), nil
+		},
+		mockBetaInstancesInsert: func(project string, zone string, instance *computebeta.Instance) (*compute.Operation, error) {
+			receivedInstance = instance
+			return &compute.Operation{Status: "DONE"}, nil
+		},
+		mockInstancesGet: func(project string, zone string, instance string) (*compute.Instance, error) {
+			if receivedInstance == nil {
+				return nil, &googleapi.Error{Code: 404, Message: "not found"}
+			}
+			return &compute.Instance{Name: instance, Status: "RUNNING"}, nil
+		},
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Security = &gceconfigv1.Security{ShieldedInstance: &gceconfigv1.ShieldedInstanceConfig{SecureBoot: true, VTPM: true, IntegrityMonitoring: true}}
+	if err := createCluster(t, newMachine(t, config), computeServiceMock, nil, newTokenCreatingKubeadm(t)); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+
+	if requestedFamily != "ubuntu-os-cloud/ubuntu-1604-lts" {
+		t.Errorf("expected the image family 'ubuntu-os-cloud/ubuntu-1604-lts' to be checked, got '%v'", requestedFamily)
+	}
+	if receivedInstance == nil {
+		t.Fatal("expected the instance to be created through the beta API")
+	}
+	shielded := receivedInstance.ShieldedVmConfig
+	if shielded == nil || !shielded.EnableSecureBoot || !shielded.EnableVtpm || !shielded.EnableIntegrityMonitoring {
+		t.Errorf("invalid Shielded VM config: got '%+v'", shielded)
+	}
+	if !receivedInstance.CanIpForward || receivedInstance.Metadata == nil || len(receivedInstance.NetworkInterfaces) == 0 {
+		t.Errorf("expected the v1 fields of the instance to be kept, got '%+v'", receivedInstance)
+	}
+}
+
+func TestShieldedVMTemplate(t *testing.T) {
+	group, computeServiceMock := newInstanceGroupMock()
+	computeServiceMock.mockImagesGetFromFamily = func(project string, family string) (*compute.Image, error) {
+		return newUEFICompatibleImage(), nil
+	}
+	var receivedTemplate *computebeta.InstanceTemplate
+	computeServiceMock.mockBetaInstanceTemplatesInsert = func(project string, instanceTemplate *computebeta.InstanceTemplate) (*compute.Operation, error) {
+		receivedTemplate = instanceTemplate
+		b, err := json.Marshal(instanceTemplate)
+		if err != nil {
+			t.Fatalf("error encoding instance template: %v", err)
+		}
+		var template compute.InstanceTemplate
+		if err := json.Unmarshal(b, &template); err != nil {
+			t.Fatalf("error decoding instance template: %v", err)
+		}
+		group.templates[template.Name] = &template
+		return &compute.Operation{}, nil
+	}
+	config := newInstanceGroupMachineConfig()
+	config.Security = &gceconfigv1.Security{ShieldedInstance: &gceconfigv1.ShieldedInstanceConfig{SecureBoot: true}}
+	machines := newInstanceGroupMachinesWithConfig(t, config, "node-0")
+	gce, _ := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machines...)
+
+	if err := gce.Create(newDefaultClusterFixture(t), machines[0]); err != nil {
+		t.Fatalf("unable to create machine: %v", err)
+	}
+	if receivedTemplate == nil {
+		t.Fatal("expected the instance template to be created through the beta API")
+	}
+	if path.Base(group.manager.InstanceTemplate) != receivedTemplate.Name {
+		t.Errorf("expected the instance group to use template %v, got '%v'", receivedTemplate.Name, group.manager.InstanceTemplate)
+	}
+	shielded := receivedTemplate.Properties.ShieldedVmConfig
+	if shielded == nil || !shielded.EnableSecureBoot || shielded.EnableVtpm || shielded.EnableIntegrityMonitoring {
+		t.Errorf("invalid Shielded VM config: got '%+v'", shielded)
+	}
+}
+
+func TestShieldedVMRequiresUEFICompatibleImage(t *testing.T) {
+	var inserted bool
+	computeServiceMock := &GCEClientComputeServiceMock{
+		mockImagesGetFromFamily: func(project string, family string) (*compute.Image, error) {
+			return &compute.Image{Name: "ubuntu-1604-xenial-v20181030"}, nil
+		},
+		mockInstancesInsert: func(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+			inserted = true
+			return &compute.Operation{}, nil
+		},
+		mockBetaInstancesInsert: func(project string, zone string, instance *computebeta.Instance) (*compute.Operation, error) {
+			inserted = true
+			return &compute.Operation{}, nil
+		},
+	}
+	config := newGCEMachineProviderConfigFixture()
+	config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	config.Security = &gceconfigv1.Security{ShieldedInstance: &gceconfigv1.ShieldedInstanceConfig{SecureBoot: true}}
+	machine := newStoredMachine(t, "node-0", config)
+	gce, fakeClient := newMachineActuatorWithClient(t, computeServiceMock, newTokenCreatingKubeadm(t), machine)
+
+	if err := gce.Create(newDefaultClusterFixture(t), machine); err == nil {
+		t.Fatal("expected an error for the image that cannot boot a Shielded VM")
+	}
+	if inserted {
+		t.Error("expected no instance to be created without the requested Shielded VM options")
+	}
+	stored := getMachine(t, fakeClient, machine)
+	if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.InvalidConfigurationMachineError {
+		t.Errorf("invalid error reason: expected '%v' got '%v'", common.InvalidConfigurationMachineError, stored.Status.ErrorReason)
+	}
+}
+
+func newUEFICompatibleImage() *compute.Image {
+	return &compute.Image{
+		Name:            "ubuntu-1604-xenial-v20181030",
+		GuestOsFeatures: []*compute.GuestOsFeature{{Type: "VIRTIO_SCSI_MULTIQUEUE"}, {Type: "UEFI_COMPATIBLE"}},
+	}
+}
@@ -17,10 +17,25 @@ limitations under the License.
 package google
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"os/exec"
+	"regexp"
+	"sync"
 
 	"github.com/golang/glog"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/iam/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimachineryerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients/errors"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
 	"sigs.k8s.io/cluster-api/pkg/util"
 )
@@ -34,10 +49,22 @@ const (
 	IngressControllerSecret = "glbc-gcp-key"
 	MachineControllerSecret = "machine-controller-credential"
 
+	// How often a change to the IAM policy of a project is attempted when
+	// the policy keeps changing concurrently.
+	maxIamPolicyAttempts = 5
+
+	// The display name of the service accounts the provider creates, which
+	// names their kind and cluster.
+	serviceAccountDisplayNameFormat = "%s service account of cluster %s"
+
+	// Older versions recorded service account emails in cluster annotations
+	// with this prefix. They are migrated into the cluster provider status.
 	ClusterAnnotationPrefix = "gce.clusterapi.k8s.io/service-account-"
 )
 
 var (
+	serviceAccountDisplayNameRegexp = regexp.MustCompile(`^k8s-[a-z-]+ service account of cluster (\S+)$`)
+
 	MasterNodeRoles = []string{
 		"compute.instanceAdmin",
 		"compute.networkAdmin",
@@ -52,29 +79,64 @@ var (
 		"compute.instanceAdmin.v1",
 		"compute.networkAdmin",
 		"compute.securityAdmin",
-		"iam.serviceAccountActor",
+		"iam.serviceAccountUser",
 	}
 	MachineControllerRoles = []string{
 		"compute.instanceAdmin.v1",
 		"compute.securityAdmin",
-		"iam.serviceAccountActor",
+		"iam.serviceAccountUser",
 	}
 )
 
+// GCEClientIAMService manages the service accounts of a project and their
+// keys.
+type GCEClientIAMService interface {
+	ServiceAccountsCreate(project string, request *iam.CreateServiceAccountRequest) (*iam.ServiceAccount, error)
+	ServiceAccountsList(project string) ([]*iam.ServiceAccount, error)
+	ServiceAccountsDelete(project string, email string) error
+	ServiceAccountKeysCreate(project string, email string, request *iam.CreateServiceAccountKeyRequest) (*iam.ServiceAccountKey, error)
+	ServiceAccountKeysList(project string, email string) ([]*iam.ServiceAccountKey, error)
+	ServiceAccountKeysDelete(name string) error
+}
+
+// GCEClientResourceManagerService reads and writes the IAM policy of a
+// project.
+type GCEClientResourceManagerService interface {
+	ProjectsGetIamPolicy(project string) (*cloudresourcemanager.Policy, error)
+	ProjectsSetIamPolicy(project string, policy *cloudresourcemanager.Policy) (*cloudresourcemanager.Policy, error)
+}
+
 type ServiceAccountService struct {
+	mu                     sync.Mutex
+	iamService             GCEClientIAMService
+	resourceManagerService GCEClientResourceManagerService
+	secretsGetter          corev1client.SecretsGetter
 }
 
-func NewServiceAccountService() *ServiceAccountService {
-	return &ServiceAccountService{}
+// Creates a ServiceAccountService. The IAM and Resource Manager clients that
+// are nil are created on first use, so that actuators that never manage
+// service accounts need no credentials for them. Without a secrets getter,
+// secrets are created in the cluster of the current kubeconfig context.
+func NewServiceAccountService(iamService GCEClientIAMService, resourceManagerService GCEClientResourceManagerService, secretsGetter corev1client.SecretsGetter) *ServiceAccountService {
+	return &ServiceAccountService{
+		iamService:             iamService,
+		resourceManagerService: resourceManagerService,
+		secretsGetter:          secretsGetter,
+	}
 }
 
 // Returns the email address of the service account that should be used
 // as the default service account for this machine
 func (sas *ServiceAccountService) GetDefaultServiceAccountForMachine(cluster *clusterv1.Cluster, machine *clusterv1.Machine) string {
+	status, err := clusterProviderStatus(cluster)
+	if err != nil {
+		glog.Warningf("Cannot parse provider status of cluster %v: %v", cluster.Name, err)
+		return ""
+	}
 	if util.IsMaster(machine) {
-		return cluster.ObjectMeta.Annotations[ClusterAnnotationPrefix+MasterNodeServiceAccountPrefix]
+		return status.ServiceAccounts.Master
 	} else {
-		return cluster.ObjectMeta.Annotations[ClusterAnnotationPrefix+WorkerNodeServiceAccountPrefix]
+		return status.ServiceAccounts.Worker
 	}
 }
 
@@ -95,132 +157,368 @@ func (sas *ServiceAccountService) CreateWorkerNodeServiceAccount(cluster *cluste
 
 // Creates a GCP service account for the ingress controller
 func (sas *ServiceAccountService) CreateIngressControllerServiceAccount(cluster *clusterv1.Cluster) error {
-	accountId, project, err := sas.createServiceAccount(IngressControllerServiceAccountPrefix, IngressControllerRoles, cluster)
+	email, project, err := sas.createServiceAccount(IngressControllerServiceAccountPrefix, IngressControllerRoles, cluster)
 	if err != nil {
 		return err
 	}
 
-	return sas.createSecretForServiceAccountKey(accountId, project, IngressControllerSecret, "kube-system")
+	return sas.createSecretForServiceAccountKey(email, project, IngressControllerSecret, "kube-system")
 }
 
 // Creates a GCP service account for the machine controller, granted the
 // permissions to manage compute instances, and stores its credentials as a
 // Kubernetes secret.
 func (sas *ServiceAccountService) CreateMachineControllerServiceAccount(cluster *clusterv1.Cluster) error {
-	accountId, project, err := sas.createServiceAccount(MachineControllerServiceAccountPrefix, MachineControllerRoles, cluster)
+	email, project, err := sas.createServiceAccount(MachineControllerServiceAccountPrefix, MachineControllerRoles, cluster)
 	if err != nil {
 		return err
 	}
 
-	return sas.createSecretForServiceAccountKey(accountId, project, MachineControllerSecret, "default")
+	return sas.createSecretForServiceAccountKey(email, project, MachineControllerSecret, "default")
 }
 
-func (sas *ServiceAccountService) createSecretForServiceAccountKey(accountId string, project string, secretName string, namespace string) error {
-	email := fmt.Sprintf("%s@%s.iam.gserviceaccount.com", accountId, project)
+// Stores a new key of the service account in a secret. A secret left behind
+// by an earlier attempt already holds a key, so it is kept.
+func (sas *ServiceAccountService) createSecretForServiceAccountKey(email string, project string, secretName string, namespace string) error {
+	secrets, err := sas.secrets()
+	if err != nil {
+		return fmt.Errorf("couldn't import service account key as credential: %v", err)
+	}
+	if _, err := secrets.Secrets(namespace).Get(secretName, metav1.GetOptions{}); err == nil {
+		return nil
+	} else if !apimachineryerrors.IsNotFound(err) {
+		return fmt.Errorf("couldn't import service account key as credential: %v", err)
+	}
 
-	localFile := accountId + "-key.json"
-	err := run("gcloud", "--project", project, "iam", "service-accounts", "keys", "create", localFile, "--iam-account", email)
+	iamService, err := sas.iam()
+	if err != nil {
+		return err
+	}
+	key, err := iamService.ServiceAccountKeysCreate(project, email, &iam.CreateServiceAccountKeyRequest{})
 	if err != nil {
 		return fmt.Errorf("couldn't create service account key: %v", err)
 	}
-
-	err = run("kubectl", "create", "secret", "generic", secretName, "--from-file=service-account.json="+localFile, "--namespace="+namespace)
+	// The private key data is a credentials file, like those gcloud writes.
+	credentials, err := base64.StdEncoding.DecodeString(key.PrivateKeyData)
+	if err == nil {
+		_, err = secrets.Secrets(namespace).Create(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: namespace,
+			},
+			Data: map[string][]byte{
+				"service-account.json": credentials,
+			},
+		})
+	}
 	if err != nil {
+		// Don't leave behind a key no one holds.
+		if err := iamService.ServiceAccountKeysDelete(key.Name); err != nil {
+			glog.Warningf("Error deleting key %v of service account %v: %v", key.Name, email, err)
+		}
 		return fmt.Errorf("couldn't import service account key as credential: %v", err)
 	}
-
-	if err := run("rm", localFile); err != nil {
-		glog.Error(err)
-	}
-
 	return nil
 }
 
-// creates a service account with the roles specifed. Returns the account id
-// of the created account and the project it belongs to.
+// Creates a service account with the roles specified, or adopts the one an
+// earlier attempt created. Returns the email of the account and the project
+// it belongs to.
 func (sas *ServiceAccountService) createServiceAccount(serviceAccountPrefix string, roles []string, cluster *clusterv1.Cluster) (string, string, error) {
-
 	config, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
 	if err != nil {
 		return "", "", err
 	}
-
-	accountId := serviceAccountPrefix + "-" + util.RandomString(5)
-
-	err = run("gcloud", "--project", config.Project, "iam", "service-accounts", "create", "--display-name="+serviceAccountPrefix+" service account", accountId)
+	status, err := clusterProviderStatus(cluster)
 	if err != nil {
-		return "", "", fmt.Errorf("couldn't create service account: %v", err)
+		return "", "", err
 	}
 
-	email := fmt.Sprintf("%s@%s.iam.gserviceaccount.com", accountId, config.Project)
-
-	for _, role := range roles {
-		err = run("gcloud", "projects", "add-iam-policy-binding", config.Project, "--member=serviceAccount:"+email, "--role=roles/"+role)
+	email := *serviceAccountEmail(status, serviceAccountPrefix)
+	if email == "" {
+		iamService, err := sas.iam()
 		if err != nil {
-			return "", "", fmt.Errorf("couldn't grant permissions to service account: %v", err)
+			return "", "", err
+		}
+		accountId := serviceAccountId(serviceAccountPrefix, cluster)
+		account, err := iamService.ServiceAccountsCreate(config.Project, &iam.CreateServiceAccountRequest{
+			AccountId: accountId,
+			ServiceAccount: &iam.ServiceAccount{
+				DisplayName: fmt.Sprintf(serviceAccountDisplayNameFormat, serviceAccountPrefix, clusterID(cluster)),
+			},
+		})
+		switch {
+		case err == nil:
+			email = account.Email
+		case errors.IsConflict(err):
+			email = serviceAccountEmailOfId(accountId, config.Project)
+			glog.Infof("Adopting existing service account %v", email)
+		default:
+			return "", "", fmt.Errorf("couldn't create service account: %v", err)
+		}
+
+		// Record the account before granting it roles, so that it gets
+		// deleted along with the cluster even if granting them fails.
+		*serviceAccountEmail(status, serviceAccountPrefix) = email
+		if err := setClusterProviderStatus(cluster, status); err != nil {
+			return "", "", err
 		}
 	}
 
-	if cluster.ObjectMeta.Annotations == nil {
-		cluster.ObjectMeta.Annotations = make(map[string]string)
+	err = sas.modifyIamPolicy(config.Project, func(policy *cloudresourcemanager.Policy) bool {
+		changed := false
+		for _, role := range roles {
+			changed = addIamPolicyBinding(policy, "roles/"+role, "serviceAccount:"+email) || changed
+		}
+		return changed
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't grant permissions to service account: %v", err)
 	}
-	cluster.ObjectMeta.Annotations[ClusterAnnotationPrefix+serviceAccountPrefix] = email
 
-	return accountId, config.Project, nil
+	return email, config.Project, nil
 }
 
 func (sas *ServiceAccountService) DeleteMasterNodeServiceAccount(cluster *clusterv1.Cluster) error {
-	return sas.deleteServiceAccount(MasterNodeServiceAccountPrefix, MasterNodeRoles, cluster)
+	return sas.deleteServiceAccount(MasterNodeServiceAccountPrefix, cluster)
 }
 
 func (sas *ServiceAccountService) DeleteWorkerNodeServiceAccount(cluster *clusterv1.Cluster) error {
-	return sas.deleteServiceAccount(WorkerNodeServiceAccountPrefix, WorkerNodeRoles, cluster)
+	return sas.deleteServiceAccount(WorkerNodeServiceAccountPrefix, cluster)
 }
 
 func (sas *ServiceAccountService) DeleteIngressControllerServiceAccount(cluster *clusterv1.Cluster) error {
-	return sas.deleteServiceAccount(IngressControllerServiceAccountPrefix, IngressControllerRoles, cluster)
+	return sas.deleteServiceAccount(IngressControllerServiceAccountPrefix, cluster)
 }
 
 func (sas *ServiceAccountService) DeleteMachineControllerServiceAccount(cluster *clusterv1.Cluster) error {
-	return sas.deleteServiceAccount(MachineControllerServiceAccountPrefix, MachineControllerRoles, cluster)
+	return sas.deleteServiceAccount(MachineControllerServiceAccountPrefix, cluster)
 }
 
-func (sas *ServiceAccountService) deleteServiceAccount(serviceAccountPrefix string, roles []string, cluster *clusterv1.Cluster) error {
+func (sas *ServiceAccountService) deleteServiceAccount(serviceAccountPrefix string, cluster *clusterv1.Cluster) error {
 	config, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
 	if err != nil {
 		glog.Info("cannot parse cluster providerConfig field")
 		return nil
 	}
 
-	var email string
-	if cluster.ObjectMeta.Annotations != nil {
-		email = cluster.ObjectMeta.Annotations[ClusterAnnotationPrefix+serviceAccountPrefix]
+	status, err := clusterProviderStatus(cluster)
+	if err != nil {
+		glog.Info("cannot parse cluster providerStatus field")
+		return nil
+	}
+	// An account whose creation failed before it got recorded is found by
+	// its ID.
+	email := *serviceAccountEmail(status, serviceAccountPrefix)
+	if email == "" {
+		email = serviceAccountEmailOfId(serviceAccountId(serviceAccountPrefix, cluster), config.Project)
+	}
+
+	if err := sas.deleteServiceAccountAndBindings(config.Project, email); err != nil {
+		return err
 	}
+	*serviceAccountEmail(status, serviceAccountPrefix) = ""
+	return setClusterProviderStatus(cluster, status)
+}
 
-	if email == "" {
-		glog.Info("No service a/c found in cluster.")
-		return nil
+// Deletes the service accounts the provider created in the project for
+// clusters other than the given existing ones, along with their role bindings
+// and keys. This catches the accounts that outlived their cluster because its
+// deletion failed halfway. The accounts recorded in the status of an existing
+// cluster are kept whatever cluster they name.
+func (sas *ServiceAccountService) DeleteServiceAccountsOfDeletedClusters(project string, clusters []clusterv1.Cluster) error {
+	existing := sets.NewString()
+	inUse := sets.NewString()
+	for i := range clusters {
+		existing.Insert(clusterID(&clusters[i]))
+		status, err := clusterProviderStatus(&clusters[i])
+		if err != nil {
+			return fmt.Errorf("cannot parse provider status of cluster %v: %v", clusters[i].Name, err)
+		}
+		for _, prefix := range []string{MasterNodeServiceAccountPrefix, WorkerNodeServiceAccountPrefix, IngressControllerServiceAccountPrefix, MachineControllerServiceAccountPrefix} {
+			inUse.Insert(*serviceAccountEmail(status, prefix))
+		}
 	}
 
-	for _, role := range roles {
-		err = run("gcloud", "projects", "remove-iam-policy-binding", config.Project, "--member=serviceAccount:"+email, "--role=roles/"+role)
+	iamService, err := sas.iam()
+	if err != nil {
+		return err
+	}
+	accounts, err := iamService.ServiceAccountsList(project)
+	if err != nil {
+		return fmt.Errorf("couldn't list service accounts: %v", err)
 	}
+	var errs []error
+	for _, account := range accounts {
+		match := serviceAccountDisplayNameRegexp.FindStringSubmatch(account.DisplayName)
+		if match == nil || existing.Has(match[1]) || inUse.Has(account.Email) {
+			continue
+		}
+		glog.Infof("Deleting service account %v of deleted cluster %v", account.Email, match[1])
+		if err := sas.deleteServiceAccountAndBindings(project, account.Email); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
 
+// Deletes the service account after removing it from the IAM policy of the
+// project and deleting its keys. Deleting the account first would leave
+// bindings of a deleted member behind.
+func (sas *ServiceAccountService) deleteServiceAccountAndBindings(project string, email string) error {
+	err := sas.modifyIamPolicy(project, func(policy *cloudresourcemanager.Policy) bool {
+		return removeIamPolicyMember(policy, "serviceAccount:"+email)
+	})
 	if err != nil {
-		return fmt.Errorf("couldn't remove permissions to service account: %v", err)
+		return fmt.Errorf("couldn't remove permissions to service account %v: %v", email, err)
 	}
 
-	err = run("gcloud", "--project", config.Project, "iam", "service-accounts", "delete", email)
+	iamService, err := sas.iam()
 	if err != nil {
-		return fmt.Errorf("couldn't delete service account: %v", err)
+		return err
+	}
+	keys, err := iamService.ServiceAccountKeysList(project, email)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't list keys of service account %v: %v", email, err)
+	}
+	for _, key := range keys {
+		if err := iamService.ServiceAccountKeysDelete(key.Name); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("couldn't delete key of service account %v: %v", email, err)
+		}
+	}
+
+	err = iamService.ServiceAccountsDelete(project, email)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("couldn't delete service account %v: %v", email, err)
 	}
 	return nil
 }
 
-func run(cmd string, args ...string) error {
-	c := exec.Command(cmd, args...)
-	if out, err := c.CombinedOutput(); err != nil {
-		return fmt.Errorf("error: %v, output: %s", err, string(out))
+// Identifies the cluster in the names of its service accounts. Unlike its
+// UID, the namespace and name of a cluster survive a pivot to another
+// management cluster.
+func clusterID(cluster *clusterv1.Cluster) string {
+	return cluster.ObjectMeta.Namespace + "/" + cluster.ObjectMeta.Name
+}
+
+// The ID of a service account of the cluster, which is the same on every
+// attempt to create it. IDs are at most 30 characters long.
+func serviceAccountId(serviceAccountPrefix string, cluster *clusterv1.Cluster) string {
+	sum := sha256.Sum256([]byte(clusterID(cluster)))
+	return serviceAccountPrefix + "-" + hex.EncodeToString(sum[:])[:7]
+}
+
+func serviceAccountEmailOfId(accountId string, project string) string {
+	return fmt.Sprintf("%s@%s.iam.gserviceaccount.com", accountId, project)
+}
+
+// Applies modify to the IAM policy of the project. Writing the policy fails
+// if it changed since it was read, in which case it is read and modified
+// again. modify returns whether it changed the policy.
+func (sas *ServiceAccountService) modifyIamPolicy(project string, modify func(*cloudresourcemanager.Policy) bool) error {
+	resourceManagerService, err := sas.resourceManager()
+	if err != nil {
+		return err
 	}
-	return nil
+	for attempt := 1; ; attempt++ {
+		policy, err := resourceManagerService.ProjectsGetIamPolicy(project)
+		if err != nil {
+			return err
+		}
+		if !modify(policy) {
+			return nil
+		}
+		_, err = resourceManagerService.ProjectsSetIamPolicy(project, policy)
+		if err == nil || !errors.IsConflict(err) || attempt == maxIamPolicyAttempts {
+			return err
+		}
+		glog.Infof("IAM policy of project %v changed concurrently, retrying: %v", project, err)
+	}
+}
+
+// Adds the member to the binding of the role, and returns whether it was
+// missing.
+func addIamPolicyBinding(policy *cloudresourcemanager.Policy, role string, member string) bool {
+	for _, binding := range policy.Bindings {
+		if binding.Role != role {
+			continue
+		}
+		for _, m := range binding.Members {
+			if m == member {
+				return false
+			}
+		}
+		binding.Members = append(binding.Members, member)
+		return true
+	}
+	policy.Bindings = append(policy.Bindings, &cloudresourcemanager.Binding{
+		Role:    role,
+		Members: []string{member},
+	})
+	return true
+}
+
+// Removes the member from the bindings of all roles, dropping the bindings
+// that have no members left, and returns whether the member was present.
+func removeIamPolicyMember(policy *cloudresourcemanager.Policy, member string) bool {
+	removed := false
+	var bindings []*cloudresourcemanager.Binding
+	for _, binding := range policy.Bindings {
+		var members []string
+		for _, m := range binding.Members {
+			if m == member {
+				removed = true
+			} else {
+				members = append(members, m)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		binding.Members = members
+		bindings = append(bindings, binding)
+	}
+	policy.Bindings = bindings
+	return removed
+}
+
+func (sas *ServiceAccountService) iam() (GCEClientIAMService, error) {
+	sas.mu.Lock()
+	defer sas.mu.Unlock()
+	if sas.iamService == nil {
+		iamService, err := clients.NewIAMService()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create IAM client: %v", err)
+		}
+		sas.iamService = iamService
+	}
+	return sas.iamService, nil
+}
+
+func (sas *ServiceAccountService) resourceManager() (GCEClientResourceManagerService, error) {
+	sas.mu.Lock()
+	defer sas.mu.Unlock()
+	if sas.resourceManagerService == nil {
+		resourceManagerService, err := clients.NewCloudResourceManagerService()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create Resource Manager client: %v", err)
+		}
+		sas.resourceManagerService = resourceManagerService
+	}
+	return sas.resourceManagerService, nil
+}
+
+// Secrets are created in the cluster of the current kubeconfig context, like
+// kubectl would, which is looked up anew each time as clusterctl switches
+// between its bootstrap and target clusters.
+func (sas *ServiceAccountService) secrets() (corev1client.SecretsGetter, error) {
+	if sas.secretsGetter != nil {
+		return sas.secretsGetter, nil
+	}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return corev1client.NewForConfig(config)
 }
@@ -0,0 +1,424 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/iam/v1"
+	corev1 "k8s.io/api/core/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google/clients"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+)
+
+const credentialsFile = `{"type": "service_account"}`
+
+func TestCreateNodeServiceAccountsGrantsRoles(t *testing.T) {
+	api := newFakeIAMAPI()
+	// Another client changes the policy between the first read and write.
+	api.conflicts = 1
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	cluster := newDefaultClusterFixture(t)
+
+	if err := sas.CreateWorkerNodeServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to create worker service account: %v", err)
+	}
+	if err := sas.CreateMasterNodeServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to create master service account: %v", err)
+	}
+
+	serviceAccounts := clusterServiceAccounts(t, cluster)
+	if !strings.HasPrefix(serviceAccounts.Worker, "k8s-worker-") || !strings.HasSuffix(serviceAccounts.Worker, "@project-name-2000.iam.gserviceaccount.com") {
+		t.Errorf("invalid worker service account: %v", serviceAccounts.Worker)
+	}
+	if !strings.HasPrefix(serviceAccounts.Master, "k8s-master-") {
+		t.Errorf("invalid master service account: %v", serviceAccounts.Master)
+	}
+	if api.conflicts != 0 {
+		t.Errorf("expected the conflicting policy write to be retried")
+	}
+	for _, role := range google.MasterNodeRoles {
+		members := api.members("roles/" + role)
+		if !reflect.DeepEqual(members, []string{"serviceAccount:" + serviceAccounts.Master}) {
+			t.Errorf("invalid members of roles/%v: %v", role, members)
+		}
+	}
+	// Bindings of other members are kept.
+	if members := api.members("roles/owner"); !reflect.DeepEqual(members, []string{"user:admin@example.com"}) {
+		t.Errorf("invalid members of roles/owner: %v", members)
+	}
+}
+
+func TestCreateMachineControllerServiceAccountCreatesSecret(t *testing.T) {
+	api := newFakeIAMAPI()
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	cluster := newDefaultClusterFixture(t)
+
+	if err := sas.CreateMachineControllerServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to create machine controller service account: %v", err)
+	}
+
+	secret := api.secrets["default/"+google.MachineControllerSecret]
+	if secret == nil {
+		t.Fatalf("expected secret %v to be created", google.MachineControllerSecret)
+	}
+	if data := string(secret.Data["service-account.json"]); data != credentialsFile {
+		t.Errorf("invalid credentials: expected '%v' got '%v'", credentialsFile, data)
+	}
+}
+
+func TestDeleteServiceAccountRemovesBindings(t *testing.T) {
+	api := newFakeIAMAPI()
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	cluster := newDefaultClusterFixture(t)
+	if err := sas.CreateMachineControllerServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to create machine controller service account: %v", err)
+	}
+
+	if err := sas.DeleteMachineControllerServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to delete machine controller service account: %v", err)
+	}
+	// Deleting service accounts that were never created succeeds.
+	if err := sas.DeleteWorkerNodeServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to delete worker service account: %v", err)
+	}
+
+	if len(api.accounts) != 0 || len(api.keys) != 0 {
+		t.Errorf("expected the service account and its keys to be deleted, got %v and %v", api.accounts, api.keys)
+	}
+	if email := clusterServiceAccounts(t, cluster).MachineController; email != "" {
+		t.Errorf("expected the deleted service account to be forgotten, got '%v'", email)
+	}
+	if len(api.policy.Bindings) != 1 || api.policy.Bindings[0].Role != "roles/owner" {
+		t.Errorf("expected only the bindings of other members to be left, got %v", api.policy.Bindings)
+	}
+}
+
+func TestCreateServiceAccountAdoptsExistingAccount(t *testing.T) {
+	api := newFakeIAMAPI()
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	cluster := newDefaultClusterFixture(t)
+
+	// An earlier attempt that failed to store the cluster status created
+	// the account already.
+	if err := sas.CreateMachineControllerServiceAccount(newDefaultClusterFixture(t)); err != nil {
+		t.Fatalf("unable to create machine controller service account: %v", err)
+	}
+	if err := sas.CreateMachineControllerServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to create machine controller service account: %v", err)
+	}
+
+	if len(api.accounts) != 1 {
+		t.Errorf("expected the existing account to be adopted, got %v", api.accounts)
+	}
+	email := clusterServiceAccounts(t, cluster).MachineController
+	if _, ok := api.accounts[email]; !ok {
+		t.Errorf("expected the existing account to be recorded, got '%v'", email)
+	}
+	if len(api.keys) != 1 {
+		t.Errorf("expected the existing secret to be kept, got %v keys", len(api.keys))
+	}
+}
+
+func TestCreateServiceAccountRecordsAccountBeforeGrantingRoles(t *testing.T) {
+	api := newFakeIAMAPI()
+	api.policyFail = true
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	cluster := newDefaultClusterFixture(t)
+
+	if err := sas.CreateMasterNodeServiceAccount(cluster); err == nil {
+		t.Fatal("expected an error granting roles")
+	}
+	email := clusterServiceAccounts(t, cluster).Master
+	if _, ok := api.accounts[email]; !ok || email == "" {
+		t.Errorf("expected the created account to be recorded, got '%v'", email)
+	}
+}
+
+func TestServiceAccountIdsSurvivePivot(t *testing.T) {
+	api := newFakeIAMAPI()
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	cluster := newDefaultClusterFixture(t)
+	cluster.ObjectMeta.UID = "0d9b1f7e-2a3c-4b5d-8e6f-7a8b9c0d1e2f"
+	if err := sas.CreateWorkerNodeServiceAccount(cluster); err != nil {
+		t.Fatalf("unable to create worker service account: %v", err)
+	}
+
+	// The pivoted cluster has another UID, and its status was lost.
+	pivoted := newDefaultClusterFixture(t)
+	pivoted.ObjectMeta.UID = "f1e2d3c4-b5a6-4978-8695-a4b3c2d1e0f9"
+	if err := sas.CreateWorkerNodeServiceAccount(pivoted); err != nil {
+		t.Fatalf("unable to create worker service account: %v", err)
+	}
+	if email := clusterServiceAccounts(t, pivoted).Worker; len(api.accounts) != 1 || email != clusterServiceAccounts(t, cluster).Worker {
+		t.Errorf("expected the pivoted cluster to adopt its account, got '%v' and accounts %v", email, api.accounts)
+	}
+
+	// The account is found without the status too.
+	if err := sas.DeleteWorkerNodeServiceAccount(newDefaultClusterFixture(t)); err != nil {
+		t.Fatalf("unable to delete worker service account: %v", err)
+	}
+	if len(api.accounts) != 0 {
+		t.Errorf("expected the unrecorded account to be deleted, got %v", api.accounts)
+	}
+}
+
+func TestDeleteServiceAccountsOfDeletedClusters(t *testing.T) {
+	api := newFakeIAMAPI()
+	sas, server := newServiceAccountService(t, api)
+	defer server.Close()
+	deleted := newNamedCluster(t, "deleted")
+	live := newNamedCluster(t, "live")
+	for _, cluster := range []*v1alpha1.Cluster{deleted, live} {
+		if err := sas.CreateWorkerNodeServiceAccount(cluster); err != nil {
+			t.Fatalf("unable to create worker service account: %v", err)
+		}
+	}
+	if err := sas.CreateMachineControllerServiceAccount(deleted); err != nil {
+		t.Fatalf("unable to create machine controller service account: %v", err)
+	}
+	// Accounts the provider didn't create are left alone.
+	api.accounts["someone@project-name-2000.iam.gserviceaccount.com"] = "k8s-worker service account"
+	// So are the accounts a live cluster records, whatever cluster they
+	// name.
+	adopted := newNamedCluster(t, "adopted")
+	if err := sas.CreateMasterNodeServiceAccount(adopted); err != nil {
+		t.Fatalf("unable to create master service account: %v", err)
+	}
+	setClusterServiceAccounts(t, live, func(accounts *gceconfigv1.ServiceAccountsStatus) {
+		accounts.Master = clusterServiceAccounts(t, adopted).Master
+	})
+
+	err := sas.DeleteServiceAccountsOfDeletedClusters("project-name-2000", []v1alpha1.Cluster{*live})
+	if err != nil {
+		t.Fatalf("unable to delete service accounts: %v", err)
+	}
+
+	liveAccounts := clusterServiceAccounts(t, live)
+	if len(api.accounts) != 3 || api.accounts[liveAccounts.Worker] == "" || api.accounts[liveAccounts.Master] == "" {
+		t.Errorf("expected only the accounts of the deleted cluster to be deleted, got %v", api.accounts)
+	}
+	if len(api.keys) != 0 {
+		t.Errorf("expected the keys of the deleted cluster to be deleted, got %v", api.keys)
+	}
+	for _, binding := range api.policy.Bindings {
+		for _, member := range binding.Members {
+			if member != "user:admin@example.com" && member != "serviceAccount:"+liveAccounts.Worker && member != "serviceAccount:"+liveAccounts.Master {
+				t.Errorf("expected the bindings of the deleted cluster to be removed, got %v in %v", member, binding.Role)
+			}
+		}
+	}
+}
+
+func newNamedCluster(t *testing.T, name string) *v1alpha1.Cluster {
+	cluster := newDefaultClusterFixture(t)
+	cluster.ObjectMeta.Name = name
+	return cluster
+}
+
+func setClusterServiceAccounts(t *testing.T, cluster *v1alpha1.Cluster, modify func(*gceconfigv1.ServiceAccountsStatus)) {
+	t.Helper()
+	status := &gceconfigv1.GCEClusterProviderStatus{}
+	if err := json.Unmarshal(cluster.Status.ProviderStatus.Raw, status); err != nil {
+		t.Fatalf("unable to decode cluster provider status: %v", err)
+	}
+	modify(&status.ServiceAccounts)
+	raw, err := json.Marshal(status)
+	if err != nil {
+		t.Fatalf("unable to encode cluster provider status: %v", err)
+	}
+	cluster.Status.ProviderStatus.Raw = raw
+}
+
+func clusterServiceAccounts(t *testing.T, cluster *v1alpha1.Cluster) gceconfigv1.ServiceAccountsStatus {
+	t.Helper()
+	status := &gceconfigv1.GCEClusterProviderStatus{}
+	if err := json.Unmarshal(cluster.Status.ProviderStatus.Raw, status); err != nil {
+		t.Fatalf("unable to decode cluster provider status: %v", err)
+	}
+	return status.ServiceAccounts
+}
+
+// fakeIAMAPI serves the parts of the IAM, Resource Manager and Kubernetes
+// APIs that service accounts are managed with.
+type fakeIAMAPI struct {
+	mu sync.Mutex
+	// The display names of the service accounts by email.
+	accounts map[string]string
+	// The emails of the service accounts of keys by name.
+	keys       map[string]string
+	keyCount   int
+	policy     *cloudresourcemanager.Policy
+	etag       int
+	conflicts  int
+	policyFail bool
+	secrets    map[string]*corev1.Secret
+}
+
+func newFakeIAMAPI() *fakeIAMAPI {
+	return &fakeIAMAPI{
+		accounts: map[string]string{},
+		keys:     map[string]string{},
+		policy: &cloudresourcemanager.Policy{
+			Bindings: []*cloudresourcemanager.Binding{{Role: "roles/owner", Members: []string{"user:admin@example.com"}}},
+		},
+		secrets: map[string]*corev1.Secret{},
+	}
+}
+
+func (f *fakeIAMAPI) members(role string) []string {
+	for _, binding := range f.policy.Bindings {
+		if binding.Role == role {
+			return binding.Members
+		}
+	}
+	return nil
+}
+
+func (f *fakeIAMAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const accountsPath = "/v1/projects/project-name-2000/serviceAccounts"
+	switch {
+	case req.URL.Path == accountsPath && req.Method == http.MethodPost:
+		var request iam.CreateServiceAccountRequest
+		decode(w, req, &request)
+		email := fmt.Sprintf("%s@project-name-2000.iam.gserviceaccount.com", request.AccountId)
+		if _, ok := f.accounts[email]; ok {
+			http.Error(w, `{"error": {"code": 409, "message": "already exists"}}`, http.StatusConflict)
+			return
+		}
+		f.accounts[email] = request.ServiceAccount.DisplayName
+		encode(w, &iam.ServiceAccount{Email: email, DisplayName: request.ServiceAccount.DisplayName})
+	case req.URL.Path == accountsPath:
+		response := iam.ListServiceAccountsResponse{}
+		for email, displayName := range f.accounts {
+			response.Accounts = append(response.Accounts, &iam.ServiceAccount{Email: email, DisplayName: displayName})
+		}
+		encode(w, &response)
+	case strings.HasPrefix(req.URL.Path, accountsPath+"/"):
+		account := strings.TrimPrefix(req.URL.Path, accountsPath+"/")
+		i := strings.Index(account, "/keys")
+		switch {
+		case i < 0 && req.Method == http.MethodDelete:
+			delete(f.accounts, account)
+			encode(w, &iam.Empty{})
+		case i < 0:
+			http.NotFound(w, req)
+		case account[i:] == "/keys" && req.Method == http.MethodPost:
+			f.keyCount++
+			name := fmt.Sprintf("projects/project-name-2000/serviceAccounts/%s/keys/%v", account[:i], f.keyCount)
+			f.keys[name] = account[:i]
+			encode(w, &iam.ServiceAccountKey{Name: name, PrivateKeyData: base64.StdEncoding.EncodeToString([]byte(credentialsFile))})
+		case account[i:] == "/keys":
+			response := iam.ListServiceAccountKeysResponse{}
+			for name, email := range f.keys {
+				if email == account[:i] {
+					response.Keys = append(response.Keys, &iam.ServiceAccountKey{Name: name})
+				}
+			}
+			encode(w, &response)
+		default:
+			delete(f.keys, strings.TrimPrefix(req.URL.Path, "/v1/"))
+			encode(w, &iam.Empty{})
+		}
+	case req.URL.Path == "/v1/projects/project-name-2000:getIamPolicy":
+		f.policy.Etag = fmt.Sprint(f.etag)
+		encode(w, f.policy)
+	case req.URL.Path == "/v1/projects/project-name-2000:setIamPolicy":
+		var request cloudresourcemanager.SetIamPolicyRequest
+		decode(w, req, &request)
+		if f.policyFail {
+			http.Error(w, `{"error": {"code": 403, "message": "permission denied"}}`, http.StatusForbidden)
+			return
+		}
+		if f.conflicts > 0 {
+			f.conflicts--
+			f.etag++
+		}
+		if request.Policy.Etag != fmt.Sprint(f.etag) {
+			http.Error(w, `{"error": {"code": 409, "message": "etag mismatch"}}`, http.StatusConflict)
+			return
+		}
+		f.etag++
+		f.policy = request.Policy
+		encode(w, f.policy)
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/") && req.Method == http.MethodPost:
+		var secret corev1.Secret
+		decode(w, req, &secret)
+		f.secrets[secret.Namespace+"/"+secret.Name] = &secret
+		encode(w, &secret)
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/"):
+		parts := strings.Split(req.URL.Path, "/")
+		secret, ok := f.secrets[parts[4]+"/"+parts[6]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		encode(w, secret)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func decode(w http.ResponseWriter, req *http.Request, v interface{}) {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func encode(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newServiceAccountService(t *testing.T, api *fakeIAMAPI) (*google.ServiceAccountService, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(api)
+	iamService, err := clients.NewIAMServiceForURL(server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("unable to create IAM service: %v", err)
+	}
+	resourceManagerService, err := clients.NewCloudResourceManagerServiceForURL(server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("unable to create Resource Manager service: %v", err)
+	}
+	secretsGetter, err := corev1client.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatalf("unable to create Kubernetes client: %v", err)
+	}
+	return google.NewServiceAccountService(iamService, resourceManagerService, secretsGetter), server
+}
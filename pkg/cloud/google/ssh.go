@@ -17,102 +17,483 @@ limitations under the License.
 package google
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	apimachineryerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	certutil "k8s.io/client-go/util/cert"
 	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/util"
 )
 
 const (
 	MachineControllerSshKeySecret = "machine-controller-sshkeys"
 	// Arbitrary name used for SSH.
-	SshUser                = "clusterapi"
-	SshKeyFile             = "clusterapi-key"
-	SshKeyFilePublic       = SshKeyFile + ".pub"
-	SshKeyFilePublicGcloud = SshKeyFilePublic + ".gcloud"
+	SshUser = "clusterapi"
+	// The keys of the private key and the user in the SSH key secret. The
+	// machine controller mounts the secret as files in SshKeysPath.
+	SshKeySecretPrivateKey = "private"
+	SshKeySecretUserKey    = "user"
+	SshKeysPath            = "/etc/sshkeys"
+
+	defaultSshPort           = 22
+	defaultSshCommandTimeout = 10 * time.Minute
+	sshDialTimeout           = 30 * time.Second
+
+	// The guest environment of GCE images prints the host keys of an
+	// instance to its first serial port between these lines.
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
 )
 
-func createSshKeyPairs() error {
-	err := run("ssh-keygen", "-t", "rsa", "-f", SshKeyFile, "-C", SshUser, "-N", "")
+// Loads the SSH credentials of the machine controller, which are only
+// mounted when it runs inside its pod.
+func loadSshCreds(path string) (SshCreds, error) {
+	privateKeyPath := path + "/" + SshKeySecretPrivateKey
+	if _, err := os.Stat(privateKeyPath); err != nil {
+		return SshCreds{}, nil
+	}
+	b, err := ioutil.ReadFile(path + "/" + SshKeySecretUserKey)
 	if err != nil {
-		return fmt.Errorf("couldn't generate RSA keys: %v", err)
+		return SshCreds{}, err
 	}
+	return SshCreds{
+		privateKeyPath: privateKeyPath,
+		user:           string(b),
+	}, nil
+}
 
-	// Prepare a gce format public key file
-	outfile, err := os.Create(SshKeyFilePublicGcloud)
+func (creds SshCreds) signer() (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(creds.privateKeyPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer outfile.Close()
-
-	b, err := ioutil.ReadFile(SshKeyFilePublic)
-	if err == nil {
-		outfile.WriteString(SshUser + ":" + string(b))
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SSH private key %v: %v", creds.privateKeyPath, err)
 	}
-
-	return err
+	return signer, nil
 }
 
-func cleanupSshKeyPairs() {
-	os.Remove(SshKeyFile)
-	os.Remove(SshKeyFilePublic)
-	os.Remove(SshKeyFilePublicGcloud)
+// Generates a key pair in memory. It returns the PEM encoded private key and
+// the public key in authorized keys format.
+func newSshKeyPair() ([]byte, string, error) {
+	key, err := certutil.NewPrivateKey()
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't generate RSA keys: %v", err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))) + " " + SshUser
+	return certutil.EncodePrivateKeyPEM(key), authorizedKey, nil
 }
 
-// It creates secret to store private key.
-func (gce *GCEClient) setupSSHAccess(cluster *clusterv1.Cluster, machine *clusterv1.Machine) error {
-	// Create public/private key pairs
-	err := createSshKeyPairs()
+// It authorizes a new key pair on every master and creates secret to store
+// private key.
+func (gce *GCEClient) setupSSHAccess(cluster *clusterv1.Cluster, masters []*clusterv1.Machine, secrets corev1client.SecretsGetter) error {
+	privateKey, authorizedKey, err := newSshKeyPair()
 	if err != nil {
 		return err
 	}
 
-	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
+	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
 	if err != nil {
 		return err
 	}
 
+	for _, machine := range masters {
+		machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
+		if err != nil {
+			return err
+		}
+		if err := gce.authorizeSshKey(clusterConfig.Project, machineConfig.Zone, machine.Name, authorizedKey); err != nil {
+			return err
+		}
+	}
+
+	// Create secrets so that machine controller container can load them.
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: MachineControllerSshKeySecret,
+		},
+		Data: map[string][]byte{
+			SshKeySecretPrivateKey: privateKey,
+			SshKeySecretUserKey:    []byte(SshUser),
+		},
+	}
+	_, err = secrets.Secrets(corev1.NamespaceDefault).Create(secret)
+	if apimachineryerrors.IsAlreadyExists(err) {
+		_, err = secrets.Secrets(corev1.NamespaceDefault).Update(secret)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't store SSH key as secret %v: %v", MachineControllerSshKeySecret, err)
+	}
+	return nil
+}
+
+// Adds the public key to the ssh-keys metadata of an instance, which makes the
+// guest environment authorize it for SshUser.
+func (gce *GCEClient) authorizeSshKey(project string, zone string, name string, authorizedKey string) error {
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
+	if err != nil {
+		return fmt.Errorf("error getting instance %v: %v", name, err)
+	}
+	entry := SshUser + ":" + authorizedKey
+	metadata := &compute.Metadata{}
+	found := false
+	if instance.Metadata != nil {
+		metadata.Fingerprint = instance.Metadata.Fingerprint
+		for _, item := range instance.Metadata.Items {
+			if item.Key == "ssh-keys" && item.Value != nil {
+				value := strings.TrimSpace(*item.Value) + "\n" + entry
+				item = &compute.MetadataItems{Key: item.Key, Value: &value}
+				found = true
+			}
+			metadata.Items = append(metadata.Items, item)
+		}
+	}
+	if !found {
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: "ssh-keys", Value: &entry})
+	}
+	op, err := gce.computeService.InstancesSetMetadata(project, zone, name, metadata)
+	if err == nil {
+		err = gce.computeService.WaitForOperation(project, op)
+	}
+	if err != nil {
+		return fmt.Errorf("error authorizing SSH key on instance %v: %v", name, err)
+	}
+	return nil
+}
+
+// Runs a command on the instance of a machine and returns its output, which
+// is logged as it arrives.
+func (gce *GCEClient) remoteSshCommand(cluster *clusterv1.Cluster, machine *clusterv1.Machine, cmd string) (string, error) {
+	machineConfig, err := machineProviderFromProviderConfig(machine.Spec.ProviderConfig)
+	if err != nil {
+		return "", err
+	}
 	clusterConfig, err := clusterProviderFromProviderConfig(cluster.Spec.ProviderConfig)
 	if err != nil {
-		return err
+		return "", err
+	}
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return "", err
 	}
+	project, zone, name := instanceLocation(status, clusterConfig, machineConfig, machine)
+	return gce.sshCommand(project, zone, name, cmd, false, machine)
+}
+
+// Runs a command on an instance. The instance has to present one of the host
+// keys it published on its serial port.
+func (gce *GCEClient) instanceSshCommand(project string, zone string, name string, cmd string) (string, error) {
+	return gce.sshCommand(project, zone, name, cmd, false, nil)
+}
+
+// Runs a command on an instance. The standard output of commands that print
+// secrets is neither logged nor included in errors. If the instance is the
+// one of the given machine, its host keys are pinned in the machine's
+// provider status.
+func (gce *GCEClient) sshCommand(project string, zone string, name string, cmd string, secret bool, machine *clusterv1.Machine) (string, error) {
+	glog.Infof("Remote SSH execution '%s' on %s", cmd, name)
 
-	err = run("gcloud", "compute", "instances", "add-metadata", machine.Name,
-		"--metadata-from-file", "ssh-keys="+SshKeyFile+".pub.gcloud",
-		"--project", clusterConfig.Project, "--zone", machineConfig.Zone)
+	if gce.sshCreds.privateKeyPath == "" {
+		return "", fmt.Errorf("no SSH key to connect to instance %v", name)
+	}
+	signer, err := gce.sshCreds.signer()
 	if err != nil {
-		return err
+		return "", err
+	}
+	instance, err := gce.computeService.InstancesGet(project, zone, name)
+	if err != nil {
+		return "", err
+	}
+	var hostKeys []ssh.PublicKey
+	if machine != nil {
+		hostKeys, err = gce.machineHostKeys(machine, project, zone, instance)
+	} else {
+		hostKeys, err = gce.instanceHostKeys(project, zone, name)
+	}
+	if err != nil {
+		return "", err
 	}
 
-	// Create secrets so that machine controller container can load them.
-	err = run("kubectl", "create", "secret", "generic", MachineControllerSshKeySecret, "--from-file=private="+SshKeyFile, "--from-literal=user="+SshUser)
+	internalIP, publicIP := instanceIPs(instance)
+	address := publicIP
+	if address == "" {
+		address = internalIP
+	}
+	config := &ssh.ClientConfig{
+		User:              gce.sshCreds.user,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   pinnedHostKeys(name, hostKeys),
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeys),
+		Timeout:           sshDialTimeout,
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(gce.sshPort)), config)
 	if err != nil {
-		return fmt.Errorf("couldn't create service account key as credential: %v", err)
+		return "", fmt.Errorf("error connecting to instance %v over SSH: %v", name, err)
 	}
+	defer client.Close()
+	return runSshCommand(client, name, cmd, gce.sshCommandTimeout, secret)
+}
 
-	cleanupSshKeyPairs()
+// Runs a command in a new session and waits at most the timeout for it.
+// Returns its standard output. Errors carry the standard error as well, and
+// unless the output is secret, the standard output.
+func runSshCommand(client *ssh.Client, instanceName string, cmd string, timeout time.Duration, secret bool) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("error opening SSH session to instance %v: %v", instanceName, err)
+	}
+	defer session.Close()
 
-	return err
+	output := &sshOutput{}
+	stdout, stderr := output.stream(instanceName), output.stream(instanceName)
+	if secret {
+		stdout = &sshOutputStream{instanceName: instanceName, secret: true}
+	}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		// Closing the connection ends the session on the machine.
+		session.Signal(ssh.SIGKILL)
+		client.Close()
+		return "", &remoteCommandError{err: fmt.Errorf("timed out after %v", timeout), output: strings.TrimSpace(output.String())}
+	}
+	stdout.flush()
+	stderr.flush()
+	combined := strings.TrimSpace(output.String())
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return "", &remoteCommandError{err: exitErr, output: combined}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error: %v, output: %s", err, combined)
+	}
+	return strings.TrimSpace(stdout.data.String()), nil
 }
 
-func (gce *GCEClient) remoteSshCommand(cluster *clusterv1.Cluster, machine *clusterv1.Machine, cmd string) (string, error) {
-	glog.Infof("Remote SSH execution '%s' on %s", cmd, machine.ObjectMeta.Name)
+// remoteCommandError is returned for a command that ran on a machine but
+// failed or timed out, as opposed to one that could not be run, e.g. because
+// the connection to the machine failed.
+type remoteCommandError struct {
+	err    error
+	output string
+}
 
-	publicIP, err := gce.GetIP(cluster, machine)
+func (e *remoteCommandError) Error() string {
+	return fmt.Sprintf("error: %v, output: %s", e.err, e.output)
+}
+
+// Returns the host keys the instance published on its serial port when it
+// last booted.
+func (gce *GCEClient) instanceHostKeys(project string, zone string, name string) ([]ssh.PublicKey, error) {
+	output, err := gce.computeService.InstancesGetSerialPortOutput(project, zone, name)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("error getting serial port output of instance %v: %v", name, err)
+	}
+	var keys []ssh.PublicKey
+	if output != nil {
+		keys = parseHostKeys(output.Contents)
 	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("instance %v has not published its SSH host keys on its serial port", name)
+	}
+	return keys, nil
+}
 
-	command := fmt.Sprintf("%s", cmd)
-	c := exec.Command("ssh", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "-i", gce.sshCreds.privateKeyPath, "-q", gce.sshCreds.user+"@"+publicIP, command)
-	out, err := c.CombinedOutput()
+// Returns the host keys pinned in the provider status of the machine if they
+// belong to the given instance. Otherwise they are read from the serial port
+// of the instance and pinned.
+func (gce *GCEClient) machineHostKeys(machine *clusterv1.Machine, project string, zone string, instance *compute.Instance) ([]ssh.PublicKey, error) {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.HostKeys) > 0 && status.InstanceName == instance.Name && status.InstanceID == instanceID(instance) {
+		var keys []ssh.PublicKey
+		for _, authorizedKey := range status.HostKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing pinned host key of instance %v: %v", instance.Name, err)
+			}
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}
+
+	keys, err := gce.instanceHostKeys(project, zone, instance.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := gce.pinHostKeys(machine, instance, keys); err != nil {
+		glog.Warningf("Error pinning the host keys of instance %v: %v", instance.Name, err)
+	}
+	return keys, nil
+}
+
+// Records the host keys of the instance in the provider status of its
+// machine, unless the machine moved on to another instance.
+func (gce *GCEClient) pinHostKeys(machine *clusterv1.Machine, instance *compute.Instance, keys []ssh.PublicKey) error {
+	if gce.client == nil {
+		return nil
+	}
+	var hostKeys []string
+	for _, key := range keys {
+		hostKeys = append(hostKeys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	current, err := util.GetMachineIfExists(gce.client, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("machine %v has already been deleted", machine.ObjectMeta.Name)
+	}
+	status, err := gce.machineProviderStatus(current)
+	if err != nil {
+		return err
+	}
+	if status.InstanceName != instance.Name || status.InstanceID != instanceID(instance) {
+		return nil
+	}
+	status.HostKeys = hostKeys
+	if err := setMachineProviderStatus(current, status); err != nil {
+		return err
+	}
+	if err := gce.client.Status().Update(context.Background(), current); err != nil {
+		return fmt.Errorf("error updating status of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	// The provider status of the machine is stored again by upgrades and
+	// replacements, which must keep the keys.
+	status, err = gce.machineProviderStatus(machine)
 	if err != nil {
-		return "", fmt.Errorf("error: %v, output: %s", err, string(out))
+		return err
+	}
+	status.HostKeys = hostKeys
+	return setMachineProviderStatus(machine, status)
+}
+
+// Parses the last block of host keys in the serial port output. Lines may be
+// prefixed, e.g. with a timestamp, so each key starts at its first field that
+// parses.
+func parseHostKeys(output string) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	inKeys := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, hostKeysBegin):
+			keys = nil
+			inKeys = true
+		case strings.Contains(line, hostKeysEnd):
+			inKeys = false
+		case inKeys:
+			fields := strings.Fields(line)
+			for i := range fields {
+				key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[i:], " ")))
+				if err == nil {
+					keys = append(keys, key)
+					break
+				}
+			}
+		}
+	}
+	return keys
+}
+
+func pinnedHostKeys(name string, keys []ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, k := range keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v host key %v of instance %v is not one it published", key.Type(), ssh.FingerprintSHA256(key), name)
+	}
+}
+
+// Restricts the negotiated host key to the types the instance published, so
+// that the server doesn't present a key that can't be verified.
+func hostKeyAlgorithms(keys []ssh.PublicKey) []string {
+	var algorithms []string
+	for _, k := range keys {
+		algorithms = append(algorithms, k.Type())
+	}
+	return algorithms
+}
+
+// Collects the output of a remote command. Each stream logs its complete
+// lines as they arrive.
+type sshOutput struct {
+	mu     sync.Mutex
+	output bytes.Buffer
+}
+
+func (o *sshOutput) stream(instanceName string) *sshOutputStream {
+	return &sshOutputStream{output: o, instanceName: instanceName}
+}
+
+func (o *sshOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.output.String()
+}
+
+type sshOutputStream struct {
+	output       *sshOutput
+	instanceName string
+	line         []byte
+	// The output of this stream alone.
+	data bytes.Buffer
+	// Secret output is only kept in data.
+	secret bool
+}
+
+func (s *sshOutputStream) Write(p []byte) (int, error) {
+	s.data.Write(p)
+	if s.secret {
+		return len(p), nil
+	}
+	s.output.mu.Lock()
+	s.output.output.Write(p)
+	s.output.mu.Unlock()
+
+	s.line = append(s.line, p...)
+	for {
+		i := bytes.IndexByte(s.line, '\n')
+		if i < 0 {
+			break
+		}
+		glog.Infof("%s: %s", s.instanceName, s.line[:i])
+		s.line = s.line[i+1:]
+	}
+	return len(p), nil
+}
+
+func (s *sshOutputStream) flush() {
+	if len(s.line) > 0 {
+		glog.Infof("%s: %s", s.instanceName, s.line)
+		s.line = nil
 	}
-	result := strings.TrimSpace(string(out))
-	return result, nil
 }
@@ -0,0 +1,378 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	compute "google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	certutil "k8s.io/client-go/util/cert"
+	"sigs.k8s.io/cluster-api-provider-gcp/pkg/cloud/google"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestMasterUpgradeRunsCommandsOverSSH(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), time.Minute)
+
+	if err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master)); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	expected := []string{
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf drain master-0 --ignore-daemonsets --delete-local-data --timeout 5m0s",
+		"sudo apt-get install -y --allow-downgrades kubelet=1.9.4-00",
+		"for i in $(seq 60); do [ \"$(sudo kubectl --kubeconfig /etc/kubernetes/admin.conf get node master-0 -o jsonpath='{.status.nodeInfo.kubeletVersion}')\" = v1.9.4 ] && exit 0; sleep 5; done; exit 1",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf uncordon master-0",
+	}
+	commands := server.Commands()
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("invalid commands: expected '%v' got '%v'", expected, commands)
+	}
+}
+
+func TestSSHRequiresPublishedHostKey(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	otherKey := newSSHSigner(t)
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, otherKey.PublicKey(), time.Minute)
+
+	err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master))
+	if err == nil || !strings.Contains(err.Error(), "is not one it published") {
+		t.Fatalf("expected an unpublished host key error, got '%v'", err)
+	}
+	if commands := server.Commands(); len(commands) != 0 {
+		t.Errorf("expected no commands to run, got '%v'", commands)
+	}
+}
+
+func TestSSHUsesPinnedHostKeys(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(server.hostKey.PublicKey())))
+	output := "Booting\n" + hostKeysOutput(authorizedKey)
+	gce, fakeClient, cluster, master := newSSHMasterWithSerialOutput(t, server, &output, time.Minute)
+
+	if err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master)); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	status := getMachineProviderStatus(t, getMachine(t, fakeClient, master))
+	if len(status.HostKeys) != 1 || status.HostKeys[0] != authorizedKey {
+		t.Fatalf("expected the host key to be pinned, got '%v'", status.HostKeys)
+	}
+
+	// The keys scrolled out of the serial port output.
+	output = strings.Repeat("Running\n", 100)
+	if err := gce.Update(cluster, upgradeMachine(t, fakeClient, master, "1.9.5", "1.9.5")); err != nil {
+		t.Fatalf("unable to update master with pinned host keys: %v", err)
+	}
+	if commands := server.Commands(); len(commands) <= 4 {
+		t.Errorf("expected both upgrades to run their commands, got '%v'", commands)
+	}
+}
+
+func TestSSHRequiresHostKeysInSerialOutput(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	output := strings.Repeat("Running\n", 100)
+	gce, fakeClient, cluster, master := newSSHMasterWithSerialOutput(t, server, &output, time.Minute)
+
+	err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master))
+	if err == nil || !strings.Contains(err.Error(), "has not published its SSH host keys") {
+		t.Fatalf("expected a missing host keys error, got '%v'", err)
+	}
+	if commands := server.Commands(); len(commands) != 0 {
+		t.Errorf("expected no commands to run, got '%v'", commands)
+	}
+}
+
+func TestSSHCommandTimeout(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	server.Respond(sshResponses{hang: "sudo apt-get install -y --allow-downgrades kubelet=1.9.4-00"})
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), 100*time.Millisecond)
+
+	err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout error, got '%v'", err)
+	}
+}
+
+func TestParseHostKeys(t *testing.T) {
+	key := newSSHSigner(t).PublicKey()
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	outdated := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(newSSHSigner(t).PublicKey())))
+	output := hostKeysOutput(outdated) + "Rebooting\n" + hostKeysOutput(authorizedKey)
+
+	keys := google.ParseHostKeys(output)
+	if len(keys) != 1 || string(keys[0].Marshal()) != string(key.Marshal()) {
+		t.Errorf("expected the host key of the last boot, got '%v'", keys)
+	}
+	if keys := google.ParseHostKeys("no keys\n"); len(keys) != 0 {
+		t.Errorf("expected no host keys, got '%v'", keys)
+	}
+}
+
+// Returns an actuator with a created master that connects to the SSH server,
+// and the instance of which published the given host key. The master runs
+// kubelet 1.9.3 and control plane 1.9.4.
+func newSSHMaster(t *testing.T, server *sshServer, hostKey ssh.PublicKey, timeout time.Duration) (*google.GCEClient, client.Client, *v1alpha1.Cluster, *v1alpha1.Machine) {
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))
+	output := "Booting\n" + hostKeysOutput(authorizedKey)
+	return newSSHMasterWithSerialOutput(t, server, &output, timeout)
+}
+
+// Returns an actuator with a created master like newSSHMaster, the instance
+// of which has the given serial port output.
+func newSSHMasterWithSerialOutput(t *testing.T, server *sshServer, output *string, timeout time.Duration) (*google.GCEClient, client.Client, *v1alpha1.Cluster, *v1alpha1.Machine) {
+	receivedInstance, computeServiceMock := newInsertInstanceCapturingMock()
+	computeServiceMock.mockInstancesGetSerialPortOutput = func(project string, zone string, instance string) (*compute.SerialPortOutput, error) {
+		return &compute.SerialPortOutput{Contents: *output}, nil
+	}
+	master := newStoredMachine(t, "master-0", newGCEMachineProviderConfigFixture())
+	master.Spec.Versions.Kubelet = "1.9.3"
+	fakeClient := listingClient{fake.NewFakeClient([]runtime.Object{master.DeepCopy()}...)}
+	params := google.MachineActuatorParams{
+		ComputeService:           computeServiceMock,
+		Kubeadm:                  newTokenCreatingKubeadm(t),
+		Client:                   fakeClient,
+		MachineSetupConfigGetter: newMachineSetupConfigWatcher(),
+		EventRecorder:            &record.FakeRecorder{},
+		Scheme:                   scheme.Scheme,
+		SSHKeysPath:              server.keysPath,
+		SSHPort:                  server.port,
+		SSHCommandTimeout:        timeout,
+	}
+	gce, err := google.NewMachineActuator(params)
+	if err != nil {
+		t.Fatalf("unable to create machine actuator: %v", err)
+	}
+	cluster := newDefaultClusterFixture(t)
+	if err := gce.Create(cluster, master); err != nil {
+		t.Fatalf("unable to create master: %v", err)
+	}
+	receivedInstance.NetworkInterfaces = []*compute.NetworkInterface{{Name: "nic0", NetworkIP: "127.0.0.1"}}
+	return gce, fakeClient, cluster, master
+}
+
+func upgradeKubelet(t *testing.T, c client.Client, machine *v1alpha1.Machine) *v1alpha1.Machine {
+	return upgradeMachine(t, c, machine, "1.9.4", "1.9.4")
+}
+
+func upgradeMachine(t *testing.T, c client.Client, machine *v1alpha1.Machine, controlPlane string, kubelet string) *v1alpha1.Machine {
+	stored := getMachine(t, c, machine)
+	stored.Spec.Versions.ControlPlane = controlPlane
+	stored.Spec.Versions.Kubelet = kubelet
+	return stored
+}
+
+func hostKeysOutput(keys ...string) string {
+	output := "Oct 18 12:00:00 instance google: -----BEGIN SSH HOST KEY KEYS-----\n"
+	for _, key := range keys {
+		output += "Oct 18 12:00:00 instance google: " + key + " root@instance\n"
+	}
+	return output + "Oct 18 12:00:00 instance google: -----END SSH HOST KEY KEYS-----\n"
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	key, err := certutil.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("unable to create signer: %v", err)
+	}
+	return signer
+}
+
+// An SSH server that accepts the key of the clusterapi user it wrote to
+// keysPath, and records and echoes the commands it runs.
+type sshServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	keysPath string
+	port     int
+
+	mu        sync.Mutex
+	commands  []string
+	responses sshResponses
+	done      chan struct{}
+}
+
+// Commands starting with hang never finish, those starting with fail exit
+// with status 1 and those starting with drop end without an exit status.
+// Commands that contain a key of output print its value instead of echoing
+// themselves.
+type sshResponses struct {
+	hang   string
+	fail   string
+	drop   string
+	output map[string]string
+}
+
+func newSSHServer(t *testing.T) *sshServer {
+	keysPath, err := ioutil.TempDir("", "sshkeys")
+	if err != nil {
+		t.Fatalf("unable to create keys directory: %v", err)
+	}
+	userKey, err := certutil.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keysPath, "private"), certutil.EncodePrivateKeyPEM(userKey), 0600); err != nil {
+		t.Fatalf("unable to write private key: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(keysPath, "user"), []byte("clusterapi"), 0600); err != nil {
+		t.Fatalf("unable to write user: %v", err)
+	}
+	userPublicKey, err := ssh.NewPublicKey(&userKey.PublicKey)
+	if err != nil {
+		t.Fatalf("unable to encode public key: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	s := &sshServer{
+		listener: listener,
+		hostKey:  newSSHSigner(t),
+		keysPath: keysPath,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		done:     make(chan struct{}),
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "clusterapi" || string(key.Marshal()) != string(userPublicKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key of user %v", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(s.hostKey)
+	go s.serve(config)
+	return s
+}
+
+func (s *sshServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, channels, requests, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go s.session(channel, requests)
+			}
+		}()
+	}
+}
+
+func (s *sshServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(request.Payload, &exec); err != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+		s.mu.Lock()
+		s.commands = append(s.commands, exec.Command)
+		responses := s.responses
+		s.mu.Unlock()
+		switch {
+		case matchesCommand(exec.Command, responses.hang):
+			<-s.done
+			return
+		case matchesCommand(exec.Command, responses.drop):
+			return
+		}
+		var status uint32
+		if matchesCommand(exec.Command, responses.fail) {
+			status = 1
+		}
+		output := exec.Command + "\n"
+		for command, o := range responses.output {
+			if strings.Contains(exec.Command, command) {
+				output = o
+			}
+		}
+		channel.Write([]byte(output))
+		channel.Stderr().Write([]byte("done"))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+func matchesCommand(command string, prefix string) bool {
+	return prefix != "" && strings.HasPrefix(command, prefix)
+}
+
+func (s *sshServer) Respond(responses sshResponses) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = responses
+}
+
+// Commands returns the commands run since the last call.
+func (s *sshServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	commands := s.commands
+	s.commands = nil
+	return commands
+}
+
+func (s *sshServer) Close() {
+	close(s.done)
+	s.listener.Close()
+	os.RemoveAll(s.keysPath)
+}
@@ -0,0 +1,428 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	commonerrors "sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	apierrors "sigs.k8s.io/cluster-api/pkg/errors"
+	"sigs.k8s.io/cluster-api/pkg/util"
+)
+
+// An in-place upgrade of a master runs these phases in order over SSH. The
+// phase an upgrade reached is recorded in the machine's provider status before
+// it runs, so that an upgrade interrupted by a restart of the controller
+// resumes there. Every phase can safely run again.
+var upgradePhases = []gceconfigv1.GCEMachineUpgradePhase{
+	gceconfigv1.UpgradePreflight,
+	gceconfigv1.UpgradeKubeadm,
+	gceconfigv1.UpgradePlan,
+	gceconfigv1.UpgradeEtcdSnapshot,
+	gceconfigv1.UpgradeControlPlane,
+	gceconfigv1.UpgradeKubelet,
+}
+
+const (
+	// Releases of kubeadm are published at this URL along with their
+	// sha256 checksums.
+	kubernetesReleaseURL = "https://dl.k8s.io/release"
+	adminKubeConfig      = "/etc/kubernetes/admin.conf"
+	// etcd of kubeadm control planes stores its data here on the host.
+	etcdDataDir = "/var/lib/etcd"
+	// How many times to check, five seconds apart, whether an upgraded
+	// kubelet reports its version.
+	kubeletVersionRetries = 60
+)
+
+// upgradeError is a failure of an upgrade that running the phase again won't
+// fix.
+type upgradeError struct {
+	message string
+}
+
+func (e *upgradeError) Error() string {
+	return e.message
+}
+
+// Upgrades the control plane and the kubelet of a master in place. Failures
+// of remote commands fail the upgrade, and the kubelet package is rolled back
+// if it was being upgraded. A failed upgrade is not retried until the
+// machine's versions change again. Other errors, like lost connections, are
+// returned to retry the phase.
+func (gce *GCEClient) updateMasterInplace(cluster *clusterv1.Cluster, oldVersions *clusterv1.MachineVersionInfo, machine *clusterv1.Machine) error {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	target := machine.Spec.Versions
+	upgrade := status.Upgrade
+	if upgrade == nil || upgrade.ToControlPlane != target.ControlPlane || upgrade.ToKubelet != target.Kubelet {
+		if oldVersions.ControlPlane == target.ControlPlane && oldVersions.Kubelet == target.Kubelet {
+			return gce.setUpgradeStatus(machine, nil)
+		}
+		glog.Infof("Upgrading master %v from %+v to %+v", machine.ObjectMeta.Name, *oldVersions, target)
+		upgrade = &gceconfigv1.GCEMachineUpgradeStatus{
+			FromControlPlane: oldVersions.ControlPlane,
+			FromKubelet:      oldVersions.Kubelet,
+			ToControlPlane:   target.ControlPlane,
+			ToKubelet:        target.Kubelet,
+			Phase:            gceconfigv1.UpgradePreflight,
+			StartTime:        metav1.Now(),
+		}
+		if err := gce.recordUpgradeStatus(machine, upgrade); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if upgrade.Phase == gceconfigv1.UpgradeFailed {
+			return fmt.Errorf("upgrade of machine %v to %+v failed: %v", machine.ObjectMeta.Name, target, upgrade.Message)
+		}
+		glog.Infof("Running upgrade phase %v of master %v", upgrade.Phase, machine.ObjectMeta.Name)
+		next, err := gce.runUpgradePhase(cluster, machine, upgrade)
+		if err != nil {
+			if !isUpgradeFailure(err) {
+				return err
+			}
+			next = failedUpgradePhase(upgrade, err)
+		}
+		if next == "" {
+			// The upgrade is cleared when the machine's instance status
+			// is recorded along with its new versions.
+			return gce.setUpgradeStatus(machine, nil)
+		}
+		upgrade.Phase = next
+		if err := gce.recordUpgradeStatus(machine, upgrade); err != nil {
+			return err
+		}
+		if next == gceconfigv1.UpgradeFailed {
+			gce.eventRecorder.Eventf(machine, corev1.EventTypeWarning, "FailedUpgrade", "Upgrade of Machine %v failed: %v", machine.ObjectMeta.Name, upgrade.Message)
+			return gce.handleMachineError(machine, &apierrors.MachineError{
+				Reason:  commonerrors.UnsupportedChangeMachineError,
+				Message: fmt.Sprintf("Upgrade to control plane %v and kubelet %v failed: %v", target.ControlPlane, target.Kubelet, upgrade.Message),
+			}, noEventAction)
+		}
+	}
+}
+
+func isUpgradeFailure(err error) bool {
+	switch err.(type) {
+	case *upgradeError, *remoteCommandError:
+		return true
+	}
+	return false
+}
+
+// Records why the upgrade failed and returns the phase it continues with. A
+// failed kubelet upgrade is rolled back first.
+func failedUpgradePhase(upgrade *gceconfigv1.GCEMachineUpgradeStatus, err error) gceconfigv1.GCEMachineUpgradePhase {
+	switch upgrade.Phase {
+	case gceconfigv1.UpgradeKubelet:
+		upgrade.Message = fmt.Sprintf("phase %v failed: %v", upgrade.Phase, err)
+		return gceconfigv1.UpgradeRollback
+	case gceconfigv1.UpgradeRollback:
+		upgrade.Message = fmt.Sprintf("%v; rollback failed: %v", upgrade.Message, err)
+	default:
+		upgrade.Message = fmt.Sprintf("phase %v failed: %v", upgrade.Phase, err)
+	}
+	return gceconfigv1.UpgradeFailed
+}
+
+// Runs the current phase of the upgrade and returns the next one, which is
+// empty once the upgrade is complete.
+func (gce *GCEClient) runUpgradePhase(cluster *clusterv1.Cluster, machine *clusterv1.Machine, upgrade *gceconfigv1.GCEMachineUpgradeStatus) (gceconfigv1.GCEMachineUpgradePhase, error) {
+	switch upgrade.Phase {
+	case gceconfigv1.UpgradePreflight:
+		if err := checkUpgradeVersionSkew(upgrade); err != nil {
+			return "", err
+		}
+
+	case gceconfigv1.UpgradeKubeadm:
+		if _, err := gce.remoteSshCommand(cluster, machine, kubeadmInstallCommand(upgrade.ToControlPlane)); err != nil {
+			return "", err
+		}
+
+	case gceconfigv1.UpgradePlan:
+		upgradesCluster, err := gce.upgradesCluster(machine)
+		if err != nil {
+			return "", err
+		}
+		if upgradesCluster {
+			cmd := fmt.Sprintf("sudo kubeadm upgrade plan v%s", upgrade.ToControlPlane)
+			if _, err := gce.remoteSshCommand(cluster, machine, cmd); err != nil {
+				return "", err
+			}
+		}
+
+	case gceconfigv1.UpgradeEtcdSnapshot:
+		upgradesCluster, err := gce.upgradesCluster(machine)
+		if err != nil {
+			return "", err
+		}
+		if upgradesCluster {
+			snapshot := fmt.Sprintf("%s/snapshot-%s.db", etcdDataDir, upgrade.StartTime.UTC().Format("20060102-150405"))
+			if _, err := gce.remoteSshCommand(cluster, machine, etcdSnapshotCommand(snapshot)); err != nil {
+				return "", err
+			}
+			upgrade.EtcdSnapshot = snapshot
+		}
+
+	case gceconfigv1.UpgradeControlPlane:
+		upgradesCluster, err := gce.upgradesCluster(machine)
+		if err != nil {
+			return "", err
+		}
+		if _, err := gce.remoteSshCommand(cluster, machine, controlPlaneUpgradeCommand(machine, upgradesCluster)); err != nil {
+			return "", err
+		}
+		// Other masters follow once the control plane version is recorded,
+		// even while this master still upgrades its kubelet.
+		versions := *machine.Status.Versions
+		versions.ControlPlane = upgrade.ToControlPlane
+		machine.Status.Versions = &versions
+
+	case gceconfigv1.UpgradeKubelet:
+		if err := gce.upgradeKubelet(cluster, machine, upgrade.ToKubelet); err != nil {
+			return "", err
+		}
+
+	case gceconfigv1.UpgradeRollback:
+		glog.Infof("Rolling back kubelet of master %v to %v", machine.ObjectMeta.Name, upgrade.FromKubelet)
+		if err := gce.installKubelet(cluster, machine, upgrade.FromKubelet); err != nil {
+			return "", err
+		}
+		return gceconfigv1.UpgradeFailed, nil
+
+	default:
+		return "", &upgradeError{fmt.Sprintf("unknown upgrade phase %v", upgrade.Phase)}
+	}
+	return nextUpgradePhase(upgrade), nil
+}
+
+// Returns the phase after the current one that the upgrade needs.
+func nextUpgradePhase(upgrade *gceconfigv1.GCEMachineUpgradeStatus) gceconfigv1.GCEMachineUpgradePhase {
+	controlPlane := upgrade.FromControlPlane != upgrade.ToControlPlane
+	kubelet := upgrade.FromKubelet != upgrade.ToKubelet
+	for i, phase := range upgradePhases {
+		if phase != upgrade.Phase {
+			continue
+		}
+		for _, next := range upgradePhases[i+1:] {
+			if next == gceconfigv1.UpgradeKubelet && kubelet || next != gceconfigv1.UpgradeKubelet && controlPlane {
+				return next
+			}
+		}
+	}
+	return ""
+}
+
+// Drains the node, upgrades its kubelet and makes it schedulable again once
+// the kubelet reports the new version.
+func (gce *GCEClient) upgradeKubelet(cluster *clusterv1.Cluster, machine *clusterv1.Machine, version string) error {
+	node, err := gce.instanceName(machine)
+	if err != nil {
+		return err
+	}
+	if _, err := gce.remoteSshCommand(cluster, machine, gce.drainCommand(node)); err != nil {
+		return err
+	}
+	return gce.installKubelet(cluster, machine, version)
+}
+
+func (gce *GCEClient) installKubelet(cluster *clusterv1.Cluster, machine *clusterv1.Machine, version string) error {
+	node, err := gce.instanceName(machine)
+	if err != nil {
+		return err
+	}
+	commands := []string{
+		fmt.Sprintf("sudo apt-get install -y --allow-downgrades kubelet=%s-00", version),
+		fmt.Sprintf("for i in $(seq %d); do [ \"$(sudo kubectl --kubeconfig %s get node %s -o jsonpath='{.status.nodeInfo.kubeletVersion}')\" = v%s ] && exit 0; sleep 5; done; exit 1",
+			kubeletVersionRetries, adminKubeConfig, node, version),
+		fmt.Sprintf("sudo kubectl --kubeconfig %s uncordon %s", adminKubeConfig, node),
+	}
+	for _, cmd := range commands {
+		if _, err := gce.remoteSshCommand(cluster, machine, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the command that drains the node on a master, which gives up after
+// the drain timeout.
+func (gce *GCEClient) drainCommand(node string) string {
+	return fmt.Sprintf("sudo kubectl --kubeconfig %s drain %s --ignore-daemonsets --delete-local-data --timeout %v", adminKubeConfig, node, gce.drainTimeout)
+}
+
+// Returns the command that replaces kubeadm with the given version once its
+// checksum matches the published one.
+func kubeadmInstallCommand(version string) string {
+	url := fmt.Sprintf("%s/v%s/bin/linux/amd64/kubeadm", kubernetesReleaseURL, version)
+	return strings.Join([]string{
+		"set -e",
+		"dir=$(mktemp -d)",
+		"trap 'rm -rf \"$dir\"' EXIT",
+		fmt.Sprintf("curl -fsSL -o \"$dir/kubeadm\" %s", url),
+		fmt.Sprintf("echo \"$(curl -fsSL %s.sha256)  $dir/kubeadm\" | sha256sum -c -", url),
+		"sudo install -m 0755 \"$dir/kubeadm\" /usr/bin/kubeadm",
+		fmt.Sprintf("[ \"$(kubeadm version -o short)\" = v%s ]", version),
+	}, "; ")
+}
+
+// Returns the command that saves a snapshot of etcd on the master.
+func etcdSnapshotCommand(snapshot string) string {
+	return etcdctlCommand("snapshot save " + snapshot)
+}
+
+// Returns the command that runs etcdctl against the etcd member of the master.
+// etcd runs in a static pod that mounts its data directory from the host. The
+// arguments are passed to a shell inside the pod, and can't contain single
+// quotes.
+func etcdctlCommand(args string) string {
+	etcdctl := "ETCDCTL_API=3 etcdctl --endpoints https://127.0.0.1:2379 " +
+		"--cacert /etc/kubernetes/pki/etcd/ca.crt " +
+		"--cert /etc/kubernetes/pki/etcd/healthcheck-client.crt " +
+		"--key /etc/kubernetes/pki/etcd/healthcheck-client.key " +
+		args
+	return fmt.Sprintf("sudo kubectl --kubeconfig %s -n kube-system exec etcd-$(hostname) -- sh -c '%s'", adminKubeConfig, etcdctl)
+}
+
+// Checks that the upgrade stays within the version skew kubeadm and the
+// kubelet support. The control plane is upgraded by at most one minor version
+// and never downgraded, and the kubelet is neither newer than the control
+// plane nor more than two minor versions older.
+func checkUpgradeVersionSkew(upgrade *gceconfigv1.GCEMachineUpgradeStatus) error {
+	fromControlPlane, err := parseVersion(upgrade.FromControlPlane)
+	if err != nil {
+		return err
+	}
+	toControlPlane, err := parseVersion(upgrade.ToControlPlane)
+	if err != nil {
+		return err
+	}
+	fromKubelet, err := parseVersion(upgrade.FromKubelet)
+	if err != nil {
+		return err
+	}
+	toKubelet, err := parseVersion(upgrade.ToKubelet)
+	if err != nil {
+		return err
+	}
+
+	if toControlPlane.less(fromControlPlane) {
+		return &upgradeError{fmt.Sprintf("downgrading the control plane from %v to %v is not supported", upgrade.FromControlPlane, upgrade.ToControlPlane)}
+	}
+	if toControlPlane.major != fromControlPlane.major || toControlPlane.minor > fromControlPlane.minor+1 {
+		return &upgradeError{fmt.Sprintf("the control plane can only be upgraded by one minor version at a time, not from %v to %v", upgrade.FromControlPlane, upgrade.ToControlPlane)}
+	}
+	if toKubelet.less(fromKubelet) {
+		return &upgradeError{fmt.Sprintf("downgrading the kubelet from %v to %v is not supported", upgrade.FromKubelet, upgrade.ToKubelet)}
+	}
+	if toControlPlane.less(toKubelet) {
+		return &upgradeError{fmt.Sprintf("kubelet %v can't be newer than control plane %v", upgrade.ToKubelet, upgrade.ToControlPlane)}
+	}
+	if toKubelet.major != toControlPlane.major || toKubelet.minor+2 < toControlPlane.minor {
+		return &upgradeError{fmt.Sprintf("kubelet %v can't be more than two minor versions older than control plane %v", upgrade.ToKubelet, upgrade.ToControlPlane)}
+	}
+	return nil
+}
+
+type version struct {
+	major, minor, patch int
+}
+
+// Parses a version like 1.12.1. A leading v and pre-release and build
+// suffixes are ignored.
+func parseVersion(s string) (version, error) {
+	v := strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return version{}, &upgradeError{fmt.Sprintf("invalid version %q", s)}
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version{}, &upgradeError{fmt.Sprintf("invalid version %q", s)}
+		}
+		numbers[i] = n
+	}
+	return version{major: numbers[0], minor: numbers[1], patch: numbers[2]}, nil
+}
+
+func (v version) less(o version) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	return v.patch < o.patch
+}
+
+// Records the upgrade in the machine's provider status, along with the
+// versions the machine reached so far.
+func (gce *GCEClient) recordUpgradeStatus(machine *clusterv1.Machine, upgrade *gceconfigv1.GCEMachineUpgradeStatus) error {
+	if err := gce.setUpgradeStatus(machine, upgrade); err != nil {
+		return err
+	}
+	return gce.storeMachineStatus(machine)
+}
+
+// Sets the upgrade in the provider status of the machine without storing it.
+func (gce *GCEClient) setUpgradeStatus(machine *clusterv1.Machine, upgrade *gceconfigv1.GCEMachineUpgradeStatus) error {
+	status, err := gce.machineProviderStatus(machine)
+	if err != nil {
+		return err
+	}
+	status.Upgrade = upgrade
+	return setMachineProviderStatus(machine, status)
+}
+
+// Stores the provider status and versions of the machine through the status
+// subresource.
+func (gce *GCEClient) storeMachineStatus(machine *clusterv1.Machine) error {
+	if gce.client == nil {
+		return nil
+	}
+	current, err := util.GetMachineIfExists(gce.client, machine.ObjectMeta.Namespace, machine.ObjectMeta.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("machine %v has already been deleted", machine.ObjectMeta.Name)
+	}
+	current.Status.ProviderStatus = machine.Status.ProviderStatus
+	current.Status.Versions = machine.Status.Versions
+	if err := gce.client.Status().Update(context.Background(), current); err != nil {
+		return fmt.Errorf("error updating status of machine %v: %v", machine.ObjectMeta.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package google_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	"sigs.k8s.io/cluster-api/pkg/apis/cluster/common"
+)
+
+func TestControlPlaneUpgrade(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), time.Minute)
+
+	if err := gce.Update(cluster, upgradeMachine(t, fakeClient, master, "1.10.0", "1.10.0")); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	commands := server.Commands()
+	expected := []string{
+		"set -e; dir=$(mktemp -d); trap 'rm -rf \"$dir\"' EXIT; " +
+			"curl -fsSL -o \"$dir/kubeadm\" https://dl.k8s.io/release/v1.10.0/bin/linux/amd64/kubeadm; " +
+			"echo \"$(curl -fsSL https://dl.k8s.io/release/v1.10.0/bin/linux/amd64/kubeadm.sha256)  $dir/kubeadm\" | sha256sum -c -; " +
+			"sudo install -m 0755 \"$dir/kubeadm\" /usr/bin/kubeadm; " +
+			"[ \"$(kubeadm version -o short)\" = v1.10.0 ]",
+		"sudo kubeadm upgrade plan v1.10.0",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf -n kube-system exec etcd-$(hostname) -- sh -c 'ETCDCTL_API=3 etcdctl",
+		"sudo kubeadm upgrade apply v1.10.0 -y",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf drain master-0",
+		"sudo apt-get install -y --allow-downgrades kubelet=1.10.0-00",
+		"for i in $(seq 60)",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf uncordon master-0",
+	}
+	checkCommandPrefixes(t, commands, expected)
+	if len(commands) == len(expected) && !strings.Contains(commands[2], "snapshot save /var/lib/etcd/snapshot-") {
+		t.Errorf("expected an etcd snapshot to be saved, got '%v'", commands[2])
+	}
+
+	stored := getMachine(t, fakeClient, master)
+	if versions := stored.Status.Versions; versions == nil || versions.ControlPlane != "1.10.0" || versions.Kubelet != "1.10.0" {
+		t.Errorf("expected the versions to be upgraded, got '%+v'", versions)
+	}
+	if upgrade := getMachineProviderStatus(t, stored).Upgrade; upgrade != nil {
+		t.Errorf("expected the completed upgrade to be cleared, got '%+v'", upgrade)
+	}
+}
+
+func TestUpgradeResumesAtRecordedPhase(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), time.Minute)
+
+	// The connection is lost while the control plane is upgraded.
+	server.Respond(sshResponses{drop: "sudo kubeadm upgrade apply"})
+	if err := gce.Update(cluster, upgradeMachine(t, fakeClient, master, "1.10.0", "1.10.0")); err == nil {
+		t.Fatal("expected an error")
+	}
+	stored := getMachine(t, fakeClient, master)
+	upgrade := getMachineProviderStatus(t, stored).Upgrade
+	if upgrade == nil || upgrade.Phase != gceconfigv1.UpgradeControlPlane {
+		t.Fatalf("expected the upgrade to be in phase ControlPlane, got '%+v'", upgrade)
+	}
+	if !strings.HasPrefix(upgrade.EtcdSnapshot, "/var/lib/etcd/snapshot-") {
+		t.Errorf("expected the etcd snapshot to be recorded, got '%v'", upgrade.EtcdSnapshot)
+	}
+	if upgrade.FromControlPlane != "1.9.4" || upgrade.ToControlPlane != "1.10.0" || upgrade.FromKubelet != "1.9.3" || upgrade.ToKubelet != "1.10.0" {
+		t.Errorf("invalid upgrade versions: '%+v'", upgrade)
+	}
+	server.Commands()
+
+	// The state is kept in the machine, so the next update, e.g. by a
+	// restarted controller, continues with the control plane.
+	server.Respond(sshResponses{})
+	if err := gce.Update(cluster, upgradeMachine(t, fakeClient, master, "1.10.0", "1.10.0")); err != nil {
+		t.Fatalf("unable to update master: %v", err)
+	}
+	checkCommandPrefixes(t, server.Commands(), []string{
+		"sudo kubeadm upgrade apply v1.10.0 -y",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf drain master-0",
+		"sudo apt-get install -y --allow-downgrades kubelet=1.10.0-00",
+		"for i in $(seq 60)",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf uncordon master-0",
+	})
+}
+
+func TestFailedKubeletUpgradeRollsBack(t *testing.T) {
+	server := newSSHServer(t)
+	defer server.Close()
+	gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), time.Minute)
+
+	server.Respond(sshResponses{fail: "sudo apt-get install -y --allow-downgrades kubelet=1.9.4-00"})
+	err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master))
+	if err == nil || !strings.Contains(err.Error(), "phase Kubelet failed") {
+		t.Fatalf("expected the kubelet upgrade to fail, got '%v'", err)
+	}
+	checkCommandPrefixes(t, server.Commands(), []string{
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf drain master-0",
+		"sudo apt-get install -y --allow-downgrades kubelet=1.9.4-00",
+		"sudo apt-get install -y --allow-downgrades kubelet=1.9.3-00",
+		"for i in $(seq 60)",
+		"sudo kubectl --kubeconfig /etc/kubernetes/admin.conf uncordon master-0",
+	})
+	stored := getMachine(t, fakeClient, master)
+	if upgrade := getMachineProviderStatus(t, stored).Upgrade; upgrade == nil || upgrade.Phase != gceconfigv1.UpgradeFailed {
+		t.Errorf("expected the upgrade to have failed, got '%+v'", upgrade)
+	}
+	if stored.Status.Versions.Kubelet != "1.9.3" {
+		t.Errorf("expected kubelet 1.9.3 to be recorded, got '%v'", stored.Status.Versions.Kubelet)
+	}
+
+	// A failed upgrade is not retried.
+	server.Respond(sshResponses{})
+	if err := gce.Update(cluster, upgradeKubelet(t, fakeClient, master)); err == nil {
+		t.Error("expected the failed upgrade to be reported")
+	}
+	if commands := server.Commands(); len(commands) != 0 {
+		t.Errorf("expected the failed upgrade not to be retried, got '%v'", commands)
+	}
+}
+
+func TestUpgradeVersionSkew(t *testing.T) {
+	testCases := []struct {
+		name         string
+		controlPlane string
+		kubelet      string
+		expected     string
+	}{
+		{"two minor versions", "1.11.0", "1.9.4", "one minor version at a time"},
+		{"control plane downgrade", "1.9.0", "1.9.0", "downgrading the control plane"},
+		{"kubelet downgrade", "1.9.4", "1.9.2", "downgrading the kubelet"},
+		{"kubelet newer than control plane", "1.9.4", "1.10.0", "can't be newer than control plane"},
+		{"invalid version", "1.10", "1.9.4", "invalid version"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newSSHServer(t)
+			defer server.Close()
+			gce, fakeClient, cluster, master := newSSHMaster(t, server, server.hostKey.PublicKey(), time.Minute)
+
+			err := gce.Update(cluster, upgradeMachine(t, fakeClient, master, tc.controlPlane, tc.kubelet))
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("expected an error containing '%v', got '%v'", tc.expected, err)
+			}
+			if commands := server.Commands(); len(commands) != 0 {
+				t.Errorf("expected no commands to run, got '%v'", commands)
+			}
+			stored := getMachine(t, fakeClient, master)
+			if upgrade := getMachineProviderStatus(t, stored).Upgrade; upgrade == nil || upgrade.Phase != gceconfigv1.UpgradeFailed {
+				t.Errorf("expected the upgrade to have failed, got '%+v'", upgrade)
+			}
+			if stored.Status.ErrorReason == nil || *stored.Status.ErrorReason != common.UnsupportedChangeMachineError {
+				t.Errorf("expected error reason UnsupportedChange, got '%v'", stored.Status.ErrorReason)
+			}
+		})
+	}
+}
+
+func checkCommandPrefixes(t *testing.T, commands []string, prefixes []string) {
+	t.Helper()
+	if len(commands) != len(prefixes) {
+		t.Fatalf("expected %v commands, got '%v'", len(prefixes), strings.Join(commands, "\n"))
+	}
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(commands[i], prefix) {
+			t.Errorf("invalid command %v: expected '%v' got '%v'", i, prefix, commands[i])
+		}
+	}
+}
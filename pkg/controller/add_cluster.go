@@ -25,7 +25,9 @@ import (
 func init() {
 	// AddToManagerFuncs is a list of functions to create controllers and add them to a manager.
 	AddToManagerFuncs = append(AddToManagerFuncs, func(m manager.Manager) error {
-		actuator, err := google.NewClusterActuator(m, google.ClusterActuatorParams{})
+		actuator, err := google.NewClusterActuator(m, google.ClusterActuatorParams{
+			ServiceAccountService: google.NewServiceAccountService(nil, nil, nil),
+		})
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package defaultserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/mattbaird/jsonpatch"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+// providerConfigDefaulter fills in the defaults of the GCE provider config of
+// machines, machine sets and machine deployments.
+type providerConfigDefaulter struct{}
+
+var _ admission.Handler = &providerConfigDefaulter{}
+
+func (h *providerConfigDefaulter) Handle(ctx context.Context, req atypes.Request) atypes.Response {
+	// See defaultingRules.
+	if req.AdmissionRequest.Operation == admissionv1beta1.Update {
+		return admission.ValidationResponse(true, "")
+	}
+	m, err := decodeMachineObject(req)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+	config, err := gceProviderConfig(m.spec)
+	if err != nil || config == nil {
+		// Provider configs that cannot be decoded are rejected by the
+		// validating webhook.
+		return admission.ValidationResponse(true, "")
+	}
+	defaulted := config.DeepCopy()
+	setDefaults(defaulted)
+	if reflect.DeepEqual(config, defaulted) {
+		return admission.ValidationResponse(true, "")
+	}
+
+	original, err := yaml.YAMLToJSON(m.spec.ProviderConfig.Value.Raw)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+	current, err := json.Marshal(defaulted)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	patches, err := providerConfigPatches(m.providerConfigPath(), original, current)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	return atypes.Response{
+		Patches: patches,
+		Response: &admissionv1beta1.AdmissionResponse{
+			Allowed:   true,
+			PatchType: &patchType,
+		},
+	}
+}
+
+// Returns the patches that turn the original provider config into the
+// current one, addressed within the object under admission. Only the
+// provider config is patched, so that fields of the object this version does
+// not know about are left alone.
+func providerConfigPatches(path *field.Path, original []byte, current []byte) ([]jsonpatch.JsonPatchOperation, error) {
+	patches, err := jsonpatch.CreatePatch(original, current)
+	if err != nil {
+		return nil, err
+	}
+	prefix := "/" + strings.Replace(path.String(), ".", "/", -1)
+	var result []jsonpatch.JsonPatchOperation
+	for _, patch := range patches {
+		// The provider config embeds ObjectMeta, which is always encoded
+		// even though provider configs have no metadata.
+		if strings.HasPrefix(patch.Path, "/metadata") {
+			continue
+		}
+		patch.Path = prefix + patch.Path
+		result = append(result, patch)
+	}
+	return result, nil
+}
+
+// providerConfigValidator rejects machines, machine sets and machine
+// deployments whose GCE provider config is invalid.
+type providerConfigValidator struct{}
+
+var _ admission.Handler = &providerConfigValidator{}
+
+func (h *providerConfigValidator) Handle(ctx context.Context, req atypes.Request) atypes.Response {
+	m, err := decodeMachineObject(req)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+	config, err := gceProviderConfig(m.spec)
+	if err != nil {
+		return validationResponse(field.ErrorList{
+			field.Invalid(m.providerConfigPath(), string(m.spec.ProviderConfig.Value.Raw), err.Error()),
+		})
+	}
+	if config == nil {
+		return admission.ValidationResponse(true, "")
+	}
+	// Machines created before the defaulting webhook are never defaulted,
+	// so they are validated as they would have been defaulted. Leaving
+	// them undefaulted keeps their instance.
+	if req.AdmissionRequest.Operation == admissionv1beta1.Update {
+		setDefaults(config)
+	}
+	return validationResponse(validateMachine(m, config))
+}
+
+func validationResponse(errs field.ErrorList) atypes.Response {
+	if len(errs) == 0 {
+		return admission.ValidationResponse(true, "")
+	}
+	return admission.ValidationResponse(false, errs.ToAggregate().Error())
+}
@@ -0,0 +1,770 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package defaultserver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+func TestDefaulterFillsInEmptyFields(t *testing.T) {
+	config := newProviderConfigFixture()
+	config.Roles = nil
+	config.OS = ""
+	config.Disks = nil
+	machineSet := &clusterv1.MachineSet{}
+	machineSet.Spec.Template.Spec = newMachineSpec(t, config)
+
+	resp := (&providerConfigDefaulter{}).Handle(context.Background(), newRequest(t, "MachineSet", machineSet))
+	if !resp.Response.Allowed {
+		t.Fatalf("expected the machine set to be allowed, got '%v'", resp.Response.Result)
+	}
+	patches := map[string]interface{}{}
+	for _, patch := range resp.Patches {
+		if patch.Operation != "add" {
+			t.Errorf("unexpected patch: %v", patch.Json())
+		}
+		patches[patch.Path] = patch.Value
+	}
+	prefix := "/spec/template/spec/providerConfig/value/"
+	expected := map[string]interface{}{
+		prefix + "roles": []interface{}{"Node"},
+		prefix + "os":    "ubuntu-1604-lts",
+		prefix + "disks": []interface{}{
+			map[string]interface{}{
+				"initializeParams": map[string]interface{}{"diskSizeGb": float64(30), "diskType": "pd-standard"},
+			},
+		},
+	}
+	if len(patches) != len(expected) {
+		t.Errorf("invalid patches: expected '%v' got '%v'", expected, patches)
+	}
+	for path, value := range expected {
+		actual, _ := json.Marshal(patches[path])
+		want, _ := json.Marshal(value)
+		if string(actual) != string(want) {
+			t.Errorf("invalid patch of %v: expected '%s' got '%s'", path, want, actual)
+		}
+	}
+}
+
+func TestDefaulterTerminatesMachinesWithAccelerators(t *testing.T) {
+	config := newProviderConfigFixture()
+	config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 1}}
+	machine := &clusterv1.Machine{Spec: newMachineSpec(t, config)}
+
+	resp := (&providerConfigDefaulter{}).Handle(context.Background(), newRequest(t, "Machine", machine))
+	if !resp.Response.Allowed {
+		t.Fatalf("expected the machine to be allowed, got '%v'", resp.Response.Result)
+	}
+	if len(resp.Patches) != 1 || resp.Patches[0].Path != "/spec/providerConfig/value/scheduling" {
+		t.Fatalf("expected the scheduling to be patched, got '%v'", resp.Patches)
+	}
+	actual, _ := json.Marshal(resp.Patches[0].Value)
+	if want := `{"onHostMaintenance":"TERMINATE"}`; string(actual) != want {
+		t.Errorf("invalid scheduling: expected '%s' got '%s'", want, actual)
+	}
+}
+
+func TestDefaulterLeavesOtherMachinesAlone(t *testing.T) {
+	testCases := []struct {
+		name string
+		spec func(t *testing.T) clusterv1.MachineSpec
+	}{
+		{
+			name: "complete provider config",
+			spec: func(t *testing.T) clusterv1.MachineSpec {
+				return newMachineSpec(t, newProviderConfigFixture())
+			},
+		},
+		{
+			name: "local SSD and existing disk",
+			spec: func(t *testing.T) clusterv1.MachineSpec {
+				config := newProviderConfigFixture()
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Type: gceconfigv1.ScratchDisk}, gceconfigv1.Disk{Source: "data"})
+				return newMachineSpec(t, config)
+			},
+		},
+		{
+			name: "provider config of another provider",
+			spec: func(t *testing.T) clusterv1.MachineSpec {
+				spec := newMachineSpec(t, newProviderConfigFixture())
+				spec.ProviderConfig.Value.Raw = []byte(`{"kind": "AWSMachineProviderConfig", "disks": "gp2"}`)
+				return spec
+			},
+		},
+		{
+			name: "no provider config",
+			spec: func(t *testing.T) clusterv1.MachineSpec {
+				return clusterv1.MachineSpec{}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := &clusterv1.Machine{Spec: tc.spec(t)}
+			resp := (&providerConfigDefaulter{}).Handle(context.Background(), newRequest(t, "Machine", machine))
+			if !resp.Response.Allowed {
+				t.Errorf("expected the machine to be allowed, got '%v'", resp.Response.Result)
+			}
+			if len(resp.Patches) != 0 {
+				t.Errorf("expected no patches, got '%v'", resp.Patches)
+			}
+		})
+	}
+}
+
+// Machines created before the webhook keep the provider config their
+// instance was created from, and so the hash of it, when they are updated.
+func TestUpdateLeavesLegacyMachinesUndefaulted(t *testing.T) {
+	config := newProviderConfigFixture()
+	config.Roles = nil
+	config.OS = ""
+	config.Disks = nil
+	machine := &clusterv1.Machine{Spec: newMachineSpec(t, config)}
+	req := newRequest(t, "Machine", machine)
+	req.AdmissionRequest.Operation = admissionv1beta1.Update
+
+	resp := (&providerConfigDefaulter{}).Handle(context.Background(), req)
+	if !resp.Response.Allowed {
+		t.Errorf("expected the machine to be allowed, got '%v'", resp.Response.Result)
+	}
+	if len(resp.Patches) != 0 {
+		t.Errorf("expected no patches, got '%v'", resp.Patches)
+	}
+	resp = (&providerConfigValidator{}).Handle(context.Background(), req)
+	if !resp.Response.Allowed {
+		t.Errorf("expected the machine to be valid, got '%v'", resp.Response.Result)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	testCases := []struct {
+		name string
+		// Modifies a valid machine spec.
+		modify func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig)
+		// The field rejected, or empty if the machine is valid.
+		expectedField string
+	}{
+		{
+			name:   "valid",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {},
+		},
+		{
+			name: "unschedulable master",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.MasterRole}
+			},
+		},
+		{
+			name: "neither master nor node",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = nil
+			},
+			expectedField: "spec.providerConfig.value.roles",
+		},
+		{
+			name: "unknown role",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = append(config.Roles, "Etcd")
+			},
+			expectedField: "spec.providerConfig.value.roles[2]",
+		},
+		{
+			name: "duplicate role",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = append(config.Roles, gceconfigv1.NodeRole)
+			},
+			expectedField: "spec.providerConfig.value.roles[2]",
+		},
+		{
+			name: "master without control plane version",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				spec.Versions.ControlPlane = ""
+			},
+			expectedField: "spec.versions.controlPlane",
+		},
+		{
+			name: "node without control plane version",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				spec.Versions.ControlPlane = ""
+			},
+		},
+		{
+			name: "no kubelet version",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				spec.Versions.Kubelet = ""
+			},
+			expectedField: "spec.versions.kubelet",
+		},
+		{
+			name: "no zone",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Zone = ""
+			},
+			expectedField: "spec.providerConfig.value.zone",
+		},
+		{
+			name: "region instead of zone",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Zone = "us-west1"
+			},
+			expectedField: "spec.providerConfig.value.zone",
+		},
+		{
+			name: "invalid machine type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = "N1 Standard 1"
+			},
+			expectedField: "spec.providerConfig.value.machineType",
+		},
+		{
+			name: "custom machine type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{Family: "n2", CPUs: 4, MemoryMB: 16384}
+				config.MinCPUPlatform = "Intel Cascade Lake"
+			},
+		},
+		{
+			name: "machine type and custom machine type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{CPUs: 1, MemoryMB: 3840}
+			},
+			expectedField: "spec.providerConfig.value.machineType",
+		},
+		{
+			name: "no machine type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+			},
+			expectedField: "spec.providerConfig.value.machineType",
+		},
+		{
+			name: "unknown machine family",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{Family: "m1", CPUs: 4, MemoryMB: 16384}
+			},
+			expectedField: "spec.providerConfig.value.customMachineType.family",
+		},
+		{
+			name: "odd number of vCPUs",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{Family: "n2", CPUs: 3, MemoryMB: 6144}
+			},
+			expectedField: "spec.providerConfig.value.customMachineType.cpus",
+		},
+		{
+			name: "memory not a multiple of 256 MB",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{CPUs: 2, MemoryMB: 4000}
+			},
+			expectedField: "spec.providerConfig.value.customMachineType.memoryMB",
+		},
+		{
+			name: "too much memory per vCPU",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{CPUs: 2, MemoryMB: 16384}
+			},
+			expectedField: "spec.providerConfig.value.customMachineType.memoryMB",
+		},
+		{
+			name: "extended memory",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{CPUs: 2, MemoryMB: 16384, ExtendedMemory: true}
+			},
+		},
+		{
+			name: "extended memory of E2 machine type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = ""
+				config.CustomMachineType = &gceconfigv1.CustomMachineType{Family: "e2", CPUs: 2, MemoryMB: 16384, ExtendedMemory: true}
+			},
+			expectedField: "spec.providerConfig.value.customMachineType.extendedMemory",
+		},
+		{
+			name: "CPU platform of E2 machine type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.MachineType = "e2-standard-2"
+				config.MinCPUPlatform = "Intel Skylake"
+			},
+			expectedField: "spec.providerConfig.value.minCpuPlatform",
+		},
+		{
+			name: "no os",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.OS = ""
+			},
+			expectedField: "spec.providerConfig.value.os",
+		},
+		{
+			name: "no disks",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks = nil
+			},
+			expectedField: "spec.providerConfig.value.disks",
+		},
+		{
+			name: "invalid disk type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].InitializeParams.DiskType = "ssd"
+			},
+			expectedField: "spec.providerConfig.value.disks[0].initializeParams.diskType",
+		},
+		{
+			name: "negative disk size",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].InitializeParams.DiskSizeGb = -1
+			},
+			expectedField: "spec.providerConfig.value.disks[0].initializeParams.diskSizeGb",
+		},
+		{
+			name: "local SSD",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Type: gceconfigv1.ScratchDisk, Interface: "NVME"})
+			},
+		},
+		{
+			name: "local SSD boot disk",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks = []gceconfigv1.Disk{{Type: gceconfigv1.ScratchDisk}}
+			},
+			expectedField: "spec.providerConfig.value.disks[0].type",
+		},
+		{
+			name: "unknown disk interface",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Type: gceconfigv1.ScratchDisk, Interface: "IDE"})
+			},
+			expectedField: "spec.providerConfig.value.disks[1].interface",
+		},
+		{
+			name: "persistent disk with interface",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].Interface = "NVME"
+			},
+			expectedField: "spec.providerConfig.value.disks[0].interface",
+		},
+		{
+			name: "local SSD kept after deletion",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				keep := false
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Type: gceconfigv1.ScratchDisk, AutoDelete: &keep})
+			},
+			expectedField: "spec.providerConfig.value.disks[1].autoDelete",
+		},
+		{
+			name: "unknown disk type of attachment",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].Type = "EPHEMERAL"
+			},
+			expectedField: "spec.providerConfig.value.disks[0].type",
+		},
+		{
+			name: "existing disk",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Source: "data", DeviceName: "data"})
+			},
+		},
+		{
+			name: "existing disk from snapshot",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks = append(config.Disks, gceconfigv1.Disk{
+					Source:           "data",
+					InitializeParams: gceconfigv1.DiskInitializeParams{SourceSnapshot: "data-backup"},
+				})
+			},
+			expectedField: "spec.providerConfig.value.disks[1].initializeParams.sourceSnapshot",
+		},
+		{
+			name: "invalid device name",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].DeviceName = "Boot Disk"
+			},
+			expectedField: "spec.providerConfig.value.disks[0].deviceName",
+		},
+		{
+			name: "encrypted disk",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].EncryptionKey = &gceconfigv1.DiskEncryptionKey{KMSKeyName: "projects/p/locations/global/keyRings/r/cryptoKeys/k"}
+			},
+		},
+		{
+			name: "invalid encryption key",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].EncryptionKey = &gceconfigv1.DiskEncryptionKey{KMSKeyName: "my-key"}
+			},
+			expectedField: "spec.providerConfig.value.disks[0].encryptionKey.kmsKeyName",
+		},
+		{
+			name: "invalid disk label key",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].InitializeParams.Labels = map[string]string{"Purpose": "boot"}
+			},
+			expectedField: "spec.providerConfig.value.disks[0].initializeParams.labels",
+		},
+		{
+			name: "invalid disk label value",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Disks[0].InitializeParams.Labels = map[string]string{"purpose": "Boot Disk"}
+			},
+			expectedField: "spec.providerConfig.value.disks[0].initializeParams.labels[purpose]",
+		},
+		{
+			name: "preemptible node",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true}
+			},
+		},
+		{
+			name: "preemptible master",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true}
+			},
+			expectedField: "spec.providerConfig.value.scheduling.preemptible",
+		},
+		{
+			name: "preemptible node restarting automatically",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				restart := true
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true, AutomaticRestart: &restart}
+			},
+			expectedField: "spec.providerConfig.value.scheduling.automaticRestart",
+		},
+		{
+			name: "preemptible node migrating on host maintenance",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.Scheduling = &gceconfigv1.Scheduling{Preemptible: true, OnHostMaintenance: "MIGRATE"}
+			},
+			expectedField: "spec.providerConfig.value.scheduling.onHostMaintenance",
+		},
+		{
+			name: "unknown on host maintenance policy",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Scheduling = &gceconfigv1.Scheduling{OnHostMaintenance: "RESTART"}
+			},
+			expectedField: "spec.providerConfig.value.scheduling.onHostMaintenance",
+		},
+		{
+			name: "accelerators",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 2}}
+			},
+		},
+		{
+			name: "accelerators of several types",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 1}, {Type: "nvidia-tesla-p100", Count: 1}}
+			},
+			expectedField: "spec.providerConfig.value.accelerators",
+		},
+		{
+			name: "accelerator without type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Accelerators = []gceconfigv1.Accelerator{{Count: 1}}
+			},
+			expectedField: "spec.providerConfig.value.accelerators[0].type",
+		},
+		{
+			name: "invalid accelerator type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Accelerators = []gceconfigv1.Accelerator{{Type: "NVIDIA Tesla K80", Count: 1}}
+			},
+			expectedField: "spec.providerConfig.value.accelerators[0].type",
+		},
+		{
+			name: "no accelerators of a type",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80"}}
+			},
+			expectedField: "spec.providerConfig.value.accelerators[0].count",
+		},
+		{
+			name: "accelerators migrating on host maintenance",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Accelerators = []gceconfigv1.Accelerator{{Type: "nvidia-tesla-k80", Count: 1}}
+				config.Scheduling = &gceconfigv1.Scheduling{OnHostMaintenance: "MIGRATE"}
+			},
+			expectedField: "spec.providerConfig.value.scheduling.onHostMaintenance",
+		},
+		{
+			name: "labels, tags and metadata",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Labels = map[string]string{"team": "platform"}
+				config.Tags = []string{"allow-ssh"}
+				config.InstanceMetadata = map[string]string{"serial-port-enable": "TRUE"}
+			},
+		},
+		{
+			name: "invalid label",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Labels = map[string]string{"team": "Platform"}
+			},
+			expectedField: "spec.providerConfig.value.labels[team]",
+		},
+		{
+			name: "label set by the provider",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Labels = map[string]string{"cluster-name": "other"}
+			},
+			expectedField: "spec.providerConfig.value.labels[cluster-name]",
+		},
+		{
+			name: "invalid tag",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Tags = []string{"allow-ssh", "Allow SSH"}
+			},
+			expectedField: "spec.providerConfig.value.tags[1]",
+		},
+		{
+			name: "invalid metadata key",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.InstanceMetadata = map[string]string{"serial port": "TRUE"}
+			},
+			expectedField: "spec.providerConfig.value.instanceMetadata",
+		},
+		{
+			name: "metadata item set by the provider",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.InstanceMetadata = map[string]string{"startup-script": "#!/bin/bash"}
+			},
+			expectedField: "spec.providerConfig.value.instanceMetadata[startup-script]",
+		},
+		{
+			name: "OS Login",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.Security = &gceconfigv1.Security{OSLogin: true}
+			},
+		},
+		{
+			name: "OS Login on master",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Security = &gceconfigv1.Security{OSLogin: true}
+			},
+			expectedField: "spec.providerConfig.value.security.osLogin",
+		},
+		{
+			name: "Shielded VM",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Security = &gceconfigv1.Security{ShieldedInstance: &gceconfigv1.ShieldedInstanceConfig{SecureBoot: true, VTPM: true, IntegrityMonitoring: true}}
+			},
+		},
+		{
+			name: "integrity monitoring without vTPM",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Security = &gceconfigv1.Security{ShieldedInstance: &gceconfigv1.ShieldedInstanceConfig{SecureBoot: true, IntegrityMonitoring: true}}
+			},
+			expectedField: "spec.providerConfig.value.security.shieldedInstance.integrityMonitoring",
+		},
+		{
+			name: "service account",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.ServiceAccounts = []gceconfigv1.ServiceAccount{{
+					Email:  "gcs-writer@my-project.iam.gserviceaccount.com",
+					Scopes: []string{"devstorage.read_write", "https://www.googleapis.com/auth/logging.write"},
+				}}
+			},
+		},
+		{
+			name: "default service account",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.ServiceAccounts = []gceconfigv1.ServiceAccount{{Email: "default"}}
+			},
+		},
+		{
+			name: "invalid service account email",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.ServiceAccounts = []gceconfigv1.ServiceAccount{{Email: "gcs-writer@example.com"}}
+			},
+			expectedField: "spec.providerConfig.value.serviceAccounts[0].email",
+		},
+		{
+			name: "invalid scope",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.ServiceAccounts = []gceconfigv1.ServiceAccount{{Email: "default", Scopes: []string{"cloud-platform", "Cloud Platform"}}}
+			},
+			expectedField: "spec.providerConfig.value.serviceAccounts[0].scopes[1]",
+		},
+		{
+			name: "two service accounts",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.ServiceAccounts = []gceconfigv1.ServiceAccount{{Email: "default"}, {Email: "gcs-writer@my-project.iam.gserviceaccount.com"}}
+			},
+			expectedField: "spec.providerConfig.value.serviceAccounts[1]",
+		},
+		{
+			name: "instance group",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.InstanceGroup = &gceconfigv1.InstanceGroup{Name: "workers"}
+			},
+		},
+		{
+			name: "master in instance group",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.InstanceGroup = &gceconfigv1.InstanceGroup{}
+			},
+			expectedField: "spec.providerConfig.value.instanceGroup",
+		},
+		{
+			name: "invalid instance group name",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.InstanceGroup = &gceconfigv1.InstanceGroup{Name: "Workers"}
+			},
+			expectedField: "spec.providerConfig.value.instanceGroup.name",
+		},
+		{
+			name: "too long instance group name",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.InstanceGroup = &gceconfigv1.InstanceGroup{Name: "workers" + strings.Repeat("-0", 23)}
+			},
+			expectedField: "spec.providerConfig.value.instanceGroup.name",
+		},
+		{
+			name: "existing disk in instance group",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+				config.InstanceGroup = &gceconfigv1.InstanceGroup{}
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Source: "data"})
+			},
+			expectedField: "spec.providerConfig.value.disks[1]",
+		},
+		{
+			name: "existing disk with the Replace upgrade strategy",
+			modify: func(spec *clusterv1.MachineSpec, config *gceconfigv1.GCEMachineProviderConfig) {
+				config.UpgradeStrategy = gceconfigv1.ReplaceUpgrade
+				config.Disks = append(config.Disks, gceconfigv1.Disk{Source: "data"})
+			},
+			expectedField: "spec.providerConfig.value.disks[1].source",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newProviderConfigFixture()
+			spec := clusterv1.MachineSpec{
+				Versions: clusterv1.MachineVersionInfo{Kubelet: "1.12.0", ControlPlane: "1.12.0"},
+			}
+			tc.modify(&spec, &config)
+			spec.ProviderConfig = newMachineSpec(t, config).ProviderConfig
+			machine := &clusterv1.Machine{Spec: spec}
+
+			resp := (&providerConfigValidator{}).Handle(context.Background(), newRequest(t, "Machine", machine))
+			checkValidationResponse(t, resp, tc.expectedField)
+		})
+	}
+}
+
+func TestValidatorChecksTemplates(t *testing.T) {
+	config := newProviderConfigFixture()
+	config.Zone = "us-west1"
+	machineDeployment := &clusterv1.MachineDeployment{}
+	machineDeployment.Spec.Template.Spec = newMachineSpec(t, config)
+
+	resp := (&providerConfigValidator{}).Handle(context.Background(), newRequest(t, "MachineDeployment", machineDeployment))
+	checkValidationResponse(t, resp, "spec.template.spec.providerConfig.value.zone")
+}
+
+func TestValidatorRejectsUndecodableProviderConfig(t *testing.T) {
+	machine := &clusterv1.Machine{Spec: newMachineSpec(t, newProviderConfigFixture())}
+	machine.Spec.ProviderConfig.Value.Raw = []byte(`{"kind": "GCEMachineProviderConfig", "disks": "pd-ssd"}`)
+
+	resp := (&providerConfigValidator{}).Handle(context.Background(), newRequest(t, "Machine", machine))
+	checkValidationResponse(t, resp, "spec.providerConfig.value")
+}
+
+func checkValidationResponse(t *testing.T, resp atypes.Response, expectedField string) {
+	t.Helper()
+	if expectedField == "" {
+		if !resp.Response.Allowed {
+			t.Errorf("expected the machine to be allowed, got '%v'", resp.Response.Result)
+		}
+		return
+	}
+	if resp.Response.Allowed {
+		t.Fatalf("expected the machine to be rejected for %v", expectedField)
+	}
+	if reason := string(resp.Response.Result.Reason); !strings.HasPrefix(reason, expectedField+":") {
+		t.Errorf("expected %v to be rejected, got '%v'", expectedField, reason)
+	}
+}
+
+func newProviderConfigFixture() gceconfigv1.GCEMachineProviderConfig {
+	return gceconfigv1.GCEMachineProviderConfig{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "gceproviderconfig/v1alpha1",
+			Kind:       "GCEMachineProviderConfig",
+		},
+		Roles:       []gceconfigv1.MachineRole{gceconfigv1.MasterRole, gceconfigv1.NodeRole},
+		Zone:        "us-west1-a",
+		MachineType: "n1-standard-1",
+		OS:          "ubuntu-1604-lts",
+		Disks: []gceconfigv1.Disk{
+			{
+				InitializeParams: gceconfigv1.DiskInitializeParams{
+					DiskSizeGb: 30,
+					DiskType:   "pd-ssd",
+				},
+			},
+		},
+	}
+}
+
+func newMachineSpec(t *testing.T, config gceconfigv1.GCEMachineProviderConfig) clusterv1.MachineSpec {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("error encoding provider config: %v", err)
+	}
+	return clusterv1.MachineSpec{
+		ProviderConfig: clusterv1.ProviderConfig{Value: &runtime.RawExtension{Raw: raw}},
+		Versions:       clusterv1.MachineVersionInfo{Kubelet: "1.12.0", ControlPlane: "1.12.0"},
+	}
+}
+
+func newRequest(t *testing.T, kind string, obj interface{}) atypes.Request {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("error encoding %v: %v", kind, err)
+	}
+	return atypes.Request{
+		AdmissionRequest: &admissionv1beta1.AdmissionRequest{
+			Kind:   metav1.GroupVersionKind{Group: "cluster.k8s.io", Version: "v1alpha1", Kind: kind},
+			Object: runtime.RawExtension{Raw: raw},
+		},
+	}
+}
@@ -0,0 +1,563 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package defaultserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	gceconfigv1 "sigs.k8s.io/cluster-api-provider-gcp/pkg/apis/gceproviderconfig/v1alpha1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+const (
+	machineProviderConfigKind = "GCEMachineProviderConfig"
+
+	defaultOS         = "ubuntu-1604-lts"
+	defaultDiskType   = "pd-standard"
+	defaultDiskSizeGb = 30
+
+	localSSDDiskType   = "local-ssd"
+	localSSDDiskSizeGb = 375
+
+	defaultMachineFamily = "n1"
+
+	// The longest instance group name that leaves room for the suffixes GCE
+	// adds to the names of its instances and the provider to its templates.
+	maxInstanceGroupNameLength = 52
+)
+
+var (
+	zoneRegexp = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
+	// GCE resource names, such as those of machine types, follow RFC 1035.
+	resourceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+	// GCE label keys and values, which may contain lower case letters of any
+	// script.
+	labelKeyRegexp   = regexp.MustCompile(`^\p{Ll}[\p{Ll}0-9_-]{0,62}$`)
+	labelValueRegexp = regexp.MustCompile(`^[\p{Ll}0-9_-]{0,63}$`)
+	kmsKeyNameRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+	supportedRoles                 = sets.NewString(string(gceconfigv1.MasterRole), string(gceconfigv1.NodeRole))
+	supportedDiskTypes             = sets.NewString("pd-standard", "pd-balanced", "pd-ssd")
+	supportedDiskTypesOfAttachment = sets.NewString(string(gceconfigv1.PersistentDisk), string(gceconfigv1.ScratchDisk))
+	supportedDiskInterfaces        = sets.NewString("SCSI", "NVME")
+
+	supportedOnHostMaintenance = sets.NewString("MIGRATE", "TERMINATE")
+
+	// Service accounts are named by their email, or "default" for the
+	// Compute Engine default service account. OAuth scopes are given by URL
+	// or by name.
+	serviceAccountEmailRegexp = regexp.MustCompile(`^[a-z0-9][-a-z0-9]*@[-a-z0-9.]+\.gserviceaccount\.com$`)
+	scopeNameRegexp           = regexp.MustCompile(`^[a-z][-a-z0-9._]*$`)
+
+	metadataKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+	// The instance labels and metadata items the provider sets itself.
+	reservedLabelKeys    = sets.NewString("bootstrap", "cluster-name", "machine-namespace", "machine-name")
+	reservedMetadataKeys = sets.NewString(
+		"startup-script", "enable-oslogin", "machine", "kubeadm-token",
+		"ca-cert", "ca-key", "etcd-ca-cert", "etcd-ca-key", "front-proxy-ca-cert", "front-proxy-ca-key", "sa-key", "sa-pub",
+	)
+
+	// The limits GCE puts on custom machine types of each family.
+	customMachineFamilies = map[string]machineFamilyLimits{
+		"n1":  {singleCPU: true, minMemoryPerCPUMB: 922, maxMemoryPerCPUMB: 6656, extendedMemory: true},
+		"n2":  {minMemoryPerCPUMB: 512, maxMemoryPerCPUMB: 8192, extendedMemory: true},
+		"n2d": {minMemoryPerCPUMB: 512, maxMemoryPerCPUMB: 8192, extendedMemory: true},
+		"e2":  {minMemoryPerCPUMB: 512, maxMemoryPerCPUMB: 8192},
+	}
+)
+
+type machineFamilyLimits struct {
+	// Whether machine types of the family may have a single vCPU rather
+	// than an even number.
+	singleCPU bool
+
+	minMemoryPerCPUMB int64
+	maxMemoryPerCPUMB int64
+	extendedMemory    bool
+}
+
+// machineObject is a Machine, MachineSet or MachineDeployment under admission.
+type machineObject struct {
+	// The spec of the machine, or of the template of the machines.
+	spec *clusterv1.MachineSpec
+	// The path of the spec within the object.
+	specPath *field.Path
+}
+
+func (m *machineObject) providerConfigPath() *field.Path {
+	return m.specPath.Child("providerConfig", "value")
+}
+
+func decodeMachineObject(req atypes.Request) (*machineObject, error) {
+	var obj interface{}
+	m := &machineObject{specPath: field.NewPath("spec")}
+	switch kind := req.AdmissionRequest.Kind.Kind; kind {
+	case "Machine":
+		machine := &clusterv1.Machine{}
+		obj, m.spec = machine, &machine.Spec
+	case "MachineSet":
+		machineSet := &clusterv1.MachineSet{}
+		obj, m.spec = machineSet, &machineSet.Spec.Template.Spec
+		m.specPath = m.specPath.Child("template", "spec")
+	case "MachineDeployment":
+		machineDeployment := &clusterv1.MachineDeployment{}
+		obj, m.spec = machineDeployment, &machineDeployment.Spec.Template.Spec
+		m.specPath = m.specPath.Child("template", "spec")
+	default:
+		return nil, fmt.Errorf("unexpected kind %q", kind)
+	}
+	if err := json.Unmarshal(req.AdmissionRequest.Object.Raw, obj); err != nil {
+		return nil, fmt.Errorf("error decoding %v: %v", req.AdmissionRequest.Kind.Kind, err)
+	}
+	return m, nil
+}
+
+// Returns the GCE provider config of the machine, or nil if the machine uses
+// another provider.
+func gceProviderConfig(spec *clusterv1.MachineSpec) (*gceconfigv1.GCEMachineProviderConfig, error) {
+	if spec.ProviderConfig.Value == nil || len(spec.ProviderConfig.Value.Raw) == 0 {
+		return nil, nil
+	}
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(spec.ProviderConfig.Value.Raw, &typeMeta); err != nil {
+		return nil, err
+	}
+	if typeMeta.Kind != machineProviderConfigKind {
+		return nil, nil
+	}
+	var config gceconfigv1.GCEMachineProviderConfig
+	if err := yaml.Unmarshal(spec.ProviderConfig.Value.Raw, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Fills in the fields of the provider config that were left empty.
+func setDefaults(config *gceconfigv1.GCEMachineProviderConfig) {
+	// Machines without a role have always joined the cluster as nodes.
+	if len(config.Roles) == 0 {
+		config.Roles = []gceconfigv1.MachineRole{gceconfigv1.NodeRole}
+	}
+	if config.OS == "" {
+		config.OS = defaultOS
+	}
+	if len(config.Disks) == 0 {
+		config.Disks = []gceconfigv1.Disk{{}}
+	}
+	for i := range config.Disks {
+		// Existing disks and local SSDs have no type or size to choose.
+		if config.Disks[i].Source != "" || config.Disks[i].Type == gceconfigv1.ScratchDisk {
+			continue
+		}
+		params := &config.Disks[i].InitializeParams
+		if params.DiskType == "" {
+			params.DiskType = defaultDiskType
+		}
+		if params.DiskSizeGb == 0 {
+			params.DiskSizeGb = defaultDiskSizeGb
+		}
+	}
+	// Preemptible instances can neither restart automatically nor migrate.
+	if scheduling := config.Scheduling; scheduling != nil && scheduling.Preemptible {
+		if scheduling.AutomaticRestart == nil {
+			automaticRestart := false
+			scheduling.AutomaticRestart = &automaticRestart
+		}
+		if scheduling.OnHostMaintenance == "" {
+			scheduling.OnHostMaintenance = "TERMINATE"
+		}
+	}
+	// Nor can instances with accelerators migrate.
+	if len(config.Accelerators) > 0 {
+		if config.Scheduling == nil {
+			config.Scheduling = &gceconfigv1.Scheduling{}
+		}
+		if config.Scheduling.OnHostMaintenance == "" {
+			config.Scheduling.OnHostMaintenance = "TERMINATE"
+		}
+	}
+}
+
+func validateMachine(m *machineObject, config *gceconfigv1.GCEMachineProviderConfig) field.ErrorList {
+	var allErrs field.ErrorList
+	versionsPath := m.specPath.Child("versions")
+	if m.spec.Versions.Kubelet == "" {
+		allErrs = append(allErrs, field.Required(versionsPath.Child("kubelet"), ""))
+	}
+	if hasRole(config.Roles, gceconfigv1.MasterRole) && m.spec.Versions.ControlPlane == "" {
+		allErrs = append(allErrs, field.Required(versionsPath.Child("controlPlane"), "machines with the Master role install the control plane"))
+	}
+	return append(allErrs, validateProviderConfig(config, m.providerConfigPath())...)
+}
+
+func validateProviderConfig(config *gceconfigv1.GCEMachineProviderConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, validateRoles(config.Roles, path.Child("roles"))...)
+
+	if config.Zone == "" {
+		allErrs = append(allErrs, field.Required(path.Child("zone"), ""))
+	} else if !zoneRegexp.MatchString(config.Zone) {
+		allErrs = append(allErrs, field.Invalid(path.Child("zone"), config.Zone, "must be a GCE zone, e.g. us-central1-a"))
+	}
+
+	switch {
+	case config.CustomMachineType != nil:
+		if config.MachineType != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("machineType"), "custom machine types are named after their vCPUs and memory"))
+		}
+		allErrs = append(allErrs, validateCustomMachineType(config.CustomMachineType, path.Child("customMachineType"))...)
+	case config.MachineType == "":
+		allErrs = append(allErrs, field.Required(path.Child("machineType"), "either a machine type or a custom machine type is required"))
+	case !resourceNameRegexp.MatchString(config.MachineType):
+		allErrs = append(allErrs, field.Invalid(path.Child("machineType"), config.MachineType, "must be the name of a GCE machine type, e.g. n1-standard-1"))
+	}
+	if config.MinCPUPlatform != "" && !supportsMinCPUPlatform(config) {
+		allErrs = append(allErrs, field.Forbidden(path.Child("minCpuPlatform"), "E2 machine types run on a CPU platform GCE picks"))
+	}
+
+	if config.OS == "" {
+		allErrs = append(allErrs, field.Required(path.Child("os"), ""))
+	}
+
+	disksPath := path.Child("disks")
+	if len(config.Disks) == 0 {
+		allErrs = append(allErrs, field.Required(disksPath, "the first disk is the boot disk"))
+	}
+	for i, disk := range config.Disks {
+		allErrs = append(allErrs, validateDisk(disk, i == 0, disksPath.Index(i))...)
+		// The new instance of a replacement is created while the old one
+		// still holds the disk.
+		if disk.Source != "" && config.UpgradeStrategy == gceconfigv1.ReplaceUpgrade {
+			allErrs = append(allErrs, field.Forbidden(disksPath.Index(i).Child("source"), "machines with the Replace upgrade strategy cannot attach existing disks"))
+		}
+	}
+
+	if config.Scheduling != nil {
+		allErrs = append(allErrs, validateScheduling(config, path.Child("scheduling"))...)
+	}
+	allErrs = append(allErrs, validateAccelerators(config.Accelerators, path.Child("accelerators"))...)
+	allErrs = append(allErrs, validateInstanceLabels(config.Labels, path.Child("labels"))...)
+	for i, tag := range config.Tags {
+		if !resourceNameRegexp.MatchString(tag) || len(tag) > 63 {
+			allErrs = append(allErrs, field.Invalid(path.Child("tags").Index(i), tag, "must consist of at most 63 lower case alphanumeric characters or '-', and start with a letter"))
+		}
+	}
+	allErrs = append(allErrs, validateInstanceMetadata(config.InstanceMetadata, path.Child("instanceMetadata"))...)
+	if config.Security != nil {
+		allErrs = append(allErrs, validateSecurity(config, path.Child("security"))...)
+	}
+	allErrs = append(allErrs, validateServiceAccounts(config.ServiceAccounts, path.Child("serviceAccounts"))...)
+	if config.InstanceGroup != nil {
+		allErrs = append(allErrs, validateInstanceGroup(config, path)...)
+	}
+	return allErrs
+}
+
+func validateScheduling(config *gceconfigv1.GCEMachineProviderConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	scheduling := config.Scheduling
+	if scheduling.OnHostMaintenance != "" && !supportedOnHostMaintenance.Has(scheduling.OnHostMaintenance) {
+		allErrs = append(allErrs, field.NotSupported(path.Child("onHostMaintenance"), scheduling.OnHostMaintenance, supportedOnHostMaintenance.List()))
+	}
+	if len(config.Accelerators) > 0 && scheduling.OnHostMaintenance == "MIGRATE" {
+		allErrs = append(allErrs, field.Invalid(path.Child("onHostMaintenance"), scheduling.OnHostMaintenance, "instances with accelerators cannot migrate"))
+	}
+	if !scheduling.Preemptible {
+		return allErrs
+	}
+	if hasRole(config.Roles, gceconfigv1.MasterRole) {
+		allErrs = append(allErrs, field.Forbidden(path.Child("preemptible"), "machines with the Master role cannot be preemptible"))
+	}
+	if scheduling.AutomaticRestart != nil && *scheduling.AutomaticRestart {
+		allErrs = append(allErrs, field.Invalid(path.Child("automaticRestart"), true, "preemptible instances cannot restart automatically"))
+	}
+	if scheduling.OnHostMaintenance == "MIGRATE" {
+		allErrs = append(allErrs, field.Invalid(path.Child("onHostMaintenance"), scheduling.OnHostMaintenance, "preemptible instances cannot migrate"))
+	}
+	return allErrs
+}
+
+func validateDisk(disk gceconfigv1.Disk, boot bool, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	paramsPath := path.Child("initializeParams")
+	params := disk.InitializeParams
+	switch disk.Type {
+	case "", gceconfigv1.PersistentDisk:
+		if disk.Interface != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("interface"), "only local SSDs can choose their interface"))
+		}
+	case gceconfigv1.ScratchDisk:
+		if boot {
+			allErrs = append(allErrs, field.Forbidden(path.Child("type"), "the boot disk cannot be a local SSD"))
+		}
+		if disk.Interface != "" && !supportedDiskInterfaces.Has(disk.Interface) {
+			allErrs = append(allErrs, field.NotSupported(path.Child("interface"), disk.Interface, supportedDiskInterfaces.List()))
+		}
+		if params.DiskType != "" && params.DiskType != localSSDDiskType {
+			allErrs = append(allErrs, field.NotSupported(paramsPath.Child("diskType"), params.DiskType, []string{localSSDDiskType}))
+		}
+		if params.DiskSizeGb != 0 && params.DiskSizeGb != localSSDDiskSizeGb {
+			allErrs = append(allErrs, field.Invalid(paramsPath.Child("diskSizeGb"), params.DiskSizeGb, fmt.Sprintf("local SSDs are %v GB", localSSDDiskSizeGb)))
+		}
+		if disk.Source != "" || params.SourceSnapshot != "" {
+			allErrs = append(allErrs, field.Forbidden(path, "local SSDs cannot be attached from an existing disk or a snapshot"))
+		}
+		if disk.AutoDelete != nil && !*disk.AutoDelete {
+			allErrs = append(allErrs, field.Invalid(path.Child("autoDelete"), false, "local SSDs are always deleted with their instance"))
+		}
+		if disk.EncryptionKey != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("encryptionKey"), "local SSDs cannot be encrypted with a customer-managed key"))
+		}
+		return append(allErrs, validateLabels(params.Labels, paramsPath.Child("labels"))...)
+	default:
+		allErrs = append(allErrs, field.NotSupported(path.Child("type"), disk.Type, supportedDiskTypesOfAttachment.List()))
+	}
+
+	if disk.DeviceName != "" && !resourceNameRegexp.MatchString(disk.DeviceName) {
+		allErrs = append(allErrs, field.Invalid(path.Child("deviceName"), disk.DeviceName, "must consist of lower case alphanumeric characters or '-', and start with a letter"))
+	}
+
+	if disk.Source != "" {
+		if params.SourceSnapshot != "" {
+			allErrs = append(allErrs, field.Forbidden(paramsPath.Child("sourceSnapshot"), "existing disks are attached as they are"))
+		}
+		if disk.EncryptionKey != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("encryptionKey"), "existing disks keep the key they were encrypted with"))
+		}
+		return allErrs
+	}
+
+	if !supportedDiskTypes.Has(params.DiskType) {
+		allErrs = append(allErrs, field.NotSupported(paramsPath.Child("diskType"), params.DiskType, supportedDiskTypes.List()))
+	}
+	if params.DiskSizeGb < 0 {
+		allErrs = append(allErrs, field.Invalid(paramsPath.Child("diskSizeGb"), params.DiskSizeGb, "must not be negative"))
+	}
+	allErrs = append(allErrs, validateLabels(params.Labels, paramsPath.Child("labels"))...)
+	if disk.EncryptionKey != nil && !kmsKeyNameRegexp.MatchString(disk.EncryptionKey.KMSKeyName) {
+		allErrs = append(allErrs, field.Invalid(path.Child("encryptionKey", "kmsKeyName"), disk.EncryptionKey.KMSKeyName,
+			"must be the resource name of a Cloud KMS key, i.e. projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>"))
+	}
+	return allErrs
+}
+
+// Validates labels against the GCE requirements on label keys and values.
+func validateLabels(labels map[string]string, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for key, value := range labels {
+		if !labelKeyRegexp.MatchString(key) {
+			allErrs = append(allErrs, field.Invalid(path, key, "label keys must start with a lower case letter and consist of at most 63 lower case letters, digits, '-' or '_'"))
+		}
+		if !labelValueRegexp.MatchString(value) {
+			allErrs = append(allErrs, field.Invalid(path.Key(key), value, "label values must consist of at most 63 lower case letters, digits, '-' or '_'"))
+		}
+	}
+	return allErrs
+}
+
+// Validates the accelerators as far as possible without asking GCE. Whether
+// the machine's zone offers them is checked when its instance is created.
+func validateAccelerators(accelerators []gceconfigv1.Accelerator, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	// GCE attaches accelerators of a single type to an instance.
+	if len(accelerators) > 1 {
+		allErrs = append(allErrs, field.Invalid(path, len(accelerators), "must hold at most one accelerator type"))
+	}
+	for i, accelerator := range accelerators {
+		acceleratorPath := path.Index(i)
+		if accelerator.Type == "" {
+			allErrs = append(allErrs, field.Required(acceleratorPath.Child("type"), ""))
+		} else if !resourceNameRegexp.MatchString(accelerator.Type) {
+			allErrs = append(allErrs, field.Invalid(acceleratorPath.Child("type"), accelerator.Type, "must be the name of a GCE accelerator type, e.g. nvidia-tesla-k80"))
+		}
+		if accelerator.Count < 1 {
+			allErrs = append(allErrs, field.Invalid(acceleratorPath.Child("count"), accelerator.Count, "must be positive"))
+		}
+	}
+	return allErrs
+}
+
+// Validates a custom machine type against the limits of its family. Whether
+// the machine's zone offers the family is checked when its instance is
+// created.
+func validateCustomMachineType(custom *gceconfigv1.CustomMachineType, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	family := custom.Family
+	if family == "" {
+		family = defaultMachineFamily
+	}
+	limits, ok := customMachineFamilies[family]
+	if !ok {
+		return append(allErrs, field.NotSupported(path.Child("family"), custom.Family, sets.StringKeySet(customMachineFamilies).List()))
+	}
+	if custom.CPUs < 1 {
+		allErrs = append(allErrs, field.Invalid(path.Child("cpus"), custom.CPUs, "must be positive"))
+	} else if custom.CPUs%2 != 0 && (custom.CPUs != 1 || !limits.singleCPU) {
+		allErrs = append(allErrs, field.Invalid(path.Child("cpus"), custom.CPUs, fmt.Sprintf("custom machine types of family %v have an even number of vCPUs", family)))
+	}
+	if custom.MemoryMB < 1 || custom.MemoryMB%256 != 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("memoryMB"), custom.MemoryMB, "must be a positive multiple of 256"))
+	} else if custom.CPUs > 0 {
+		if custom.MemoryMB < custom.CPUs*limits.minMemoryPerCPUMB {
+			allErrs = append(allErrs, field.Invalid(path.Child("memoryMB"), custom.MemoryMB, fmt.Sprintf("custom machine types of family %v have at least %v MB of memory per vCPU", family, limits.minMemoryPerCPUMB)))
+		}
+		if !custom.ExtendedMemory && custom.MemoryMB > custom.CPUs*limits.maxMemoryPerCPUMB {
+			allErrs = append(allErrs, field.Invalid(path.Child("memoryMB"), custom.MemoryMB, fmt.Sprintf("custom machine types of family %v have at most %v MB of memory per vCPU without extended memory", family, limits.maxMemoryPerCPUMB)))
+		}
+	}
+	if custom.ExtendedMemory && !limits.extendedMemory {
+		allErrs = append(allErrs, field.Forbidden(path.Child("extendedMemory"), fmt.Sprintf("custom machine types of family %v cannot have extended memory", family)))
+	}
+	return allErrs
+}
+
+// E2 instances cannot choose their CPU platform.
+func supportsMinCPUPlatform(config *gceconfigv1.GCEMachineProviderConfig) bool {
+	if config.CustomMachineType != nil {
+		return config.CustomMachineType.Family != "e2"
+	}
+	return !strings.HasPrefix(config.MachineType, "e2-")
+}
+
+// Validates the labels of an instance, which cannot replace the labels the
+// provider sets.
+func validateInstanceLabels(labels map[string]string, path *field.Path) field.ErrorList {
+	allErrs := validateLabels(labels, path)
+	for key := range labels {
+		if reservedLabelKeys.Has(key) {
+			allErrs = append(allErrs, field.Forbidden(path.Key(key), "the label is set by the provider"))
+		}
+	}
+	return allErrs
+}
+
+// Validates the metadata items of an instance, which cannot replace the items
+// the provider sets.
+func validateInstanceMetadata(metadata map[string]string, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for key := range metadata {
+		if !metadataKeyRegexp.MatchString(key) {
+			allErrs = append(allErrs, field.Invalid(path, key, "metadata keys must consist of at most 128 alphanumeric characters, '-' or '_'"))
+		} else if reservedMetadataKeys.Has(key) {
+			allErrs = append(allErrs, field.Forbidden(path.Key(key), "the metadata item is set by the provider"))
+		}
+	}
+	return allErrs
+}
+
+// Validates the security features of the instance.
+func validateSecurity(config *gceconfigv1.GCEMachineProviderConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	security := config.Security
+	if shielded := security.ShieldedInstance; shielded != nil && shielded.IntegrityMonitoring && !shielded.VTPM {
+		allErrs = append(allErrs, field.Invalid(path.Child("shieldedInstance", "integrityMonitoring"), true, "integrity monitoring requires a vTPM"))
+	}
+	if security.OSLogin && hasRole(config.Roles, gceconfigv1.MasterRole) {
+		allErrs = append(allErrs, field.Forbidden(path.Child("osLogin"), "machines with the Master role are upgraded over SSH with a key from project metadata, which OS Login ignores"))
+	}
+	return allErrs
+}
+
+// Validates the service accounts of the instance, of which GCE allows only
+// one.
+func validateServiceAccounts(serviceAccounts []gceconfigv1.ServiceAccount, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, sa := range serviceAccounts {
+		saPath := path.Index(i)
+		if i > 0 {
+			allErrs = append(allErrs, field.Forbidden(saPath, "instances can have only one service account"))
+		}
+		if sa.Email == "" {
+			allErrs = append(allErrs, field.Required(saPath.Child("email"), ""))
+		} else if sa.Email != "default" && !serviceAccountEmailRegexp.MatchString(sa.Email) {
+			allErrs = append(allErrs, field.Invalid(saPath.Child("email"), sa.Email, "must be the email of a service account or 'default'"))
+		}
+		seen := sets.NewString()
+		for j, scope := range sa.Scopes {
+			scopePath := saPath.Child("scopes").Index(j)
+			if !strings.HasPrefix(scope, "https://www.googleapis.com/auth/") && !scopeNameRegexp.MatchString(scope) {
+				allErrs = append(allErrs, field.Invalid(scopePath, scope, "must be the URL or the name of an OAuth scope, e.g. cloud-platform"))
+			} else if seen.Has(scope) {
+				allErrs = append(allErrs, field.Duplicate(scopePath, scope))
+			}
+			seen.Insert(scope)
+		}
+	}
+	return allErrs
+}
+
+// Validates the instance group of the machines of a MachineSet. Its instances
+// all share one instance template, so they cannot attach disks of their own.
+func validateInstanceGroup(config *gceconfigv1.GCEMachineProviderConfig, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	groupPath := path.Child("instanceGroup")
+	if hasRole(config.Roles, gceconfigv1.MasterRole) {
+		allErrs = append(allErrs, field.Forbidden(groupPath, "machines with the Master role cannot use instance groups"))
+	}
+	if name := config.InstanceGroup.Name; name != "" {
+		if !resourceNameRegexp.MatchString(name) {
+			allErrs = append(allErrs, field.Invalid(groupPath.Child("name"), name, "must consist of lower case alphanumeric characters or '-', and start with a letter"))
+		} else if len(name) > maxInstanceGroupNameLength {
+			allErrs = append(allErrs, field.Invalid(groupPath.Child("name"), name, fmt.Sprintf("must be no more than %v characters", maxInstanceGroupNameLength)))
+		}
+	}
+	for i, disk := range config.Disks {
+		if disk.Source != "" || disk.InitializeParams.SourceSnapshot != "" {
+			allErrs = append(allErrs, field.Forbidden(path.Child("disks").Index(i), "instances of instance groups cannot attach existing disks or disks from snapshots"))
+		}
+	}
+	return allErrs
+}
+
+// Validates the roles against the table in the MachineRole documentation,
+// which calls machines that are neither masters nor nodes invalid.
+func validateRoles(roles []gceconfigv1.MachineRole, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	seen := sets.NewString()
+	for i, role := range roles {
+		if !supportedRoles.Has(string(role)) {
+			allErrs = append(allErrs, field.NotSupported(path.Index(i), role, supportedRoles.List()))
+		} else if seen.Has(string(role)) {
+			allErrs = append(allErrs, field.Duplicate(path.Index(i), role))
+		}
+		seen.Insert(string(role))
+	}
+	if !hasRole(roles, gceconfigv1.MasterRole) && !hasRole(roles, gceconfigv1.NodeRole) {
+		allErrs = append(allErrs, field.Invalid(path, roles, "must include the Master role, the Node role or both"))
+	}
+	return allErrs
+}
+
+func hasRole(roles []gceconfigv1.MachineRole, role gceconfigv1.MachineRole) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
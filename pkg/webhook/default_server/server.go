@@ -0,0 +1,118 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package defaultserver
+
+import (
+	"os"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	clusterv1 "sigs.k8s.io/cluster-api/pkg/apis/cluster/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission/builder"
+)
+
+const (
+	serverName = "gcp-provider-admission-server"
+
+	// The namespace the server runs in if the POD_NAMESPACE environment
+	// variable is not set. It matches config/default/kustomization.yaml.
+	defaultNamespace = "gcp-provider-system"
+)
+
+// The Machines, MachineSets and MachineDeployments whose GCE provider config
+// the webhooks default and validate.
+var machineRule = admissionregistrationv1beta1.Rule{
+	APIGroups:   []string{clusterv1.SchemeGroupVersion.Group},
+	APIVersions: []string{clusterv1.SchemeGroupVersion.Version},
+	Resources:   []string{"machines", "machinesets", "machinedeployments"},
+}
+
+// Provider configs are only defaulted when they are created. Defaulting
+// machines created before the webhook when they are updated would change
+// the provider config their instance was created from, and so replace it.
+var defaultingRules = []admissionregistrationv1beta1.RuleWithOperations{
+	{
+		Operations: []admissionregistrationv1beta1.OperationType{
+			admissionregistrationv1beta1.Create,
+		},
+		Rule: machineRule,
+	},
+}
+
+var validatingRules = []admissionregistrationv1beta1.RuleWithOperations{
+	{
+		Operations: []admissionregistrationv1beta1.OperationType{
+			admissionregistrationv1beta1.Create,
+			admissionregistrationv1beta1.Update,
+		},
+		Rule: machineRule,
+	},
+}
+
+// Add creates the admission webhook server, which defaults and validates the
+// GCE provider config of machines, and adds it to the Manager. The server
+// provisions its own certificate and installs its service and webhook
+// configurations when it starts.
+func Add(mgr manager.Manager) error {
+	mutating, err := builder.NewWebhookBuilder().
+		Name("mutating.gcemachineproviderconfig.gceproviderconfig.k8s.io").
+		Path("/mutate-gcemachineproviderconfig").
+		Mutating().
+		Rules(defaultingRules...).
+		Handlers(&providerConfigDefaulter{}).
+		Build()
+	if err != nil {
+		return err
+	}
+	validating, err := builder.NewWebhookBuilder().
+		Name("validating.gcemachineproviderconfig.gceproviderconfig.k8s.io").
+		Path("/validate-gcemachineproviderconfig").
+		Validating().
+		Rules(validatingRules...).
+		Handlers(&providerConfigValidator{}).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	server, err := webhook.NewServer(serverName, mgr, webhook.ServerOptions{
+		Port:    9876,
+		CertDir: "/tmp/cert",
+		BootstrapOptions: &webhook.BootstrapOptions{
+			MutatingWebhookConfigName:   "gcp-provider-mutating-webhook-configuration",
+			ValidatingWebhookConfigName: "gcp-provider-validating-webhook-configuration",
+			Service: &webhook.Service{
+				Namespace: namespace,
+				Name:      serverName,
+				// Selects the pods of config/manager/manager.yaml.
+				Selectors: map[string]string{
+					"control-plane":           "controller-manager",
+					"controller-tools.k8s.io": "1.0",
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return server.Register(mutating, validating)
+}
@@ -37,7 +37,7 @@ gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$M
 gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$INGRESS_CONTROLLER_SERVICE_ACCOUNT --role='roles/compute.instanceAdmin.v1'
 gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$INGRESS_CONTROLLER_SERVICE_ACCOUNT --role='roles/compute.networkAdmin'
 gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$INGRESS_CONTROLLER_SERVICE_ACCOUNT --role='roles/compute.securityAdmin'
-gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$INGRESS_CONTROLLER_SERVICE_ACCOUNT --role='roles/iam.serviceAccountActor'
+gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$INGRESS_CONTROLLER_SERVICE_ACCOUNT --role='roles/iam.serviceAccountUser'
 
 gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$MACHINE_CONTROLLER_SERVICE_ACCOUNT --role='roles/compute.instanceAdmin.v1'
-gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$MACHINE_CONTROLLER_SERVICE_ACCOUNT --role='roles/iam.serviceAccountActor'
+gcloud projects remove-iam-policy-binding $PROJECT_ID --member=serviceAccount:$MACHINE_CONTROLLER_SERVICE_ACCOUNT --role='roles/iam.serviceAccountUser'